@@ -37,8 +37,92 @@ type Apartment struct {
 	Latitude  float32 `json:"latitude"`
 	Longitude float32 `json:"longitude"`
 
-	// Availability of the apartment
-	Available bool `json:"available"`
+	// Stage of the listing. See ApartmentTransitions
+	Status string `gorm:"index" json:"status"`
+
+	// Availability of the apartment. Derived from Status,
+	// only published apartments are available.
+	Available bool `gorm:"-" json:"available"`
+
+	// Incremented on every change. Used as the ETag of the apartment.
+	Version uint `gorm:"not null;default:1" json:"version"`
+
+	// When the apartment was moved to the trash. Trashed apartments
+	// are left out of every query unless it's unscoped, and purged
+	// once they have been in the trash for the retention period.
+	DeletedAt *time.Time `gorm:"index" json:"deletedAt,omitempty"`
+}
+
+// Listing statuses
+const (
+	ApartmentDraft     = "draft"
+	ApartmentPublished = "published"
+	ApartmentReserved  = "reserved"
+	ApartmentRented    = "rented"
+	ApartmentArchived  = "archived"
+)
+
+// Statuses a listing can move to from each status
+var ApartmentTransitions = map[string][]string{
+	ApartmentDraft:     {ApartmentPublished, ApartmentArchived},
+	ApartmentPublished: {ApartmentDraft, ApartmentReserved, ApartmentRented, ApartmentArchived},
+	ApartmentReserved:  {ApartmentPublished, ApartmentRented, ApartmentArchived},
+	ApartmentRented:    {ApartmentPublished, ApartmentArchived},
+	ApartmentArchived:  {ApartmentDraft},
+}
+
+var InvalidTransitionError = errors.New("apartment can't move to that status")
+
+// Statuses of the listings everyone can see. Drafts and archived
+// listings are only seen by their realtor and admins.
+var ApartmentListedStatuses = []string{ApartmentPublished, ApartmentReserved, ApartmentRented}
+
+// Returns true if the user with the given id and role can see the
+// apartment
+func CanSeeApartment(apartment Apartment, actorId uint, actorRole string) bool {
+	if actorRole == "admin" || (actorRole == "realtor" && apartment.RealtorId == actorId) {
+		return true
+	}
+
+	for _, status := range ApartmentListedStatuses {
+		if apartment.Status == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if a listing in status from can move to status to
+func CanTransition(from, to string) bool {
+	for _, status := range ApartmentTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record of a listing changing status
+type ApartmentStatusChange struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	ApartmentID uint   `gorm:"index" json:"apartmentId"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+
+	// User that made the change. 0 if it was made by the system
+	ActorID uint `json:"actorId"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Keeps Available in sync with Status when loading apartments
+func (s *Apartment) AfterFind() error {
+	s.Available = s.Status == ApartmentPublished
+	return nil
 }
 
 func (uid) UnmarshalJSON([]byte) error {
@@ -86,10 +170,30 @@ type ApartmentService interface {
 	Find(ApartmentFindInput) (*ApartmentFindOutput, error)
 	Update(ApartmentUpdateInput) (*ApartmentUpdateOutput, error)
 	Delete(ApartmentDeleteInput) (*ApartmentDeleteOutput, error)
+	Reassign(ApartmentReassignInput) (*ApartmentReassignOutput, error)
+	Transition(ApartmentTransitionInput) (*ApartmentTransitionOutput, error)
+	History(ApartmentHistoryInput) (*ApartmentHistoryOutput, error)
+
+	// Trash lists the deleted apartments that can still be restored
+	Trash(ApartmentTrashInput) (*ApartmentTrashOutput, error)
+	Restore(ApartmentRestoreInput) (*ApartmentRestoreOutput, error)
+
+	// Purge removes for good the apartments deleted before
+	// deletedBefore, along with their media. Apartments with
+	// applications or leases are kept.
+	Purge(deletedBefore time.Time) (int, error)
+
+	// Export returns a page of the apartments matching the same
+	// filters as Find, by id, with the usernames of their realtors
+	Export(ApartmentExportInput) (*ApartmentExportOutput, error)
 }
 
 type ApartmentCreateInput struct {
 	Apartment
+
+	// User making the change and the request it was made in
+	ActorId   uint   `json:"-"`
+	RequestId string `json:"-"`
 }
 
 type ApartmentCreateOutput struct {
@@ -99,6 +203,10 @@ type ApartmentCreateOutput struct {
 type ApartmentReadInput struct {
 	// ID to lookup the apartment
 	Id string
+
+	// User reading it, see CanSeeApartment
+	ActorId   uint
+	ActorRole string
 }
 
 type ApartmentReadOutput struct {
@@ -106,20 +214,35 @@ type ApartmentReadOutput struct {
 }
 
 type ApartmentFindInput struct {
-	Query string
+	Query  string
+	Cursor string
+	Limit  int
+
+	// User listing them, see CanSeeApartment
+	ActorId   uint
+	ActorRole string
 }
 
 type ApartmentFindOutput struct {
 	Apartments []Apartment
+	NextCursor string
 }
 
 func (o *ApartmentFindOutput) Public() interface{} {
-	return o.Apartments
+	return Page{Items: o.Apartments, NextCursor: o.NextCursor}
 }
 
 type ApartmentUpdateInput struct {
 	Id   string
 	Data map[string]interface{}
+
+	// Version the change was made against, see Apartment.Version.
+	// 0 skips the check.
+	Version uint
+
+	// User making the change and the request it was made in
+	ActorId   uint
+	RequestId string
 }
 
 type ApartmentUpdateOutput struct {
@@ -128,8 +251,106 @@ type ApartmentUpdateOutput struct {
 
 type ApartmentDeleteInput struct {
 	Id string
+
+	// Version the apartment was read at. 0 skips the check.
+	Version uint
+
+	// User making the change and the request it was made in
+	ActorId   uint
+	RequestId string
 }
 
 type ApartmentDeleteOutput struct {
 	Message string
 }
+
+// Moves apartments from one realtor to another. Query uses the same
+// filters as ApartmentFindInput and Ids restricts the apartments
+// further. If both are empty all the apartments are moved.
+type ApartmentReassignInput struct {
+	FromRealtorId string `json:"-"`
+	ToRealtorId   string `json:"toRealtorId"`
+	Query         string `json:"query"`
+	Ids           []uint `json:"apartmentIds"`
+
+	// User making the change and the request it was made in
+	ActorId   uint   `json:"-"`
+	RequestId string `json:"-"`
+}
+
+type ApartmentReassignOutput struct {
+	FromRealtorId uint   `json:"fromRealtorId"`
+	ToRealtorId   uint   `json:"toRealtorId"`
+	Count         int    `json:"count"`
+	ApartmentIds  []uint `json:"apartmentIds"`
+}
+
+type ApartmentTransitionInput struct {
+	Id        string `json:"-"`
+	Status    string `json:"status"`
+	ActorId   uint   `json:"-"`
+	RequestId string `json:"-"`
+}
+
+type ApartmentTransitionOutput struct {
+	Apartment
+}
+
+type ApartmentHistoryInput struct {
+	Id string
+}
+
+type ApartmentHistoryOutput struct {
+	Changes []ApartmentStatusChange
+}
+
+func (o *ApartmentHistoryOutput) Public() interface{} {
+	return o.Changes
+}
+
+// Realtors only see the apartments they manage in the trash, admins
+// see all of them
+type ApartmentTrashInput struct {
+	ActorId   uint
+	ActorRole string
+	Cursor    string
+	Limit     int
+}
+
+type ApartmentTrashOutput struct {
+	Apartments []Apartment
+	NextCursor string
+}
+
+func (o *ApartmentTrashOutput) Public() interface{} {
+	return Page{Items: o.Apartments, NextCursor: o.NextCursor}
+}
+
+type ApartmentRestoreInput struct {
+	Id string
+
+	// User making the change and the request it was made in
+	ActorId   uint
+	ActorRole string
+	RequestId string
+}
+
+type ApartmentRestoreOutput struct {
+	Apartment
+}
+
+type ApartmentExportInput struct {
+	Query     string
+	ActorRole string
+	Cursor    string
+	Limit     int
+}
+
+type ApartmentExportOutput struct {
+	Apartments []ExportedApartment
+	NextCursor string
+}
+
+func (o *ApartmentExportOutput) Public() interface{} {
+	return Page{Items: o.Apartments, NextCursor: o.NextCursor}
+}
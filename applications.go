@@ -0,0 +1,93 @@
+package rentals
+
+import (
+	"errors"
+	"time"
+)
+
+// Application statuses
+const (
+	ApplicationPending   = "pending"
+	ApplicationAccepted  = "accepted"
+	ApplicationRejected  = "rejected"
+	ApplicationWithdrawn = "withdrawn"
+)
+
+var ApartmentNotAvailableError = errors.New("apartment is not available")
+
+var DuplicateApplicationError = errors.New("there is already a pending application for this apartment")
+
+var ApplicationClosedError = errors.New("application is not pending")
+
+var ForbiddenError = errors.New("not allowed")
+
+// Request of a client to rent an apartment
+type RentalApplication struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	ApartmentID uint      `gorm:"index" json:"apartmentId"`
+	Apartment   Apartment `json:"-"`
+
+	// Client applying
+	ClientID uint `gorm:"index" json:"clientId"`
+	Client   User `json:"-" gorm:"foreignkey:ClientID"`
+
+	Message    string    `json:"message"`
+	MoveInDate time.Time `json:"moveInDate"`
+
+	Status string `gorm:"index" json:"status"`
+
+	CreatedAt time.Time  `json:"createdAt"`
+	DecidedAt *time.Time `json:"decidedAt"`
+}
+
+type ApplicationService interface {
+	Create(ApplicationCreateInput) (*ApplicationCreateOutput, error)
+	Find(ApplicationFindInput) (*ApplicationFindOutput, error)
+	Accept(ApplicationDecisionInput) (*ApplicationDecisionOutput, error)
+	Reject(ApplicationDecisionInput) (*ApplicationDecisionOutput, error)
+	Withdraw(ApplicationDecisionInput) (*ApplicationDecisionOutput, error)
+}
+
+type ApplicationCreateInput struct {
+	ApartmentId uint   `json:"apartmentId"`
+	ClientId    uint   `json:"-"`
+	Message     string `json:"message"`
+
+	// Date in the 2006-01-02 format
+	MoveInDate string `json:"moveInDate"`
+}
+
+type ApplicationCreateOutput struct {
+	RentalApplication
+}
+
+// Lists the applications visible to the actor: clients see
+// their own, realtors the ones on their apartments and admins
+// all of them.
+type ApplicationFindInput struct {
+	ActorId     uint
+	ActorRole   string
+	ApartmentId string
+	Status      string
+}
+
+type ApplicationFindOutput struct {
+	Applications []RentalApplication
+}
+
+func (o *ApplicationFindOutput) Public() interface{} {
+	return o.Applications
+}
+
+type ApplicationDecisionInput struct {
+	Id        string
+	ActorId   uint
+	ActorRole string
+	RequestId string
+}
+
+type ApplicationDecisionOutput struct {
+	RentalApplication
+}
@@ -0,0 +1,109 @@
+package rentals
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Audited entities
+const (
+	AuditApartment = "apartment"
+	AuditUser      = "user"
+)
+
+// Audited actions
+const (
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditTransition = "transition"
+	AuditReassign   = "reassign"
+	AuditDelete     = "delete"
+	AuditRestore    = "restore"
+	AuditPurge      = "purge"
+	AuditSetStatus  = "set_status"
+)
+
+// Value shown instead of secrets, e.g. passwords, in diffs
+const AuditRedacted = "[redacted]"
+
+// Entry of the audit trail. Entries are written in the same
+// transaction as the mutation they describe and never changed.
+type AuditEntry struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	// User that made the change. 0 for changes made by the app
+	// itself, e.g. signups or command line tools.
+	ActorID uint `gorm:"index" json:"actorId"`
+
+	Action   string `json:"action"`
+	Entity   string `gorm:"index:idx_audit_entity" json:"entity"`
+	EntityID uint   `gorm:"index:idx_audit_entity" json:"entityId"`
+
+	// Fields changed, stored as json
+	Changes    []FieldChange `gorm:"-" json:"changes"`
+	ChangeList string        `gorm:"type:text" json:"-"`
+
+	// X-Request-ID of the request that made the change
+	RequestID string `gorm:"index" json:"requestId"`
+
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+}
+
+func (e *AuditEntry) BeforeSave() error {
+	changes, err := json.Marshal(e.Changes)
+	e.ChangeList = string(changes)
+	return err
+}
+
+func (e *AuditEntry) AfterFind() error {
+	e.Changes = make([]FieldChange, 0)
+	if e.ChangeList == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(e.ChangeList), &e.Changes)
+}
+
+// Change of a single field. From is nil for created entities and
+// To for deleted ones.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type AuditService interface {
+	// Entries lists the audit trail, newest first
+	Entries(AuditListInput) (*AuditListOutput, error)
+
+	// ApartmentHistory lists the changes made to an apartment,
+	// oldest first. Only its realtor and admins can see it.
+	ApartmentHistory(ApartmentAuditInput) (*AuditListOutput, error)
+}
+
+// Filters of the audit trail. Zero values mean no filtering.
+type AuditListInput struct {
+	Entity   string
+	EntityId string
+	ActorId  string
+	Action   string
+	Cursor   string
+	Limit    int
+}
+
+type AuditListOutput struct {
+	Entries    []AuditEntry
+	NextCursor string
+}
+
+func (o *AuditListOutput) Public() interface{} {
+	return Page{Items: o.Entries, NextCursor: o.NextCursor}
+}
+
+type ApartmentAuditInput struct {
+	Id        string
+	ActorId   uint
+	ActorRole string
+	Cursor    string
+	Limit     int
+}
@@ -2,11 +2,14 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/jinzhu/gorm"
+	"log"
 	"rentals"
 	"rentals/crypto"
+	"strconv"
 )
 
 // Elements related to authentication and authorization.
@@ -14,6 +17,16 @@ import (
 // Error thrown when a login fails
 var LoginError = errors.New("incorrect username/password")
 
+// Information about the client starting a session or making
+// a request
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+
+	// Authenticated user making the request, if any
+	ActorId uint
+}
+
 // AuthnService is the interface that should be implemented when
 // designing an auth scheme that depends on a stateful bearer token
 // Note: It is NOT safe to use this for stateless authentications schemes
@@ -24,61 +37,105 @@ type AuthnService interface {
 	// and in case it is, generate a token that can be used
 	// for future requests. Users should include this token in
 	// their requests
-	Login(username, password string) (string, error)
+	Login(username, password string, client ClientInfo) (string, error)
 
 	// Verify checks whether or not the given token is valid.
 	// If it is, it returns the user associated to such token.
 	// Otherwise, returns nil.
 	Verify(token string) *rentals.User
+
+	// Sessions returns the active sessions of the given user
+	Sessions(userId uint) ([]rentals.UserSession, error)
+
+	// RevokeSession deletes a single session of the given user.
+	// Returns rentals.NotFoundError if the user has no such session.
+	RevokeSession(userId uint, sessionId string, client ClientInfo) error
+
+	// RevokeSessions deletes all the sessions of the given user
+	// except the one identified by keepToken. An empty keepToken
+	// revokes every session.
+	RevokeSessions(userId uint, keepToken string, client ClientInfo) error
 }
 
-// Implementation of a AuthnService using a relational database
+// Implementation of a AuthnService using a relational database.
+// Only hashes of the tokens are stored.
 type dbAuthnService struct {
 	Db *gorm.DB
+
+	// Optional. Where successful logins are published.
+	Events rentals.EventPublisher
+
+	// Optional. Where logins and revoked sessions are recorded.
+	Security rentals.SecurityLog
 }
 
-func (a *dbAuthnService) Login(username, password string) (string, error) {
+func (a *dbAuthnService) Login(username, password string, client ClientInfo) (string, error) {
 	var user rentals.User
 	a.Db.Where("username = ?", username).First(&user)
 
 	// Username was not found as we don't allow empty passwords
 	if user.PasswordHash == "" {
+		a.record(rentals.SecurityLoginFailed, uint(user.ID), username, client, "unknown username")
 		return "", LoginError
 	}
 
 	if crypto.CheckPassword(user.PasswordHash, password) != nil {
+		a.record(rentals.SecurityLoginFailed, uint(user.ID), username, client, "wrong password")
 		return "", LoginError
 	}
 
-	// Check if there is an existing session already.
-	existingSession := a.findExistingUserSession(user)
-	if existingSession != nil {
-		return existingSession.Token, nil
+	// Suspended or deactivated users can't log in
+	if user.Status != rentals.UserActive {
+		a.record(rentals.SecurityLoginFailed, uint(user.ID), username, client, "user "+user.Status)
+		return "", LoginError
+	}
+
+	// Upgrade hashes made with old algorithms or parameters
+	// now that we know the password
+	if crypto.NeedsRehash(user.PasswordHash) {
+		a.rehashPassword(user, password)
 	}
 
-	// Otherwise, create a new token and session and save it to the Db
+	// Create a new token and session and save it to the Db.
+	// Tokens can't be recovered from existing sessions.
 	token := generateToken()
 	session := rentals.UserSession{
-		Token:  token,
-		UserID: uint(user.ID),
-		User:   user,
+		TokenHash: HashToken(token),
+		UserID:    uint(user.ID),
+		UserAgent: client.UserAgent,
+		IP:        client.IP,
+	}
+	if err := a.Db.Create(&session).Error; err != nil {
+		return "", fmt.Errorf("[dbAuthnService.Login] error creating session %v", err)
+	}
+
+	a.record(rentals.SecurityLoginSucceeded, uint(user.ID), username, client, "")
+	if a.Events != nil {
+		a.Events.Publish(rentals.LoginSucceeded{
+			UserId:    uint(user.ID),
+			Username:  user.Username,
+			IP:        client.IP,
+			UserAgent: client.UserAgent,
+			At:        session.CreatedAt,
+		})
 	}
-	a.Db.Create(&session)
 
 	return token, nil
 }
 
-func (a *dbAuthnService) findExistingUserSession(user rentals.User) *rentals.UserSession {
-	var session rentals.UserSession
-
-	a.Db.Where("user_id = ?", user.ID).First(&session)
-
-	// Session not found
-	if session.Token == "" {
-		return nil
+func (a *dbAuthnService) rehashPassword(user rentals.User, password string) {
+	hash, err := crypto.EncryptPassword(password)
+	if err != nil {
+		log.Printf("[ERROR] rehashing password of user %d: %v", user.ID, err)
+		return
 	}
 
-	return &session
+	// A change like any other, so it moves the user to its next version
+	err = a.Db.Model(&user).
+		UpdateColumns(map[string]interface{}{"password_hash": hash, "version": gorm.Expr("version + 1")}).Error
+	if err != nil {
+		log.Printf("[ERROR] rehashing password of user %d: %v", user.ID, err)
+	}
 }
 
 // Generates a random by drawing a number of bytes from
@@ -95,20 +152,106 @@ func generateToken() string {
 	return fmt.Sprintf("%X", ret)
 }
 
+// Returns the hash of a token as stored in the db. Tokens are
+// random so a fast unsalted hash is enough.
+func HashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
 func (a *dbAuthnService) Verify(token string) *rentals.User {
-	var userSession rentals.UserSession
-	a.Db.Where("token = ?", token).First(&userSession)
+	if token == "" {
+		return nil
+	}
 
-	if userSession.Token != token {
+	var userSession rentals.UserSession
+	if a.Db.Where("token_hash = ?", HashToken(token)).First(&userSession).Error != nil {
 		return nil
 	}
 
 	var user rentals.User
 	a.Db.Model(&userSession).Related(&user)
 
+	if user.Status != rentals.UserActive {
+		return nil
+	}
+
 	return &user
 }
 
+func (a *dbAuthnService) Sessions(userId uint) ([]rentals.UserSession, error) {
+	var sessions []rentals.UserSession
+	if err := a.Db.Where("user_id = ?", userId).Order("created_at DESC").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (a *dbAuthnService) RevokeSession(userId uint, sessionId string, client ClientInfo) error {
+	intId, err := strconv.Atoi(sessionId)
+	if err != nil {
+		return err
+	}
+
+	res := a.Db.Where("id = ? AND user_id = ?", intId, userId).Delete(rentals.UserSession{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return rentals.NotFoundError
+	}
+
+	a.recordRevoke(rentals.SecuritySessionRevoked, userId, client, "session "+sessionId)
+	return nil
+}
+
+func (a *dbAuthnService) RevokeSessions(userId uint, keepToken string, client ClientInfo) error {
+	tx := a.Db.Where("user_id = ?", userId)
+	detail := "all sessions"
+	if keepToken != "" {
+		tx = tx.Where("token_hash <> ?", HashToken(keepToken))
+		detail = "all other sessions"
+	}
+
+	res := tx.Delete(rentals.UserSession{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	a.recordRevoke(rentals.SecuritySessionsRevoked, userId, client,
+		fmt.Sprintf("%s, %d revoked", detail, res.RowsAffected))
+	return nil
+}
+
+// Records an event about the user with the given id in the security
+// log, if there's one. userId is 0 for unknown usernames.
+func (a *dbAuthnService) record(event string, userId uint, username string, client ClientInfo, detail string) {
+	if a.Security == nil {
+		return
+	}
+
+	a.Security.Record(rentals.SecurityEvent{
+		Event:     event,
+		UserID:    userId,
+		Username:  username,
+		ActorID:   client.ActorId,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		Detail:    detail,
+	})
+}
+
+func (a *dbAuthnService) recordRevoke(event string, userId uint, client ClientInfo, detail string) {
+	if a.Security == nil {
+		return
+	}
+
+	var user rentals.User
+	a.Db.Select("username").First(&user, userId)
+	a.record(event, userId, user.Username, client, detail)
+}
+
 // Creates a new database authenticator
 func NewDbAuthnService(db *gorm.DB) *dbAuthnService {
 	return &dbAuthnService{Db: db}
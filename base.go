@@ -4,6 +4,35 @@ var DbModels = []interface{}{
 	&User{},
 	&UserSession{},
 	&Apartment{},
+	&ApartmentMedia{},
+	&ApartmentStatusChange{},
+	&RentalApplication{},
+	&Lease{},
+	&ViewingSlot{},
+	&Viewing{},
+	&Favorite{},
+	&SavedSearch{},
+	&SearchMatch{},
+	&InboxNotification{},
+	&NotificationPreference{},
+	&Thread{},
+	&Message{},
+	&MessageAttachment{},
+	&OutboxEvent{},
+	&WebhookSubscription{},
+	&WebhookDelivery{},
+	&WebhookAttempt{},
+	&AuditEntry{},
+	&SecurityEvent{},
+	&IdempotencyKey{},
+	&ApartmentImport{},
 }
 
 type uid uint
+
+// Envelope returned by paginated listings. NextCursor
+// is empty when there are no more results.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor"`
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rentals"
+	"rentals/postgres"
+	"strconv"
+	"strings"
+)
+
+// Runs the apartments subcommands:
+//
+//	rentals-cli apartments reassign -from 1 -to 2 [-query roomCount=2] [-ids 1,2,3]
+//	rentals-cli apartments import -file apartments.csv [-mode best_effort] [-dry-run] [-realtor 2]
+//	rentals-cli apartments export [-format csv|ndjson|geojson] [-query roomCount=2] [-out apartments.csv]
+func apartmentsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: rentals-cli apartments reassign|import|export")
+	}
+
+	switch args[0] {
+	case "reassign":
+		return reassignCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	}
+
+	return fmt.Errorf("unknown apartments command %s", args[0])
+}
+
+func reassignCommand(args []string) error {
+	flags := flag.NewFlagSet("reassign", flag.ExitOnError)
+	testing := flags.Bool("local", false, "uses a local db")
+	from := flags.Int("from", 0, "id of the realtor to take apartments from")
+	to := flags.Int("to", 0, "id of the realtor to move apartments to")
+	query := flags.String("query", "", "only move apartments matching this filter")
+	ids := flags.String("ids", "", "comma separated ids of the apartments to move")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == 0 || *to == 0 {
+		return fmt.Errorf("-from and -to are required")
+	}
+
+	input := rentals.ApartmentReassignInput{
+		FromRealtorId: strconv.Itoa(*from),
+		ToRealtorId:   strconv.Itoa(*to),
+		Query:         *query,
+	}
+
+	if *ids != "" {
+		for _, id := range strings.Split(*ids, ",") {
+			intId, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				return fmt.Errorf("invalid apartment id %s", id)
+			}
+			input.Ids = append(input.Ids, uint(intId))
+		}
+	}
+
+	db, err := postgres.ConnectToDB(*testing)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	shared, err := setupSharedServices(db)
+	if err != nil {
+		return err
+	}
+	defer shared.bus.Close()
+
+	apartments := postgres.NewDbApartmentService(db)
+	apartments.Events = shared.bus
+	apartments.Media = shared.media
+	result, err := apartments.Reassign(input)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(result)
+}
+
+// Imports apartments as an admin, waiting for the import however
+// large the file is
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	testing := flags.Bool("local", false, "uses a local db")
+	file := flags.String("file", "", "csv or ndjson file to import")
+	format := flags.String("format", "", "csv or ndjson, taken from the file extension by default")
+	mode := flags.String("mode", rentals.ImportAllOrNothing, "all or best_effort")
+	dryRun := flags.Bool("dry-run", false, "only validates the file")
+	realtor := flags.Int("realtor", 0, "id of the realtor of the rows that don't say")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(*file)) {
+		case ".csv":
+			*format = rentals.ImportCsv
+		case ".ndjson", ".jsonl":
+			*format = rentals.ImportNdjson
+		default:
+			return fmt.Errorf("-format is required for %s", *file)
+		}
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+
+	db, err := postgres.ConnectToDB(*testing)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	shared, err := setupSharedServices(db)
+	if err != nil {
+		return err
+	}
+	defer shared.bus.Close()
+
+	apartments := postgres.NewDbApartmentService(db)
+	apartments.Events = shared.bus
+	apartments.Media = shared.media
+	importService := postgres.NewDbApartmentImportService(db, apartments)
+	result, err := importService.Import(rentals.ApartmentImportInput{
+		Format:    *format,
+		Mode:      *mode,
+		DryRun:    *dryRun,
+		Data:      data,
+		RealtorId: uint(*realtor),
+		Wait:      true,
+		ActorRole: "admin",
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		return err
+	}
+
+	if result.Status == rentals.ImportFailed {
+		return fmt.Errorf("import failed, %d rows with errors", result.Failed)
+	}
+
+	return nil
+}
+
+// Exports apartments a page at a time to stdout, or to -out
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	testing := flags.Bool("local", false, "uses a local db")
+	format := flags.String("format", rentals.ExportCsv, "csv, ndjson or geojson")
+	query := flags.String("query", "", "only export apartments matching this filter")
+	out := flags.String("out", "", "file to write, stdout by default")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	file := os.Stdout
+	if *out != "" {
+		var err error
+		if file, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+
+	buffered := bufio.NewWriter(file)
+	writer, err := rentals.NewApartmentExportWriter(*format, buffered)
+	if err != nil {
+		return err
+	}
+
+	db, err := postgres.ConnectToDB(*testing)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	shared, err := setupSharedServices(db)
+	if err != nil {
+		return err
+	}
+	defer shared.bus.Close()
+
+	service := postgres.NewDbApartmentService(db)
+	service.Events = shared.bus
+	service.Media = shared.media
+	input := rentals.ApartmentExportInput{Query: *query, ActorRole: "admin", Limit: 500}
+	for {
+		page, err := service.Export(input)
+		if err != nil {
+			return err
+		}
+
+		if err := writer.Write(page.Apartments); err != nil {
+			return err
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		input.Cursor = page.NextCursor
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return buffered.Flush()
+}
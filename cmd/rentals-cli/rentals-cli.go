@@ -3,16 +3,48 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/jinzhu/gorm"
 	"log"
+	"math"
 	"os"
 	"rentals"
 	"rentals/auth"
+	"rentals/crypto"
+	"rentals/events"
+	"rentals/jobs"
+	"rentals/live"
+	"rentals/mail"
+	"rentals/notify"
 	"rentals/postgres"
+	"rentals/storage"
 	"rentals/transport"
+	"rentals/webhook"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// Changes to apartments kept for streaming clients to resume
+const liveHistorySize = 1000
+
+// Hours idempotency keys are kept, unless RENTALS_IDEMPOTENCY_TTL_HOURS
+// says otherwise
+const defaultIdempotencyTTLHours = 24
+
+// Days deleted apartments stay in the trash, unless
+// RENTALS_TRASH_RETENTION_DAYS says otherwise
+const defaultTrashRetentionDays = 30
+
 func main() {
+	// Subcommands. Without one, the server is run.
+	if len(os.Args) > 1 && os.Args[1] == "apartments" {
+		if err := apartmentsCommand(os.Args[2:]); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	testing := flag.Bool("local", false, "runs the server with a local db")
 	port := flag.Int("port", 8083, "port to bind to")
 
@@ -27,12 +59,31 @@ func runServer(testing bool, port int) {
 		log.Fatal(err)
 	}
 
-	db.AutoMigrate(rentals.DbModels...)
+	if err := postgres.Migrate(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupPasswordHasher(); err != nil {
+		log.Fatal(err)
+	}
 
+	shared, err := setupSharedServices(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bus := shared.bus
+	defer bus.Close()
+
+	securityLog := postgres.NewDbSecurityLog(db)
 	authN := auth.NewDbAuthnService(db)
+	authN.Events = bus
+	authN.Security = securityLog
 	authZ := auth.NewAuthzService()
 	apartmentsSrv := postgres.NewDbApartmentService(db)
+	apartmentsSrv.Events = bus
+	apartmentsSrv.Media = shared.media
 	userService := postgres.NewDbUserService(db)
+	userService.Events = bus
 
 	srv, err := transport.NewServer(db, authN, authZ, apartmentsSrv, userService)
 	if err != nil {
@@ -40,6 +91,122 @@ func runServer(testing bool, port int) {
 		os.Exit(1)
 	}
 
+	// X-Forwarded-For is only read from these proxies
+	if proxies := os.Getenv("RENTALS_TRUSTED_PROXIES"); proxies != "" {
+		if err := srv.TrustProxies(strings.Split(proxies, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ttlHours, err := envInt("RENTALS_IDEMPOTENCY_TTL_HOURS", defaultIdempotencyTTLHours)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idempotencyTTL := time.Duration(ttlHours) * time.Hour
+	idempotencyStore := postgres.NewDbIdempotencyStore(db, idempotencyTTL)
+	srv.UseIdempotencyKeys(idempotencyStore)
+
+	// Forget the idempotency keys past their window
+	stopIdempotency := jobs.Every("purge-idempotency-keys", time.Hour, func() error {
+		_, err := idempotencyStore.Purge(time.Now().Add(-idempotencyTTL))
+		return err
+	})
+	defer stopIdempotency()
+
+	srv.AddMediaHandlers("apartments", shared.media)
+	srv.UseSecurityLog(securityLog)
+	srv.AddSecurityEventsHandlers("security-events", securityLog)
+
+	auditService := postgres.NewDbAuditService(db)
+	srv.AddAuditHandlers("audit", auditService)
+	srv.AddApartmentHistoryHandlers("apartments", auditService)
+
+	notifier := shared.notifier
+	srv.AddNotificationsHandlers("me/notifications", notifier)
+
+	// Streams only reach the clients of this process, so the hub is
+	// subscribed here rather than with the shared subscribers
+	apartmentsHub := live.NewHub(liveHistorySize)
+	bus.Subscribe(events.ApartmentChanges(apartmentsHub.ApartmentChanged), events.ApartmentChangeEvents...)
+	srv.AddApartmentStreamHandlers("apartments", apartmentsHub)
+	srv.AddFavoritesHandlers("me/favorites", shared.favorites)
+	srv.AddSavedSearchesHandlers("me/searches", shared.searches)
+
+	// Send the new matches of saved searches
+	stopDigests := jobs.Every("search-digests", 5*time.Minute, func() error {
+		sent, err := shared.searches.SendDigests(time.Now())
+		if sent > 0 {
+			log.Printf("[INFO] sent %d saved search digests", sent)
+		}
+		return err
+	})
+	defer stopDigests()
+
+	applicationService := postgres.NewDbApplicationService(db, notifier)
+	applicationService.Events = bus
+	srv.AddApplicationsHandlers("applications", applicationService)
+
+	viewingService := postgres.NewDbViewingService(db, notifier)
+	srv.AddViewingSlotsHandlers("apartments", viewingService)
+	srv.AddViewingsHandlers("viewings", viewingService)
+
+	srv.AddThreadsHandlers("threads", postgres.NewDbMessageService(db, notifier))
+
+	webhookService := postgres.NewDbWebhookService(db, webhook.NewSender())
+	srv.AddWebhooksHandlers("webhooks", webhookService)
+
+	// Turn the changes recorded in the outbox into webhook deliveries
+	// and send them
+	stopOutbox := jobs.Every("webhook-outbox", 5*time.Second, func() error {
+		_, err := webhookService.Dispatch(time.Now())
+		return err
+	})
+	defer stopOutbox()
+
+	stopDeliveries := jobs.Every("webhook-deliveries", 10*time.Second, func() error {
+		_, err := webhookService.Deliver(time.Now())
+		return err
+	})
+	defer stopDeliveries()
+
+	leaseService := postgres.NewDbLeaseService(db)
+	leaseService.Events = bus
+	srv.AddLeasesHandlers("leases", leaseService)
+
+	// Return the apartments of ended leases to the market
+	stopLeases := jobs.Every("end-leases", time.Hour, func() error {
+		ended, err := leaseService.EndExpired(time.Now())
+		if ended > 0 {
+			log.Printf("[INFO] ended %d leases", ended)
+		}
+		return err
+	})
+	defer stopLeases()
+
+	// Remove for good the apartments that have been in the trash for
+	// longer than the retention period
+	retentionDays, err := envInt("RENTALS_TRASH_RETENTION_DAYS", defaultTrashRetentionDays)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopPurge := jobs.Every("purge-trash", time.Hour, func() error {
+		purged, err := apartmentsSrv.Purge(time.Now().AddDate(0, 0, -retentionDays))
+		if purged > 0 {
+			log.Printf("[INFO] purged %d apartments from the trash", purged)
+		}
+		return err
+	})
+	defer stopPurge()
+
+	// Run the large imports left in the background
+	importService := postgres.NewDbApartmentImportService(db, apartmentsSrv)
+	srv.AddApartmentImportHandlers("apartments", importService)
+	stopImports := jobs.Every("apartment-imports", 5*time.Second, func() error {
+		_, err := importService.RunPending()
+		return err
+	})
+	defer stopImports()
+
 	portStr := os.Getenv("PORT")
 	if portStr != "" {
 		port, err = strconv.Atoi(portStr)
@@ -52,3 +219,163 @@ func runServer(testing bool, port int) {
 	_, _ = fmt.Fprintf(os.Stderr, "Running in %s\n", addr)
 	_, _ = fmt.Fprintf(os.Stderr, "[ERROR] %s", srv.ServeHTTP(addr))
 }
+
+// Services the server and the subcommands share, set up the same way
+// so that changes made from either reach the same subscribers
+type sharedServices struct {
+	// Domain events published by the services once their changes
+	// are committed. Closing waits for asynchronous subscribers.
+	bus *events.Bus
+
+	notifier  rentals.NotificationService
+	media     rentals.MediaService
+	favorites rentals.FavoriteService
+	searches  rentals.SavedSearchService
+}
+
+// Sets up the shared services, with the favorites and saved searches
+// subscribed to apartment changes
+func setupSharedServices(db *gorm.DB) (*sharedServices, error) {
+	mediaStorage, err := setupStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	notifier := postgres.NewDbNotificationService(db,
+		notify.NewEmailChannel(setupMailer()), notify.NewWebhookChannel())
+	shared := &sharedServices{
+		bus:       events.NewBus(),
+		notifier:  notifier,
+		media:     postgres.NewDbMediaService(db, mediaStorage),
+		favorites: postgres.NewDbFavoriteService(db, notifier),
+		searches:  postgres.NewDbSavedSearchService(db, notifier),
+	}
+
+	shared.bus.SubscribeAsync(events.ApartmentChanges(shared.favorites.ApartmentChanged), events.ApartmentChangeEvents...)
+	shared.bus.SubscribeAsync(events.ApartmentChanges(shared.searches.ApartmentChanged), events.ApartmentChangeEvents...)
+	return shared, nil
+}
+
+// Configures how new passwords are hashed from env variables:
+//
+//	RENTALS_PASSWORD_HASHER  argon2id (default) or bcrypt
+//	RENTALS_BCRYPT_COST      bcrypt cost
+//	RENTALS_ARGON2_MEMORY    argon2id memory in KiB
+//	RENTALS_ARGON2_TIME      argon2id iterations
+//	RENTALS_ARGON2_THREADS   argon2id parallelism
+func setupPasswordHasher() error {
+	switch os.Getenv("RENTALS_PASSWORD_HASHER") {
+	case "bcrypt":
+		cost, err := envInt("RENTALS_BCRYPT_COST", crypto.DefaultBcryptCost)
+		if err != nil {
+			return err
+		}
+
+		if cost < crypto.MinBcryptCost || cost > crypto.MaxBcryptCost {
+			return fmt.Errorf("RENTALS_BCRYPT_COST must be between %d and %d, got %d",
+				crypto.MinBcryptCost, crypto.MaxBcryptCost, cost)
+		}
+		crypto.SetDefaultHasher(crypto.NewBcryptHasher(cost))
+	case "", "argon2id":
+		params := crypto.DefaultArgon2idParams
+		memory, err := envInt("RENTALS_ARGON2_MEMORY", int(params.Memory))
+		if err != nil {
+			return err
+		}
+		iterations, err := envInt("RENTALS_ARGON2_TIME", int(params.Iterations))
+		if err != nil {
+			return err
+		}
+		threads, err := envInt("RENTALS_ARGON2_THREADS", int(params.Threads))
+		if err != nil {
+			return err
+		}
+
+		// Checked before the conversions below, argon2 panics without threads
+		// and quietly raises memory under 8 KiB per thread
+		if threads < 1 || threads > math.MaxUint8 {
+			return fmt.Errorf("RENTALS_ARGON2_THREADS must be between 1 and %d, got %d", math.MaxUint8, threads)
+		}
+		if memory < 8*threads || memory > math.MaxUint32 {
+			return fmt.Errorf("RENTALS_ARGON2_MEMORY must be at least 8 KiB per thread (%d), got %d", 8*threads, memory)
+		}
+		if iterations < 1 || iterations > math.MaxUint32 {
+			return fmt.Errorf("RENTALS_ARGON2_TIME must be at least 1, got %d", iterations)
+		}
+
+		params.Memory = uint32(memory)
+		params.Iterations = uint32(iterations)
+		params.Threads = uint8(threads)
+		crypto.SetDefaultHasher(crypto.NewArgon2idHasher(params))
+	default:
+		return fmt.Errorf("unknown password hasher %s", os.Getenv("RENTALS_PASSWORD_HASHER"))
+	}
+
+	return nil
+}
+
+// Reads an int from an env variable, returning def if it's not set
+func envInt(name string, def int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %s", name, raw)
+	}
+
+	return value, nil
+}
+
+// Creates the mailer used to email notifications from env variables.
+// Emails are only logged if RENTALS_SMTP_ADDR is not set.
+//
+//	RENTALS_SMTP_ADDR      host:port of the SMTP server
+//	RENTALS_SMTP_USER
+//	RENTALS_SMTP_PASSWORD
+//	RENTALS_SMTP_FROM      sender address
+func setupMailer() mail.Mailer {
+	addr := os.Getenv("RENTALS_SMTP_ADDR")
+	if addr == "" {
+		return mail.NewLogMailer()
+	}
+
+	return mail.NewSMTPMailer(mail.SMTPConfig{
+		Addr:     addr,
+		Username: os.Getenv("RENTALS_SMTP_USER"),
+		Password: os.Getenv("RENTALS_SMTP_PASSWORD"),
+		From:     os.Getenv("RENTALS_SMTP_FROM"),
+	})
+}
+
+// Creates the storage for uploaded media from env variables:
+//
+//	RENTALS_MEDIA_STORAGE    local (default) or s3
+//	RENTALS_MEDIA_DIR        directory used by the local storage
+//	RENTALS_S3_ENDPOINT      e.g. https://s3.amazonaws.com
+//	RENTALS_S3_BUCKET
+//	RENTALS_S3_REGION
+//	RENTALS_S3_ACCESS_KEY
+//	RENTALS_S3_SECRET_KEY
+func setupStorage() (storage.Storage, error) {
+	switch os.Getenv("RENTALS_MEDIA_STORAGE") {
+	case "", "local":
+		dir := os.Getenv("RENTALS_MEDIA_DIR")
+		if dir == "" {
+			dir = "media"
+		}
+		return storage.NewLocalStorage(dir)
+	case "s3":
+		return storage.NewS3Storage(storage.S3Config{
+			Endpoint:  os.Getenv("RENTALS_S3_ENDPOINT"),
+			Bucket:    os.Getenv("RENTALS_S3_BUCKET"),
+			Region:    os.Getenv("RENTALS_S3_REGION"),
+			AccessKey: os.Getenv("RENTALS_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("RENTALS_S3_SECRET_KEY"),
+		}), nil
+	}
+
+	return nil, fmt.Errorf("unknown media storage %s", os.Getenv("RENTALS_MEDIA_STORAGE"))
+}
@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+var InvalidHashError = errors.New("invalid password hash")
+
+// Cost parameters of argon2id. Memory is in KiB.
+type Argon2idParams struct {
+	Memory     uint32
+	Iterations uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// See https://tools.ietf.org/html/draft-irtf-cfrg-argon2-04#section-4
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:     64 * 1024,
+	Iterations: 1,
+	Threads:    4,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+// Hashes passwords with argon2id. Hashes look like
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+type Argon2idHasher struct {
+	params Argon2idParams
+}
+
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := h.params
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Threads, p.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		p.Memory, p.Iterations, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Check(hash, password string) error {
+	p, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Threads, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return MismatchError
+	}
+
+	return nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash string) bool {
+	p, salt, _, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	p.SaltLength = uint32(len(salt))
+	return p != h.params
+}
+
+// Parses an argon2id PHC string into its parameters, salt and key
+func decodeArgon2id(hash string) (Argon2idParams, []byte, []byte, error) {
+	var p Argon2idParams
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, InvalidHashError
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, InvalidHashError
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Threads); err != nil {
+		return p, nil, nil, InvalidHashError
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, InvalidHashError
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, InvalidHashError
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
@@ -2,24 +2,74 @@ package crypto
 
 import (
 	"encoding/hex"
-	"fmt"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
 )
 
-func EncryptPassword(password string) (string, error) {
-	hashPassword, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+const DefaultBcryptCost = bcrypt.DefaultCost
+
+// Costs bcrypt accepts
+const (
+	MinBcryptCost = bcrypt.MinCost
+	MaxBcryptCost = bcrypt.MaxCost
+)
+
+// Hashes passwords with bcrypt. Its output is already
+// in the modular crypt format ($2a$<cost>$<salt+hash>).
+type BcryptHasher struct {
+	cost int
+}
+
+// Costs under MinBcryptCost use DefaultBcryptCost, and costs over
+// MaxBcryptCost are lowered to it, as bcrypt fails with them
+func NewBcryptHasher(cost int) *BcryptHasher {
+	if cost < MinBcryptCost {
+		cost = DefaultBcryptCost
+	}
+
+	if cost > MaxBcryptCost {
+		cost = MaxBcryptCost
+	}
+
+	return &BcryptHasher{cost: cost}
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
 	if err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%x", hashPassword), nil
+	return string(hashPassword), nil
+}
+
+func (h *BcryptHasher) Check(hash, password string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return MismatchError
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, "$2") {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost
 }
 
-func CheckPassword(hashPassword, password string) error {
+// Hashes stored before PHC strings were used are hex
+// encoded bcrypt hashes
+func checkLegacyPassword(hashPassword, password string) error {
 	hashBytes, err := hex.DecodeString(hashPassword)
 	if err != nil {
 		return err
 	}
 
-	return bcrypt.CompareHashAndPassword(hashBytes, []byte(password))
+	return bcryptHasher.Check(string(hashBytes), password)
 }
@@ -18,3 +18,23 @@ func TestEncryptPassword(t *testing.T) {
 	err = CheckPassword(encrypted, "password")
 	tst.True(t, err == nil, fmt.Sprintf("Unexpected error %v", err))
 }
+
+func TestBcryptCost(t *testing.T) {
+	for _, elt := range []struct {
+		name string
+		cost int
+		want int
+	}{
+		{"Too low, default", MinBcryptCost - 1, DefaultBcryptCost},
+		{"In range, kept", MinBcryptCost, MinBcryptCost},
+		{"Too high, lowered", MaxBcryptCost + 1, MaxBcryptCost},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			// Act
+			hasher := NewBcryptHasher(elt.cost)
+
+			// True
+			tst.True(t, hasher.cost == elt.want, fmt.Sprintf("Expected cost %d, got %d", elt.want, hasher.cost))
+		})
+	}
+}
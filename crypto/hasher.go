@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"errors"
+	"strings"
+)
+
+// Error returned when a password doesn't match its hash
+var MismatchError = errors.New("password does not match")
+
+// Hasher hashes passwords into PHC strings
+// ($<id>$<params>$<salt>$<hash>). Each hasher must be able
+// to tell if a hash it produced used outdated parameters.
+type Hasher interface {
+	// Hash returns the PHC string of the given password
+	Hash(password string) (string, error)
+
+	// Check returns nil if password matches hash
+	Check(hash, password string) error
+
+	// NeedsRehash returns true if hash was not produced by this
+	// hasher with its current parameters
+	NeedsRehash(hash string) bool
+}
+
+var (
+	bcryptHasher   Hasher = NewBcryptHasher(DefaultBcryptCost)
+	argon2idHasher Hasher = NewArgon2idHasher(DefaultArgon2idParams)
+
+	// Hasher used for new passwords
+	defaultHasher = argon2idHasher
+)
+
+// Sets the hasher used for new passwords. Hashes produced by
+// other hashers are still verified and flagged for rehash.
+func SetDefaultHasher(h Hasher) {
+	defaultHasher = h
+
+	switch h.(type) {
+	case *BcryptHasher:
+		bcryptHasher = h
+	case *Argon2idHasher:
+		argon2idHasher = h
+	}
+}
+
+func EncryptPassword(password string) (string, error) {
+	return defaultHasher.Hash(password)
+}
+
+// Checks a password against a hash produced by any of the
+// supported hashers, including hex encoded bcrypt hashes.
+func CheckPassword(hashPassword, password string) error {
+	switch {
+	case strings.HasPrefix(hashPassword, argon2idPrefix):
+		return argon2idHasher.Check(hashPassword, password)
+	case strings.HasPrefix(hashPassword, "$2"):
+		return bcryptHasher.Check(hashPassword, password)
+	}
+
+	return checkLegacyPassword(hashPassword, password)
+}
+
+// Returns true if the hash should be replaced by one
+// produced by the default hasher
+func NeedsRehash(hashPassword string) bool {
+	return defaultHasher.NeedsRehash(hashPassword)
+}
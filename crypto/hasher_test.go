@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"rentals/tst"
+	"strings"
+	"testing"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	// Arrange
+	hasher := NewArgon2idHasher(DefaultArgon2idParams)
+
+	// Act
+	hash, err := hasher.Hash("password")
+	tst.Ok(t, err)
+
+	// True
+	tst.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=4$"),
+		fmt.Sprintf("Unexpected hash format %s", hash))
+	tst.Ok(t, hasher.Check(hash, "password"))
+	tst.True(t, hasher.Check(hash, "wrong") == MismatchError, "Expected mismatch")
+	tst.True(t, !hasher.NeedsRehash(hash), "Expected no rehash")
+
+	stronger := DefaultArgon2idParams
+	stronger.Iterations = 2
+	tst.True(t, NewArgon2idHasher(stronger).NeedsRehash(hash), "Expected rehash")
+}
+
+func TestBcryptHasher(t *testing.T) {
+	// Arrange
+	hasher := NewBcryptHasher(bcrypt.MinCost)
+
+	// Act
+	hash, err := hasher.Hash("password")
+	tst.Ok(t, err)
+
+	// True
+	tst.True(t, strings.HasPrefix(hash, "$2a$04$"), fmt.Sprintf("Unexpected hash format %s", hash))
+	tst.Ok(t, hasher.Check(hash, "password"))
+	tst.True(t, hasher.Check(hash, "wrong") == MismatchError, "Expected mismatch")
+	tst.True(t, !hasher.NeedsRehash(hash), "Expected no rehash")
+	tst.True(t, NewBcryptHasher(bcrypt.MinCost+1).NeedsRehash(hash), "Expected rehash")
+}
+
+func TestLegacyHexBcryptHash(t *testing.T) {
+	// Arrange
+	raw, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	tst.Ok(t, err)
+	legacy := fmt.Sprintf("%x", raw)
+
+	// Act & True
+	tst.Ok(t, CheckPassword(legacy, "password"))
+	tst.True(t, CheckPassword(legacy, "wrong") != nil, "Expected mismatch")
+	tst.True(t, NeedsRehash(legacy), "Expected legacy hash to need rehash")
+}
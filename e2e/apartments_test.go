@@ -29,6 +29,11 @@ type apartmentResponse struct {
 	Available        bool    `json:"available"`
 }
 
+type apartmentsPage struct {
+	Items      []apartmentResponse `json:"items"`
+	NextCursor string              `json:"nextCursor"`
+}
+
 func newServer(t *testing.T) (*transport.Server, func()) {
 	t.Helper()
 
@@ -49,7 +54,7 @@ func newServer(t *testing.T) (*transport.Server, func()) {
 	}
 }
 
-func startServer(wg sync.WaitGroup, addr string, srv *transport.Server) {
+func startServer(wg *sync.WaitGroup, addr string, srv *transport.Server) {
 	go func() {
 		defer wg.Done()
 		log.Printf("[ERROR] %s", srv.ServeHTTP(addr))
@@ -66,7 +71,7 @@ func TestCRUDApartment(t *testing.T) {
 	serverUrl := fmt.Sprintf("http://%s", addr)
 
 	wg.Add(1)
-	startServer(wg, addr, srv)
+	startServer(&wg, addr, srv)
 
 	_, err := createUser("admin", "admin", "admin", srv.Db)
 	tst.Ok(t, err)
@@ -208,7 +213,7 @@ func TestReadAllApartmentsAndSearch(t *testing.T) {
 	serverUrl := fmt.Sprintf("http://%s", addr)
 
 	wg.Add(1)
-	startServer(wg, addr, srv)
+	startServer(&wg, addr, srv)
 
 	_, err := createUser("admin", "admin", "admin", srv.Db)
 	tst.Ok(t, err)
@@ -232,13 +237,13 @@ func TestReadAllApartmentsAndSearch(t *testing.T) {
 			tst.True(t, res.StatusCode == http.StatusOK,
 				fmt.Sprintf("Expected 200, got %d", res.StatusCode))
 
-			var returnedApartments []apartmentResponse
+			var page apartmentsPage
 			decoder := json.NewDecoder(res.Body)
-			err = decoder.Decode(&returnedApartments)
+			err = decoder.Decode(&page)
 			tst.Ok(t, err)
 
-			tst.True(t, len(returnedApartments) == 10,
-				fmt.Sprintf("Expected 10 apartments, got %d", len(returnedApartments)))
+			tst.True(t, len(page.Items) == 10,
+				fmt.Sprintf("Expected 10 apartments, got %d", len(page.Items)))
 		}
 	})
 
@@ -254,13 +259,13 @@ func TestReadAllApartmentsAndSearch(t *testing.T) {
 		tst.True(t, res.StatusCode == http.StatusOK,
 			fmt.Sprintf("Expected 200, got %d", res.StatusCode))
 
-		var returnedApartments []apartmentResponse
+		var page apartmentsPage
 		decoder := json.NewDecoder(res.Body)
-		err = decoder.Decode(&returnedApartments)
+		err = decoder.Decode(&page)
 		tst.Ok(t, err)
 
-		tst.True(t, len(returnedApartments) == 5,
-			fmt.Sprintf("Expected 5 apartments, got %d", len(returnedApartments)))
+		tst.True(t, len(page.Items) == 5,
+			fmt.Sprintf("Expected 5 apartments, got %d", len(page.Items)))
 	})
 }
 
@@ -17,6 +17,7 @@ type userResponse struct {
 	ID       uint   `json:"id"`
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	Status   string `json:"status"`
 }
 
 func TestCRUDUsers(t *testing.T) {
@@ -29,7 +30,7 @@ func TestCRUDUsers(t *testing.T) {
 	serverUrl := fmt.Sprintf("http://%s", addr)
 
 	wg.Add(1)
-	startServer(wg, addr, srv)
+	startServer(&wg, addr, srv)
 
 	payload := []byte(`{"username":"john", "password": "secret", "role": "client"}`)
 
@@ -165,10 +166,18 @@ func TestCRUDUsers(t *testing.T) {
 		tst.True(t, res.StatusCode == http.StatusNoContent,
 			fmt.Sprintf("Expected 204, got %d", res.StatusCode))
 
+		// Deleted users are kept as deactivated
 		res, err = tst.MakeRequest("GET", userUrl, token, []byte(""))
 		tst.Ok(t, err)
-		tst.True(t, res.StatusCode == http.StatusNotFound,
-			fmt.Sprintf("Expected 404, got %d", res.StatusCode))
+		tst.True(t, res.StatusCode == http.StatusOK,
+			fmt.Sprintf("Expected 200, got %d", res.StatusCode))
+		rawContent, err = ioutil.ReadAll(res.Body)
+		tst.Ok(t, err)
+
+		var delUser userResponse
+		err = json.Unmarshal(rawContent, &delUser)
+		tst.True(t, delUser.Status == rentals.UserDeactivated,
+			fmt.Sprintf("Expected status deactivated, got %s", delUser.Status))
 	})
 }
 
@@ -181,7 +190,7 @@ func TestFetchOwnUserData(t *testing.T) {
 	serverUrl := fmt.Sprintf("http://%s", addr)
 
 	wg.Add(1)
-	startServer(wg, addr, srv)
+	startServer(&wg, addr, srv)
 
 	_, err := createUser("admin", "admin", "admin", srv.Db)
 	tst.Ok(t, err)
@@ -237,7 +246,7 @@ func TestCreateClient(t *testing.T) {
 	serverUrl := fmt.Sprintf("http://%s", addr)
 
 	wg.Add(1)
-	startServer(wg, addr, srv)
+	startServer(&wg, addr, srv)
 
 	_, err := createUser("admin", "admin", "admin", srv.Db)
 	tst.Ok(t, err)
@@ -284,3 +293,149 @@ func createUser(username, pwd, role string, db *gorm.DB) (uint, error) {
 
 	return uint(result.ID), nil
 }
+
+func TestUpdateOwnProfile(t *testing.T) {
+	var wg sync.WaitGroup
+	const addr = "localhost:8083"
+	srv, clean := newServer(t)
+	defer clean()
+
+	serverUrl := fmt.Sprintf("http://%s", addr)
+
+	wg.Add(1)
+	startServer(&wg, addr, srv)
+
+	_, err := createUser("client", "client", "client", srv.Db)
+	tst.Ok(t, err)
+
+	t.Run("Change password without current one, fail", func(t *testing.T) {
+		token, err := loginWithUser(t, serverUrl, "client", "client")
+		tst.Ok(t, err)
+
+		// Act
+		payload := []byte(`{"currentPassword": "wrong", "newPassword": "new"}`)
+		res, err := tst.MakeRequest("PATCH", serverUrl+"/profile", token, payload)
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, res.StatusCode == http.StatusForbidden,
+			fmt.Sprintf("Expected 403, got %d", res.StatusCode))
+	})
+
+	t.Run("Role can't be changed, contact details can", func(t *testing.T) {
+		token, err := loginWithUser(t, serverUrl, "client", "client")
+		tst.Ok(t, err)
+
+		// Act
+		payload := []byte(`{"role": "admin", "email": "client@example.com"}`)
+		res, err := tst.MakeRequest("PATCH", serverUrl+"/profile", token, payload)
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, res.StatusCode == http.StatusOK,
+			fmt.Sprintf("Expected 200, got %d", res.StatusCode))
+
+		var returnedUser rentals.User
+		err = json.NewDecoder(res.Body).Decode(&returnedUser)
+		tst.Ok(t, err)
+
+		assertUser(t, &returnedUser, "client", "client")
+		tst.True(t, returnedUser.Email == "client@example.com",
+			fmt.Sprintf("Expected email client@example.com, got %s", returnedUser.Email))
+	})
+
+	t.Run("Change password and delete account, success", func(t *testing.T) {
+		token, err := loginWithUser(t, serverUrl, "client", "client")
+		tst.Ok(t, err)
+
+		// Act
+		payload := []byte(`{"currentPassword": "client", "newPassword": "new"}`)
+		res, err := tst.MakeRequest("PATCH", serverUrl+"/profile", token, payload)
+		tst.Ok(t, err)
+		tst.True(t, res.StatusCode == http.StatusOK,
+			fmt.Sprintf("Expected 200, got %d", res.StatusCode))
+
+		token, err = loginWithUser(t, serverUrl, "client", "new")
+		tst.Ok(t, err)
+
+		res, err = tst.MakeRequest("DELETE", serverUrl+"/profile", token, []byte(""))
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, res.StatusCode == http.StatusNoContent,
+			fmt.Sprintf("Expected 204, got %d", res.StatusCode))
+
+		res, err = tst.MakeRequest("GET", serverUrl+"/profile", token, []byte(""))
+		tst.Ok(t, err)
+		tst.True(t, res.StatusCode == http.StatusUnauthorized,
+			fmt.Sprintf("Expected 401, got %d", res.StatusCode))
+	})
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	var wg sync.WaitGroup
+	const addr = "localhost:8083"
+	srv, clean := newServer(t)
+	defer clean()
+
+	serverUrl := fmt.Sprintf("http://%s", addr)
+
+	wg.Add(1)
+	startServer(&wg, addr, srv)
+
+	_, err := createUser("client", "client", "client", srv.Db)
+	tst.Ok(t, err)
+
+	firstToken, err := loginWithUser(t, serverUrl, "client", "client")
+	tst.Ok(t, err)
+	secondToken, err := loginWithUser(t, serverUrl, "client", "client")
+	tst.Ok(t, err)
+
+	t.Run("Tokens are not stored", func(t *testing.T) {
+		var count int
+		srv.Db.Model(&rentals.UserSession{}).Where("token_hash IN (?)",
+			[]string{firstToken, secondToken}).Count(&count)
+		tst.True(t, count == 0, fmt.Sprintf("Expected 0 raw tokens, got %d", count))
+	})
+
+	t.Run("List and revoke other session", func(t *testing.T) {
+		// Act
+		res, err := tst.MakeRequest("GET", serverUrl+"/sessions", secondToken, []byte(""))
+		tst.Ok(t, err)
+		tst.True(t, res.StatusCode == http.StatusOK,
+			fmt.Sprintf("Expected 200, got %d", res.StatusCode))
+
+		var sessions []struct {
+			ID      uint `json:"id"`
+			Current bool `json:"current"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&sessions)
+		tst.Ok(t, err)
+		tst.True(t, len(sessions) == 2, fmt.Sprintf("Expected 2 sessions, got %d", len(sessions)))
+
+		var otherId uint
+		for _, session := range sessions {
+			if !session.Current {
+				otherId = session.ID
+			}
+		}
+
+		sessionUrl := fmt.Sprintf("%s/sessions/%d", serverUrl, otherId)
+		res, err = tst.MakeRequest("DELETE", sessionUrl, secondToken, []byte(""))
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, res.StatusCode == http.StatusNoContent,
+			fmt.Sprintf("Expected 204, got %d", res.StatusCode))
+
+		res, err = tst.MakeRequest("GET", serverUrl+"/profile", firstToken, []byte(""))
+		tst.Ok(t, err)
+		tst.True(t, res.StatusCode == http.StatusUnauthorized,
+			fmt.Sprintf("Expected 401, got %d", res.StatusCode))
+
+		res, err = tst.MakeRequest("GET", serverUrl+"/profile", secondToken, []byte(""))
+		tst.Ok(t, err)
+		tst.True(t, res.StatusCode == http.StatusOK,
+			fmt.Sprintf("Expected 200, got %d", res.StatusCode))
+	})
+}
@@ -3,3 +3,15 @@ package rentals
 import "errors"
 
 var NotFoundError = errors.New("entity not found")
+
+var WrongPasswordError = errors.New("current password is incorrect")
+
+// Returned when a change is made against an outdated copy, i.e. the
+// version it was read at isn't the current one anymore
+var VersionMismatchError = errors.New("changed since it was read, read it again")
+
+var RealtorHasApartmentsError = errors.New("realtor has apartments, reassign or archive them first")
+
+// Returned when a user can't move to the requested status. See
+// UserStatusTransitions.
+var InvalidStatusChangeError = errors.New("user can't move to that status")
@@ -0,0 +1,114 @@
+package rentals
+
+import "time"
+
+// Event is something that happened in the domain. Services publish
+// events once the change they describe is committed, so subscribers
+// never see changes that were rolled back.
+type Event interface {
+	EventName() string
+}
+
+// EventPublisher hands events to whoever subscribed to them. See
+// package events.
+type EventPublisher interface {
+	Publish(Event)
+}
+
+// Event names
+const (
+	EventApartmentCreated     = "ApartmentCreated"
+	EventApartmentUpdated     = "ApartmentUpdated"
+	EventApartmentsReassigned = "ApartmentsReassigned"
+	EventApartmentDeleted     = "ApartmentDeleted"
+	EventApartmentRestored    = "ApartmentRestored"
+	EventUserCreated          = "UserCreated"
+	EventUserUpdated          = "UserUpdated"
+	EventUserRoleChanged      = "UserRoleChanged"
+	EventUserStatusChanged    = "UserStatusChanged"
+	EventLoginSucceeded       = "LoginSucceeded"
+)
+
+type ApartmentCreated struct {
+	Apartment Apartment
+}
+
+func (ApartmentCreated) EventName() string { return EventApartmentCreated }
+
+// Published for edits and status changes, including the ones made
+// by accepting applications and by leases
+type ApartmentUpdated struct {
+	Before  Apartment
+	After   Apartment
+	ActorId uint
+}
+
+func (ApartmentUpdated) EventName() string { return EventApartmentUpdated }
+
+type ApartmentsReassigned struct {
+	ApartmentIds  []uint
+	FromRealtorId uint
+	ToRealtorId   uint
+}
+
+func (ApartmentsReassigned) EventName() string { return EventApartmentsReassigned }
+
+type ApartmentDeleted struct {
+	Apartment Apartment
+}
+
+func (ApartmentDeleted) EventName() string { return EventApartmentDeleted }
+
+// Published when an apartment is taken out of the trash
+type ApartmentRestored struct {
+	Apartment Apartment
+	ActorId   uint
+}
+
+func (ApartmentRestored) EventName() string { return EventApartmentRestored }
+
+type UserCreated struct {
+	User User
+}
+
+func (UserCreated) EventName() string { return EventUserCreated }
+
+// Published when the password, email or phone of a user change.
+// Role changes are published as UserRoleChanged as well.
+type UserUpdated struct {
+	Before User
+	After  User
+}
+
+func (UserUpdated) EventName() string { return EventUserUpdated }
+
+type UserRoleChanged struct {
+	UserId uint
+	From   string
+	To     string
+}
+
+func (UserRoleChanged) EventName() string { return EventUserRoleChanged }
+
+type UserStatusChanged struct {
+	// The user after the change
+	User User
+
+	UserId  uint
+	From    string
+	To      string
+	Reason  string
+	ActorId uint
+}
+
+func (UserStatusChanged) EventName() string { return EventUserStatusChanged }
+
+type LoginSucceeded struct {
+	UserId    uint
+	Username  string
+	IP        string
+	UserAgent string
+	At        time.Time
+}
+
+func (LoginSucceeded) EventName() string { return EventLoginSucceeded }
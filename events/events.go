@@ -0,0 +1,206 @@
+package events
+
+import (
+	"log"
+	"rentals"
+	"sync"
+)
+
+// Package events delivers the domain events published by the
+// services to the parts of the app interested in them
+
+// Events queued per asynchronous subscriber. Publishing blocks once
+// a subscriber falls this far behind.
+const queueSize = 1024
+
+type Handler func(rentals.Event)
+
+type subscriber struct {
+	handler Handler
+
+	// Names of the events handled. All of them if empty.
+	names map[string]bool
+
+	// Nil for synchronous subscribers
+	queue chan rentals.Event
+}
+
+func (s *subscriber) wants(event rentals.Event) bool {
+	return len(s.names) == 0 || s.names[event.EventName()]
+}
+
+// Calls the handler, logging panics so a faulty subscriber doesn't
+// take down the publisher or the other subscribers
+func (s *subscriber) handle(event rentals.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[ERROR] handling event %s: %v", event.EventName(), r)
+		}
+	}()
+
+	s.handler(event)
+}
+
+// Bus is an in-process rentals.EventPublisher. Synchronous
+// subscribers run in Publish, in the order they subscribed.
+// Asynchronous ones run in their own goroutine and get events in the
+// order they were published.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []*subscriber
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe calls handler from Publish with the events named, or
+// every event if no names are given
+func (b *Bus) Subscribe(handler Handler, names ...string) {
+	b.add(&subscriber{handler: handler, names: nameSet(names)})
+}
+
+// SubscribeAsync calls handler in the background with the events
+// named, or every event if no names are given
+func (b *Bus) SubscribeAsync(handler Handler, names ...string) {
+	s := &subscriber{handler: handler, names: nameSet(names), queue: make(chan rentals.Event, queueSize)}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for event := range s.queue {
+			s.handle(event)
+		}
+	}()
+
+	b.add(s)
+}
+
+func (b *Bus) add(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, s)
+
+	// Nothing will be published, let the goroutine end
+	if b.closed && s.queue != nil {
+		close(s.queue)
+	}
+}
+
+func (b *Bus) Publish(event rentals.Event) {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+
+	for _, s := range subscribers {
+		if s.queue == nil && s.wants(event) {
+			s.handle(event)
+		}
+	}
+
+	// Queues are closed with the lock held, see Close
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		log.Printf("[ERROR] event %s published after the bus was closed", event.EventName())
+		return
+	}
+
+	for _, s := range subscribers {
+		if s.queue != nil && s.wants(event) {
+			s.queue <- event
+		}
+	}
+}
+
+// Close waits for the asynchronous subscribers to handle the events
+// already published. Events published afterwards are dropped.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, s := range b.subscribers {
+			if s.queue != nil {
+				close(s.queue)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+}
+
+func nameSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// Events ApartmentChanges handles
+var ApartmentChangeEvents = []string{
+	rentals.EventApartmentCreated,
+	rentals.EventApartmentUpdated,
+	rentals.EventApartmentDeleted,
+	rentals.EventApartmentRestored,
+}
+
+// ApartmentChanges adapts fn, called with an apartment before and
+// after it changed, to a handler of ApartmentChangeEvents. Before is
+// the zero Apartment for new apartments, restored ones included, and
+// after is nil for deleted ones.
+func ApartmentChanges(fn func(before rentals.Apartment, after *rentals.Apartment)) Handler {
+	return func(event rentals.Event) {
+		switch e := event.(type) {
+		case rentals.ApartmentCreated:
+			fn(rentals.Apartment{}, &e.Apartment)
+		case rentals.ApartmentUpdated:
+			fn(e.Before, &e.After)
+		case rentals.ApartmentDeleted:
+			fn(e.Apartment, nil)
+		case rentals.ApartmentRestored:
+			fn(rentals.Apartment{}, &e.Apartment)
+		}
+	}
+}
+
+// Recorder is a rentals.EventPublisher keeping the events published,
+// so tests can check what services emit
+type Recorder struct {
+	mu     sync.Mutex
+	events []rentals.Event
+}
+
+func (r *Recorder) Publish(event rentals.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Events returns the events published so far, in order
+func (r *Recorder) Events() []rentals.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]rentals.Event(nil), r.events...)
+}
+
+// Named returns the events published so far with the given name
+func (r *Recorder) Named(name string) []rentals.Event {
+	var named []rentals.Event
+	for _, event := range r.Events() {
+		if event.EventName() == name {
+			named = append(named, event)
+		}
+	}
+	return named
+}
+
+// Reset forgets the events published so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
@@ -0,0 +1,123 @@
+package events
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"sync"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	t.Run("Synchronous subscribers run before Publish returns", func(t *testing.T) {
+		// Arrange
+		bus := NewBus()
+		defer bus.Close()
+
+		var names []string
+		bus.Subscribe(func(event rentals.Event) {
+			names = append(names, event.EventName())
+		}, rentals.EventApartmentCreated, rentals.EventApartmentDeleted)
+
+		// Act
+		bus.Publish(rentals.ApartmentCreated{})
+		bus.Publish(rentals.UserCreated{})
+		bus.Publish(rentals.ApartmentDeleted{})
+
+		// True
+		tst.True(t, len(names) == 2 && names[0] == rentals.EventApartmentCreated &&
+			names[1] == rentals.EventApartmentDeleted,
+			fmt.Sprintf("Expected the apartment events in order, got %v", names))
+	})
+
+	t.Run("Asynchronous subscribers get every event in order", func(t *testing.T) {
+		// Arrange
+		bus := NewBus()
+
+		var mu sync.Mutex
+		var ids []uint
+		bus.SubscribeAsync(func(event rentals.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			ids = append(ids, event.(rentals.UserRoleChanged).UserId)
+		})
+
+		// Act
+		for i := uint(1); i <= 100; i++ {
+			bus.Publish(rentals.UserRoleChanged{UserId: i})
+		}
+		bus.Close()
+
+		// True
+		tst.True(t, len(ids) == 100, fmt.Sprintf("Expected 100 events, got %d", len(ids)))
+		for i, id := range ids {
+			tst.True(t, id == uint(i+1), fmt.Sprintf("Expected event %d at %d, got %d", i+1, i, id))
+		}
+	})
+
+	t.Run("Panics don't reach the publisher or other subscribers", func(t *testing.T) {
+		bus := NewBus()
+		defer bus.Close()
+
+		handled := false
+		bus.Subscribe(func(rentals.Event) { panic("faulty subscriber") })
+		bus.Subscribe(func(rentals.Event) { handled = true })
+
+		bus.Publish(rentals.LoginSucceeded{})
+
+		tst.True(t, handled, "Expected the second subscriber to run")
+	})
+}
+
+func TestRecorder(t *testing.T) {
+	// Arrange
+	recorder := &Recorder{}
+
+	// Act
+	recorder.Publish(rentals.ApartmentUpdated{Before: rentals.Apartment{Name: "before"}})
+	recorder.Publish(rentals.LoginSucceeded{Username: "user"})
+
+	// True
+	updated := recorder.Named(rentals.EventApartmentUpdated)
+	tst.True(t, len(recorder.Events()) == 2, "Expected 2 events")
+	tst.True(t, len(updated) == 1 && updated[0].(rentals.ApartmentUpdated).Before.Name == "before",
+		"Expected the update to be recorded")
+
+	recorder.Reset()
+	tst.True(t, len(recorder.Events()) == 0, "Expected no events after Reset")
+}
+
+func TestApartmentChanges(t *testing.T) {
+	// Arrange
+	bus := NewBus()
+	defer bus.Close()
+
+	type change struct {
+		before rentals.Apartment
+		after  *rentals.Apartment
+	}
+	var changes []change
+	bus.Subscribe(ApartmentChanges(func(before rentals.Apartment, after *rentals.Apartment) {
+		changes = append(changes, change{before, after})
+	}), ApartmentChangeEvents...)
+
+	published := rentals.Apartment{Name: "apt", Status: rentals.ApartmentPublished}
+	rented := published
+	rented.Status = rentals.ApartmentRented
+
+	// Act
+	bus.Publish(rentals.ApartmentCreated{Apartment: published})
+	bus.Publish(rentals.ApartmentUpdated{Before: published, After: rented})
+	bus.Publish(rentals.UserCreated{})
+	bus.Publish(rentals.ApartmentDeleted{Apartment: rented})
+	bus.Publish(rentals.ApartmentRestored{Apartment: rented})
+
+	// True
+	tst.True(t, len(changes) == 4, fmt.Sprintf("Expected 4 changes, got %d", len(changes)))
+	tst.True(t, changes[0].before.Name == "" && changes[0].after.Name == "apt", "Expected a new apartment")
+	tst.True(t, changes[1].before.Status == rentals.ApartmentPublished &&
+		changes[1].after.Status == rentals.ApartmentRented, "Expected the update")
+	tst.True(t, changes[2].before.Name == "apt" && changes[2].after == nil, "Expected a deleted apartment")
+	tst.True(t, changes[3].before.Name == "" && changes[3].after.Status == rentals.ApartmentRented,
+		"Expected restored apartments to be new")
+}
@@ -0,0 +1,198 @@
+package rentals
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Formats apartments can be exported to
+const (
+	ExportCsv     = "csv"
+	ExportNdjson  = "ndjson"
+	ExportGeoJson = "geojson"
+)
+
+// Content types of the export formats
+var ExportContentTypes = map[string]string{
+	ExportCsv:     "text/csv; charset=utf-8",
+	ExportNdjson:  "application/x-ndjson",
+	ExportGeoJson: "application/geo+json",
+}
+
+// Apartment as exported, with the username of its realtor
+type ExportedApartment struct {
+	Apartment
+	RealtorUsername string `json:"realtorUsername"`
+}
+
+// Writes the pages of an export as they are read. Close ends the
+// file and must be called once every page is written.
+type ApartmentExportWriter interface {
+	Write([]ExportedApartment) error
+	Close() error
+}
+
+func NewApartmentExportWriter(format string, w io.Writer) (ApartmentExportWriter, error) {
+	switch format {
+	case ExportCsv:
+		return &csvApartmentWriter{w: csv.NewWriter(w)}, nil
+	case ExportNdjson:
+		return &ndjsonApartmentWriter{encoder: json.NewEncoder(w)}, nil
+	case ExportGeoJson:
+		return &geoJsonApartmentWriter{w: w}, nil
+	}
+
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+// Writes a row per apartment, after a header with the json names of
+// the fields
+type csvApartmentWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvApartmentWriter) Write(apartments []ExportedApartment) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	float := func(f float32) string {
+		return strconv.FormatFloat(float64(f), 'f', -1, 32)
+	}
+
+	for _, apartment := range apartments {
+		err := c.w.Write([]string{
+			strconv.Itoa(int(apartment.ID)),
+			apartment.Name,
+			apartment.Desc,
+			strconv.Itoa(int(apartment.RealtorId)),
+			apartment.RealtorUsername,
+			float(apartment.FloorAreaMeters),
+			float(apartment.PricePerMonthUsd),
+			strconv.Itoa(apartment.RoomCount),
+			float(apartment.Latitude),
+			float(apartment.Longitude),
+			apartment.Status,
+			strconv.FormatBool(apartment.Available),
+			apartment.DateAdded.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvApartmentWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvApartmentWriter) writeHeader() error {
+	if c.header {
+		return nil
+	}
+
+	c.header = true
+	return c.w.Write([]string{"id", "name", "description", "realtorId", "realtorUsername", "floorAreaMeters",
+		"pricePerMonthUSD", "roomCount", "latitude", "longitude", "status", "available", "dateAdded"})
+}
+
+type ndjsonApartmentWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonApartmentWriter) Write(apartments []ExportedApartment) error {
+	for _, apartment := range apartments {
+		if err := n.encoder.Encode(apartment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *ndjsonApartmentWriter) Close() error {
+	return nil
+}
+
+// Writes a feature collection with a point per apartment. The
+// apartment is in the properties of its feature.
+type geoJsonApartmentWriter struct {
+	w        io.Writer
+	started  bool
+	features int
+}
+
+type geoJsonFeature struct {
+	Type       string            `json:"type"`
+	Id         uint              `json:"id"`
+	Geometry   geoJsonPoint      `json:"geometry"`
+	Properties ExportedApartment `json:"properties"`
+}
+
+type geoJsonPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float32 `json:"coordinates"`
+}
+
+func (g *geoJsonApartmentWriter) Write(apartments []ExportedApartment) error {
+	if err := g.start(); err != nil {
+		return err
+	}
+
+	for _, apartment := range apartments {
+		feature, err := json.Marshal(geoJsonFeature{
+			Type: "Feature",
+			Id:   uint(apartment.ID),
+			Geometry: geoJsonPoint{
+				Type:        "Point",
+				Coordinates: [2]float32{apartment.Longitude, apartment.Latitude},
+			},
+			Properties: apartment,
+		})
+		if err != nil {
+			return err
+		}
+
+		if g.features > 0 {
+			feature = append([]byte(",\n"), feature...)
+		}
+		if _, err := g.w.Write(feature); err != nil {
+			return err
+		}
+		g.features++
+	}
+
+	return nil
+}
+
+func (g *geoJsonApartmentWriter) Close() error {
+	if err := g.start(); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(g.w, "\n]}\n")
+	return err
+}
+
+func (g *geoJsonApartmentWriter) start() error {
+	if g.started {
+		return nil
+	}
+
+	g.started = true
+	_, err := io.WriteString(g.w, `{"type":"FeatureCollection","features":[`+"\n")
+	return err
+}
@@ -0,0 +1,51 @@
+package rentals
+
+import "time"
+
+// Apartment a user is watching. Users are notified when the price
+// or availability of their favorites changes.
+type Favorite struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	UserID      uint `gorm:"unique_index:idx_favorite_user_apartment" json:"userId"`
+	ApartmentID uint `gorm:"unique_index:idx_favorite_user_apartment;index" json:"apartmentId"`
+
+	// Nil if the apartment no longer exists
+	Apartment *Apartment `json:"apartment"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type FavoriteService interface {
+	// ApartmentChanged notifies the users watching the apartment.
+	// Subscribed to the apartment events, see events.ApartmentChanges.
+	ApartmentChanged(before Apartment, after *Apartment)
+
+	Add(FavoriteInput) (*FavoriteAddOutput, error)
+	Remove(FavoriteInput) (*FavoriteRemoveOutput, error)
+	List(FavoriteListInput) (*FavoriteListOutput, error)
+}
+
+type FavoriteInput struct {
+	UserId      uint
+	ApartmentId string
+}
+
+type FavoriteAddOutput struct {
+	Favorite
+}
+
+type FavoriteRemoveOutput struct{}
+
+type FavoriteListInput struct {
+	UserId uint
+}
+
+type FavoriteListOutput struct {
+	Favorites []Favorite
+}
+
+func (o *FavoriteListOutput) Public() interface{} {
+	return o.Favorites
+}
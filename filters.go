@@ -0,0 +1,146 @@
+package rentals
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Numeric apartment fields that can be filtered by, by json tag
+var ApartmentFilterFields = map[string]func(Apartment) float64{
+	"floorAreaMeters":  func(a Apartment) float64 { return float64(a.FloorAreaMeters) },
+	"pricePerMonthUSD": func(a Apartment) float64 { return float64(a.PricePerMonthUsd) },
+	"roomCount":        func(a Apartment) float64 { return float64(a.RoomCount) },
+}
+
+// Criteria apartments are listed by. Parsed from query strings such
+// as roomCount=2&maxPricePerMonthUSD=1500&available=true.
+type ApartmentFilter struct {
+	// Exact values and inclusive bounds, by json tag
+	Equal map[string]float64
+	Min   map[string]float64
+	Max   map[string]float64
+
+	Status string
+
+	// Apartments within RadiusKm of Latitude, Longitude
+	Near *GeoRadius
+
+	// Only published apartments are available
+	Available *bool
+}
+
+type GeoRadius struct {
+	Latitude  float64
+	Longitude float64
+	RadiusKm  float64
+}
+
+const earthRadiusKm = 6371
+
+func ParseApartmentFilter(query string) (*ApartmentFilter, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &ApartmentFilter{
+		Equal:  make(map[string]float64),
+		Min:    make(map[string]float64),
+		Max:    make(map[string]float64),
+		Status: values.Get("status"),
+	}
+
+	for tag := range ApartmentFilterFields {
+		if v := values.Get(tag); v != "" {
+			if filter.Equal[tag], err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s %s", tag, v)
+			}
+		}
+
+		// Ranges, e.g. minRoomCount=2&maxPricePerMonthUSD=1500
+		bound := strings.ToUpper(tag[:1]) + tag[1:]
+		for prefix, bounds := range map[string]map[string]float64{"min": filter.Min, "max": filter.Max} {
+			if v := values.Get(prefix + bound); v != "" {
+				if bounds[tag], err = strconv.ParseFloat(v, 64); err != nil {
+					return nil, fmt.Errorf("invalid %s%s %s", prefix, bound, v)
+				}
+			}
+		}
+	}
+
+	if v := values.Get("radiusKm"); v != "" {
+		radius, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid radiusKm %s", v)
+		}
+
+		lat, errLat := strconv.ParseFloat(values.Get("latitude"), 64)
+		lng, errLng := strconv.ParseFloat(values.Get("longitude"), 64)
+		if errLat != nil || errLng != nil {
+			return nil, fmt.Errorf("radiusKm needs a latitude and a longitude")
+		}
+
+		filter.Near = &GeoRadius{Latitude: lat, Longitude: lng, RadiusKm: radius}
+	}
+
+	if v := values.Get("available"); v != "" {
+		available, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid available %s", v)
+		}
+		filter.Available = &available
+	}
+
+	return filter, nil
+}
+
+// Matches tells whether apartment meets all the criteria. It must
+// agree with the queries built from the filter when listing.
+func (f *ApartmentFilter) Matches(apartment Apartment) bool {
+	for tag, value := range f.Equal {
+		if ApartmentFilterFields[tag](apartment) != value {
+			return false
+		}
+	}
+
+	for tag, min := range f.Min {
+		if ApartmentFilterFields[tag](apartment) < min {
+			return false
+		}
+	}
+
+	for tag, max := range f.Max {
+		if ApartmentFilterFields[tag](apartment) > max {
+			return false
+		}
+	}
+
+	if f.Status != "" && apartment.Status != f.Status {
+		return false
+	}
+
+	if f.Near != nil && f.Near.DistanceKm(float64(apartment.Latitude), float64(apartment.Longitude)) > f.Near.RadiusKm {
+		return false
+	}
+
+	if f.Available != nil && *f.Available != (apartment.Status == ApartmentPublished) {
+		return false
+	}
+
+	return true
+}
+
+// Great-circle distance from the center of r, by the same formula
+// used in queries
+func (r *GeoRadius) DistanceKm(latitude, longitude float64) float64 {
+	radians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	cos := math.Cos(radians(r.Latitude))*math.Cos(radians(latitude))*
+		math.Cos(radians(longitude)-radians(r.Longitude)) +
+		math.Sin(radians(r.Latitude))*math.Sin(radians(latitude))
+
+	return earthRadiusKm * math.Acos(math.Min(1, cos))
+}
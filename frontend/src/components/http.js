@@ -2,3 +2,16 @@ import Axios from 'axios';
 
 const baseUrl = process.env.VUE_APP_API_ADDR;
 export let $http = Axios.create({baseURL: baseUrl});
+
+// Gets every item of a paginated list, following nextCursor page by page
+export function getAllPages(url, config, items = [], cursor = '') {
+    const params = Object.assign({}, config.params, cursor ? {cursor} : {});
+    return $http.get(url, Object.assign({}, config, {params})).then(response => {
+        const page = response.data || {};
+        items = items.concat(page.items || []);
+        if (!page.nextCursor) {
+            return items;
+        }
+        return getAllPages(url, config, items, page.nextCursor);
+    });
+}
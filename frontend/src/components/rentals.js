@@ -1,4 +1,4 @@
-import { $http } from "./http";
+import { $http, getAllPages } from "./http";
 import $auth from "./auth";
 
 export default {
@@ -16,13 +16,11 @@ export default {
             finalUrl += `roomCount=${filters.roomCount}`;
         }
 
-        return $http.get(
+        return getAllPages(
             finalUrl, {
                 headers: {Authorization: $auth.getToken()}
             }
-        ).then(response => {
-            return response.data;
-        }).catch(err => {
+        ).catch(err => {
             alert(err);
             throw err;
         })
@@ -1,4 +1,4 @@
-import { $http } from "./http";
+import { $http, getAllPages } from "./http";
 import $auth from "./auth";
 
 export default {
@@ -7,10 +7,8 @@ export default {
     },
 
     getAllUsers() {
-        return $http.get('/users', {
+        return getAllPages('/users', {
             headers: {Authorization: $auth.getToken()}
-        }).then(res => {
-            return res.data || [];
         }).catch(err => {
             if (err.response && err.response.status !== 403) {
                 throw err
@@ -0,0 +1,131 @@
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Package ical writes iCalendar (RFC 5545) feeds
+
+// Event statuses
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusCancelled = "CANCELLED"
+)
+
+const timeFormat = "20060102T150405Z"
+
+// Content lines longer than this many octets are folded
+const maxLineLength = 75
+
+type Calendar struct {
+	// Identifier of the product that created the feed
+	ProdID string
+
+	// Name shown by calendar clients
+	Name string
+
+	Events []Event
+}
+
+// A VEVENT. UID must be stable across feeds so clients update
+// events instead of duplicating them, and Sequence must grow
+// every time the event changes.
+type Event struct {
+	UID      string
+	Sequence int
+	Status   string
+
+	// Time the event was last changed
+	Stamp time.Time
+
+	Start time.Time
+	End   time.Time
+
+	Summary     string
+	Description string
+	Location    string
+
+	// Latitude and longitude. Omitted if nil.
+	Geo *[2]float32
+}
+
+// Writes the calendar to w
+func Write(w io.Writer, cal Calendar) error {
+	bw := bufio.NewWriter(w)
+
+	writeLine(bw, "BEGIN:VCALENDAR")
+	writeLine(bw, "VERSION:2.0")
+	writeLine(bw, "PRODID:"+escape(cal.ProdID))
+	writeLine(bw, "CALSCALE:GREGORIAN")
+	writeLine(bw, "METHOD:PUBLISH")
+	if cal.Name != "" {
+		writeLine(bw, "X-WR-CALNAME:"+escape(cal.Name))
+	}
+
+	for _, event := range cal.Events {
+		writeLine(bw, "BEGIN:VEVENT")
+		writeLine(bw, "UID:"+escape(event.UID))
+		writeLine(bw, "DTSTAMP:"+event.Stamp.UTC().Format(timeFormat))
+		writeLine(bw, "DTSTART:"+event.Start.UTC().Format(timeFormat))
+		writeLine(bw, "DTEND:"+event.End.UTC().Format(timeFormat))
+		writeLine(bw, fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+		if event.Status != "" {
+			writeLine(bw, "STATUS:"+event.Status)
+		}
+		writeLine(bw, "SUMMARY:"+escape(event.Summary))
+		if event.Description != "" {
+			writeLine(bw, "DESCRIPTION:"+escape(event.Description))
+		}
+		if event.Location != "" {
+			writeLine(bw, "LOCATION:"+escape(event.Location))
+		}
+		if event.Geo != nil {
+			writeLine(bw, fmt.Sprintf("GEO:%f;%f", event.Geo[0], event.Geo[1]))
+		}
+		writeLine(bw, "END:VEVENT")
+	}
+
+	writeLine(bw, "END:VCALENDAR")
+
+	return bw.Flush()
+}
+
+// Writes a content line, folding it so no line is longer than
+// maxLineLength octets. Multi-byte characters are not split.
+func writeLine(w *bufio.Writer, line string) {
+	limit := maxLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+
+		_, _ = w.WriteString(line[:cut])
+		_, _ = w.WriteString("\r\n ")
+		line = line[cut:]
+
+		// Continuation lines start with a space
+		limit = maxLineLength - 1
+	}
+
+	_, _ = w.WriteString(line)
+	_, _ = w.WriteString("\r\n")
+}
+
+var textEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// Escapes a TEXT value
+func escape(text string) string {
+	return textEscaper.Replace(text)
+}
@@ -0,0 +1,73 @@
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"rentals/tst"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	// Arrange
+	start := time.Date(2030, 5, 1, 10, 0, 0, 0, time.FixedZone("UTC-3", -3*3600))
+	cal := Calendar{
+		ProdID: "-//rentals//viewings//EN",
+		Name:   "Viewings",
+		Events: []Event{{
+			UID:         "viewing-1@rentals",
+			Sequence:    2,
+			Status:      StatusCancelled,
+			Stamp:       start,
+			Start:       start,
+			End:         start.Add(30 * time.Minute),
+			Summary:     "Viewing of Flat; 2 rooms, balcony",
+			Description: "Line one\nLine two",
+			Geo:         &[2]float32{-34.5, 58.25},
+		}},
+	}
+
+	// Act
+	var buf bytes.Buffer
+	tst.Ok(t, Write(&buf, cal))
+	out := buf.String()
+
+	// True
+	for _, line := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"DTSTART:20300501T130000Z\r\n",
+		"DTEND:20300501T133000Z\r\n",
+		"SEQUENCE:2\r\n",
+		"STATUS:CANCELLED\r\n",
+		`SUMMARY:Viewing of Flat\; 2 rooms\, balcony` + "\r\n",
+		`DESCRIPTION:Line one\nLine two` + "\r\n",
+		"GEO:-34.500000;58.250000\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		tst.True(t, strings.Contains(out, line), fmt.Sprintf("Expected %q in %q", line, out))
+	}
+}
+
+func TestFoldLongLines(t *testing.T) {
+	// Arrange
+	cal := Calendar{Events: []Event{{Summary: strings.Repeat("ñ", 100)}}}
+
+	// Act
+	var buf bytes.Buffer
+	tst.Ok(t, Write(&buf, cal))
+
+	// True
+	unfolded := ""
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		tst.True(t, len(line) <= maxLineLength, fmt.Sprintf("Line longer than %d octets: %q", maxLineLength, line))
+		if strings.HasPrefix(line, " ") {
+			unfolded += line[1:]
+		} else {
+			unfolded += "\n" + line
+		}
+	}
+
+	tst.True(t, strings.Contains(unfolded, "\nSUMMARY:"+strings.Repeat("ñ", 100)+"\n"),
+		"Expected the summary to unfold to the original text")
+}
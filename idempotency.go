@@ -0,0 +1,53 @@
+package rentals
+
+import (
+	"errors"
+	"time"
+)
+
+var IdempotencyKeyReusedError = errors.New("idempotency key already used with another request")
+
+var IdempotencyKeyInProgressError = errors.New("a request with this idempotency key is still being processed")
+
+// Idempotency key sent by a client, along with the response to the
+// request it was first sent with, so retries get the same response.
+type IdempotencyKey struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	// Keys are chosen by clients, so they are only unique per user.
+	// Requests made without logging in don't take keys.
+	UserID uint   `gorm:"unique_index:idx_idempotency_key" json:"userId"`
+	Key    string `gorm:"unique_index:idx_idempotency_key" json:"key"`
+
+	// SHA-256 of the method, path and body of the request
+	Fingerprint string `json:"-"`
+
+	// Response to the request. Status is 0 while it's being processed.
+	Status int    `json:"status"`
+	Body   []byte `json:"-"`
+
+	// Headers set by the handler, e.g. Location or ETag, as json
+	Header string `json:"-"`
+
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+}
+
+// IdempotencyStore keeps the idempotency keys for a window of time,
+// after which they can be used again
+type IdempotencyStore interface {
+	// Begin claims the key for the request with the fingerprint. The
+	// key is returned as is if it's new, to be completed, or with the
+	// stored response if it was already used with the same request.
+	Begin(IdempotencyKey) (*IdempotencyKey, error)
+
+	// Complete stores the response to the request that claimed the key
+	Complete(IdempotencyKey) error
+
+	// Release forgets a key, e.g. when the request failed and can be
+	// retried
+	Release(IdempotencyKey) error
+
+	// Purge removes the keys created before createdBefore
+	Purge(createdBefore time.Time) (int, error)
+}
@@ -0,0 +1,154 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// Package imaging validates uploaded images and produces
+// re-encoded copies and thumbnails of them
+
+var UnsupportedFormatError = errors.New("unsupported image format")
+
+var TooManyPixelsError = errors.New("image dimensions are too large")
+
+// Images above this many pixels are rejected before decoding them
+const maxPixels = 40 * 1000 * 1000
+
+// Result of processing an upload. Data is the re-encoded image, which
+// drops any metadata (EXIF, comments, etc) the original file had.
+type Image struct {
+	ContentType string
+	Data        []byte
+	Width       int
+	Height      int
+
+	// Thumbnails by name, see Process
+	Thumbnails map[string][]byte
+}
+
+// Sniffs the content type of data and returns it if it's an
+// image we accept
+func Sniff(data []byte) (string, error) {
+	switch contentType := http.DetectContentType(data); contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return contentType, nil
+	}
+
+	return "", UnsupportedFormatError
+}
+
+// Decodes data, re-encodes it without metadata and creates a
+// thumbnail for each entry in sizes, which maps names to the max
+// width/height of the thumbnail. JPEGs stay JPEGs, other formats
+// are stored as PNG.
+func Process(data []byte, sizes map[string]int) (*Image, error) {
+	contentType, err := Sniff(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, UnsupportedFormatError
+	}
+
+	if config.Width*config.Height > maxPixels {
+		return nil, TooManyPixelsError
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, UnsupportedFormatError
+	}
+
+	if contentType != "image/jpeg" {
+		contentType = "image/png"
+	}
+
+	result := &Image{
+		ContentType: contentType,
+		Width:       src.Bounds().Dx(),
+		Height:      src.Bounds().Dy(),
+		Thumbnails:  make(map[string][]byte),
+	}
+
+	if result.Data, err = encode(src, contentType); err != nil {
+		return nil, err
+	}
+
+	for name, size := range sizes {
+		if result.Thumbnails[name], err = encode(Fit(src, size), contentType); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func encode(img image.Image, contentType string) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buffer, img)
+	}
+
+	return buffer.Bytes(), err
+}
+
+// Scales img down so that neither side is larger than size, keeping
+// its aspect ratio. Smaller images are returned as they are. Each
+// destination pixel is the average of the source pixels it covers.
+func Fit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= size && srcH <= size {
+		return img
+	}
+
+	dstW, dstH := size, srcH*size/srcW
+	if srcH > srcW {
+		dstW, dstH = srcW*size/srcH, size
+	}
+	if dstW == 0 {
+		dstW = 1
+	}
+	if dstH == 0 {
+		dstH = 1
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, (y+1)*srcH/dstH
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, (x+1)*srcW/dstW
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r, g, b, a = r+int(p[0]), g+int(p[1]), b+int(p[2]), a+int(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,62 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"rentals/tst"
+	"testing"
+)
+
+func TestProcessJpeg(t *testing.T) {
+	// Arrange
+	var buffer bytes.Buffer
+	err := jpeg.Encode(&buffer, newImage(400, 200), nil)
+	tst.Ok(t, err)
+
+	// Add an APP1 (EXIF) segment right after the SOI marker
+	exif := []byte{0xFF, 0xE1, 0x00, 0x0C, 'E', 'x', 'i', 'f', 0, 0, 'G', 'P', 'S', '!'}
+	data := append(append([]byte{}, buffer.Bytes()[:2]...), exif...)
+	data = append(data, buffer.Bytes()[2:]...)
+
+	// Act
+	img, err := Process(data, map[string]int{"small": 100})
+	tst.Ok(t, err)
+
+	// True
+	tst.True(t, img.ContentType == "image/jpeg", fmt.Sprintf("Expected jpeg, got %s", img.ContentType))
+	tst.True(t, img.Width == 400 && img.Height == 200,
+		fmt.Sprintf("Expected 400x200, got %dx%d", img.Width, img.Height))
+	tst.True(t, !bytes.Contains(img.Data, []byte("Exif")), "Expected exif to be removed")
+
+	thumb, _, err := image.DecodeConfig(bytes.NewReader(img.Thumbnails["small"]))
+	tst.Ok(t, err)
+	tst.True(t, thumb.Width == 100 && thumb.Height == 50,
+		fmt.Sprintf("Expected 100x50, got %dx%d", thumb.Width, thumb.Height))
+}
+
+func TestProcessNotAnImage(t *testing.T) {
+	_, err := Process([]byte("%PDF-1.4 not an image"), nil)
+	tst.True(t, err == UnsupportedFormatError, fmt.Sprintf("Expected UnsupportedFormatError, got %v", err))
+}
+
+func TestFitKeepsSmallImages(t *testing.T) {
+	img := newImage(50, 80)
+	tst.True(t, Fit(img, 100) == image.Image(img), "Expected same image")
+
+	fitted := Fit(img, 40).Bounds()
+	tst.True(t, fitted.Dx() == 25 && fitted.Dy() == 40,
+		fmt.Sprintf("Expected 25x40, got %dx%d", fitted.Dx(), fitted.Dy()))
+}
+
+func newImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 100, 255})
+		}
+	}
+	return img
+}
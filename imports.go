@@ -0,0 +1,135 @@
+package rentals
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Formats apartments can be imported from. Csv files have a header
+// with the json names of the fields, e.g. name,pricePerMonthUSD.
+const (
+	ImportCsv    = "csv"
+	ImportNdjson = "ndjson"
+)
+
+// Import modes. All or nothing imports create no apartment if a
+// single row is wrong, best effort ones create the valid rows.
+const (
+	ImportAllOrNothing = "all"
+	ImportBestEffort   = "best_effort"
+)
+
+// Import statuses. Imports with more rows than
+// ImportBackgroundThreshold are pending until a background job runs
+// them.
+const (
+	ImportPending   = "pending"
+	ImportRunning   = "running"
+	ImportSucceeded = "succeeded"
+	ImportFailed    = "failed"
+)
+
+// Rows above which imports run in the background
+const ImportBackgroundThreshold = 100
+
+// Import of apartments from a file, with its progress and the errors
+// found in each row
+type ApartmentImport struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	// User that made the import
+	ActorID   uint   `gorm:"index" json:"actorId"`
+	ActorRole string `json:"-"`
+	RequestID string `json:"requestId"`
+
+	Format string `json:"format"`
+	Mode   string `json:"mode"`
+	DryRun bool   `json:"dryRun"`
+
+	// Realtor of the rows that don't say. Realtors can only import
+	// their own apartments.
+	RealtorID uint `json:"realtorId"`
+
+	Status string `gorm:"index" json:"status"`
+
+	// Rows in the file, rows looked at so far, and how many of them
+	// were created (or would be, in dry runs) and failed
+	Total     int `json:"total"`
+	Processed int `json:"processed"`
+	Created   int `json:"created"`
+	Failed    int `json:"failed"`
+
+	// Errors by row, stored as json
+	Errors    []ImportRowError `gorm:"-" json:"errors"`
+	ErrorList string           `gorm:"type:text" json:"-"`
+
+	// The file, kept until the import is run
+	Data []byte `json:"-"`
+
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+func (i *ApartmentImport) BeforeSave() error {
+	errors, err := json.Marshal(i.Errors)
+	i.ErrorList = string(errors)
+	return err
+}
+
+func (i *ApartmentImport) AfterFind() error {
+	i.Errors = make([]ImportRowError, 0)
+	if i.ErrorList == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(i.ErrorList), &i.Errors)
+}
+
+// Why a row can't be imported. Rows are numbered from 1, not counting
+// the csv header.
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type ApartmentImportService interface {
+	// Import validates the rows in the file and creates the apartments.
+	// Large files are left to RunPending unless Wait is set.
+	Import(ApartmentImportInput) (*ApartmentImportOutput, error)
+
+	// Read returns the progress of an import. Only admins and the
+	// user that made it can see it.
+	Read(ApartmentImportReadInput) (*ApartmentImportOutput, error)
+
+	// RunPending runs the imports left in the background
+	RunPending() (int, error)
+}
+
+type ApartmentImportInput struct {
+	Format string
+	Mode   string
+	DryRun bool
+	Data   []byte
+
+	// Realtor of the rows that don't say. Defaults to the actor for
+	// realtors.
+	RealtorId uint
+
+	// Runs the import before returning, however large it is
+	Wait bool
+
+	// User making the change and the request it was made in
+	ActorId   uint
+	ActorRole string
+	RequestId string
+}
+
+type ApartmentImportOutput struct {
+	ApartmentImport
+}
+
+type ApartmentImportReadInput struct {
+	Id        string
+	ActorId   uint
+	ActorRole string
+}
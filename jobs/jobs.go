@@ -0,0 +1,44 @@
+package jobs
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Package jobs runs periodic background tasks
+
+// Runs fn every interval, starting after the first interval, until
+// the returned function is called. Errors are logged and don't stop
+// the job. Calling stop waits for a running fn to finish.
+func Every(name string, interval time.Duration, fn func() error) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := fn(); err != nil {
+					log.Printf("[ERROR] job %s: %v", name, err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
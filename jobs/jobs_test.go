@@ -0,0 +1,31 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"rentals/tst"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	// Arrange
+	var runs int32
+
+	// Act
+	stop := Every("test", time.Millisecond, func() error {
+		atomic.AddInt32(&runs, 1)
+		return errors.New("errors don't stop the job")
+	})
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	stop()
+
+	// True
+	afterStop := atomic.LoadInt32(&runs)
+	tst.True(t, afterStop > 1, fmt.Sprintf("Expected several runs, got %d", afterStop))
+
+	time.Sleep(5 * time.Millisecond)
+	tst.True(t, atomic.LoadInt32(&runs) == afterStop, "Expected no runs after stop")
+}
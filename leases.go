@@ -0,0 +1,113 @@
+package rentals
+
+import (
+	"time"
+)
+
+// Lease statuses. Renewals are upcoming until the lease they renew
+// ends, which is then renewed rather than ended.
+const (
+	LeaseUpcoming = "upcoming"
+	LeaseActive   = "active"
+	LeaseRenewed  = "renewed"
+	LeaseEnded    = "ended"
+)
+
+// Rental agreement between a tenant and the realtor of an apartment
+type Lease struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	ApartmentID uint `gorm:"index" json:"apartmentId"`
+	TenantID    uint `gorm:"index" json:"tenantId"`
+	RealtorID   uint `gorm:"index" json:"realtorId"`
+
+	StartDate time.Time `json:"startDate"`
+	EndDate   time.Time `gorm:"index" json:"endDate"`
+
+	MonthlyRentUsd float32 `json:"monthlyRentUSD"`
+	DepositUsd     float32 `json:"depositUSD"`
+
+	Status string `gorm:"index" json:"status"`
+
+	// Lease this one renews, if any
+	PreviousLeaseID *uint `json:"previousLeaseId"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type LeaseService interface {
+	Create(LeaseCreateInput) (*LeaseCreateOutput, error)
+	Read(LeaseReadInput) (*LeaseReadOutput, error)
+	Find(LeaseFindInput) (*LeaseFindOutput, error)
+	Renew(LeaseRenewInput) (*LeaseRenewOutput, error)
+
+	// EndExpired ends the active leases whose end date is before
+	// the day of now, as leases last their whole end date, and makes
+	// their apartments available again. Renewed leases hand their
+	// apartment over to their renewal instead. Returns the number of
+	// leases ended.
+	EndExpired(now time.Time) (int, error)
+}
+
+// Dates use the 2006-01-02 format
+type LeaseCreateInput struct {
+	ApartmentId    uint    `json:"apartmentId"`
+	TenantId       uint    `json:"tenantId"`
+	StartDate      string  `json:"startDate"`
+	EndDate        string  `json:"endDate"`
+	MonthlyRentUsd float32 `json:"monthlyRentUSD"`
+	DepositUsd     float32 `json:"depositUSD"`
+	ActorId        uint    `json:"-"`
+	ActorRole      string  `json:"-"`
+	RequestId      string  `json:"-"`
+}
+
+type LeaseCreateOutput struct {
+	Lease
+}
+
+type LeaseReadInput struct {
+	Id        string
+	ActorId   uint
+	ActorRole string
+}
+
+type LeaseReadOutput struct {
+	Lease
+}
+
+// Lists the leases visible to the actor: tenants see their own,
+// realtors the ones they manage and admins all of them.
+type LeaseFindInput struct {
+	ActorId   uint
+	ActorRole string
+	Status    string
+
+	// Only active leases ending in the next ExpiringInDays days that
+	// haven't been renewed. Ignored if 0.
+	ExpiringInDays int
+}
+
+type LeaseFindOutput struct {
+	Leases []Lease
+}
+
+func (o *LeaseFindOutput) Public() interface{} {
+	return o.Leases
+}
+
+// Creates a lease continuing the given one. MonthlyRentUsd and
+// DepositUsd default to the values of the renewed lease.
+type LeaseRenewInput struct {
+	Id             string  `json:"-"`
+	EndDate        string  `json:"endDate"`
+	MonthlyRentUsd float32 `json:"monthlyRentUSD"`
+	DepositUsd     float32 `json:"depositUSD"`
+	ActorId        uint    `json:"-"`
+	ActorRole      string  `json:"-"`
+}
+
+type LeaseRenewOutput struct {
+	Lease
+}
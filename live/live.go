@@ -0,0 +1,228 @@
+package live
+
+import (
+	"fmt"
+	"rentals"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Package live fans out changes to apartments to the clients
+// streaming them
+
+// Event types
+const (
+	ApartmentCreated             = "apartment.created"
+	ApartmentUpdated             = "apartment.updated"
+	ApartmentDeleted             = "apartment.deleted"
+	ApartmentAvailabilityChanged = "apartment.availability_changed"
+)
+
+var EventTypes = []string{ApartmentCreated, ApartmentUpdated, ApartmentDeleted, ApartmentAvailabilityChanged}
+
+// Events buffered per subscriber. Subscribers falling further
+// behind are dropped and have to resume with their last event id.
+const subscriberBuffer = 64
+
+type Event struct {
+	// Unique per hub. See Hub.Subscribe.
+	ID   string
+	Type string
+
+	// The apartment after the change, or before being deleted
+	Apartment rentals.Apartment
+
+	// The apartment before the change. Zero for new apartments.
+	Before rentals.Apartment `json:"-"`
+
+	Time time.Time
+}
+
+type Subscription struct {
+	// Closed when the subscription ends. Read Dropped to tell
+	// whether the subscriber was too slow.
+	Events <-chan Event
+
+	events  chan Event
+	filter  func(Event) bool
+	dropped bool
+	hub     *Hub
+}
+
+// Dropped reports whether the subscription ended because the
+// subscriber didn't keep up
+func (s *Subscription) Dropped() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.dropped
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Hub keeps the latest events so subscribers can resume after a
+// disconnection. Event ids are made of the time the hub started and
+// a sequence number, ids from before a restart can't be resumed.
+type Hub struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	history     []Event
+	historySize int
+	subscribers map[*Subscription]struct{}
+}
+
+func NewHub(historySize int) *Hub {
+	return &Hub{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		historySize: historySize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publishes the changes to apartments. Subscribed to the apartment
+// events, see events.ApartmentChanges.
+func (h *Hub) ApartmentChanged(before rentals.Apartment, after *rentals.Apartment) {
+	switch {
+	case after == nil:
+		h.Publish(ApartmentDeleted, before, before)
+	case before.ID == 0:
+		h.Publish(ApartmentCreated, rentals.Apartment{}, *after)
+	default:
+		h.Publish(ApartmentUpdated, before, *after)
+		if after.Available != before.Available {
+			h.Publish(ApartmentAvailabilityChanged, before, *after)
+		}
+	}
+}
+
+func (h *Hub) Publish(eventType string, before, apartment rentals.Apartment) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	event := Event{
+		ID:        fmt.Sprintf("%s-%d", h.epoch, h.seq),
+		Type:      eventType,
+		Apartment: apartment,
+		Before:    before,
+		Time:      time.Now(),
+	}
+
+	h.history = append(h.history, event)
+	if len(h.history) > h.historySize {
+		h.history = h.history[len(h.history)-h.historySize:]
+	}
+
+	for s := range h.subscribers {
+		if !s.filter(event) {
+			continue
+		}
+
+		select {
+		case s.events <- event:
+		default:
+			s.dropped = true
+			h.remove(s)
+		}
+	}
+
+	return event
+}
+
+// Subscribes to the events filter accepts. If lastEventId is set,
+// the events after it are returned to be sent first. ok is false if
+// they can't be replayed because the id is unknown or too old.
+func (h *Hub) Subscribe(lastEventId string, filter func(Event) bool) (s *Subscription, missed []Event, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make(chan Event, subscriberBuffer)
+	s = &Subscription{Events: events, events: events, filter: filter, hub: h}
+	h.subscribers[s] = struct{}{}
+
+	if lastEventId == "" {
+		return s, nil, true
+	}
+
+	seq, ok := h.parseId(lastEventId)
+	if !ok || seq > h.seq {
+		return s, nil, false
+	}
+
+	// The history holds the events up to h.seq with no gaps
+	first := h.seq - uint64(len(h.history)) + 1
+	if seq+1 < first {
+		return s, nil, false
+	}
+
+	for _, event := range h.history[seq+1-first:] {
+		if filter(event) {
+			missed = append(missed, event)
+		}
+	}
+
+	return s, missed, true
+}
+
+func (h *Hub) parseId(id string) (uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != h.epoch {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	return seq, err == nil
+}
+
+// Must be called holding h.mu
+func (h *Hub) remove(s *Subscription) {
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// Returns a filter accepting the given event types, or all of them
+// if types is empty, about apartments matching query as Find does
+// for the given user. Changes that take an apartment out of the
+// results match too, so subscribers can remove it.
+func Filter(query string, types []string, actorId uint, actorRole string) (func(Event) bool, error) {
+	filter, err := rentals.ParseApartmentFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range types {
+		if !contains(EventTypes, t) {
+			return nil, fmt.Errorf("unknown event %s", t)
+		}
+	}
+
+	listed := func(apartment rentals.Apartment) bool {
+		return apartment.ID != 0 && apartment.Status != rentals.ApartmentArchived &&
+			rentals.CanSeeApartment(apartment, actorId, actorRole) && filter.Matches(apartment)
+	}
+
+	return func(event Event) bool {
+		if len(types) > 0 && !contains(types, event.Type) {
+			return false
+		}
+
+		return listed(event.Apartment) || listed(event.Before)
+	}, nil
+}
+
+func contains(a []string, b string) bool {
+	for _, s := range a {
+		if s == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package live
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+)
+
+func apartment(rooms int, status string) rentals.Apartment {
+	return rentals.Apartment{RoomCount: rooms, Status: status, Available: status == rentals.ApartmentPublished}
+}
+
+func TestHubFiltersEvents(t *testing.T) {
+	// Arrange
+	hub := NewHub(10)
+	filter, err := Filter("minRoomCount=2", []string{ApartmentCreated, ApartmentAvailabilityChanged}, 0, "")
+	tst.Ok(t, err)
+
+	subscription, _, _ := hub.Subscribe("", filter)
+	defer subscription.Close()
+
+	small := apartment(1, rentals.ApartmentPublished)
+	small.ID = 1
+	big := apartment(3, rentals.ApartmentPublished)
+	big.ID = 2
+	rented := big
+	rented.Status = rentals.ApartmentRented
+	rented.Available = false
+
+	// Act
+	hub.ApartmentChanged(rentals.Apartment{}, &small)
+	hub.ApartmentChanged(rentals.Apartment{}, &big)
+	hub.ApartmentChanged(big, &rented)
+
+	// True
+	tst.True(t, len(subscription.Events) == 2, fmt.Sprintf("Expected 2 events, got %d", len(subscription.Events)))
+	created := <-subscription.Events
+	tst.True(t, created.Type == ApartmentCreated && created.Apartment.ID == big.ID, "Expected the big apartment to be created")
+	changed := <-subscription.Events
+	tst.True(t, changed.Type == ApartmentAvailabilityChanged && !changed.Apartment.Available,
+		"Expected the big apartment to be rented")
+}
+
+func TestFilterHidesDrafts(t *testing.T) {
+	// Arrange
+	draft := apartment(1, rentals.ApartmentDraft)
+	draft.ID = 1
+	draft.RealtorId = 1
+	created := Event{Type: ApartmentCreated, Apartment: draft}
+
+	for _, elt := range []struct {
+		actorId   uint
+		actorRole string
+		sees      bool
+	}{
+		{0, "", false},
+		{2, "client", false},
+		{2, "realtor", false},
+		{1, "realtor", true},
+		{2, "admin", true},
+	} {
+		t.Run(fmt.Sprintf("%s %d sees drafts: %v", elt.actorRole, elt.actorId, elt.sees), func(t *testing.T) {
+			// Act
+			filter, err := Filter("", nil, elt.actorId, elt.actorRole)
+			tst.Ok(t, err)
+
+			// True
+			tst.True(t, filter(created) == elt.sees, fmt.Sprintf("Expected %v, got %v", elt.sees, !elt.sees))
+		})
+	}
+}
+
+func TestHubResumes(t *testing.T) {
+	// Arrange
+	hub := NewHub(2)
+	all, err := Filter("", nil, 0, "admin")
+	tst.Ok(t, err)
+
+	a := apartment(1, rentals.ApartmentDraft)
+	a.ID = 1
+	hub.Publish(ApartmentCreated, rentals.Apartment{}, a)
+	hub.Publish(ApartmentUpdated, a, a)
+	last := hub.Publish(ApartmentDeleted, a, a)
+
+	t.Run("Events after the last event id are replayed", func(t *testing.T) {
+		// Act
+		subscription, missed, ok := hub.Subscribe(fmt.Sprintf("%s-%d", hub.epoch, 2), all)
+		defer subscription.Close()
+
+		// True
+		tst.True(t, ok, "Expected to resume")
+		tst.True(t, len(missed) == 1 && missed[0].ID == last.ID, fmt.Sprintf("Expected the last event, got %v", missed))
+	})
+
+	t.Run("Events no longer kept can't be replayed", func(t *testing.T) {
+		subscription, missed, ok := hub.Subscribe(fmt.Sprintf("%s-%d", hub.epoch, 0), all)
+		defer subscription.Close()
+
+		tst.True(t, !ok && len(missed) == 0, "Expected a reset")
+	})
+
+	t.Run("Ids from another hub can't be replayed", func(t *testing.T) {
+		subscription, _, ok := hub.Subscribe("other-1", all)
+		defer subscription.Close()
+
+		tst.True(t, !ok, "Expected a reset")
+	})
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	// Arrange
+	hub := NewHub(10)
+	all, err := Filter("", nil, 0, "admin")
+	tst.Ok(t, err)
+
+	subscription, _, _ := hub.Subscribe("", all)
+
+	// Act
+	a := apartment(1, rentals.ApartmentDraft)
+	a.ID = 1
+	for i := 0; i <= subscriberBuffer; i++ {
+		hub.Publish(ApartmentUpdated, a, a)
+	}
+
+	// True
+	tst.True(t, subscription.Dropped(), "Expected the subscriber to be dropped")
+	for range subscription.Events {
+	}
+}
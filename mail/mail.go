@@ -0,0 +1,90 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Package mail sends emails
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(Message) error
+}
+
+type SMTPConfig struct {
+	// host:port of the server
+	Addr string
+
+	// Credentials for PLAIN auth. No auth if Username is empty.
+	Username string
+	Password string
+
+	// Sender address
+	From string
+}
+
+type smtpMailer struct {
+	config SMTPConfig
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.config.Username != "" {
+		host := m.config.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", m.config.Username, m.config.Password, host)
+	}
+
+	return smtp.SendMail(m.config.Addr, auth, m.config.From, []string{msg.To}, m.compose(msg))
+}
+
+// Builds a plain text RFC 5322 message
+func (m *smtpMailer) compose(msg Message) []byte {
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", m.config.From},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+	}
+	for _, h := range headers {
+		// Header values can't contain line breaks
+		value := strings.NewReplacer("\r", "", "\n", "").Replace(h[1])
+		_, _ = fmt.Fprintf(&buf, "%s: %s\r\n", h[0], value)
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+
+	return buf.Bytes()
+}
+
+func NewSMTPMailer(config SMTPConfig) Mailer {
+	return &smtpMailer{config: config}
+}
+
+// Writes emails to the log. Useful in development
+type logMailer struct{}
+
+func (logMailer) Send(msg Message) error {
+	log.Printf("[MAIL] to=%s subject=%q", msg.To, msg.Subject)
+	return nil
+}
+
+func NewLogMailer() Mailer {
+	return logMailer{}
+}
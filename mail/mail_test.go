@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"fmt"
+	"rentals/tst"
+	"strings"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	// Arrange
+	mailer := &smtpMailer{config: SMTPConfig{From: "rentals@example.com"}}
+
+	// Act
+	raw := string(mailer.compose(Message{
+		To:      "user@example.com\r\nBcc: someone@example.com",
+		Subject: "Precio bajó",
+		Body:    "Line one\nLine two",
+	}))
+
+	// True
+	for _, part := range []string{
+		"From: rentals@example.com\r\n",
+		"Subject: =?utf-8?q?Precio_baj=C3=B3?=\r\n",
+		"\r\n\r\nLine one\r\nLine two",
+	} {
+		tst.True(t, strings.Contains(raw, part), fmt.Sprintf("Expected %q in %q", part, raw))
+	}
+
+	tst.True(t, !strings.Contains(raw, "\r\nBcc:"), "Expected headers not to be injected")
+}
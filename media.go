@@ -0,0 +1,125 @@
+package rentals
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Kinds of apartment media
+const (
+	MediaPhoto     = "photo"
+	MediaFloorPlan = "floorPlan"
+)
+
+// Max size of an uploaded file
+const MaxMediaSize = 10 << 20
+
+// Thumbnails created for each upload, by name and max width/height
+var ThumbnailSizes = map[string]int{
+	"small":  160,
+	"medium": 480,
+	"large":  1024,
+}
+
+var UnsupportedMediaError = errors.New("unsupported media type, use jpeg, png or gif")
+
+var MediaTooLargeError = errors.New("file is too large")
+
+// Photo or floor plan of an apartment. The files are kept in a
+// storage under StorageKey + "/original" and StorageKey + "/<thumbnail>".
+type ApartmentMedia struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	// Apartment this media belongs to
+	ApartmentID uint `gorm:"index" json:"apartmentId"`
+
+	// Photo or floor plan
+	Kind string `json:"kind"`
+
+	ContentType string `json:"contentType"`
+	StorageKey  string `json:"-"`
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+
+	Caption string `json:"caption"`
+
+	// Order in which media is shown, starting from 0
+	Position int `json:"position"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type MediaService interface {
+	Upload(MediaUploadInput) (*MediaUploadOutput, error)
+	List(MediaListInput) (*MediaListOutput, error)
+	Open(MediaOpenInput) (*MediaOpenOutput, error)
+	Update(MediaUpdateInput) (*MediaUpdateOutput, error)
+	Delete(MediaDeleteInput) (*MediaDeleteOutput, error)
+
+	// DeleteAll removes all the media of an apartment
+	DeleteAll(apartmentId string) error
+}
+
+type MediaUploadInput struct {
+	ApartmentId string
+	Kind        string
+	Caption     string
+
+	// File contents. At most MaxMediaSize bytes are read.
+	File io.Reader
+}
+
+type MediaUploadOutput struct {
+	ApartmentMedia
+}
+
+type MediaListInput struct {
+	ApartmentId string
+}
+
+type MediaListOutput struct {
+	Media []ApartmentMedia
+}
+
+func (o *MediaListOutput) Public() interface{} {
+	return o.Media
+}
+
+type MediaOpenInput struct {
+	ApartmentId string
+	Id          string
+
+	// Name of a thumbnail. Empty for the original file.
+	Size string
+}
+
+// Callers must close File
+type MediaOpenOutput struct {
+	ContentType string
+	File        io.ReadCloser
+}
+
+// Empty fields are left untouched. Position moves the
+// media and shifts the rest.
+type MediaUpdateInput struct {
+	ApartmentId string  `json:"-"`
+	Id          string  `json:"-"`
+	Caption     *string `json:"caption"`
+	Position    *int    `json:"position"`
+}
+
+type MediaUpdateOutput struct {
+	ApartmentMedia
+}
+
+type MediaDeleteInput struct {
+	ApartmentId string
+	Id          string
+}
+
+type MediaDeleteOutput struct {
+	Message string
+}
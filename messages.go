@@ -0,0 +1,157 @@
+package rentals
+
+import "time"
+
+// Conversation between a client and the realtor of an apartment.
+// There is one thread per apartment and client.
+type Thread struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	ApartmentID uint `gorm:"unique_index:idx_thread_apartment_client" json:"apartmentId"`
+	ClientID    uint `gorm:"unique_index:idx_thread_apartment_client;index" json:"clientId"`
+	RealtorID   uint `gorm:"index" json:"realtorId"`
+
+	LastMessageAt time.Time `gorm:"index" json:"lastMessageAt"`
+
+	// Messages sent by the other participant and not read yet
+	// by the user listing threads
+	UnreadCount int `gorm:"-" json:"unreadCount"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type Message struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	ThreadID uint `gorm:"index" json:"threadId"`
+	SenderID uint `json:"senderId"`
+
+	Body        string              `json:"body"`
+	Attachments []MessageAttachment `json:"attachments"`
+
+	// Read receipt. Set when the recipient reads the message.
+	ReadAt *time.Time `json:"readAt"`
+
+	// Set when an admin hides the message. The body of hidden
+	// messages is only shown to admins.
+	HiddenAt *time.Time `json:"hiddenAt"`
+	HiddenBy uint       `json:"-"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Reference to something shared in a message: a media of the
+// apartment of the thread or an external url.
+type MessageAttachment struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	MessageID uint `gorm:"index" json:"-"`
+
+	MediaID *uint  `json:"mediaId"`
+	URL     string `json:"url"`
+	Name    string `json:"name"`
+}
+
+type MessageService interface {
+	CreateThread(ThreadCreateInput) (*ThreadCreateOutput, error)
+	Threads(ThreadListInput) (*ThreadListOutput, error)
+	Thread(ThreadReadInput) (*ThreadReadOutput, error)
+
+	Messages(MessageListInput) (*MessageListOutput, error)
+	Send(MessageSendInput) (*MessageSendOutput, error)
+
+	// MarkRead marks the messages the actor received in a
+	// thread as read
+	MarkRead(ThreadReadInput) (*ThreadReadOutput, error)
+
+	// Hide is used by admins to moderate messages
+	Hide(MessageHideInput) (*MessageHideOutput, error)
+}
+
+// Starts a thread with the realtor of an apartment, or continues
+// the existing one, with a first message
+type ThreadCreateInput struct {
+	ApartmentId uint                `json:"apartmentId"`
+	Body        string              `json:"body"`
+	Attachments []MessageAttachment `json:"attachments"`
+	ClientId    uint                `json:"-"`
+}
+
+type ThreadCreateOutput struct {
+	Thread  Thread  `json:"thread"`
+	Message Message `json:"message"`
+}
+
+// Lists the threads of the actor, most recent first. Admins see
+// all the threads and can filter them by apartment or user.
+type ThreadListInput struct {
+	ActorId     uint
+	ActorRole   string
+	ApartmentId string
+	UserId      string
+	Cursor      string
+	Limit       int
+}
+
+type ThreadListOutput struct {
+	Threads    []Thread
+	NextCursor string
+}
+
+func (o *ThreadListOutput) Public() interface{} {
+	return Page{Items: o.Threads, NextCursor: o.NextCursor}
+}
+
+// Only participants and admins can read a thread
+type ThreadReadInput struct {
+	Id        string
+	ActorId   uint
+	ActorRole string
+}
+
+type ThreadReadOutput struct {
+	Thread
+}
+
+// Lists messages newest first
+type MessageListInput struct {
+	ThreadId  string
+	ActorId   uint
+	ActorRole string
+	Cursor    string
+	Limit     int
+}
+
+type MessageListOutput struct {
+	Messages   []Message
+	NextCursor string
+}
+
+func (o *MessageListOutput) Public() interface{} {
+	return Page{Items: o.Messages, NextCursor: o.NextCursor}
+}
+
+type MessageSendInput struct {
+	ThreadId    string              `json:"-"`
+	Body        string              `json:"body"`
+	Attachments []MessageAttachment `json:"attachments"`
+	ActorId     uint                `json:"-"`
+}
+
+type MessageSendOutput struct {
+	Message
+}
+
+type MessageHideInput struct {
+	ThreadId  string
+	Id        string
+	ActorId   uint
+	ActorRole string
+}
+
+type MessageHideOutput struct {
+	Message
+}
@@ -0,0 +1,171 @@
+package rentals
+
+import "time"
+
+// Events users are notified about
+const (
+	EventApplicationReceived         = "application.received"
+	EventApplicationAccepted         = "application.accepted"
+	EventApplicationRejected         = "application.rejected"
+	EventViewingBooked               = "viewing.booked"
+	EventViewingCancelled            = "viewing.cancelled"
+	EventViewingRescheduled          = "viewing.rescheduled"
+	EventFavoritePriceChanged        = "favorite.price_changed"
+	EventFavoriteAvailabilityChanged = "favorite.availability_changed"
+	EventSearchMatches               = "search.matches"
+	EventMessageReceived             = "message.received"
+)
+
+// Message for a single user
+type Notification struct {
+	// Recipient
+	UserID uint `json:"userId"`
+
+	// One of the Event* constants
+	Event string `json:"event"`
+
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// Notifier delivers notifications to users. Failing to notify
+// must not undo the change that triggered the notification, so
+// callers usually just log errors.
+type Notifier interface {
+	Notify(Notification) error
+}
+
+// All the events, in the order preferences are listed
+var NotificationEvents = []string{
+	EventApplicationReceived,
+	EventApplicationAccepted,
+	EventApplicationRejected,
+	EventViewingBooked,
+	EventViewingCancelled,
+	EventViewingRescheduled,
+	EventFavoritePriceChanged,
+	EventFavoriteAvailabilityChanged,
+	EventSearchMatches,
+	EventMessageReceived,
+}
+
+// Channels notifications are delivered through, besides the inbox
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// Notification kept in the inbox of a user
+type InboxNotification struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	UserID uint   `gorm:"index" json:"userId"`
+	Event  string `json:"event"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+
+	// Nil until the user reads it
+	ReadAt *time.Time `json:"readAt"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// How a user wants to be told about an event. Users without a
+// preference for an event get DefaultNotificationPreference.
+type NotificationPreference struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"-"`
+
+	UserID uint   `gorm:"unique_index:idx_notification_preference" json:"-"`
+	Event  string `gorm:"unique_index:idx_notification_preference" json:"event"`
+
+	InApp   bool `json:"inApp"`
+	Email   bool `json:"email"`
+	Webhook bool `json:"webhook"`
+}
+
+// Email and webhook notifications are only sent if the
+// user has an email or a webhook url
+var DefaultNotificationPreference = NotificationPreference{InApp: true, Email: true, Webhook: true}
+
+// Returns true if the preference enables channel
+func (p NotificationPreference) Enabled(channel string) bool {
+	switch channel {
+	case ChannelEmail:
+		return p.Email
+	case ChannelWebhook:
+		return p.Webhook
+	}
+
+	return false
+}
+
+// NotificationChannel delivers notifications outside the app
+type NotificationChannel interface {
+	// One of the Channel* constants
+	Name() string
+
+	Deliver(User, Notification) error
+}
+
+// NotificationService keeps the inbox of users and delivers
+// notifications through the channels they chose
+type NotificationService interface {
+	Notifier
+
+	Inbox(NotificationInboxInput) (*NotificationInboxOutput, error)
+	MarkRead(NotificationReadInput) (*NotificationReadOutput, error)
+	Preferences(NotificationPreferencesInput) (*NotificationPreferencesOutput, error)
+	UpdatePreferences(NotificationPreferencesUpdateInput) (*NotificationPreferencesOutput, error)
+}
+
+type NotificationInboxInput struct {
+	UserId     uint
+	UnreadOnly bool
+	Cursor     string
+	Limit      int
+}
+
+type NotificationInboxOutput struct {
+	Notifications []InboxNotification
+	NextCursor    string
+	UnreadCount   int
+}
+
+func (o *NotificationInboxOutput) Public() interface{} {
+	return struct {
+		Page
+		UnreadCount int `json:"unreadCount"`
+	}{Page{Items: o.Notifications, NextCursor: o.NextCursor}, o.UnreadCount}
+}
+
+// Marks the notifications with the given ids as read, or all
+// of them if All is set
+type NotificationReadInput struct {
+	UserId uint   `json:"-"`
+	Ids    []uint `json:"ids"`
+	All    bool   `json:"all"`
+}
+
+type NotificationReadOutput struct {
+	UnreadCount int `json:"unreadCount"`
+}
+
+type NotificationPreferencesInput struct {
+	UserId uint
+}
+
+// Preferences for every event, defaults included
+type NotificationPreferencesOutput struct {
+	WebhookUrl string                   `json:"webhookUrl"`
+	Events     []NotificationPreference `json:"events"`
+}
+
+// Only the events present are changed. WebhookUrl is changed
+// if not nil, an empty url disables the webhook channel.
+type NotificationPreferencesUpdateInput struct {
+	UserId     uint                     `json:"-"`
+	WebhookUrl *string                  `json:"webhookUrl"`
+	Events     []NotificationPreference `json:"events"`
+}
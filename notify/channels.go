@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rentals"
+	"rentals/mail"
+	"time"
+)
+
+// Emails notifications to users that have an email
+type emailChannel struct {
+	mailer mail.Mailer
+}
+
+func (emailChannel) Name() string {
+	return rentals.ChannelEmail
+}
+
+func (c emailChannel) Deliver(user rentals.User, n rentals.Notification) error {
+	if user.Email == "" {
+		return nil
+	}
+
+	return c.mailer.Send(mail.Message{To: user.Email, Subject: n.Title, Body: n.Body})
+}
+
+func NewEmailChannel(mailer mail.Mailer) rentals.NotificationChannel {
+	return emailChannel{mailer: mailer}
+}
+
+// Posts notifications as json to the webhook url of users
+type webhookChannel struct {
+	client *http.Client
+}
+
+func (webhookChannel) Name() string {
+	return rentals.ChannelWebhook
+}
+
+func (c webhookChannel) Deliver(user rentals.User, n rentals.Notification) error {
+	if user.NotificationWebhookUrl == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.client.Post(user.NotificationWebhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded %d", user.NotificationWebhookUrl, res.StatusCode)
+	}
+
+	return nil
+}
+
+func NewWebhookChannel() rentals.NotificationChannel {
+	return webhookChannel{client: &http.Client{Timeout: 10 * time.Second}}
+}
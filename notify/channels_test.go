@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rentals"
+	"rentals/tst"
+	"testing"
+)
+
+func TestWebhookChannel(t *testing.T) {
+	// Arrange
+	received := make(chan rentals.Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n rentals.Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- n
+	}))
+	defer server.Close()
+
+	channel := NewWebhookChannel()
+	user := rentals.User{NotificationWebhookUrl: server.URL}
+	n := rentals.Notification{UserID: 1, Event: rentals.EventViewingBooked, Title: "New viewing"}
+
+	// Act
+	err := channel.Deliver(user, n)
+
+	// True
+	tst.Ok(t, err)
+	got := <-received
+	tst.True(t, got == n, fmt.Sprintf("Expected %v, got %v", n, got))
+
+	// Users without a url are skipped
+	tst.Ok(t, channel.Deliver(rentals.User{}, n))
+}
@@ -0,0 +1,21 @@
+package notify
+
+import (
+	"log"
+	"rentals"
+)
+
+// Package notify has the different ways of delivering
+// notifications to users
+
+// Writes notifications to the log. Useful in development
+type logNotifier struct{}
+
+func (logNotifier) Notify(n rentals.Notification) error {
+	log.Printf("[NOTIFY] user=%d event=%s title=%q", n.UserID, n.Event, n.Title)
+	return nil
+}
+
+func NewLogNotifier() rentals.Notifier {
+	return logNotifier{}
+}
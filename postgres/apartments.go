@@ -3,10 +3,11 @@ package postgres
 import (
 	"fmt"
 	"github.com/jinzhu/gorm"
-	"net/url"
+	"log"
 	"reflect"
 	"rentals"
 	"strconv"
+	"time"
 )
 
 var JsonTagsToFilter = map[string]string{
@@ -17,11 +18,30 @@ var JsonTagsToFilter = map[string]string{
 
 type dbApartmentService struct {
 	Db *gorm.DB
+
+	// Optional. Used to remove the media of purged apartments.
+	Media rentals.MediaService
+
+	// Optional. Where domain events are published.
+	Events rentals.EventPublisher
 }
 
 func (ar *dbApartmentService) Create(in rentals.ApartmentCreateInput) (*rentals.ApartmentCreateOutput, error) {
-	ar.Db.Create(&(in.Apartment))
+	if err := prepareApartment(&in.Apartment); err != nil {
+		return nil, err
+	}
+
+	tx := ar.Db.Begin()
+	if err := createApartment(tx, &in.Apartment, in.ActorId, in.RequestId); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
 
+	ar.created(in.Apartment)
 	return &rentals.ApartmentCreateOutput{Apartment: in.Apartment}, nil
 }
 
@@ -31,30 +51,36 @@ func (ar *dbApartmentService) Read(in rentals.ApartmentReadInput) (*rentals.Apar
 		return nil, err
 	}
 
+	if !rentals.CanSeeApartment(*apartment, in.ActorId, in.ActorRole) {
+		return nil, rentals.NotFoundError
+	}
+
 	return &rentals.ApartmentReadOutput{Apartment: *apartment}, nil
 }
 
 func (ar *dbApartmentService) Find(input rentals.ApartmentFindInput) (*rentals.ApartmentFindOutput, error) {
-	values, err := url.ParseQuery(input.Query)
+	tx, err := applyFilters(listedApartments(ar.Db.New(), input.ActorId, input.ActorRole), input.Query)
 	if err != nil {
 		return nil, err
 	}
 
-	tx := ar.Db.New()
-	for dbField, jsonTag := range JsonTagsToFilter {
-		if v, ok := values[jsonTag]; ok {
-			if !ok || len(v) == 0 {
-				continue
-			}
+	tx, limit, err := paginate(tx, "id", false, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
 
-			// TODO potential for injection here
-			tx = tx.Where(fmt.Sprintf("%s = ?", dbField), v[0])
-		}
+	apartments := make([]rentals.Apartment, 0)
+	if err := tx.Find(&apartments).Error; err != nil {
+		return nil, fmt.Errorf("[dbApartmentService.Find] error loading apartments %v", err)
 	}
 
-	var apartments []rentals.Apartment
-	tx.Find(&apartments)
-	return &rentals.ApartmentFindOutput{Apartments: apartments}, nil
+	output := &rentals.ApartmentFindOutput{Apartments: apartments}
+	if len(apartments) > limit {
+		output.Apartments = apartments[:limit]
+		output.NextCursor = encodeCursor("", uint(apartments[limit-1].ID))
+	}
+
+	return output, nil
 }
 
 func (ar *dbApartmentService) Update(input rentals.ApartmentUpdateInput) (*rentals.ApartmentUpdateOutput, error) {
@@ -63,27 +89,531 @@ func (ar *dbApartmentService) Update(input rentals.ApartmentUpdateInput) (*renta
 		return nil, err
 	}
 
+	if err := checkVersion(input.Version, apartment.Version); err != nil {
+		return nil, err
+	}
+
+	before := *apartment
 	if err := updateFields(apartment, input.Data); err != nil {
 		return nil, err
 	}
 
+	tx := ar.Db.Begin()
+	if err := bumpVersion(tx, &rentals.Apartment{}, uint(apartment.ID), apartment.Version); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	apartment.Version++
+
+	if status := requestedStatus(input.Data); status != "" && status != apartment.Status {
+		if err := transitionApartment(tx, apartment, status, input.ActorId); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
 	// Save to DB
-	if err = ar.Db.Save(&apartment).Error; err != nil {
+	if err = tx.Save(&apartment).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	entry := apartmentAudit(rentals.AuditUpdate, uint(apartment.ID), input.ActorId, input.RequestId)
+	if err := writeAudit(tx, entry, before, apartment); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	event := rentals.ApartmentUpdated{Before: before, After: *apartment, ActorId: input.ActorId}
+	if err := outboxEvent(tx, event); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
 		return nil, err
 	}
+
+	publish(ar.Events, event)
 	return &rentals.ApartmentUpdateOutput{Apartment: *apartment}, nil
 }
 
+func (ar *dbApartmentService) Reassign(input rentals.ApartmentReassignInput) (*rentals.ApartmentReassignOutput, error) {
+	from, err := getUser(input.FromRealtorId, ar.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := getActiveRealtor(input.ToRealtorId, ar.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if from.ID == to.ID {
+		return nil, fmt.Errorf("can't reassign apartments to the same realtor")
+	}
+
+	tx := ar.Db.Begin()
+	query, err := applyFilters(tx.Model(&rentals.Apartment{}).Where("realtor_id = ?", from.ID), input.Query)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if len(input.Ids) > 0 {
+		query = query.Where("id IN (?)", input.Ids)
+	}
+
+	// Lock the rows so the summary matches what was updated
+	var apartments []rentals.Apartment
+	if err := query.Set("gorm:query_option", "FOR UPDATE").Select("id").Find(&apartments).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(apartments))
+	for _, apt := range apartments {
+		ids = append(ids, uint(apt.ID))
+	}
+
+	if len(ids) > 0 {
+		err = tx.Model(&rentals.Apartment{}).Where("id IN (?)", ids).
+			Updates(map[string]interface{}{"realtor_id": to.ID, "version": nextVersion}).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("[dbApartmentService.Reassign] error updating %v", err)
+		}
+
+		if err := reassignThreads(tx, ids, uint(to.ID)); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("[dbApartmentService.Reassign] error updating threads %v", err)
+		}
+
+		err = auditReassign(tx, ids, uint(from.ID), uint(to.ID), input.ActorId, input.RequestId)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	event := rentals.ApartmentsReassigned{
+		ApartmentIds:  ids,
+		FromRealtorId: uint(from.ID),
+		ToRealtorId:   uint(to.ID),
+	}
+	if len(ids) > 0 {
+		if err := outboxEvent(tx, event); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		publish(ar.Events, event)
+	}
+
+	return &rentals.ApartmentReassignOutput{
+		FromRealtorId: uint(from.ID),
+		ToRealtorId:   uint(to.ID),
+		Count:         len(ids),
+		ApartmentIds:  ids,
+	}, nil
+}
+
+func (ar *dbApartmentService) Transition(input rentals.ApartmentTransitionInput) (*rentals.ApartmentTransitionOutput, error) {
+	apartment, err := getApartment(input.Id, ar.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	before := *apartment
+	tx := ar.Db.Begin()
+	if err := changeStatus(tx, apartment, input.Status, input.ActorId, input.RequestId); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	event := rentals.ApartmentUpdated{Before: before, After: *apartment, ActorId: input.ActorId}
+	if err := outboxEvent(tx, event); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	publish(ar.Events, event)
+	return &rentals.ApartmentTransitionOutput{Apartment: *apartment}, nil
+}
+
+func (ar *dbApartmentService) History(input rentals.ApartmentHistoryInput) (*rentals.ApartmentHistoryOutput, error) {
+	apartment, err := getApartment(input.Id, ar.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]rentals.ApartmentStatusChange, 0)
+	if err := ar.Db.Where("apartment_id = ?", apartment.ID).Order("id").Find(&changes).Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.ApartmentHistoryOutput{Changes: changes}, nil
+}
+
 func (ar *dbApartmentService) Delete(input rentals.ApartmentDeleteInput) (*rentals.ApartmentDeleteOutput, error) {
 	apartment, err := getApartment(input.Id, ar.Db)
 	if err != nil {
 		return nil, err
 	}
 
-	ar.Db.Delete(&apartment)
+	if err := checkVersion(input.Version, apartment.Version); err != nil {
+		return nil, err
+	}
+
+	// Moved to the trash, see Purge for the actual removal
+	now := time.Now()
+	tx := ar.Db.Begin()
+	if err := bumpVersion(tx, &rentals.Apartment{}, uint(apartment.ID), apartment.Version); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Model(apartment).UpdateColumn("deleted_at", now).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbApartmentService.Delete] error trashing apartment %v", err)
+	}
+	apartment.DeletedAt = &now
+	apartment.Version++
+
+	entry := apartmentAudit(rentals.AuditDelete, uint(apartment.ID), input.ActorId, input.RequestId)
+	if err := writeAudit(tx, entry, apartment, nil); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	event := rentals.ApartmentDeleted{Apartment: *apartment}
+	if err := outboxEvent(tx, event); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	publish(ar.Events, event)
+
 	return &rentals.ApartmentDeleteOutput{Message: "success"}, nil
 }
 
+func (ar *dbApartmentService) Trash(input rentals.ApartmentTrashInput) (*rentals.ApartmentTrashOutput, error) {
+	tx := ar.Db.Unscoped().Where("deleted_at IS NOT NULL")
+	switch input.ActorRole {
+	case "admin":
+	case "realtor":
+		tx = tx.Where("realtor_id = ?", input.ActorId)
+	default:
+		return nil, rentals.ForbiddenError
+	}
+
+	// Newest first
+	tx, limit, err := paginate(tx, "id", true, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	apartments := make([]rentals.Apartment, 0)
+	if err := tx.Find(&apartments).Error; err != nil {
+		return nil, err
+	}
+
+	output := &rentals.ApartmentTrashOutput{Apartments: apartments}
+	if len(apartments) > limit {
+		output.Apartments = apartments[:limit]
+		last := output.Apartments[limit-1]
+		output.NextCursor = encodeCursor("", uint(last.ID))
+	}
+
+	return output, nil
+}
+
+// Only admins can export apartments, as the export names the realtors
+func (ar *dbApartmentService) Export(input rentals.ApartmentExportInput) (*rentals.ApartmentExportOutput, error) {
+	if input.ActorRole != "admin" {
+		return nil, rentals.ForbiddenError
+	}
+
+	tx, err := applyFilters(listedApartments(ar.Db.New(), 0, input.ActorRole), input.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, limit, err := paginate(tx, "id", false, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var apartments []rentals.Apartment
+	if err := tx.Find(&apartments).Error; err != nil {
+		return nil, fmt.Errorf("[dbApartmentService.Export] error loading apartments %v", err)
+	}
+
+	output := &rentals.ApartmentExportOutput{Apartments: make([]rentals.ExportedApartment, 0, len(apartments))}
+	if len(apartments) > limit {
+		apartments = apartments[:limit]
+		output.NextCursor = encodeCursor("", uint(apartments[limit-1].ID))
+	}
+
+	// Usernames of the realtors in the page, deleted ones included
+	ids := make([]uint, 0, len(apartments))
+	for _, apartment := range apartments {
+		ids = append(ids, apartment.RealtorId)
+	}
+
+	var realtors []rentals.User
+	if len(ids) > 0 {
+		err := ar.Db.Unscoped().Select("id, username").Where("id IN (?)", ids).Find(&realtors).Error
+		if err != nil {
+			return nil, fmt.Errorf("[dbApartmentService.Export] error loading realtors %v", err)
+		}
+	}
+
+	usernames := make(map[uint]string, len(realtors))
+	for _, realtor := range realtors {
+		usernames[uint(realtor.ID)] = realtor.Username
+	}
+
+	for _, apartment := range apartments {
+		output.Apartments = append(output.Apartments, rentals.ExportedApartment{
+			Apartment:       apartment,
+			RealtorUsername: usernames[apartment.RealtorId],
+		})
+	}
+
+	return output, nil
+}
+
+// Takes an apartment out of the trash. It's back in the status it was
+// deleted in, but the favorites removed with it aren't.
+func (ar *dbApartmentService) Restore(input rentals.ApartmentRestoreInput) (*rentals.ApartmentRestoreOutput, error) {
+	apartment, err := getTrashedApartment(input.Id, ar.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManage(apartment.RealtorId, input.ActorId, input.ActorRole) {
+		return nil, rentals.ForbiddenError
+	}
+
+	before := *apartment
+	tx := ar.Db.Begin()
+	err = tx.Unscoped().Model(apartment).
+		UpdateColumns(map[string]interface{}{"deleted_at": gorm.Expr("NULL"), "version": nextVersion}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbApartmentService.Restore] error restoring apartment %v", err)
+	}
+	apartment.DeletedAt = nil
+	apartment.Version++
+
+	entry := apartmentAudit(rentals.AuditRestore, uint(apartment.ID), input.ActorId, input.RequestId)
+	if err := writeAudit(tx, entry, before, apartment); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	event := rentals.ApartmentRestored{Apartment: *apartment, ActorId: input.ActorId}
+	if err := outboxEvent(tx, event); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	publish(ar.Events, event)
+
+	return &rentals.ApartmentRestoreOutput{Apartment: *apartment}, nil
+}
+
+func (ar *dbApartmentService) Purge(deletedBefore time.Time) (int, error) {
+	// Applications and leases are records of what was agreed with
+	// clients, so their apartments stay in the trash
+	var apartments []rentals.Apartment
+	err := ar.Db.Unscoped().Where("deleted_at < ?", deletedBefore).
+		Where("NOT EXISTS (SELECT 1 FROM leases WHERE leases.apartment_id = apartments.id)").
+		Where("NOT EXISTS (SELECT 1 FROM rental_applications WHERE rental_applications.apartment_id = apartments.id)").
+		Order("id").Find(&apartments).Error
+	if err != nil {
+		return 0, fmt.Errorf("[dbApartmentService.Purge] error loading apartments %v", err)
+	}
+
+	purged := 0
+	for _, apartment := range apartments {
+		tx := ar.Db.Begin()
+		if err := deleteDependents(tx, uint(apartment.ID)); err != nil {
+			tx.Rollback()
+			return purged, fmt.Errorf("[dbApartmentService.Purge] error deleting dependents of apartment %d %v", apartment.ID, err)
+		}
+
+		if err := tx.Unscoped().Delete(&apartment).Error; err != nil {
+			tx.Rollback()
+			return purged, fmt.Errorf("[dbApartmentService.Purge] error deleting apartment %d %v", apartment.ID, err)
+		}
+
+		// Made by the system, so no actor
+		entry := apartmentAudit(rentals.AuditPurge, uint(apartment.ID), 0, "")
+		if err := writeAudit(tx, entry, apartment, nil); err != nil {
+			tx.Rollback()
+			return purged, err
+		}
+
+		if err := tx.Commit().Error; err != nil {
+			return purged, err
+		}
+		purged++
+
+		if ar.Media != nil {
+			id := strconv.Itoa(int(apartment.ID))
+			if err := ar.Media.DeleteAll(id); err != nil {
+				log.Printf("[ERROR] deleting media of apartment %s: %v", id, err)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// Deletes the rows belonging to an apartment about to be purged. The
+// audit trail is append-only and webhook events were already sent, so
+// both are kept, as are search matches, which show the apartment as
+// gone. Media is removed with its files once the purge is committed.
+// Apartments with applications or leases aren't purged at all.
+func deleteDependents(tx *gorm.DB, apartmentId uint) error {
+	threads := "SELECT id FROM threads WHERE apartment_id = ?"
+	messages := "SELECT id FROM messages WHERE thread_id IN (" + threads + ")"
+
+	for _, dependent := range []struct {
+		model interface{}
+		where string
+	}{
+		{rentals.MessageAttachment{}, "message_id IN (" + messages + ")"},
+		{rentals.Message{}, "thread_id IN (" + threads + ")"},
+		{rentals.Thread{}, "apartment_id = ?"},
+		{rentals.Viewing{}, "apartment_id = ?"},
+		{rentals.ViewingSlot{}, "apartment_id = ?"},
+		{rentals.Favorite{}, "apartment_id = ?"},
+		{rentals.ApartmentStatusChange{}, "apartment_id = ?"},
+	} {
+		if err := tx.Where(dependent.where, apartmentId).Delete(dependent.model).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sets the status of a new apartment and checks it's one apartments
+// can be created in
+func prepareApartment(apartment *rentals.Apartment) error {
+	// Apartments used to be created with just the available flag
+	if apartment.Status == "" {
+		apartment.Status = rentals.ApartmentDraft
+		if apartment.Available {
+			apartment.Status = rentals.ApartmentPublished
+		}
+	}
+
+	if apartment.Status != rentals.ApartmentDraft && apartment.Status != rentals.ApartmentPublished {
+		return fmt.Errorf("new apartments must be %s or %s", rentals.ApartmentDraft, rentals.ApartmentPublished)
+	}
+
+	apartment.Available = apartment.Status == rentals.ApartmentPublished
+	apartment.Version = 1
+	return nil
+}
+
+// Inserts apartment and records it in the audit trail and the outbox
+func createApartment(tx *gorm.DB, apartment *rentals.Apartment, actorId uint, requestId string) error {
+	if err := tx.Create(apartment).Error; err != nil {
+		return fmt.Errorf("[dbApartmentService.Create] error creating apartment %v", err)
+	}
+
+	entry := apartmentAudit(rentals.AuditCreate, uint(apartment.ID), actorId, requestId)
+	if err := writeAudit(tx, entry, nil, apartment); err != nil {
+		return err
+	}
+
+	return outboxEvent(tx, rentals.ApartmentCreated{Apartment: *apartment})
+}
+
+// Tells subscribers about a committed apartment
+func (ar *dbApartmentService) created(apartment rentals.Apartment) {
+	publish(ar.Events, rentals.ApartmentCreated{Apartment: apartment})
+}
+
+// Scopes tx to the apartments listed to the given user. Archived
+// apartments are left out for everyone, drafts shown only to their
+// realtor and admins. See rentals.CanSeeApartment.
+func listedApartments(tx *gorm.DB, actorId uint, actorRole string) *gorm.DB {
+	switch actorRole {
+	case "admin":
+		return tx.Where("status <> ?", rentals.ApartmentArchived)
+	case "realtor":
+		return tx.Where("status IN (?) OR (status = ? AND realtor_id = ?)",
+			rentals.ApartmentListedStatuses, rentals.ApartmentDraft, actorId)
+	}
+
+	return tx.Where("status IN (?)", rentals.ApartmentListedStatuses)
+}
+
+// Adds the filters in query (see rentals.ParseApartmentFilter) to tx
+func applyFilters(tx *gorm.DB, query string) (*gorm.DB, error) {
+	filter, err := rentals.ParseApartmentFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for dbField, jsonTag := range JsonTagsToFilter {
+		if v, ok := filter.Equal[jsonTag]; ok {
+			tx = tx.Where(fmt.Sprintf("%s = ?", dbField), v)
+		}
+		if v, ok := filter.Min[jsonTag]; ok {
+			tx = tx.Where(fmt.Sprintf("%s >= ?", dbField), v)
+		}
+		if v, ok := filter.Max[jsonTag]; ok {
+			tx = tx.Where(fmt.Sprintf("%s <= ?", dbField), v)
+		}
+	}
+
+	if filter.Status != "" {
+		tx = tx.Where("status = ?", filter.Status)
+	}
+
+	// Same formula as rentals.GeoRadius.DistanceKm
+	if near := filter.Near; near != nil {
+		tx = tx.Where(`6371 * acos(least(1, cos(radians(?)) * cos(radians(latitude)) *
+			cos(radians(longitude) - radians(?)) + sin(radians(?)) * sin(radians(latitude)))) <= ?`,
+			near.Latitude, near.Longitude, near.Latitude, near.RadiusKm)
+	}
+
+	if filter.Available != nil {
+		if *filter.Available {
+			tx = tx.Where("status = ?", rentals.ApartmentPublished)
+		} else {
+			tx = tx.Where("status <> ?", rentals.ApartmentPublished)
+		}
+	}
+
+	return tx, nil
+}
+
 func getApartment(id string, db *gorm.DB) (*rentals.Apartment, error) {
 	intId, err := strconv.Atoi(id)
 	if err != nil {
@@ -101,6 +631,24 @@ func getApartment(id string, db *gorm.DB) (*rentals.Apartment, error) {
 	return &apartment, nil
 }
 
+// Loads an apartment from the trash
+func getTrashedApartment(id string, db *gorm.DB) (*rentals.Apartment, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var apartment rentals.Apartment
+	if err = db.Unscoped().Where("deleted_at IS NOT NULL").First(&apartment, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &apartment, nil
+}
+
 func updateFields(apartment *rentals.Apartment, data map[string]interface{}) error {
 	if v, ok := data["name"]; ok {
 		apartment.Name = v.(string)
@@ -110,30 +658,122 @@ func updateFields(apartment *rentals.Apartment, data map[string]interface{}) err
 		apartment.Desc = v.(string)
 	}
 
-	if v, ok := data["floorAreaMeters"]; ok {
-		apartment.FloorAreaMeters = v.(float32)
+	// Numbers decoded from json are float64
+	floats := map[string]*float32{
+		"floorAreaMeters":  &apartment.FloorAreaMeters,
+		"pricePerMonthUSD": &apartment.PricePerMonthUsd,
+		"latitude":         &apartment.Latitude,
+		"longitude":        &apartment.Longitude,
 	}
-
-	if v, ok := data["pricePerMonthUSD"]; ok {
-		apartment.PricePerMonthUsd = v.(float32)
+	for key, field := range floats {
+		if v, ok := data[key]; ok {
+			f, err := toFloat(key, v)
+			if err != nil {
+				return err
+			}
+			*field = float32(f)
+		}
 	}
 
 	if v, ok := data["roomCount"]; ok {
-		apartment.RoomCount = v.(int)
+		f, err := toFloat("roomCount", v)
+		if err != nil {
+			return err
+		}
+		apartment.RoomCount = int(f)
 	}
 
-	if v, ok := data["latitude"]; ok {
-		apartment.Latitude = v.(float32)
+	return nil
+}
+
+func toFloat(key string, v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	}
+
+	return 0, fmt.Errorf("invalid %s %v", key, v)
+}
+
+// Returns the status requested in an update, if any. The available
+// flag is still accepted: available apartments are published and
+// unavailable ones are rented.
+func requestedStatus(data map[string]interface{}) string {
+	if v, ok := data["status"].(string); ok {
+		return v
+	}
+
+	if v, ok := data["available"].(bool); ok {
+		if v {
+			return rentals.ApartmentPublished
+		}
+		return rentals.ApartmentRented
+	}
+
+	return ""
+}
+
+// Moves apartment to status to and records who did it. The
+// apartment itself is not saved.
+func transitionApartment(tx *gorm.DB, apartment *rentals.Apartment, to string, actorId uint) error {
+	if !rentals.CanTransition(apartment.Status, to) {
+		return rentals.InvalidTransitionError
+	}
+
+	change := rentals.ApartmentStatusChange{
+		ApartmentID: uint(apartment.ID),
+		From:        apartment.Status,
+		To:          to,
+		ActorID:     actorId,
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		return fmt.Errorf("error recording status change %v", err)
+	}
+
+	apartment.Status = to
+	apartment.Available = to == rentals.ApartmentPublished
+	return nil
+}
+
+// Moves apartment to status to as part of tx, saves it and records
+// who did it in the audit trail. Publish the change as
+// ApartmentUpdated once tx is committed, so it reaches the
+// subscribers whichever service made it.
+func changeStatus(tx *gorm.DB, apartment *rentals.Apartment, to string, actorId uint, requestId string) error {
+	before := *apartment
+	if err := transitionApartment(tx, apartment, to, actorId); err != nil {
+		return err
+	}
+
+	if err := saveStatus(tx, apartment); err != nil {
+		return fmt.Errorf("error updating status of apartment %d %v", apartment.ID, err)
 	}
 
-	if v, ok := data["longitude"]; ok {
-		apartment.Longitude = v.(float32)
+	entry := apartmentAudit(rentals.AuditTransition, uint(apartment.ID), actorId, requestId)
+	return writeAudit(tx, entry, before, apartment)
+}
+
+// Saves the status set by transitionApartment, moving the apartment
+// to its next version. Trashed apartments are saved too, so leases
+// ending while they're in the trash free them.
+func saveStatus(tx *gorm.DB, apartment *rentals.Apartment) error {
+	res := tx.Unscoped().Model(apartment).UpdateColumns(map[string]interface{}{
+		"status":  apartment.Status,
+		"version": nextVersion,
+	})
+	if res.Error != nil {
+		return res.Error
 	}
 
-	if v, ok := data["available"]; ok {
-		apartment.Available = v.(bool)
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("apartment %d not found", apartment.ID)
 	}
 
+	apartment.Version++
 	return nil
 }
 
@@ -147,6 +787,36 @@ func getJsonTag(v interface{}, fieldName string) string {
 	return field.Tag.Get("json")
 }
 
+func apartmentAudit(action string, id, actorId uint, requestId string) rentals.AuditEntry {
+	return rentals.AuditEntry{
+		ActorID:   actorId,
+		Action:    action,
+		Entity:    rentals.AuditApartment,
+		EntityID:  id,
+		RequestID: requestId,
+	}
+}
+
+// Records the move of the given apartments to another realtor
+func auditReassign(tx *gorm.DB, ids []uint, fromId, toId, actorId uint, requestId string) error {
+	for _, id := range ids {
+		entry := apartmentAudit(rentals.AuditReassign, id, actorId, requestId)
+		entry.Changes = []rentals.FieldChange{{Field: "realtorId", From: fromId, To: toId}}
+		if err := tx.Create(&entry).Error; err != nil {
+			return fmt.Errorf("error recording reassignment of apartment %d %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// Publishes event if there's a publisher
+func publish(publisher rentals.EventPublisher, event rentals.Event) {
+	if publisher != nil {
+		publisher.Publish(event)
+	}
+}
+
 func NewDbApartmentService(db *gorm.DB) *dbApartmentService {
 	return &dbApartmentService{Db: db}
 }
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"github.com/jinzhu/gorm"
 	"rentals"
+	"rentals/events"
 	"rentals/tst"
 	"testing"
+	"time"
 )
 
 func TestFindApartment(t *testing.T) {
@@ -98,3 +100,429 @@ func createRealtor(t *testing.T, db *gorm.DB) {
 	})
 	tst.Ok(t, err)
 }
+
+func TestReassignApartments(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	aptResource := &dbApartmentService{Db: db}
+
+	createRealtor(t, db)
+	createApartments(t, aptResource)
+
+	usrService := NewDbUserService(db)
+	target, err := usrService.Create(rentals.UserCreateInput{Username: "target", Password: "pass", Role: "realtor"})
+	tst.Ok(t, err)
+	client, err := usrService.Create(rentals.UserCreateInput{Username: "client", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+
+	t.Run("Reassign to client, fail", func(t *testing.T) {
+		_, err := aptResource.Reassign(rentals.ApartmentReassignInput{
+			FromRealtorId: "1",
+			ToRealtorId:   fmt.Sprint(client.ID),
+		})
+		tst.True(t, err != nil, "Expected error, got success")
+	})
+
+	t.Run("Reassign to the same realtor, fail", func(t *testing.T) {
+		res, err := aptResource.Reassign(rentals.ApartmentReassignInput{FromRealtorId: "1", ToRealtorId: "1"})
+		tst.True(t, err != nil, fmt.Sprintf("Expected error, got %+v", res))
+	})
+
+	t.Run("Reassign filtered subset, success", func(t *testing.T) {
+		// Act
+		res, err := aptResource.Reassign(rentals.ApartmentReassignInput{
+			FromRealtorId: "1",
+			ToRealtorId:   fmt.Sprint(target.ID),
+			Query:         "roomCount=1",
+		})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, res.Count == 4, fmt.Sprintf("Expected 4 apartments, got %d", res.Count))
+
+		var count int
+		db.Model(&rentals.Apartment{}).Where("realtor_id = ?", target.ID).Count(&count)
+		tst.True(t, count == 4, fmt.Sprintf("Expected 4 apartments, got %d", count))
+	})
+}
+
+func TestApartmentTransitions(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	aptResource := &dbApartmentService{Db: db}
+	createRealtor(t, db)
+
+	created, err := aptResource.Create(newApartmentPayload("apt", "apt", 1, 1, 1, 1))
+	tst.Ok(t, err)
+	tst.True(t, created.Status == rentals.ApartmentPublished,
+		fmt.Sprintf("Expected published, got %s", created.Status))
+	id := fmt.Sprint(created.ID)
+
+	t.Run("Follow the lifecycle, success", func(t *testing.T) {
+		for _, status := range []string{rentals.ApartmentReserved, rentals.ApartmentRented, rentals.ApartmentArchived} {
+			res, err := aptResource.Transition(rentals.ApartmentTransitionInput{Id: id, Status: status, ActorId: 1})
+			tst.Ok(t, err)
+			tst.True(t, res.Status == status, fmt.Sprintf("Expected %s, got %s", status, res.Status))
+			tst.True(t, !res.Available, "Expected apartment to not be available")
+		}
+
+		found, err := aptResource.Find(rentals.ApartmentFindInput{})
+		tst.Ok(t, err)
+		tst.True(t, len(found.Apartments) == 0, "Expected archived apartment to be hidden")
+	})
+
+	t.Run("Skip to published from archived, fail", func(t *testing.T) {
+		_, err := aptResource.Transition(rentals.ApartmentTransitionInput{Id: id, Status: rentals.ApartmentPublished})
+		tst.True(t, err == rentals.InvalidTransitionError,
+			fmt.Sprintf("Expected InvalidTransitionError, got %v", err))
+	})
+
+	t.Run("Transitions are recorded", func(t *testing.T) {
+		history, err := aptResource.History(rentals.ApartmentHistoryInput{Id: id})
+		tst.Ok(t, err)
+		tst.True(t, len(history.Changes) == 3, fmt.Sprintf("Expected 3 changes, got %d", len(history.Changes)))
+		tst.True(t, history.Changes[0].ActorID == 1, "Expected actor to be recorded")
+	})
+}
+
+func TestDraftsVisibility(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	aptService := NewDbApartmentService(db)
+	createRealtor(t, db)
+
+	payload := newApartmentPayload("draft", "draft", 1, 1, 1, 1)
+	payload.Status = rentals.ApartmentDraft
+	draft, err := aptService.Create(payload)
+	tst.Ok(t, err)
+
+	for _, elt := range []struct {
+		actorId   uint
+		actorRole string
+		sees      bool
+	}{
+		{0, "", false},
+		{2, "client", false},
+		{2, "realtor", false},
+		{1, "realtor", true},
+		{2, "admin", true},
+	} {
+		t.Run(fmt.Sprintf("%s %d sees drafts: %v", elt.actorRole, elt.actorId, elt.sees), func(t *testing.T) {
+			// Act
+			_, readErr := aptService.Read(rentals.ApartmentReadInput{
+				Id: fmt.Sprint(draft.ID), ActorId: elt.actorId, ActorRole: elt.actorRole})
+			found, err := aptService.Find(rentals.ApartmentFindInput{ActorId: elt.actorId, ActorRole: elt.actorRole})
+			tst.Ok(t, err)
+
+			// True
+			tst.True(t, (readErr == nil) == elt.sees, fmt.Sprintf("Unexpected read error %v", readErr))
+			tst.True(t, (len(found.Apartments) == 1) == elt.sees,
+				fmt.Sprintf("Expected the draft to be listed: %v, got %d apartments", elt.sees, len(found.Apartments)))
+		})
+	}
+}
+
+func TestApartmentEvents(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	createRealtor(t, db)
+	recorder := &events.Recorder{}
+	aptService := NewDbApartmentService(db)
+	aptService.Events = recorder
+
+	created, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+	id := fmt.Sprint(created.ID)
+
+	t.Run("Updates carry the apartment before and after", func(t *testing.T) {
+		// Act
+		_, err := aptService.Update(rentals.ApartmentUpdateInput{
+			Id:      id,
+			Data:    map[string]interface{}{"pricePerMonthUSD": 900},
+			ActorId: 1,
+		})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, len(recorder.Named(rentals.EventApartmentCreated)) == 1, "Expected ApartmentCreated")
+
+		updated := recorder.Named(rentals.EventApartmentUpdated)
+		tst.True(t, len(updated) == 1, fmt.Sprintf("Expected 1 ApartmentUpdated, got %d", len(updated)))
+
+		event := updated[0].(rentals.ApartmentUpdated)
+		tst.True(t, event.Before.PricePerMonthUsd == 1000 && event.After.PricePerMonthUsd == 900,
+			fmt.Sprintf("Unexpected prices %v and %v", event.Before.PricePerMonthUsd, event.After.PricePerMonthUsd))
+		tst.True(t, event.ActorId == 1, "Expected the actor")
+	})
+
+	t.Run("Failed changes aren't published", func(t *testing.T) {
+		// Arrange
+		recorder.Reset()
+
+		// Act
+		_, err := aptService.Update(rentals.ApartmentUpdateInput{
+			Id:   id,
+			Data: map[string]interface{}{"name": "renamed", "status": "unknown"},
+		})
+
+		// True
+		tst.True(t, err == rentals.InvalidTransitionError, fmt.Sprintf("Expected InvalidTransitionError, got %v", err))
+		tst.True(t, len(recorder.Events()) == 0, "Expected no events")
+	})
+}
+
+func TestApartmentTrash(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	aptService := NewDbApartmentService(db)
+	createRealtor(t, db)
+
+	created, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+	id := fmt.Sprint(created.ID)
+
+	_, err = aptService.Delete(rentals.ApartmentDeleteInput{Id: id, ActorId: 1})
+	tst.Ok(t, err)
+
+	t.Run("Deleted apartments are hidden", func(t *testing.T) {
+		_, err := aptService.Read(rentals.ApartmentReadInput{Id: id})
+		found, findErr := aptService.Find(rentals.ApartmentFindInput{})
+		tst.Ok(t, findErr)
+
+		tst.True(t, err == rentals.NotFoundError, fmt.Sprintf("Expected NotFoundError, got %v", err))
+		tst.True(t, len(found.Apartments) == 0, "Expected the apartment to be left out")
+	})
+
+	t.Run("Only the realtor and admins see the trash", func(t *testing.T) {
+		own, err := aptService.Trash(rentals.ApartmentTrashInput{ActorId: 1, ActorRole: "realtor"})
+		tst.Ok(t, err)
+		other, err := aptService.Trash(rentals.ApartmentTrashInput{ActorId: 2, ActorRole: "realtor"})
+		tst.Ok(t, err)
+		_, clientErr := aptService.Trash(rentals.ApartmentTrashInput{ActorId: 3, ActorRole: "client"})
+
+		tst.True(t, len(own.Apartments) == 1 && own.Apartments[0].DeletedAt != nil,
+			fmt.Sprintf("Expected the deleted apartment, got %+v", own.Apartments))
+		tst.True(t, len(other.Apartments) == 0, "Expected other realtors to see an empty trash")
+		tst.True(t, clientErr == rentals.ForbiddenError, fmt.Sprintf("Expected ForbiddenError, got %v", clientErr))
+	})
+
+	t.Run("Restore, success", func(t *testing.T) {
+		_, err := aptService.Restore(rentals.ApartmentRestoreInput{Id: id, ActorId: 2, ActorRole: "realtor"})
+		tst.True(t, err == rentals.ForbiddenError, fmt.Sprintf("Expected ForbiddenError, got %v", err))
+
+		restored, err := aptService.Restore(rentals.ApartmentRestoreInput{Id: id, ActorId: 1, ActorRole: "realtor"})
+		tst.Ok(t, err)
+		read, err := aptService.Read(rentals.ApartmentReadInput{Id: id})
+		tst.Ok(t, err)
+
+		tst.True(t, restored.DeletedAt == nil && read.Status == rentals.ApartmentPublished,
+			fmt.Sprintf("Unexpected apartment %+v", read.Apartment))
+	})
+
+	t.Run("Purge removes apartments past the retention period", func(t *testing.T) {
+		_, err := aptService.Delete(rentals.ApartmentDeleteInput{Id: id, ActorId: 1})
+		tst.Ok(t, err)
+
+		kept, err := aptService.Purge(time.Now().Add(-time.Hour))
+		tst.Ok(t, err)
+		purged, err := aptService.Purge(time.Now().Add(time.Minute))
+		tst.Ok(t, err)
+		_, restoreErr := aptService.Restore(rentals.ApartmentRestoreInput{Id: id, ActorRole: "admin"})
+
+		tst.True(t, kept == 0 && purged == 1, fmt.Sprintf("Expected 0 then 1 purged, got %d and %d", kept, purged))
+		tst.True(t, restoreErr == rentals.NotFoundError, fmt.Sprintf("Expected NotFoundError, got %v", restoreErr))
+	})
+}
+
+func TestPurgeApartmentDependents(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	aptService := NewDbApartmentService(db)
+	createRealtor(t, db)
+
+	apt, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+	client, err := usrService.Create(rentals.UserCreateInput{Username: "client", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+
+	today := time.Now()
+	_, err = NewDbApplicationService(db, nil).Create(rentals.ApplicationCreateInput{
+		ApartmentId: uint(apt.ID),
+		ClientId:    uint(client.ID),
+		MoveInDate:  today.AddDate(0, 1, 0).Format("2006-01-02"),
+	})
+	tst.Ok(t, err)
+	_, err = NewDbLeaseService(db).Create(rentals.LeaseCreateInput{
+		ApartmentId:    uint(apt.ID),
+		TenantId:       uint(client.ID),
+		StartDate:      today.Format("2006-01-02"),
+		EndDate:        today.AddDate(1, 0, 0).Format("2006-01-02"),
+		MonthlyRentUsd: 1000,
+		ActorId:        1,
+		ActorRole:      "realtor",
+	})
+	tst.Ok(t, err)
+
+	unleased, err := aptService.Create(newApartmentPayload("unleased", "unleased", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+	_, err = NewDbFavoriteService(db, nil).Add(rentals.FavoriteInput{UserId: uint(client.ID), ApartmentId: fmt.Sprint(unleased.ID)})
+	tst.Ok(t, err)
+
+	for _, id := range []uint{uint(apt.ID), uint(unleased.ID)} {
+		_, err = aptService.Delete(rentals.ApartmentDeleteInput{Id: fmt.Sprint(id), ActorId: 1})
+		tst.Ok(t, err)
+	}
+
+	// Act
+	purged, err := aptService.Purge(time.Now().Add(time.Minute))
+	tst.Ok(t, err)
+
+	// True
+	tst.True(t, purged == 1, fmt.Sprintf("Expected 1 apartment purged, got %d", purged))
+
+	var leases, applications, favorites, trashed int
+	db.Model(&rentals.Lease{}).Where("apartment_id = ?", apt.ID).Count(&leases)
+	db.Model(&rentals.RentalApplication{}).Where("apartment_id = ?", apt.ID).Count(&applications)
+	tst.True(t, leases == 1 && applications == 1,
+		fmt.Sprintf("Expected the lease and application to be kept, got %d and %d", leases, applications))
+
+	db.Model(&rentals.Favorite{}).Where("apartment_id = ?", unleased.ID).Count(&favorites)
+	db.Unscoped().Model(&rentals.Apartment{}).Where("id = ?", apt.ID).Count(&trashed)
+	tst.True(t, favorites == 0, fmt.Sprintf("Expected the favorite to be purged, got %d", favorites))
+	tst.True(t, trashed == 1, "Expected the leased apartment to stay in the trash")
+}
+
+func TestApartmentVersions(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	aptService := NewDbApartmentService(db)
+	createRealtor(t, db)
+
+	created, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+	id := fmt.Sprint(created.ID)
+	tst.True(t, created.Version == 1, fmt.Sprintf("Expected version 1, got %d", created.Version))
+
+	t.Run("Every change moves to the next version", func(t *testing.T) {
+		updated, err := aptService.Update(rentals.ApartmentUpdateInput{
+			Id:      id,
+			Data:    map[string]interface{}{"name": "renamed"},
+			Version: 1,
+		})
+		tst.Ok(t, err)
+		moved, err := aptService.Transition(rentals.ApartmentTransitionInput{Id: id, Status: rentals.ApartmentReserved})
+		tst.Ok(t, err)
+		read, err := aptService.Read(rentals.ApartmentReadInput{Id: id})
+		tst.Ok(t, err)
+
+		tst.True(t, updated.Version == 2 && moved.Version == 3 && read.Version == 3,
+			fmt.Sprintf("Expected versions 2, 3 and 3, got %d, %d and %d", updated.Version, moved.Version, read.Version))
+	})
+
+	t.Run("Changes to an outdated version, fail", func(t *testing.T) {
+		_, updateErr := aptService.Update(rentals.ApartmentUpdateInput{
+			Id:      id,
+			Data:    map[string]interface{}{"name": "lost"},
+			Version: 1,
+		})
+		_, deleteErr := aptService.Delete(rentals.ApartmentDeleteInput{Id: id, Version: 2})
+		read, err := aptService.Read(rentals.ApartmentReadInput{Id: id})
+		tst.Ok(t, err)
+
+		tst.True(t, updateErr == rentals.VersionMismatchError,
+			fmt.Sprintf("Expected VersionMismatchError, got %v", updateErr))
+		tst.True(t, deleteErr == rentals.VersionMismatchError,
+			fmt.Sprintf("Expected VersionMismatchError, got %v", deleteErr))
+		tst.True(t, read.Name == "renamed", fmt.Sprintf("Expected the name to be kept, got %s", read.Name))
+	})
+
+	t.Run("Rows changed since they were read aren't overwritten", func(t *testing.T) {
+		// Arrange
+		tx := db.Begin()
+		defer tx.Rollback()
+
+		// Act
+		err := bumpVersion(tx, &rentals.Apartment{}, uint(created.ID), 1)
+
+		// True
+		tst.True(t, err == rentals.VersionMismatchError, fmt.Sprintf("Expected VersionMismatchError, got %v", err))
+	})
+}
+
+func TestApartmentExport(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	aptService := NewDbApartmentService(db)
+	createRealtor(t, db)
+
+	for rooms := 1; rooms <= 3; rooms++ {
+		_, err := aptService.Create(newApartmentPayload("apt", "apt", 50, 1000, rooms, 1))
+		tst.Ok(t, err)
+	}
+
+	t.Run("Pages follow the filters of Find", func(t *testing.T) {
+		// Act
+		input := rentals.ApartmentExportInput{Query: "minRoomCount=2", ActorRole: "admin", Limit: 1}
+		first, err := aptService.Export(input)
+		tst.Ok(t, err)
+
+		input.Cursor = first.NextCursor
+		second, err := aptService.Export(input)
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, len(first.Apartments) == 1 && first.NextCursor != "", "Expected a first page")
+		tst.True(t, len(second.Apartments) == 1 && second.NextCursor == "", "Expected a last page")
+		tst.True(t, first.Apartments[0].RoomCount == 2 && second.Apartments[0].RoomCount == 3,
+			fmt.Sprintf("Unexpected apartments %+v %+v", first.Apartments, second.Apartments))
+		tst.True(t, first.Apartments[0].RealtorUsername == "user",
+			fmt.Sprintf("Expected the realtor username, got %s", first.Apartments[0].RealtorUsername))
+	})
+
+	t.Run("Only admins export", func(t *testing.T) {
+		_, err := aptService.Export(rentals.ApartmentExportInput{ActorRole: "realtor"})
+
+		tst.True(t, err == rentals.ForbiddenError, fmt.Sprintf("Expected ForbiddenError, got %v", err))
+	})
+}
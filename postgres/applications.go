@@ -0,0 +1,302 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"log"
+	"rentals"
+	"strconv"
+	"time"
+)
+
+// Name of the unique index that keeps clients from having more than
+// one pending application per apartment. Created in Migrate.
+const pendingApplicationIndex = "idx_pending_application"
+
+type dbApplicationService struct {
+	Db       *gorm.DB
+	Notifier rentals.Notifier
+
+	// Optional. Where apartments rented by accepting applications are
+	// published.
+	Events rentals.EventPublisher
+}
+
+func (as *dbApplicationService) Create(input rentals.ApplicationCreateInput) (*rentals.ApplicationCreateOutput, error) {
+	moveIn, err := time.Parse("2006-01-02", input.MoveInDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid move in date %s", input.MoveInDate)
+	}
+
+	if moveIn.Before(time.Now().Truncate(24 * time.Hour)) {
+		return nil, fmt.Errorf("move in date can't be in the past")
+	}
+
+	apartment, err := getApartment(strconv.Itoa(int(input.ApartmentId)), as.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if apartment.Status != rentals.ApartmentPublished {
+		return nil, rentals.ApartmentNotAvailableError
+	}
+
+	var pending int
+	err = as.Db.Model(&rentals.RentalApplication{}).
+		Where("apartment_id = ? AND client_id = ? AND status = ?",
+			apartment.ID, input.ClientId, rentals.ApplicationPending).
+		Count(&pending).Error
+	if err != nil {
+		return nil, fmt.Errorf("[dbApplicationService.Create] error counting pending applications %v", err)
+	}
+
+	if pending > 0 {
+		return nil, rentals.DuplicateApplicationError
+	}
+
+	application := rentals.RentalApplication{
+		ApartmentID: uint(apartment.ID),
+		ClientID:    input.ClientId,
+		Message:     input.Message,
+		MoveInDate:  moveIn,
+		Status:      rentals.ApplicationPending,
+	}
+	if err := as.Db.Create(&application).Error; err != nil {
+		// Applied twice at once, see addPendingApplicationIndex
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Constraint == pendingApplicationIndex {
+			return nil, rentals.DuplicateApplicationError
+		}
+		return nil, fmt.Errorf("[dbApplicationService.Create] error creating application %v", err)
+	}
+
+	as.notify(rentals.Notification{
+		UserID: apartment.RealtorId,
+		Event:  rentals.EventApplicationReceived,
+		Title:  fmt.Sprintf("New application for %s", apartment.Name),
+		Body:   application.Message,
+	})
+
+	return &rentals.ApplicationCreateOutput{RentalApplication: application}, nil
+}
+
+func (as *dbApplicationService) Find(input rentals.ApplicationFindInput) (*rentals.ApplicationFindOutput, error) {
+	tx := as.Db.New().Model(&rentals.RentalApplication{})
+
+	switch input.ActorRole {
+	case "admin":
+	case "realtor":
+		tx = tx.Where("apartment_id IN (?)",
+			as.Db.Model(&rentals.Apartment{}).Select("id").Where("realtor_id = ?", input.ActorId).QueryExpr())
+	default:
+		tx = tx.Where("client_id = ?", input.ActorId)
+	}
+
+	if input.ApartmentId != "" {
+		tx = tx.Where("apartment_id = ?", input.ApartmentId)
+	}
+
+	if input.Status != "" {
+		tx = tx.Where("status = ?", input.Status)
+	}
+
+	applications := make([]rentals.RentalApplication, 0)
+	if err := tx.Order("created_at DESC").Find(&applications).Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.ApplicationFindOutput{Applications: applications}, nil
+}
+
+// Accepts an application. The apartment is marked as rented and the
+// rest of the pending applications for it are rejected, all at once.
+func (as *dbApplicationService) Accept(input rentals.ApplicationDecisionInput) (*rentals.ApplicationDecisionOutput, error) {
+	tx := as.Db.Begin()
+
+	application, apartment, err := lockApplication(tx, input.Id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if !canDecide(apartment, input) {
+		tx.Rollback()
+		return nil, rentals.ForbiddenError
+	}
+
+	if application.Status != rentals.ApplicationPending {
+		tx.Rollback()
+		return nil, rentals.ApplicationClosedError
+	}
+
+	before := *apartment
+	if err := changeStatus(tx, apartment, rentals.ApartmentRented, input.ActorId, input.RequestId); err != nil {
+		tx.Rollback()
+		if err == rentals.InvalidTransitionError {
+			return nil, rentals.ApartmentNotAvailableError
+		}
+		return nil, err
+	}
+
+	var competing []rentals.RentalApplication
+	err = tx.Where("apartment_id = ? AND status = ? AND id <> ?",
+		apartment.ID, rentals.ApplicationPending, application.ID).Find(&competing).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	now := time.Now()
+	err = tx.Model(&rentals.RentalApplication{}).
+		Where("apartment_id = ? AND status = ? AND id <> ?", apartment.ID, rentals.ApplicationPending, application.ID).
+		Updates(map[string]interface{}{"status": rentals.ApplicationRejected, "decided_at": now}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	application.Status = rentals.ApplicationAccepted
+	application.DecidedAt = &now
+	if err := tx.Save(application).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	event := rentals.ApartmentUpdated{Before: before, After: *apartment, ActorId: input.ActorId}
+	if err := outboxEvent(tx, event); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	as.notify(rentals.Notification{
+		UserID: application.ClientID,
+		Event:  rentals.EventApplicationAccepted,
+		Title:  fmt.Sprintf("Your application for %s was accepted", apartment.Name),
+	})
+	as.notify(rentals.Notification{
+		UserID: apartment.RealtorId,
+		Event:  rentals.EventApplicationAccepted,
+		Title:  fmt.Sprintf("%s is now rented", apartment.Name),
+	})
+	publish(as.Events, event)
+	for _, other := range competing {
+		as.notify(rentals.Notification{
+			UserID: other.ClientID,
+			Event:  rentals.EventApplicationRejected,
+			Title:  fmt.Sprintf("Your application for %s was rejected", apartment.Name),
+		})
+	}
+
+	return &rentals.ApplicationDecisionOutput{RentalApplication: *application}, nil
+}
+
+func (as *dbApplicationService) Reject(input rentals.ApplicationDecisionInput) (*rentals.ApplicationDecisionOutput, error) {
+	application, apartment, err := as.close(input, rentals.ApplicationRejected, canDecide)
+	if err != nil {
+		return nil, err
+	}
+
+	as.notify(rentals.Notification{
+		UserID: application.ClientID,
+		Event:  rentals.EventApplicationRejected,
+		Title:  fmt.Sprintf("Your application for %s was rejected", apartment.Name),
+	})
+
+	return &rentals.ApplicationDecisionOutput{RentalApplication: *application}, nil
+}
+
+func (as *dbApplicationService) Withdraw(input rentals.ApplicationDecisionInput) (*rentals.ApplicationDecisionOutput, error) {
+	application, _, err := as.close(input, rentals.ApplicationWithdrawn, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.ApplicationDecisionOutput{RentalApplication: *application}, nil
+}
+
+// Moves a pending application to status. If allowed is nil only
+// the applicant can do it.
+func (as *dbApplicationService) close(input rentals.ApplicationDecisionInput, status string,
+	allowed func(*rentals.Apartment, rentals.ApplicationDecisionInput) bool) (*rentals.RentalApplication, *rentals.Apartment, error) {
+	tx := as.Db.Begin()
+
+	application, apartment, err := lockApplication(tx, input.Id)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	if (allowed == nil && application.ClientID != input.ActorId) || (allowed != nil && !allowed(apartment, input)) {
+		tx.Rollback()
+		return nil, nil, rentals.ForbiddenError
+	}
+
+	if application.Status != rentals.ApplicationPending {
+		tx.Rollback()
+		return nil, nil, rentals.ApplicationClosedError
+	}
+
+	now := time.Now()
+	application.Status = status
+	application.DecidedAt = &now
+	if err := tx.Save(application).Error; err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, nil, err
+	}
+
+	return application, apartment, nil
+}
+
+func (as *dbApplicationService) notify(n rentals.Notification) {
+	if as.Notifier == nil {
+		return
+	}
+
+	if err := as.Notifier.Notify(n); err != nil {
+		log.Printf("[ERROR] notifying user %d of %s: %v", n.UserID, n.Event, err)
+	}
+}
+
+// Only the realtor of the apartment or admins can decide on applications
+func canDecide(apartment *rentals.Apartment, input rentals.ApplicationDecisionInput) bool {
+	return canManage(apartment.RealtorId, input.ActorId, input.ActorRole)
+}
+
+// Loads an application and its apartment, locking both rows
+// until tx ends
+func lockApplication(tx *gorm.DB, id string) (*rentals.RentalApplication, *rentals.Apartment, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var application rentals.RentalApplication
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&application, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, rentals.NotFoundError
+		}
+		return nil, nil, err
+	}
+
+	var apartment rentals.Apartment
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&apartment, application.ApartmentID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, rentals.NotFoundError
+		}
+		return nil, nil, err
+	}
+
+	return &application, &apartment, nil
+}
+
+func NewDbApplicationService(db *gorm.DB, notifier rentals.Notifier) *dbApplicationService {
+	return &dbApplicationService{Db: db, Notifier: notifier}
+}
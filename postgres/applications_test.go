@@ -0,0 +1,144 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingNotifier struct {
+	notifications []rentals.Notification
+}
+
+func (n *recordingNotifier) Notify(notification rentals.Notification) error {
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func TestAcceptApplication(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	aptService := NewDbApartmentService(db)
+	notifier := &recordingNotifier{}
+	appService := NewDbApplicationService(db, notifier)
+
+	createRealtor(t, db)
+	apt, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1, 1, 1))
+	tst.Ok(t, err)
+
+	moveIn := time.Now().AddDate(0, 1, 0).Format("2006-01-02")
+	var applicationIds []string
+	for _, name := range []string{"client1", "client2"} {
+		client, err := usrService.Create(rentals.UserCreateInput{Username: name, Password: name, Role: "client"})
+		tst.Ok(t, err)
+
+		application, err := appService.Create(rentals.ApplicationCreateInput{
+			ApartmentId: uint(apt.ID),
+			ClientId:    uint(client.ID),
+			Message:     "I like it",
+			MoveInDate:  moveIn,
+		})
+		tst.Ok(t, err)
+		applicationIds = append(applicationIds, fmt.Sprint(application.ID))
+	}
+
+	t.Run("Accept from another realtor, fail", func(t *testing.T) {
+		_, err := appService.Accept(rentals.ApplicationDecisionInput{
+			Id: applicationIds[0], ActorId: 99, ActorRole: "realtor",
+		})
+		tst.True(t, err == rentals.ForbiddenError, fmt.Sprintf("Expected ForbiddenError, got %v", err))
+	})
+
+	t.Run("Accept, success", func(t *testing.T) {
+		notifier.notifications = nil
+
+		// Act
+		res, err := appService.Accept(rentals.ApplicationDecisionInput{
+			Id: applicationIds[0], ActorId: 1, ActorRole: "realtor",
+		})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, res.Status == rentals.ApplicationAccepted,
+			fmt.Sprintf("Expected accepted, got %s", res.Status))
+
+		apartment, err := aptService.Read(rentals.ApartmentReadInput{Id: fmt.Sprint(apt.ID)})
+		tst.Ok(t, err)
+		tst.True(t, apartment.Status == rentals.ApartmentRented,
+			fmt.Sprintf("Expected rented, got %s", apartment.Status))
+
+		var other rentals.RentalApplication
+		db.First(&other, applicationIds[1])
+		tst.True(t, other.Status == rentals.ApplicationRejected,
+			fmt.Sprintf("Expected rejected, got %s", other.Status))
+
+		tst.True(t, len(notifier.notifications) == 3,
+			fmt.Sprintf("Expected 3 notifications, got %d", len(notifier.notifications)))
+	})
+
+	t.Run("Accept closed application, fail", func(t *testing.T) {
+		_, err := appService.Accept(rentals.ApplicationDecisionInput{
+			Id: applicationIds[1], ActorId: 1, ActorRole: "realtor",
+		})
+		tst.True(t, err == rentals.ApplicationClosedError,
+			fmt.Sprintf("Expected ApplicationClosedError, got %v", err))
+	})
+}
+
+func TestConcurrentApplications(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	tst.Ok(t, Migrate(db))
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	aptService := NewDbApartmentService(db)
+	appService := NewDbApplicationService(db, nil)
+
+	createRealtor(t, db)
+	apt, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1, 1, 1))
+	tst.Ok(t, err)
+	client, err := usrService.Create(rentals.UserCreateInput{Username: "client", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+
+	// Act
+	input := rentals.ApplicationCreateInput{
+		ApartmentId: uint(apt.ID),
+		ClientId:    uint(client.ID),
+		MoveInDate:  time.Now().AddDate(0, 1, 0).Format("2006-01-02"),
+	}
+	errs := make(chan error, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := appService.Create(input)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// True
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		tst.True(t, err == rentals.DuplicateApplicationError, fmt.Sprintf("Expected DuplicateApplicationError, got %v", err))
+	}
+	tst.True(t, created == 1, fmt.Sprintf("Expected 1 application, got %d", created))
+}
@@ -0,0 +1,205 @@
+package postgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"reflect"
+	"rentals"
+	"sort"
+	"strconv"
+)
+
+// Fields left out of diffs. They change on every save or are
+// derived from other fields.
+var auditIgnoredFields = map[string]bool{
+	"id":              true,
+	"available":       true,
+	"createdAt":       true,
+	"dateAdded":       true,
+	"statusChangedAt": true,
+	"version":         true,
+}
+
+type dbAuditService struct {
+	Db *gorm.DB
+}
+
+func (as *dbAuditService) Entries(input rentals.AuditListInput) (*rentals.AuditListOutput, error) {
+	tx := as.Db.New()
+	if input.Entity != "" {
+		tx = tx.Where("entity = ?", input.Entity)
+	}
+
+	if input.EntityId != "" {
+		id, err := strconv.Atoi(input.EntityId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %s", input.EntityId)
+		}
+		tx = tx.Where("entity_id = ?", id)
+	}
+
+	if input.ActorId != "" {
+		id, err := strconv.Atoi(input.ActorId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid actor %s", input.ActorId)
+		}
+		tx = tx.Where("actor_id = ?", id)
+	}
+
+	if input.Action != "" {
+		tx = tx.Where("action = ?", input.Action)
+	}
+
+	// Newest first
+	return listAudit(tx, true, input.Cursor, input.Limit)
+}
+
+// Deleted apartments can only be looked into by admins, as their
+// realtor can't be told anymore
+func (as *dbAuditService) ApartmentHistory(input rentals.ApartmentAuditInput) (*rentals.AuditListOutput, error) {
+	id, err := strconv.Atoi(input.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	apartment, err := getApartment(input.Id, as.Db)
+	switch {
+	case err == rentals.NotFoundError && input.ActorRole == "admin":
+	case err != nil:
+		return nil, err
+	case !canManage(apartment.RealtorId, input.ActorId, input.ActorRole):
+		return nil, rentals.ForbiddenError
+	}
+
+	tx := as.Db.Where("entity = ? AND entity_id = ?", rentals.AuditApartment, id)
+	return listAudit(tx, false, input.Cursor, input.Limit)
+}
+
+func listAudit(tx *gorm.DB, desc bool, cursor string, limit int) (*rentals.AuditListOutput, error) {
+	tx, limit, err := paginate(tx, "id", desc, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]rentals.AuditEntry, 0)
+	if err := tx.Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	output := &rentals.AuditListOutput{Entries: entries}
+	if len(entries) > limit {
+		output.Entries = entries[:limit]
+		last := output.Entries[limit-1]
+		output.NextCursor = encodeCursor("", uint(last.ID))
+	}
+
+	return output, nil
+}
+
+// Records entry as part of tx, with the fields that differ between
+// before and after. Either of them can be nil for entities created
+// or deleted. Updates that change nothing aren't recorded.
+func writeAudit(tx *gorm.DB, entry rentals.AuditEntry, before, after interface{}) error {
+	changes, err := diffFields(before, after)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 && before != nil && after != nil {
+		return nil
+	}
+
+	entry.Changes = changes
+	if err := tx.Create(&entry).Error; err != nil {
+		return fmt.Errorf("error recording %s of %s %d %v", entry.Action, entry.Entity, entry.EntityID, err)
+	}
+
+	return nil
+}
+
+// Records the changes made to a user. Password hashes aren't shown
+// in json so password changes are added explicitly, redacted.
+func writeUserAudit(tx *gorm.DB, entry rentals.AuditEntry, before, after *rentals.User) error {
+	entry.Entity = rentals.AuditUser
+	entry.EntityID = uint(after.ID)
+
+	var from interface{}
+	if before != nil {
+		from = before
+		if before.PasswordHash != after.PasswordHash {
+			entry.Changes = []rentals.FieldChange{
+				{Field: "password", From: rentals.AuditRedacted, To: rentals.AuditRedacted},
+			}
+		}
+	}
+
+	changes, err := diffFields(from, after)
+	if err != nil {
+		return err
+	}
+
+	entry.Changes = append(entry.Changes, changes...)
+	if len(entry.Changes) == 0 && before != nil {
+		return nil
+	}
+
+	if err := tx.Create(&entry).Error; err != nil {
+		return fmt.Errorf("error recording %s of user %d %v", entry.Action, entry.EntityID, err)
+	}
+
+	return nil
+}
+
+// Returns the fields, by json name, whose values differ between a
+// and b, sorted by name
+func diffFields(a, b interface{}) ([]rentals.FieldChange, error) {
+	fieldsA, err := jsonFields(a)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldsB, err := jsonFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fieldsA)+len(fieldsB))
+	for name := range fieldsA {
+		names = append(names, name)
+	}
+	for name := range fieldsB {
+		if _, ok := fieldsA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]rentals.FieldChange, 0)
+	for _, name := range names {
+		if auditIgnoredFields[name] || reflect.DeepEqual(fieldsA[name], fieldsB[name]) {
+			continue
+		}
+		changes = append(changes, rentals.FieldChange{Field: name, From: fieldsA[name], To: fieldsB[name]})
+	}
+
+	return changes, nil
+}
+
+func jsonFields(v interface{}) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return fields, nil
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return fields, json.Unmarshal(raw, &fields)
+}
+
+func NewDbAuditService(db *gorm.DB) *dbAuditService {
+	return &dbAuditService{Db: db}
+}
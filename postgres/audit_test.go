@@ -0,0 +1,112 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"strconv"
+	"testing"
+)
+
+func TestAuditTrail(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	auditService := NewDbAuditService(db)
+	aptService := NewDbApartmentService(db)
+	usrService := NewDbUserService(db)
+
+	createRealtor(t, db)
+	input := newApartmentPayload("apt", "apt", 1, 1000, 1, 1)
+	input.ActorId = 1
+	created, err := aptService.Create(input)
+	tst.Ok(t, err)
+	id := strconv.Itoa(int(created.ID))
+
+	t.Run("Updates record who changed which fields", func(t *testing.T) {
+		// Act
+		_, err := aptService.Update(rentals.ApartmentUpdateInput{
+			Id:        id,
+			Data:      map[string]interface{}{"pricePerMonthUSD": 900},
+			ActorId:   1,
+			RequestId: "req-1",
+		})
+		tst.Ok(t, err)
+
+		entries, err := auditService.Entries(rentals.AuditListInput{Entity: rentals.AuditApartment, EntityId: id})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, len(entries.Entries) == 2, fmt.Sprintf("Expected 2 entries, got %d", len(entries.Entries)))
+
+		update := entries.Entries[0]
+		tst.True(t, update.Action == rentals.AuditUpdate && update.ActorID == 1 && update.RequestID == "req-1",
+			fmt.Sprintf("Unexpected entry %+v", update))
+		tst.True(t, len(update.Changes) == 1 && update.Changes[0].Field == "pricePerMonthUSD",
+			fmt.Sprintf("Expected only the price to change, got %+v", update.Changes))
+		tst.True(t, update.Changes[0].From == float64(1000) && update.Changes[0].To == float64(900),
+			fmt.Sprintf("Unexpected price change %+v", update.Changes[0]))
+	})
+
+	t.Run("Deleted apartments keep their history for admins", func(t *testing.T) {
+		// Act
+		_, err := aptService.Delete(rentals.ApartmentDeleteInput{Id: id, ActorId: 1})
+		tst.Ok(t, err)
+
+		history, err := auditService.ApartmentHistory(rentals.ApartmentAuditInput{Id: id, ActorRole: "admin"})
+		tst.Ok(t, err)
+		_, realtorErr := auditService.ApartmentHistory(rentals.ApartmentAuditInput{Id: id, ActorId: 1, ActorRole: "realtor"})
+
+		// True
+		actions := make([]string, len(history.Entries))
+		for i, entry := range history.Entries {
+			actions[i] = entry.Action
+		}
+		tst.True(t, fmt.Sprint(actions) == "[create update delete]", fmt.Sprintf("Unexpected history %v", actions))
+		tst.True(t, realtorErr == rentals.NotFoundError, fmt.Sprintf("Expected NotFoundError, got %v", realtorErr))
+	})
+
+	t.Run("Passwords are redacted", func(t *testing.T) {
+		// Act
+		_, err := usrService.Update(rentals.UserUpdateInput{Id: "1", Password: "other", Role: "admin", ActorId: 1})
+		tst.Ok(t, err)
+
+		entries, err := auditService.Entries(rentals.AuditListInput{Entity: rentals.AuditUser, Action: rentals.AuditUpdate})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, len(entries.Entries) == 1, fmt.Sprintf("Expected 1 entry, got %d", len(entries.Entries)))
+		changes := entries.Entries[0].Changes
+		tst.True(t, len(changes) == 2 && changes[0].Field == "password" && changes[0].To == rentals.AuditRedacted &&
+			changes[1].Field == "role", fmt.Sprintf("Unexpected changes %+v", changes))
+	})
+}
+
+func TestDiffFields(t *testing.T) {
+	// Arrange
+	before := rentals.Apartment{Name: "apt", PricePerMonthUsd: 1000, Status: rentals.ApartmentPublished, Available: true}
+	after := before
+	after.Name = "renamed"
+	after.Status = rentals.ApartmentRented
+	after.Available = false
+
+	// Act
+	changes, err := diffFields(before, &after)
+	tst.Ok(t, err)
+	created, err := diffFields(nil, after)
+	tst.Ok(t, err)
+
+	// True
+	tst.True(t, len(changes) == 2, fmt.Sprintf("Expected 2 changes, got %+v", changes))
+	tst.True(t, changes[0] == rentals.FieldChange{Field: "name", From: "apt", To: "renamed"},
+		fmt.Sprintf("Unexpected change %+v", changes[0]))
+	tst.True(t, changes[1].Field == "status", fmt.Sprintf("Unexpected change %+v", changes[1]))
+
+	for _, change := range created {
+		tst.True(t, change.From == nil, fmt.Sprintf("Expected no previous value for %s", change.Field))
+	}
+}
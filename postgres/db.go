@@ -5,6 +5,7 @@ import (
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"os"
+	"rentals"
 )
 
 // Creates a new connection to the Db and migrates
@@ -39,3 +40,119 @@ func ConnectToDB(testing bool) (*gorm.DB, error) {
 
 	return db, nil
 }
+
+// Migrates the db to the current models. Data that can't be
+// migrated by gorm.AutoMigrate is converted here.
+func Migrate(db *gorm.DB) error {
+	// Apartments had available/archived flags before having a status
+	hadStatus := db.Dialect().HasColumn("apartments", "status")
+	hadApartments := db.HasTable(&rentals.Apartment{})
+
+	if err := db.AutoMigrate(rentals.DbModels...).Error; err != nil {
+		return err
+	}
+
+	if hadApartments && !hadStatus {
+		archived := "false"
+		if db.Dialect().HasColumn("apartments", "archived") {
+			archived = "archived"
+		}
+
+		err := db.Exec(fmt.Sprintf(`UPDATE apartments SET status = CASE
+			WHEN %s THEN 'archived'
+			WHEN available THEN 'published'
+			ELSE 'rented' END`, archived)).Error
+		if err != nil {
+			return fmt.Errorf("[Migrate] error setting apartments status: %v", err)
+		}
+	}
+
+	if err := backfillUsersCreatedAt(db); err != nil {
+		return err
+	}
+
+	if err := addViewingOverlapConstraint(db); err != nil {
+		return err
+	}
+
+	if err := addPendingApplicationIndex(db); err != nil {
+		return err
+	}
+
+	return addAuditTrigger(db)
+}
+
+// Users created before they had a creation date get the date of
+// their first audit entry, or the migration date without one, so they
+// can be sorted and paginated by it
+func backfillUsersCreatedAt(db *gorm.DB) error {
+	err := db.Exec(`UPDATE users SET created_at = COALESCE(
+			(SELECT MIN(created_at) FROM audit_entries WHERE entity = ? AND entity_id = users.id),
+			now())
+		WHERE created_at IS NULL`, rentals.AuditUser).Error
+	if err != nil {
+		return fmt.Errorf("[Migrate] error setting users creation date: %v", err)
+	}
+
+	return nil
+}
+
+// Keeps clients from having more than one pending application for
+// the same apartment, however close together they apply
+func addPendingApplicationIndex(db *gorm.DB) error {
+	err := db.Exec(fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS %s
+		ON rental_applications (apartment_id, client_id) WHERE status = '%s'`,
+		pendingApplicationIndex, rentals.ApplicationPending)).Error
+	if err != nil {
+		return fmt.Errorf("[Migrate] error adding pending applications index: %v", err)
+	}
+
+	return nil
+}
+
+// Rejects updates and deletes of audit entries so the trail can
+// only be appended to
+func addAuditTrigger(db *gorm.DB) error {
+	err := db.Exec(`CREATE OR REPLACE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit entries can not be changed';
+		END;
+		$$ LANGUAGE plpgsql`).Error
+	if err != nil {
+		return fmt.Errorf("[Migrate] error creating audit function: %v", err)
+	}
+
+	err = db.Exec(`DROP TRIGGER IF EXISTS audit_entries_append_only ON audit_entries;
+		CREATE TRIGGER audit_entries_append_only BEFORE UPDATE OR DELETE ON audit_entries
+		FOR EACH ROW EXECUTE PROCEDURE audit_entries_append_only()`).Error
+	if err != nil {
+		return fmt.Errorf("[Migrate] error adding audit trigger: %v", err)
+	}
+
+	return nil
+}
+
+// Keeps realtors from having two scheduled viewings at the same
+// time, even when concurrent requests book them
+func addViewingOverlapConstraint(db *gorm.DB) error {
+	var count int
+	err := db.Table("pg_constraint").Where("conname = ?", viewingOverlapConstraint).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+
+	// Needed to use = on integers in a gist index
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS btree_gist").Error; err != nil {
+		return fmt.Errorf("[Migrate] error creating btree_gist extension: %v", err)
+	}
+
+	err = db.Exec(fmt.Sprintf(`ALTER TABLE viewings ADD CONSTRAINT %s EXCLUDE USING gist (
+		realtor_id WITH =,
+		tstzrange(starts_at, ends_at) WITH &&
+	) WHERE (status = '%s')`, viewingOverlapConstraint, rentals.ViewingScheduled)).Error
+	if err != nil {
+		return fmt.Errorf("[Migrate] error adding viewings constraint: %v", err)
+	}
+
+	return nil
+}
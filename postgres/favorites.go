@@ -0,0 +1,143 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"rentals"
+	"strconv"
+)
+
+type dbFavoriteService struct {
+	Db       *gorm.DB
+	Notifier rentals.Notifier
+}
+
+// Adding an apartment twice returns the existing favorite
+func (fs *dbFavoriteService) Add(input rentals.FavoriteInput) (*rentals.FavoriteAddOutput, error) {
+	apartment, err := getApartment(input.ApartmentId, fs.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if apartment.Status == rentals.ApartmentArchived || apartment.Status == rentals.ApartmentDraft {
+		return nil, rentals.ApartmentNotAvailableError
+	}
+
+	favorite := rentals.Favorite{UserID: input.UserId, ApartmentID: uint(apartment.ID)}
+	err = fs.Db.Where("user_id = ? AND apartment_id = ?", favorite.UserID, favorite.ApartmentID).
+		FirstOrCreate(&favorite).Error
+	if err != nil {
+		return nil, fmt.Errorf("[dbFavoriteService.Add] error creating favorite %v", err)
+	}
+
+	favorite.Apartment = apartment
+	return &rentals.FavoriteAddOutput{Favorite: favorite}, nil
+}
+
+func (fs *dbFavoriteService) Remove(input rentals.FavoriteInput) (*rentals.FavoriteRemoveOutput, error) {
+	apartmentId, err := strconv.Atoi(input.ApartmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	res := fs.Db.Where("user_id = ? AND apartment_id = ?", input.UserId, apartmentId).Delete(rentals.Favorite{})
+	if res.Error != nil {
+		return nil, fmt.Errorf("[dbFavoriteService.Remove] error deleting favorite %v", res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, rentals.NotFoundError
+	}
+
+	return &rentals.FavoriteRemoveOutput{}, nil
+}
+
+// Archived apartments are listed with their status so users can
+// tell them apart. Favorites of deleted apartments have no apartment.
+func (fs *dbFavoriteService) List(input rentals.FavoriteListInput) (*rentals.FavoriteListOutput, error) {
+	favorites := make([]rentals.Favorite, 0)
+	err := fs.Db.Preload("Apartment").Where("user_id = ?", input.UserId).
+		Order("created_at DESC").Find(&favorites).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.FavoriteListOutput{Favorites: favorites}, nil
+}
+
+// Tells the users watching the apartment about price and
+// availability changes. Favorites of deleted apartments are removed.
+func (fs *dbFavoriteService) ApartmentChanged(before rentals.Apartment, after *rentals.Apartment) {
+	// New apartments have no watchers yet
+	if before.ID == 0 {
+		return
+	}
+
+	var userIds []uint
+	err := fs.Db.Model(&rentals.Favorite{}).Where("apartment_id = ?", before.ID).Pluck("user_id", &userIds).Error
+	if err != nil {
+		log.Printf("[ERROR] loading watchers of apartment %d: %v", before.ID, err)
+		return
+	}
+
+	var notifications []rentals.Notification
+	switch {
+	case after == nil:
+		err := fs.Db.Where("apartment_id = ?", before.ID).Delete(rentals.Favorite{}).Error
+		if err != nil {
+			log.Printf("[ERROR] deleting favorites of apartment %d: %v", before.ID, err)
+		}
+
+		notifications = append(notifications, rentals.Notification{
+			Event: rentals.EventFavoriteAvailabilityChanged,
+			Title: fmt.Sprintf("%s is no longer listed", before.Name),
+		})
+	default:
+		if after.PricePerMonthUsd != before.PricePerMonthUsd {
+			change := "went up"
+			if after.PricePerMonthUsd < before.PricePerMonthUsd {
+				change = "dropped"
+			}
+
+			notifications = append(notifications, rentals.Notification{
+				Event: rentals.EventFavoritePriceChanged,
+				Title: fmt.Sprintf("The price of %s %s to $%.2f", after.Name, change, after.PricePerMonthUsd),
+				Body:  fmt.Sprintf("It was $%.2f", before.PricePerMonthUsd),
+			})
+		}
+
+		if after.Available != before.Available {
+			title := fmt.Sprintf("%s is available again", after.Name)
+			if !after.Available {
+				title = fmt.Sprintf("%s is no longer available", after.Name)
+			}
+
+			notifications = append(notifications, rentals.Notification{
+				Event: rentals.EventFavoriteAvailabilityChanged,
+				Title: title,
+			})
+		}
+	}
+
+	for _, userId := range userIds {
+		for _, n := range notifications {
+			n.UserID = userId
+			fs.notify(n)
+		}
+	}
+}
+
+func (fs *dbFavoriteService) notify(n rentals.Notification) {
+	if fs.Notifier == nil {
+		return
+	}
+
+	if err := fs.Notifier.Notify(n); err != nil {
+		log.Printf("[ERROR] notifying user %d of %s: %v", n.UserID, n.Event, err)
+	}
+}
+
+func NewDbFavoriteService(db *gorm.DB, notifier rentals.Notifier) *dbFavoriteService {
+	return &dbFavoriteService{Db: db, Notifier: notifier}
+}
@@ -0,0 +1,74 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/events"
+	"rentals/tst"
+	"testing"
+)
+
+func TestWatchFavorites(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	notifier := &recordingNotifier{}
+	favService := NewDbFavoriteService(db, notifier)
+	bus := events.NewBus()
+	defer bus.Close()
+	bus.Subscribe(events.ApartmentChanges(favService.ApartmentChanged), events.ApartmentChangeEvents...)
+
+	aptService := NewDbApartmentService(db)
+	aptService.Events = bus
+
+	createRealtor(t, db)
+	apt, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+	aptId := fmt.Sprint(apt.ID)
+
+	_, err = favService.Add(rentals.FavoriteInput{UserId: 2, ApartmentId: aptId})
+	tst.Ok(t, err)
+
+	// Adding twice keeps one favorite
+	_, err = favService.Add(rentals.FavoriteInput{UserId: 2, ApartmentId: aptId})
+	tst.Ok(t, err)
+
+	t.Run("Price drop and availability change notify watchers", func(t *testing.T) {
+		// Act
+		_, err := aptService.Update(rentals.ApartmentUpdateInput{
+			Id:   aptId,
+			Data: map[string]interface{}{"pricePerMonthUSD": 900.0, "available": false},
+		})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, len(notifier.notifications) == 2,
+			fmt.Sprintf("Expected 2 notifications, got %d", len(notifier.notifications)))
+		tst.True(t, notifier.notifications[0].Event == rentals.EventFavoritePriceChanged,
+			fmt.Sprintf("Expected a price notification, got %s", notifier.notifications[0].Event))
+		tst.True(t, notifier.notifications[0].UserID == 2, "Expected the watcher to be notified")
+	})
+
+	t.Run("Archived favorites are still listed", func(t *testing.T) {
+		_, err := aptService.Transition(rentals.ApartmentTransitionInput{Id: aptId, Status: rentals.ApartmentArchived})
+		tst.Ok(t, err)
+
+		res, err := favService.List(rentals.FavoriteListInput{UserId: 2})
+		tst.Ok(t, err)
+		tst.True(t, len(res.Favorites) == 1, fmt.Sprintf("Expected 1 favorite, got %d", len(res.Favorites)))
+		tst.True(t, res.Favorites[0].Apartment.Status == rentals.ApartmentArchived, "Expected an archived apartment")
+	})
+
+	t.Run("Deleting the apartment removes favorites", func(t *testing.T) {
+		_, err := aptService.Delete(rentals.ApartmentDeleteInput{Id: aptId})
+		tst.Ok(t, err)
+
+		res, err := favService.List(rentals.FavoriteListInput{UserId: 2})
+		tst.Ok(t, err)
+		tst.True(t, len(res.Favorites) == 0, fmt.Sprintf("Expected no favorites, got %d", len(res.Favorites)))
+	})
+}
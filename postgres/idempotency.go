@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"rentals"
+	"time"
+)
+
+// Name of the unique index on the user and key of idempotency keys
+const idempotencyKeyIndex = "idx_idempotency_key"
+
+type dbIdempotencyStore struct {
+	Db *gorm.DB
+
+	// How long keys are kept. Older keys are treated as new.
+	TTL time.Duration
+}
+
+func (is *dbIdempotencyStore) Begin(key rentals.IdempotencyKey) (*rentals.IdempotencyKey, error) {
+	err := is.Db.Where("user_id = ? AND key = ? AND created_at < ?", key.UserID, key.Key, time.Now().Add(-is.TTL)).
+		Delete(rentals.IdempotencyKey{}).Error
+	if err != nil {
+		return nil, fmt.Errorf("[dbIdempotencyStore.Begin] error forgetting expired key %v", err)
+	}
+
+	claimed := rentals.IdempotencyKey{UserID: key.UserID, Key: key.Key, Fingerprint: key.Fingerprint}
+	err = is.Db.Create(&claimed).Error
+	if err == nil {
+		return &claimed, nil
+	}
+
+	// Someone else claimed it first
+	if pqErr, ok := err.(*pq.Error); !ok || pqErr.Constraint != idempotencyKeyIndex {
+		return nil, fmt.Errorf("[dbIdempotencyStore.Begin] error claiming key %v", err)
+	}
+
+	var stored rentals.IdempotencyKey
+	if err := is.Db.Where("user_id = ? AND key = ?", key.UserID, key.Key).First(&stored).Error; err != nil {
+		return nil, fmt.Errorf("[dbIdempotencyStore.Begin] error loading key %v", err)
+	}
+
+	switch {
+	case stored.Fingerprint != key.Fingerprint:
+		return nil, rentals.IdempotencyKeyReusedError
+	case stored.Status == 0:
+		return nil, rentals.IdempotencyKeyInProgressError
+	}
+
+	return &stored, nil
+}
+
+func (is *dbIdempotencyStore) Complete(key rentals.IdempotencyKey) error {
+	err := is.Db.Model(&rentals.IdempotencyKey{}).Where("id = ?", key.ID).
+		UpdateColumns(map[string]interface{}{"status": key.Status, "body": key.Body, "header": key.Header}).Error
+	if err != nil {
+		return fmt.Errorf("[dbIdempotencyStore.Complete] error storing response %v", err)
+	}
+
+	return nil
+}
+
+func (is *dbIdempotencyStore) Release(key rentals.IdempotencyKey) error {
+	if err := is.Db.Where("id = ?", key.ID).Delete(rentals.IdempotencyKey{}).Error; err != nil {
+		return fmt.Errorf("[dbIdempotencyStore.Release] error deleting key %v", err)
+	}
+
+	return nil
+}
+
+func (is *dbIdempotencyStore) Purge(createdBefore time.Time) (int, error) {
+	res := is.Db.Where("created_at < ?", createdBefore).Delete(rentals.IdempotencyKey{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("[dbIdempotencyStore.Purge] error deleting keys %v", res.Error)
+	}
+
+	return int(res.RowsAffected), nil
+}
+
+func NewDbIdempotencyStore(db *gorm.DB, ttl time.Duration) *dbIdempotencyStore {
+	return &dbIdempotencyStore{Db: db, TTL: ttl}
+}
@@ -0,0 +1,69 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	store := NewDbIdempotencyStore(db, time.Hour)
+	key := rentals.IdempotencyKey{UserID: 1, Key: "retry-me", Fingerprint: "first"}
+
+	claimed, err := store.Begin(key)
+	tst.Ok(t, err)
+
+	t.Run("Keys being processed can't be claimed again", func(t *testing.T) {
+		_, err := store.Begin(key)
+
+		tst.True(t, claimed.Status == 0, "Expected a new key")
+		tst.True(t, err == rentals.IdempotencyKeyInProgressError,
+			fmt.Sprintf("Expected IdempotencyKeyInProgressError, got %v", err))
+	})
+
+	t.Run("Retries get the stored response", func(t *testing.T) {
+		// Act
+		claimed.Status = 201
+		claimed.Body = []byte(`{"id":1}`)
+		claimed.Header = `{"Location":["/apartments/1"]}`
+		tst.Ok(t, store.Complete(*claimed))
+
+		stored, err := store.Begin(key)
+		tst.Ok(t, err)
+		_, otherUserErr := store.Begin(rentals.IdempotencyKey{UserID: 2, Key: key.Key, Fingerprint: "other"})
+
+		// True
+		tst.True(t, stored.Status == 201 && string(stored.Body) == `{"id":1}` && stored.Header == claimed.Header,
+			fmt.Sprintf("Unexpected response %d %s %s", stored.Status, stored.Body, stored.Header))
+		tst.True(t, otherUserErr == nil, fmt.Sprintf("Expected keys to be per user, got %v", otherUserErr))
+	})
+
+	t.Run("Same key with another request, fail", func(t *testing.T) {
+		_, err := store.Begin(rentals.IdempotencyKey{UserID: 1, Key: key.Key, Fingerprint: "second"})
+
+		tst.True(t, err == rentals.IdempotencyKeyReusedError,
+			fmt.Sprintf("Expected IdempotencyKeyReusedError, got %v", err))
+	})
+
+	t.Run("Purged keys can be used again", func(t *testing.T) {
+		// Act
+		purged, err := store.Purge(time.Now().Add(time.Minute))
+		tst.Ok(t, err)
+
+		again, err := store.Begin(rentals.IdempotencyKey{UserID: 1, Key: key.Key, Fingerprint: "second"})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, purged == 2, fmt.Sprintf("Expected 2 keys purged, got %d", purged))
+		tst.True(t, again.Status == 0, "Expected the key to be new")
+	})
+}
@@ -0,0 +1,447 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"io"
+	"log"
+	"rentals"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rows between the progress updates of an import
+const importProgressInterval = 50
+
+// Columns of csv imports that aren't numbers
+var importTextColumns = map[string]bool{"name": true, "description": true, "status": true}
+
+type dbApartmentImportService struct {
+	Db *gorm.DB
+
+	// Creates the apartments, so watchers and subscribers are told
+	// about them as usual
+	Apartments *dbApartmentService
+}
+
+func (is *dbApartmentImportService) Import(input rentals.ApartmentImportInput) (*rentals.ApartmentImportOutput, error) {
+	if input.Mode == "" {
+		input.Mode = rentals.ImportAllOrNothing
+	}
+
+	if input.Mode != rentals.ImportAllOrNothing && input.Mode != rentals.ImportBestEffort {
+		return nil, fmt.Errorf("unknown mode %s", input.Mode)
+	}
+
+	switch input.ActorRole {
+	case "admin":
+	case "realtor":
+		if input.RealtorId != 0 && input.RealtorId != input.ActorId {
+			return nil, rentals.ForbiddenError
+		}
+		input.RealtorId = input.ActorId
+	default:
+		return nil, rentals.ForbiddenError
+	}
+
+	rows, err := parseImport(input.Format, input.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the file has no rows")
+	}
+
+	imp := rentals.ApartmentImport{
+		ActorID:   input.ActorId,
+		ActorRole: input.ActorRole,
+		RequestID: input.RequestId,
+		Format:    input.Format,
+		Mode:      input.Mode,
+		DryRun:    input.DryRun,
+		RealtorID: input.RealtorId,
+		Status:    rentals.ImportPending,
+		Total:     len(rows),
+	}
+
+	// Left for RunPending, which needs the file
+	if len(rows) > rentals.ImportBackgroundThreshold && !input.Wait {
+		imp.Data = input.Data
+		if err := is.Db.Create(&imp).Error; err != nil {
+			return nil, fmt.Errorf("[dbApartmentImportService.Import] error creating import %v", err)
+		}
+
+		imp.Data = nil
+		return &rentals.ApartmentImportOutput{ApartmentImport: imp}, nil
+	}
+
+	imp.Status = rentals.ImportRunning
+	if err := is.Db.Create(&imp).Error; err != nil {
+		return nil, fmt.Errorf("[dbApartmentImportService.Import] error creating import %v", err)
+	}
+
+	if err := is.run(&imp, rows); err != nil {
+		return nil, err
+	}
+
+	return &rentals.ApartmentImportOutput{ApartmentImport: imp}, nil
+}
+
+func (is *dbApartmentImportService) Read(input rentals.ApartmentImportReadInput) (*rentals.ApartmentImportOutput, error) {
+	intId, err := strconv.Atoi(input.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var imp rentals.ApartmentImport
+	if err := is.Db.First(&imp, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	if input.ActorRole != "admin" && imp.ActorID != input.ActorId {
+		return nil, rentals.ForbiddenError
+	}
+
+	imp.Data = nil
+	return &rentals.ApartmentImportOutput{ApartmentImport: imp}, nil
+}
+
+// Runs the imports left in the background, oldest first. Imports
+// claimed by another server are skipped.
+func (is *dbApartmentImportService) RunPending() (int, error) {
+	var imports []rentals.ApartmentImport
+	if err := is.Db.Where("status = ?", rentals.ImportPending).Order("id").Find(&imports).Error; err != nil {
+		return 0, fmt.Errorf("[dbApartmentImportService.RunPending] error loading imports %v", err)
+	}
+
+	ran := 0
+	for _, imp := range imports {
+		imp := imp
+		claim := is.Db.Model(&rentals.ApartmentImport{}).
+			Where("id = ? AND status = ?", imp.ID, rentals.ImportPending).
+			UpdateColumn("status", rentals.ImportRunning)
+		if claim.Error != nil {
+			return ran, fmt.Errorf("[dbApartmentImportService.RunPending] error claiming import %d %v", imp.ID, claim.Error)
+		}
+
+		if claim.RowsAffected == 0 {
+			continue
+		}
+
+		rows, err := parseImport(imp.Format, imp.Data)
+		if err != nil {
+			imp.Errors = []rentals.ImportRowError{{Error: err.Error()}}
+			if err := is.finish(&imp, rentals.ImportFailed); err != nil {
+				return ran, err
+			}
+			continue
+		}
+
+		if err := is.run(&imp, rows); err != nil {
+			return ran, err
+		}
+		ran++
+	}
+
+	return ran, nil
+}
+
+// Validates rows and, unless it's a dry run, creates the apartments
+// as the mode of imp says
+func (is *dbApartmentImportService) run(imp *rentals.ApartmentImport, rows []importRow) error {
+	realtors := make(map[uint]error)
+	for i := range rows {
+		if rows[i].err == nil {
+			rows[i].err = is.validate(imp, &rows[i].apartment, realtors)
+		}
+	}
+
+	var valid []*importRow
+	for i := range rows {
+		if rows[i].err != nil {
+			imp.Failed++
+			imp.Errors = append(imp.Errors, rentals.ImportRowError{Row: rows[i].row, Error: rows[i].err.Error()})
+			continue
+		}
+		valid = append(valid, &rows[i])
+	}
+
+	switch {
+	case imp.DryRun:
+		imp.Processed = imp.Total
+		imp.Created = len(valid)
+	case imp.Mode == rentals.ImportAllOrNothing && imp.Failed > 0:
+		imp.Processed = imp.Total
+	case imp.Mode == rentals.ImportAllOrNothing:
+		if err := is.createAll(imp, valid); err != nil {
+			return err
+		}
+	default:
+		imp.Processed = imp.Failed
+		for i, row := range valid {
+			err := is.create(imp, []*importRow{row})
+			if err != nil {
+				imp.Failed++
+				imp.Errors = append(imp.Errors, rentals.ImportRowError{Row: row.row, Error: err.Error()})
+			} else {
+				imp.Created++
+			}
+
+			imp.Processed++
+			if (i+1)%importProgressInterval == 0 {
+				is.progress(imp)
+			}
+		}
+	}
+
+	status := rentals.ImportSucceeded
+	if imp.Mode == rentals.ImportAllOrNothing && imp.Failed > 0 {
+		status = rentals.ImportFailed
+	}
+
+	return is.finish(imp, status)
+}
+
+// Creates every row in a single transaction. A row that can't be
+// created fails them all.
+func (is *dbApartmentImportService) createAll(imp *rentals.ApartmentImport, rows []*importRow) error {
+	err := is.create(imp, rows)
+	if err != nil {
+		imp.Failed = len(rows)
+		imp.Errors = append(imp.Errors, rentals.ImportRowError{Error: err.Error()})
+	} else {
+		imp.Created = len(rows)
+	}
+
+	imp.Processed = imp.Total
+	return nil
+}
+
+// Creates the apartments of rows in a transaction, and tells watchers
+// and subscribers about them once committed
+func (is *dbApartmentImportService) create(imp *rentals.ApartmentImport, rows []*importRow) error {
+	tx := is.Db.Begin()
+	for i, row := range rows {
+		if err := createApartment(tx, &row.apartment, imp.ActorID, imp.RequestID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("row %d: %v", row.row, err)
+		}
+
+		if len(rows) > 1 && (i+1)%importProgressInterval == 0 {
+			imp.Processed = i + 1
+			is.progress(imp)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		is.Apartments.created(row.apartment)
+	}
+
+	return nil
+}
+
+// Checks a row can be created. Whether realtors are active is looked
+// up once per import.
+func (is *dbApartmentImportService) validate(imp *rentals.ApartmentImport, apartment *rentals.Apartment,
+	realtors map[uint]error) error {
+	if apartment.RealtorId == 0 {
+		apartment.RealtorId = imp.RealtorID
+	}
+
+	switch {
+	case apartment.RealtorId == 0:
+		return fmt.Errorf("realtorId is required")
+	case imp.ActorRole == "realtor" && apartment.RealtorId != imp.ActorID:
+		return fmt.Errorf("realtors can only import their own apartments")
+	}
+
+	err, ok := realtors[apartment.RealtorId]
+	if !ok {
+		_, err = getActiveRealtor(strconv.Itoa(int(apartment.RealtorId)), is.Db)
+		realtors[apartment.RealtorId] = err
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := prepareApartment(apartment); err != nil {
+		return err
+	}
+
+	if err := apartment.Validate(); err != nil {
+		return fmt.Errorf("%s", strings.Replace(strings.TrimSpace(err.Error()), "\n", "; ", -1))
+	}
+
+	return nil
+}
+
+// Stores how far the import got, so it can be polled. Errors are
+// only logged, the import goes on.
+func (is *dbApartmentImportService) progress(imp *rentals.ApartmentImport) {
+	err := is.Db.Model(&rentals.ApartmentImport{}).Where("id = ?", imp.ID).UpdateColumns(map[string]interface{}{
+		"processed": imp.Processed,
+		"created":   imp.Created,
+		"failed":    imp.Failed,
+	}).Error
+	if err != nil {
+		log.Printf("[ERROR] updating progress of import %d: %v", imp.ID, err)
+	}
+}
+
+func (is *dbApartmentImportService) finish(imp *rentals.ApartmentImport, status string) error {
+	now := time.Now()
+	imp.Status = status
+	imp.FinishedAt = &now
+	imp.Data = nil
+	if imp.Errors == nil {
+		imp.Errors = make([]rentals.ImportRowError, 0)
+	}
+
+	if err := is.Db.Save(imp).Error; err != nil {
+		return fmt.Errorf("[dbApartmentImportService] error finishing import %d %v", imp.ID, err)
+	}
+
+	return nil
+}
+
+// Row of an imported file, with the apartment in it or why it
+// couldn't be read
+type importRow struct {
+	row       int
+	apartment rentals.Apartment
+	err       error
+}
+
+func parseImport(format string, data []byte) ([]importRow, error) {
+	switch format {
+	case rentals.ImportCsv:
+		return parseCsvImport(data)
+	case rentals.ImportNdjson:
+		return parseNdjsonImport(data), nil
+	}
+
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+// Reads a csv file with a header of the json names of the fields.
+// Empty values are left unset.
+func parseCsvImport(data []byte) ([]importRow, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv header %v", err)
+	}
+
+	known := map[string]bool{"realtorId": true, "available": true}
+	for column := range importTextColumns {
+		known[column] = true
+	}
+	for _, column := range []string{"floorAreaMeters", "pricePerMonthUSD", "roomCount", "latitude", "longitude"} {
+		known[column] = true
+	}
+
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		if !known[header[i]] {
+			return nil, fmt.Errorf("unknown column %s", header[i])
+		}
+	}
+
+	var rows []importRow
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		row := importRow{row: n}
+		if err != nil {
+			row.err = err
+		} else {
+			row.err = csvApartment(header, record, &row.apartment)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func csvApartment(header, record []string, apartment *rentals.Apartment) error {
+	data := make(map[string]interface{})
+	for i, column := range header {
+		value := strings.TrimSpace(record[i])
+		if value == "" {
+			continue
+		}
+
+		switch {
+		case importTextColumns[column]:
+			data[column] = value
+		case column == "available":
+			available, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid available %s", value)
+			}
+			apartment.Available = available
+		default:
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %s", column, value)
+			}
+			data[column] = number
+		}
+	}
+
+	if v, ok := data["status"]; ok {
+		apartment.Status = v.(string)
+	}
+
+	if v, ok := data["realtorId"]; ok {
+		apartment.RealtorId = uint(v.(float64))
+	}
+
+	return updateFields(apartment, data)
+}
+
+// Reads one apartment, as json, per line. Blank lines are skipped
+// but still counted.
+func parseNdjsonImport(data []byte) []importRow {
+	var rows []importRow
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		row := importRow{row: n + 1}
+		if err := json.Unmarshal(line, &row.apartment); err != nil {
+			row.err = fmt.Errorf("invalid json %v", err)
+		}
+
+		// Only new apartments can be imported
+		row.apartment.DeletedAt = nil
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func NewDbApartmentImportService(db *gorm.DB, apartments *dbApartmentService) *dbApartmentImportService {
+	return &dbApartmentImportService{Db: db, Apartments: apartments}
+}
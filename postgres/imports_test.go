@@ -0,0 +1,119 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+)
+
+const importCsv = `name,description,pricePerMonthUSD,floorAreaMeters,roomCount,latitude,longitude,status
+Loft,Near the park,1200,80,2,21.2,34.3,published
+Studio,,900,35,1,21.2,34.3,
+Nowhere,Bad price,-1,40,1,21.2,34.3,draft
+`
+
+func TestParseImport(t *testing.T) {
+	t.Run("Csv rows are read by header", func(t *testing.T) {
+		// Act
+		rows, err := parseImport(rentals.ImportCsv, []byte(importCsv))
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, len(rows) == 3, fmt.Sprintf("Expected 3 rows, got %d", len(rows)))
+		tst.True(t, rows[0].err == nil && rows[0].apartment.Name == "Loft" &&
+			rows[0].apartment.PricePerMonthUsd == 1200 && rows[0].apartment.Status == rentals.ApartmentPublished,
+			fmt.Sprintf("Unexpected first row %+v", rows[0]))
+		tst.True(t, rows[2].row == 3, fmt.Sprintf("Expected rows numbered from 1, got %d", rows[2].row))
+	})
+
+	t.Run("Unknown csv column, fail", func(t *testing.T) {
+		_, err := parseImport(rentals.ImportCsv, []byte("name,floors\nLoft,3\n"))
+
+		tst.True(t, err != nil, "Expected an error")
+	})
+
+	t.Run("Invalid ndjson lines are row errors", func(t *testing.T) {
+		// Act
+		rows, err := parseImport(rentals.ImportNdjson, []byte("{\"name\":\"Loft\"}\n\n{oops\n"))
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, len(rows) == 2, fmt.Sprintf("Expected 2 rows, got %d", len(rows)))
+		tst.True(t, rows[0].err == nil && rows[0].apartment.Name == "Loft", "Expected the first row to be read")
+		tst.True(t, rows[1].err != nil && rows[1].row == 3, fmt.Sprintf("Unexpected last row %+v", rows[1]))
+	})
+}
+
+func TestApartmentImports(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	createRealtor(t, db)
+	importService := NewDbApartmentImportService(db, NewDbApartmentService(db))
+	input := rentals.ApartmentImportInput{
+		Format:    rentals.ImportCsv,
+		Data:      []byte(importCsv),
+		ActorId:   1,
+		ActorRole: "realtor",
+	}
+
+	count := func() int {
+		var n int
+		tst.Ok(t, db.Model(&rentals.Apartment{}).Count(&n).Error)
+		return n
+	}
+
+	t.Run("Dry runs create nothing", func(t *testing.T) {
+		// Act
+		dryRun := input
+		dryRun.DryRun = true
+		out, err := importService.Import(dryRun)
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, out.Created == 2 && out.Failed == 1, fmt.Sprintf("Unexpected report %+v", out.ApartmentImport))
+		tst.True(t, len(out.Errors) == 1 && out.Errors[0].Row == 3, fmt.Sprintf("Unexpected errors %+v", out.Errors))
+		tst.True(t, count() == 0, "Expected no apartments")
+	})
+
+	t.Run("All or nothing imports with a wrong row, fail", func(t *testing.T) {
+		// Act
+		out, err := importService.Import(input)
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, out.Status == rentals.ImportFailed, fmt.Sprintf("Expected failed, got %s", out.Status))
+		tst.True(t, count() == 0, "Expected no apartments")
+	})
+
+	t.Run("Best effort imports create the valid rows", func(t *testing.T) {
+		// Act
+		bestEffort := input
+		bestEffort.Mode = rentals.ImportBestEffort
+		out, err := importService.Import(bestEffort)
+		tst.Ok(t, err)
+
+		read, err := importService.Read(rentals.ApartmentImportReadInput{
+			Id: fmt.Sprint(uint(out.ID)), ActorId: 1, ActorRole: "realtor"})
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, out.Status == rentals.ImportSucceeded, fmt.Sprintf("Expected succeeded, got %s", out.Status))
+		tst.True(t, read.Created == 2 && read.Processed == 3 && len(read.Errors) == 1,
+			fmt.Sprintf("Unexpected report %+v", read.ApartmentImport))
+		tst.True(t, count() == 2, fmt.Sprintf("Expected 2 apartments, got %d", count()))
+	})
+
+	t.Run("Realtors importing for others, fail", func(t *testing.T) {
+		other := input
+		other.RealtorId = 2
+		_, err := importService.Import(other)
+
+		tst.True(t, err == rentals.ForbiddenError, fmt.Sprintf("Expected ForbiddenError, got %v", err))
+	})
+}
@@ -0,0 +1,382 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"rentals"
+	"strconv"
+	"time"
+)
+
+type dbLeaseService struct {
+	Db *gorm.DB
+
+	// Optional. Where apartments rented or freed by leases are
+	// published.
+	Events rentals.EventPublisher
+}
+
+func (ls *dbLeaseService) Create(input rentals.LeaseCreateInput) (*rentals.LeaseCreateOutput, error) {
+	start, end, err := parseLeaseDates(input.StartDate, input.EndDate)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.MonthlyRentUsd <= 0 {
+		return nil, fmt.Errorf("monthly rent must be greater than 0")
+	}
+
+	tenant, err := getUser(strconv.Itoa(int(input.TenantId)), ls.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if tenant.Role != "client" || tenant.Status != rentals.UserActive {
+		return nil, fmt.Errorf("tenant must be an active client")
+	}
+
+	tx := ls.Db.Begin()
+	var apartment rentals.Apartment
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&apartment, input.ApartmentId).Error; err != nil {
+		tx.Rollback()
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	if !canManage(apartment.RealtorId, input.ActorId, input.ActorRole) {
+		tx.Rollback()
+		return nil, rentals.ForbiddenError
+	}
+
+	var active int
+	tx.Model(&rentals.Lease{}).Where("apartment_id = ? AND status = ?", apartment.ID, rentals.LeaseActive).Count(&active)
+	if active > 0 {
+		tx.Rollback()
+		return nil, rentals.ApartmentNotAvailableError
+	}
+
+	// The apartment may already be rented if an application was accepted
+	before := apartment
+	if apartment.Status != rentals.ApartmentRented {
+		if err := changeStatus(tx, &apartment, rentals.ApartmentRented, input.ActorId, input.RequestId); err != nil {
+			tx.Rollback()
+			if err == rentals.InvalidTransitionError {
+				return nil, rentals.ApartmentNotAvailableError
+			}
+			return nil, err
+		}
+	}
+
+	lease := rentals.Lease{
+		ApartmentID:    uint(apartment.ID),
+		TenantID:       uint(tenant.ID),
+		RealtorID:      apartment.RealtorId,
+		StartDate:      start,
+		EndDate:        end,
+		MonthlyRentUsd: input.MonthlyRentUsd,
+		DepositUsd:     input.DepositUsd,
+		Status:         rentals.LeaseActive,
+	}
+	if err := tx.Create(&lease).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbLeaseService.Create] error creating lease %v", err)
+	}
+
+	event := rentals.ApartmentUpdated{Before: before, After: apartment, ActorId: input.ActorId}
+	if apartment.Status != before.Status {
+		if err := outboxEvent(tx, event); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	if apartment.Status != before.Status {
+		publish(ls.Events, event)
+	}
+	return &rentals.LeaseCreateOutput{Lease: lease}, nil
+}
+
+func (ls *dbLeaseService) Read(input rentals.LeaseReadInput) (*rentals.LeaseReadOutput, error) {
+	lease, err := getLease(input.Id, ls.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canSeeLease(lease, input.ActorId, input.ActorRole) {
+		return nil, rentals.NotFoundError
+	}
+
+	return &rentals.LeaseReadOutput{Lease: *lease}, nil
+}
+
+func (ls *dbLeaseService) Find(input rentals.LeaseFindInput) (*rentals.LeaseFindOutput, error) {
+	tx := ls.Db.New()
+
+	switch input.ActorRole {
+	case "admin":
+	case "realtor":
+		tx = tx.Where("realtor_id = ?", input.ActorId)
+	default:
+		tx = tx.Where("tenant_id = ?", input.ActorId)
+	}
+
+	if input.Status != "" {
+		tx = tx.Where("status = ?", input.Status)
+	}
+
+	order := "start_date DESC"
+	if input.ExpiringInDays > 0 {
+		today := leaseDay(time.Now())
+		tx = tx.Where("status = ? AND end_date >= ? AND end_date < ?",
+			rentals.LeaseActive, today, today.AddDate(0, 0, input.ExpiringInDays)).
+			Where("NOT EXISTS (SELECT 1 FROM leases renewals WHERE renewals.previous_lease_id = leases.id)")
+		order = "end_date"
+	}
+
+	leases := make([]rentals.Lease, 0)
+	if err := tx.Order(order).Find(&leases).Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.LeaseFindOutput{Leases: leases}, nil
+}
+
+// Renewing creates an upcoming lease starting when the renewed one
+// ends. The renewed lease stays active until then, when EndExpired
+// hands the apartment over to the renewal.
+func (ls *dbLeaseService) Renew(input rentals.LeaseRenewInput) (*rentals.LeaseRenewOutput, error) {
+	tx := ls.Db.Begin()
+
+	previous, err := getLease(input.Id, tx.Set("gorm:query_option", "FOR UPDATE"))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if !canManage(previous.RealtorID, input.ActorId, input.ActorRole) {
+		tx.Rollback()
+		return nil, rentals.ForbiddenError
+	}
+
+	if previous.Status != rentals.LeaseActive {
+		tx.Rollback()
+		return nil, fmt.Errorf("only active leases can be renewed")
+	}
+
+	var renewals int
+	if err := tx.Model(&rentals.Lease{}).Where("previous_lease_id = ?", previous.ID).Count(&renewals).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if renewals > 0 {
+		tx.Rollback()
+		return nil, fmt.Errorf("lease was already renewed")
+	}
+
+	_, end, err := parseLeaseDates(previous.EndDate.Format("2006-01-02"), input.EndDate)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	previousId := uint(previous.ID)
+	lease := rentals.Lease{
+		ApartmentID:     previous.ApartmentID,
+		TenantID:        previous.TenantID,
+		RealtorID:       previous.RealtorID,
+		StartDate:       previous.EndDate,
+		EndDate:         end,
+		MonthlyRentUsd:  previous.MonthlyRentUsd,
+		DepositUsd:      previous.DepositUsd,
+		Status:          rentals.LeaseUpcoming,
+		PreviousLeaseID: &previousId,
+	}
+
+	if input.MonthlyRentUsd > 0 {
+		lease.MonthlyRentUsd = input.MonthlyRentUsd
+	}
+
+	if input.DepositUsd > 0 {
+		lease.DepositUsd = input.DepositUsd
+	}
+
+	if err := tx.Create(&lease).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbLeaseService.Renew] error creating lease %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.LeaseRenewOutput{Lease: lease}, nil
+}
+
+// Leases that can't be ended are logged and left for the next run,
+// so they don't hold back the others
+func (ls *dbLeaseService) EndExpired(now time.Time) (int, error) {
+	var expired []rentals.Lease
+	err := ls.Db.Where("status = ? AND end_date < ?", rentals.LeaseActive, leaseDay(now)).Find(&expired).Error
+	if err != nil {
+		return 0, err
+	}
+
+	ended, failed := 0, 0
+	for _, lease := range expired {
+		if err := ls.end(lease); err != nil {
+			log.Printf("[ERROR] ending lease %d: %v", lease.ID, err)
+			failed++
+			continue
+		}
+		ended++
+	}
+
+	if failed > 0 {
+		return ended, fmt.Errorf("[dbLeaseService.EndExpired] %d leases couldn't be ended", failed)
+	}
+
+	return ended, nil
+}
+
+// Ends a lease and publishes its apartment again, if it's still rented.
+// Leases of trashed apartments are ended too, and so are the ones of
+// purged apartments, which have nothing left to publish. Renewed
+// leases make their renewal active instead, and the apartment stays
+// rented.
+func (ls *dbLeaseService) end(lease rentals.Lease) error {
+	tx := ls.Db.Begin()
+
+	var renewal rentals.Lease
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("previous_lease_id = ? AND status = ?", lease.ID, rentals.LeaseUpcoming).First(&renewal).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return err
+	}
+	renewed := err == nil
+
+	status := rentals.LeaseEnded
+	if renewed {
+		status = rentals.LeaseRenewed
+	}
+
+	res := tx.Model(&lease).Where("status = ?", rentals.LeaseActive).UpdateColumn("status", status)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+
+	// Someone else ended it already
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	if renewed {
+		if err := tx.Model(&renewal).UpdateColumn("status", rentals.LeaseActive).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit().Error
+	}
+
+	var apartment rentals.Apartment
+	err = tx.Unscoped().Set("gorm:query_option", "FOR UPDATE").First(&apartment, lease.ApartmentID).Error
+	if err == gorm.ErrRecordNotFound {
+		return tx.Commit().Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if apartment.Status != rentals.ApartmentRented {
+		return tx.Commit().Error
+	}
+
+	before := apartment
+	// Made by the system, so no actor
+	if err := changeStatus(tx, &apartment, rentals.ApartmentPublished, 0, ""); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Trashed apartments are announced as published when restored
+	event := rentals.ApartmentUpdated{Before: before, After: apartment}
+	if apartment.DeletedAt == nil {
+		if err := outboxEvent(tx, event); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	if apartment.DeletedAt == nil {
+		publish(ls.Events, event)
+	}
+	return nil
+}
+
+// Realtors manage their own apartments and leases, admins all of them
+func canManage(realtorId, actorId uint, actorRole string) bool {
+	return actorRole == "admin" || (actorRole == "realtor" && realtorId == actorId)
+}
+
+func canSeeLease(lease *rentals.Lease, actorId uint, actorRole string) bool {
+	return canManage(lease.RealtorID, actorId, actorRole) || lease.TenantID == actorId
+}
+
+// Day of t, as lease dates are stored
+func leaseDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func parseLeaseDates(startDate, endDate string) (time.Time, time.Time, error) {
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return start, start, fmt.Errorf("invalid start date %s", startDate)
+	}
+
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return start, end, fmt.Errorf("invalid end date %s", endDate)
+	}
+
+	if !end.After(start) {
+		return start, end, fmt.Errorf("end date must be after start date")
+	}
+
+	return start, end, nil
+}
+
+func getLease(id string, db *gorm.DB) (*rentals.Lease, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var lease rentals.Lease
+	if err = db.First(&lease, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+func NewDbLeaseService(db *gorm.DB) *dbLeaseService {
+	return &dbLeaseService{Db: db}
+}
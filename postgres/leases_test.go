@@ -0,0 +1,227 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/events"
+	"rentals/tst"
+	"testing"
+	"time"
+)
+
+func TestLeaseLifecycle(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	aptService := NewDbApartmentService(db)
+	leaseService := NewDbLeaseService(db)
+	recorder := &events.Recorder{}
+	leaseService.Events = recorder
+
+	createRealtor(t, db)
+	tenant, err := usrService.Create(rentals.UserCreateInput{Username: "tenant", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+	apt, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1, 1, 1))
+	tst.Ok(t, err)
+
+	today := time.Now()
+	lease, err := leaseService.Create(rentals.LeaseCreateInput{
+		ApartmentId:    uint(apt.ID),
+		TenantId:       uint(tenant.ID),
+		StartDate:      today.AddDate(-1, 0, 0).Format("2006-01-02"),
+		EndDate:        today.AddDate(0, 0, 10).Format("2006-01-02"),
+		MonthlyRentUsd: 1000,
+		ActorId:        1,
+		ActorRole:      "realtor",
+	})
+	tst.Ok(t, err)
+
+	t.Run("Creating a lease rents the apartment", func(t *testing.T) {
+		res, err := aptService.Read(rentals.ApartmentReadInput{Id: fmt.Sprint(apt.ID)})
+		tst.Ok(t, err)
+		tst.True(t, res.Status == rentals.ApartmentRented, fmt.Sprintf("Expected rented, got %s", res.Status))
+
+		updated := recorder.Named(rentals.EventApartmentUpdated)
+		tst.True(t, len(updated) == 1 && updated[0].(rentals.ApartmentUpdated).After.Status == rentals.ApartmentRented,
+			fmt.Sprintf("Expected the rented apartment to be published, got %v", updated))
+
+		audit, err := NewDbAuditService(db).Entries(rentals.AuditListInput{
+			Entity: rentals.AuditApartment, EntityId: fmt.Sprint(apt.ID), Action: rentals.AuditTransition})
+		tst.Ok(t, err)
+		tst.True(t, len(audit.Entries) == 1 && audit.Entries[0].ActorID == 1,
+			fmt.Sprintf("Expected the realtor in the audit trail, got %+v", audit.Entries))
+	})
+
+	t.Run("List expiring leases", func(t *testing.T) {
+		for _, elt := range []struct {
+			days  int
+			count int
+		}{{5, 0}, {15, 1}} {
+			res, err := leaseService.Find(rentals.LeaseFindInput{ActorRole: "admin", ExpiringInDays: elt.days})
+			tst.Ok(t, err)
+			tst.True(t, len(res.Leases) == elt.count,
+				fmt.Sprintf("Expected %d leases in %d days, got %d", elt.count, elt.days, len(res.Leases)))
+		}
+	})
+
+	t.Run("Leases last their whole end date", func(t *testing.T) {
+		// Act
+		ended, err := leaseService.EndExpired(today.AddDate(0, 0, 10))
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, ended == 0, fmt.Sprintf("Expected no lease ended on its end date, got %d", ended))
+
+		res, err := leaseService.Find(rentals.LeaseFindInput{ActorRole: "admin", ExpiringInDays: 11})
+		tst.Ok(t, err)
+		tst.True(t, len(res.Leases) == 1, fmt.Sprintf("Expected the lease to be expiring, got %d", len(res.Leases)))
+	})
+
+	t.Run("Ended lease frees the apartment", func(t *testing.T) {
+		// Act
+		ended, err := leaseService.EndExpired(today.AddDate(0, 0, 11))
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, ended == 1, fmt.Sprintf("Expected 1 lease ended, got %d", ended))
+
+		res, err := leaseService.Read(rentals.LeaseReadInput{Id: fmt.Sprint(lease.ID), ActorRole: "admin"})
+		tst.Ok(t, err)
+		tst.True(t, res.Status == rentals.LeaseEnded, fmt.Sprintf("Expected ended, got %s", res.Status))
+
+		apartment, err := aptService.Read(rentals.ApartmentReadInput{Id: fmt.Sprint(apt.ID)})
+		tst.Ok(t, err)
+		tst.True(t, apartment.Available, "Expected apartment to be available")
+
+		updated := recorder.Named(rentals.EventApartmentUpdated)
+		tst.True(t, len(updated) == 2 && updated[1].(rentals.ApartmentUpdated).After.Available,
+			fmt.Sprintf("Expected the freed apartment to be published, got %v", updated))
+	})
+
+	t.Run("Leases of trashed apartments end too", func(t *testing.T) {
+		// Arrange
+		trashed, err := aptService.Create(newApartmentPayload("trashed", "trashed", 1, 1, 1, 1))
+		tst.Ok(t, err)
+		expired, err := leaseService.Create(rentals.LeaseCreateInput{
+			ApartmentId:    uint(trashed.ID),
+			TenantId:       uint(tenant.ID),
+			StartDate:      today.AddDate(-1, 0, 0).Format("2006-01-02"),
+			EndDate:        today.AddDate(0, 0, -1).Format("2006-01-02"),
+			MonthlyRentUsd: 1000,
+			ActorId:        1,
+			ActorRole:      "realtor",
+		})
+		tst.Ok(t, err)
+		_, err = aptService.Delete(rentals.ApartmentDeleteInput{Id: fmt.Sprint(trashed.ID)})
+		tst.Ok(t, err)
+		recorder.Reset()
+
+		// Act
+		ended, err := leaseService.EndExpired(today)
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, ended == 1, fmt.Sprintf("Expected 1 lease ended, got %d", ended))
+
+		res, err := leaseService.Read(rentals.LeaseReadInput{Id: fmt.Sprint(expired.ID), ActorRole: "admin"})
+		tst.Ok(t, err)
+		tst.True(t, res.Status == rentals.LeaseEnded, fmt.Sprintf("Expected ended, got %s", res.Status))
+		tst.True(t, len(recorder.Events()) == 0,
+			fmt.Sprintf("Expected the trashed apartment not to be published, got %v", recorder.Events()))
+
+		restored, err := aptService.Restore(rentals.ApartmentRestoreInput{
+			Id:        fmt.Sprint(trashed.ID),
+			ActorId:   1,
+			ActorRole: "realtor",
+		})
+		tst.Ok(t, err)
+		tst.True(t, restored.Status == rentals.ApartmentPublished,
+			fmt.Sprintf("Expected the restored apartment to be published, got %s", restored.Status))
+	})
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	aptService := NewDbApartmentService(db)
+	leaseService := NewDbLeaseService(db)
+	recorder := &events.Recorder{}
+	leaseService.Events = recorder
+
+	createRealtor(t, db)
+	tenant, err := usrService.Create(rentals.UserCreateInput{Username: "tenant", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+	apt, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1, 1, 1))
+	tst.Ok(t, err)
+
+	today := time.Now()
+	previous, err := leaseService.Create(rentals.LeaseCreateInput{
+		ApartmentId:    uint(apt.ID),
+		TenantId:       uint(tenant.ID),
+		StartDate:      today.AddDate(-1, 0, 0).Format("2006-01-02"),
+		EndDate:        today.AddDate(0, 0, 10).Format("2006-01-02"),
+		MonthlyRentUsd: 1000,
+		ActorId:        1,
+		ActorRole:      "realtor",
+	})
+	tst.Ok(t, err)
+
+	renewInput := rentals.LeaseRenewInput{
+		Id:        fmt.Sprint(previous.ID),
+		EndDate:   today.AddDate(1, 0, 10).Format("2006-01-02"),
+		ActorId:   1,
+		ActorRole: "realtor",
+	}
+	renewal, err := leaseService.Renew(renewInput)
+	tst.Ok(t, err)
+	recorder.Reset()
+
+	t.Run("Renewed leases stay active until they end", func(t *testing.T) {
+		res, err := leaseService.Read(rentals.LeaseReadInput{Id: fmt.Sprint(previous.ID), ActorRole: "admin"})
+		tst.Ok(t, err)
+		tst.True(t, res.Status == rentals.LeaseActive, fmt.Sprintf("Expected active, got %s", res.Status))
+		tst.True(t, renewal.Status == rentals.LeaseUpcoming, fmt.Sprintf("Expected upcoming, got %s", renewal.Status))
+
+		expiring, err := leaseService.Find(rentals.LeaseFindInput{ActorRole: "admin", ExpiringInDays: 15})
+		tst.Ok(t, err)
+		tst.True(t, len(expiring.Leases) == 0, fmt.Sprintf("Expected no expiring leases, got %v", expiring.Leases))
+	})
+
+	t.Run("Leases are only renewed once", func(t *testing.T) {
+		_, err := leaseService.Renew(renewInput)
+		tst.True(t, err != nil, "Expected the second renewal to fail")
+	})
+
+	t.Run("Ending a renewed lease hands the apartment over", func(t *testing.T) {
+		// Act
+		ended, err := leaseService.EndExpired(today.AddDate(0, 0, 11))
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, ended == 1, fmt.Sprintf("Expected 1 lease ended, got %d", ended))
+
+		res, err := leaseService.Read(rentals.LeaseReadInput{Id: fmt.Sprint(previous.ID), ActorRole: "admin"})
+		tst.Ok(t, err)
+		tst.True(t, res.Status == rentals.LeaseRenewed, fmt.Sprintf("Expected renewed, got %s", res.Status))
+
+		res, err = leaseService.Read(rentals.LeaseReadInput{Id: fmt.Sprint(renewal.ID), ActorRole: "admin"})
+		tst.Ok(t, err)
+		tst.True(t, res.Status == rentals.LeaseActive, fmt.Sprintf("Expected active, got %s", res.Status))
+
+		apartment, err := aptService.Read(rentals.ApartmentReadInput{Id: fmt.Sprint(apt.ID), ActorRole: "admin"})
+		tst.Ok(t, err)
+		tst.True(t, apartment.Status == rentals.ApartmentRented, fmt.Sprintf("Expected rented, got %s", apartment.Status))
+		tst.True(t, len(recorder.Events()) == 0, fmt.Sprintf("Expected no events, got %v", recorder.Events()))
+	})
+}
@@ -0,0 +1,280 @@
+package postgres
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"io"
+	"io/ioutil"
+	"log"
+	"rentals"
+	"rentals/imaging"
+	"rentals/storage"
+	"strconv"
+)
+
+type dbMediaService struct {
+	Db      *gorm.DB
+	Storage storage.Storage
+}
+
+func (ms *dbMediaService) Upload(input rentals.MediaUploadInput) (*rentals.MediaUploadOutput, error) {
+	if input.Kind == "" {
+		input.Kind = rentals.MediaPhoto
+	}
+
+	if input.Kind != rentals.MediaPhoto && input.Kind != rentals.MediaFloorPlan {
+		return nil, fmt.Errorf("unknown media kind %s", input.Kind)
+	}
+
+	apartment, err := getApartment(input.ApartmentId, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(input.File, rentals.MaxMediaSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > rentals.MaxMediaSize {
+		return nil, rentals.MediaTooLargeError
+	}
+
+	img, err := imaging.Process(data, rentals.ThumbnailSizes)
+	if err != nil {
+		return nil, rentals.UnsupportedMediaError
+	}
+
+	key := fmt.Sprintf("apartments/%d/%s", apartment.ID, randomKey())
+	if err := ms.Storage.Put(key+"/original", img.ContentType, img.Data); err != nil {
+		return nil, fmt.Errorf("[dbMediaService.Upload] error storing file %v", err)
+	}
+
+	for name, thumbnail := range img.Thumbnails {
+		if err := ms.Storage.Put(key+"/"+name, img.ContentType, thumbnail); err != nil {
+			ms.deleteFiles(key)
+			return nil, fmt.Errorf("[dbMediaService.Upload] error storing thumbnail %v", err)
+		}
+	}
+
+	var count int
+	ms.Db.Model(&rentals.ApartmentMedia{}).Where("apartment_id = ?", apartment.ID).Count(&count)
+
+	media := rentals.ApartmentMedia{
+		ApartmentID: uint(apartment.ID),
+		Kind:        input.Kind,
+		ContentType: img.ContentType,
+		StorageKey:  key,
+		Size:        len(img.Data),
+		Width:       img.Width,
+		Height:      img.Height,
+		Caption:     input.Caption,
+		Position:    count,
+	}
+
+	if err := ms.Db.Create(&media).Error; err != nil {
+		ms.deleteFiles(key)
+		return nil, fmt.Errorf("[dbMediaService.Upload] error creating media %v", err)
+	}
+
+	return &rentals.MediaUploadOutput{ApartmentMedia: media}, nil
+}
+
+func (ms *dbMediaService) List(input rentals.MediaListInput) (*rentals.MediaListOutput, error) {
+	media, err := listMedia(input.ApartmentId, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.MediaListOutput{Media: media}, nil
+}
+
+func (ms *dbMediaService) Open(input rentals.MediaOpenInput) (*rentals.MediaOpenOutput, error) {
+	media, err := getMedia(input.ApartmentId, input.Id, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "original"
+	if input.Size != "" {
+		if _, ok := rentals.ThumbnailSizes[input.Size]; !ok {
+			return nil, fmt.Errorf("unknown size %s", input.Size)
+		}
+		name = input.Size
+	}
+
+	file, err := ms.Storage.Get(media.StorageKey + "/" + name)
+	if err == storage.NotFoundError {
+		return nil, rentals.NotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.MediaOpenOutput{ContentType: media.ContentType, File: file}, nil
+}
+
+func (ms *dbMediaService) Update(input rentals.MediaUpdateInput) (*rentals.MediaUpdateOutput, error) {
+	media, err := getMedia(input.ApartmentId, input.Id, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := ms.Db.Begin()
+	if input.Caption != nil {
+		media.Caption = *input.Caption
+		if err := tx.Model(media).UpdateColumn("caption", media.Caption).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if input.Position != nil {
+		if err := moveMedia(tx, media, *input.Position); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.MediaUpdateOutput{ApartmentMedia: *media}, nil
+}
+
+func (ms *dbMediaService) Delete(input rentals.MediaDeleteInput) (*rentals.MediaDeleteOutput, error) {
+	media, err := getMedia(input.ApartmentId, input.Id, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := ms.Db.Begin()
+	if err := tx.Delete(media).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Close the gap left in the ordering
+	err = tx.Model(&rentals.ApartmentMedia{}).
+		Where("apartment_id = ? AND position > ?", media.ApartmentID, media.Position).
+		UpdateColumn("position", gorm.Expr("position - 1")).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	ms.deleteFiles(media.StorageKey)
+	return &rentals.MediaDeleteOutput{Message: "success"}, nil
+}
+
+func (ms *dbMediaService) DeleteAll(apartmentId string) error {
+	media, err := listMedia(apartmentId, ms.Db)
+	if err != nil {
+		return err
+	}
+
+	if err := ms.Db.Where("apartment_id = ?", apartmentId).Delete(rentals.ApartmentMedia{}).Error; err != nil {
+		return err
+	}
+
+	for _, m := range media {
+		ms.deleteFiles(m.StorageKey)
+	}
+
+	return nil
+}
+
+// Removes the original file and thumbnails under key. Errors are
+// only logged, as the rows referencing them are already gone.
+func (ms *dbMediaService) deleteFiles(key string) {
+	names := []string{"original"}
+	for name := range rentals.ThumbnailSizes {
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		if err := ms.Storage.Delete(key + "/" + name); err != nil {
+			log.Printf("[ERROR] deleting %s/%s: %v", key, name, err)
+		}
+	}
+}
+
+// Moves media to position, shifting the media in between
+func moveMedia(tx *gorm.DB, media *rentals.ApartmentMedia, position int) error {
+	var count int
+	if err := tx.Model(&rentals.ApartmentMedia{}).Where("apartment_id = ?", media.ApartmentID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+
+	if position < 0 || position >= count {
+		return fmt.Errorf("position must be in the range [0, %d]", count-1)
+	}
+
+	siblings := tx.Model(&rentals.ApartmentMedia{}).Where("apartment_id = ?", media.ApartmentID)
+	var err error
+	if position < media.Position {
+		err = siblings.Where("position >= ? AND position < ?", position, media.Position).
+			UpdateColumn("position", gorm.Expr("position + 1")).Error
+	} else if position > media.Position {
+		err = siblings.Where("position > ? AND position <= ?", media.Position, position).
+			UpdateColumn("position", gorm.Expr("position - 1")).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	media.Position = position
+	return tx.Model(media).UpdateColumn("position", position).Error
+}
+
+func listMedia(apartmentId string, db *gorm.DB) ([]rentals.ApartmentMedia, error) {
+	intId, err := strconv.Atoi(apartmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	media := make([]rentals.ApartmentMedia, 0)
+	if err := db.Where("apartment_id = ?", intId).Order("position").Find(&media).Error; err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+func getMedia(apartmentId, id string, db *gorm.DB) (*rentals.ApartmentMedia, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var media rentals.ApartmentMedia
+	if err = db.Where("apartment_id = ?", apartmentId).First(&media, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &media, nil
+}
+
+// Random hex string used to build storage keys
+func randomKey() string {
+	ret := make([]byte, 16)
+	if _, err := rand.Read(ret); err != nil {
+		panic(err)
+	}
+
+	return fmt.Sprintf("%x", ret)
+}
+
+func NewDbMediaService(db *gorm.DB, storage storage.Storage) *dbMediaService {
+	return &dbMediaService{Db: db, Storage: storage}
+}
@@ -0,0 +1,441 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"net/url"
+	"rentals"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxMessageLength      = 5000
+	maxMessageAttachments = 10
+)
+
+type dbMessageService struct {
+	Db       *gorm.DB
+	Notifier rentals.Notifier
+}
+
+// Clients start threads with the realtor of a published apartment.
+// Writing again about the same apartment continues the existing
+// thread, as long as the apartment isn't archived.
+func (ms *dbMessageService) CreateThread(input rentals.ThreadCreateInput) (*rentals.ThreadCreateOutput, error) {
+	apartment, err := getApartment(strconv.Itoa(int(input.ApartmentId)), ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if apartment.Status == rentals.ApartmentArchived {
+		return nil, rentals.ApartmentNotAvailableError
+	}
+
+	if err := validateMessage(input.Body, input.Attachments, uint(apartment.ID), ms.Db); err != nil {
+		return nil, err
+	}
+
+	tx := ms.Db.Begin()
+	thread := rentals.Thread{ApartmentID: uint(apartment.ID), ClientID: input.ClientId}
+	err = tx.Where(thread).First(&thread).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		if apartment.Status != rentals.ApartmentPublished {
+			tx.Rollback()
+			return nil, rentals.ApartmentNotAvailableError
+		}
+
+		thread.RealtorID = apartment.RealtorId
+		thread.LastMessageAt = time.Now()
+		if err := tx.Create(&thread).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("[dbMessageService.CreateThread] error creating thread %v", err)
+		}
+	case err != nil:
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbMessageService.CreateThread] error loading thread %v", err)
+	}
+
+	message, err := addMessage(tx, &thread, input.ClientId, input.Body, input.Attachments)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	ms.notifyMessage(&thread, message, apartment.Name)
+	return &rentals.ThreadCreateOutput{Thread: thread, Message: *message}, nil
+}
+
+// Lists the threads of the actor by latest message. Admins moderate
+// all the threads and can filter them by apartment or participant.
+func (ms *dbMessageService) Threads(input rentals.ThreadListInput) (*rentals.ThreadListOutput, error) {
+	tx := ms.Db.New()
+	if input.ActorRole == "admin" {
+		if input.ApartmentId != "" {
+			tx = tx.Where("apartment_id = ?", input.ApartmentId)
+		}
+		if input.UserId != "" {
+			tx = tx.Where("client_id = ? OR realtor_id = ?", input.UserId, input.UserId)
+		}
+	} else {
+		tx = tx.Where("client_id = ? OR realtor_id = ?", input.ActorId, input.ActorId)
+	}
+
+	tx, limit, err := paginate(tx, "last_message_at", true, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := make([]rentals.Thread, 0)
+	if err := tx.Find(&threads).Error; err != nil {
+		return nil, err
+	}
+
+	output := &rentals.ThreadListOutput{Threads: threads}
+	if len(threads) > limit {
+		output.Threads = threads[:limit]
+		last := output.Threads[limit-1]
+		output.NextCursor = encodeCursor(last.LastMessageAt.Format(time.RFC3339Nano), uint(last.ID))
+	}
+
+	if err := ms.countUnread(output.Threads, input.ActorId); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (ms *dbMessageService) Thread(input rentals.ThreadReadInput) (*rentals.ThreadReadOutput, error) {
+	thread, err := ms.readableThread(input.Id, input.ActorId, input.ActorRole)
+	if err != nil {
+		return nil, err
+	}
+
+	threads := []rentals.Thread{*thread}
+	if err := ms.countUnread(threads, input.ActorId); err != nil {
+		return nil, err
+	}
+
+	return &rentals.ThreadReadOutput{Thread: threads[0]}, nil
+}
+
+// Lists the messages of a thread, newest first. Hidden messages
+// keep their place but only admins see what they said.
+func (ms *dbMessageService) Messages(input rentals.MessageListInput) (*rentals.MessageListOutput, error) {
+	thread, err := ms.readableThread(input.ThreadId, input.ActorId, input.ActorRole)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, limit, err := paginate(ms.Db.Preload("Attachments").Where("thread_id = ?", thread.ID),
+		"id", true, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]rentals.Message, 0)
+	if err := tx.Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	output := &rentals.MessageListOutput{Messages: messages}
+	if len(messages) > limit {
+		output.Messages = messages[:limit]
+		last := output.Messages[limit-1]
+		output.NextCursor = encodeCursor("", uint(last.ID))
+	}
+
+	if input.ActorRole != "admin" {
+		for i := range output.Messages {
+			redactHidden(&output.Messages[i])
+		}
+	}
+
+	return output, nil
+}
+
+// Only the participants of a thread can write to it
+func (ms *dbMessageService) Send(input rentals.MessageSendInput) (*rentals.MessageSendOutput, error) {
+	thread, err := getThread(input.ThreadId, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isParticipant(thread, input.ActorId) {
+		return nil, rentals.ForbiddenError
+	}
+
+	if err := validateMessage(input.Body, input.Attachments, thread.ApartmentID, ms.Db); err != nil {
+		return nil, err
+	}
+
+	tx := ms.Db.Begin()
+	message, err := addMessage(tx, thread, input.ActorId, input.Body, input.Attachments)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	var apartmentName string
+	if apartment, err := getApartment(strconv.Itoa(int(thread.ApartmentID)), ms.Db); err == nil {
+		apartmentName = apartment.Name
+	}
+
+	ms.notifyMessage(thread, message, apartmentName)
+	return &rentals.MessageSendOutput{Message: *message}, nil
+}
+
+// Marks the messages received by the actor as read. Admins reading
+// a thread to moderate it don't mark anything.
+func (ms *dbMessageService) MarkRead(input rentals.ThreadReadInput) (*rentals.ThreadReadOutput, error) {
+	thread, err := ms.readableThread(input.Id, input.ActorId, input.ActorRole)
+	if err != nil {
+		return nil, err
+	}
+
+	if isParticipant(thread, input.ActorId) {
+		err := ms.Db.Model(&rentals.Message{}).
+			Where("thread_id = ? AND sender_id <> ? AND read_at IS NULL", thread.ID, input.ActorId).
+			UpdateColumn("read_at", time.Now()).Error
+		if err != nil {
+			return nil, fmt.Errorf("[dbMessageService.MarkRead] error updating messages %v", err)
+		}
+	}
+
+	return &rentals.ThreadReadOutput{Thread: *thread}, nil
+}
+
+func (ms *dbMessageService) Hide(input rentals.MessageHideInput) (*rentals.MessageHideOutput, error) {
+	if input.ActorRole != "admin" {
+		return nil, rentals.ForbiddenError
+	}
+
+	thread, err := getThread(input.ThreadId, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	intId, err := strconv.Atoi(input.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var message rentals.Message
+	if err := ms.Db.Preload("Attachments").Where("thread_id = ?", thread.ID).First(&message, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	if message.HiddenAt == nil {
+		now := time.Now()
+		message.HiddenAt = &now
+		message.HiddenBy = input.ActorId
+		err := ms.Db.Model(&message).
+			UpdateColumns(map[string]interface{}{"hidden_at": message.HiddenAt, "hidden_by": message.HiddenBy}).Error
+		if err != nil {
+			return nil, fmt.Errorf("[dbMessageService.Hide] error updating message %v", err)
+		}
+	}
+
+	return &rentals.MessageHideOutput{Message: message}, nil
+}
+
+// Returns a thread the actor takes part in or moderates
+func (ms *dbMessageService) readableThread(id string, actorId uint, actorRole string) (*rentals.Thread, error) {
+	thread, err := getThread(id, ms.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if actorRole != "admin" && !isParticipant(thread, actorId) {
+		return nil, rentals.ForbiddenError
+	}
+
+	return thread, nil
+}
+
+// Sets the number of messages each thread has for the actor that
+// they haven't read. Threads the actor isn't part of have none.
+func (ms *dbMessageService) countUnread(threads []rentals.Thread, actorId uint) error {
+	if len(threads) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(threads))
+	for i, thread := range threads {
+		ids[i] = uint(thread.ID)
+	}
+
+	rows, err := ms.Db.Model(&rentals.Message{}).
+		Select("thread_id, count(*)").
+		Where("thread_id IN (?) AND sender_id <> ? AND read_at IS NULL", ids, actorId).
+		Group("thread_id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	counts := make(map[uint]int)
+	for rows.Next() {
+		var threadId uint
+		var count int
+		if err := rows.Scan(&threadId, &count); err != nil {
+			return err
+		}
+		counts[threadId] = count
+	}
+
+	for i := range threads {
+		if isParticipant(&threads[i], actorId) {
+			threads[i].UnreadCount = counts[uint(threads[i].ID)]
+		}
+	}
+
+	return rows.Err()
+}
+
+func (ms *dbMessageService) notifyMessage(thread *rentals.Thread, message *rentals.Message, apartmentName string) {
+	recipient := thread.RealtorID
+	if message.SenderID == thread.RealtorID {
+		recipient = thread.ClientID
+	}
+
+	ms.notify(rentals.Notification{
+		UserID: recipient,
+		Event:  rentals.EventMessageReceived,
+		Title:  fmt.Sprintf("New message about %s", apartmentName),
+		Body:   message.Body,
+	})
+}
+
+func (ms *dbMessageService) notify(n rentals.Notification) {
+	if ms.Notifier == nil {
+		return
+	}
+
+	if err := ms.Notifier.Notify(n); err != nil {
+		log.Printf("[ERROR] notifying user %d of %s: %v", n.UserID, n.Event, err)
+	}
+}
+
+// Stores a message and moves the thread to the top of the listings
+func addMessage(tx *gorm.DB, thread *rentals.Thread, senderId uint, body string,
+	attachments []rentals.MessageAttachment) (*rentals.Message, error) {
+	message := rentals.Message{
+		ThreadID:    uint(thread.ID),
+		SenderID:    senderId,
+		Body:        strings.TrimSpace(body),
+		Attachments: attachments,
+	}
+	if err := tx.Create(&message).Error; err != nil {
+		return nil, fmt.Errorf("[dbMessageService] error creating message %v", err)
+	}
+
+	thread.LastMessageAt = message.CreatedAt
+	if err := tx.Model(thread).UpdateColumn("last_message_at", thread.LastMessageAt).Error; err != nil {
+		return nil, fmt.Errorf("[dbMessageService] error updating thread %v", err)
+	}
+
+	if message.Attachments == nil {
+		message.Attachments = make([]rentals.MessageAttachment, 0)
+	}
+
+	return &message, nil
+}
+
+// Messages need a body or attachments. Attachments reference either
+// a media of the apartment the thread is about or an external url.
+func validateMessage(body string, attachments []rentals.MessageAttachment, apartmentId uint, db *gorm.DB) error {
+	if strings.TrimSpace(body) == "" && len(attachments) == 0 {
+		return fmt.Errorf("message is empty")
+	}
+
+	if len(body) > maxMessageLength {
+		return fmt.Errorf("message is longer than %d characters", maxMessageLength)
+	}
+
+	if len(attachments) > maxMessageAttachments {
+		return fmt.Errorf("messages can't have more than %d attachments", maxMessageAttachments)
+	}
+
+	for _, attachment := range attachments {
+		switch {
+		case attachment.MediaID != nil && attachment.URL != "":
+			return fmt.Errorf("attachments reference either a media or an url")
+		case attachment.MediaID != nil:
+			var count int
+			err := db.Model(&rentals.ApartmentMedia{}).
+				Where("id = ? AND apartment_id = ?", *attachment.MediaID, apartmentId).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return fmt.Errorf("media %d doesn't belong to the apartment", *attachment.MediaID)
+			}
+		case attachment.URL != "":
+			u, err := url.Parse(attachment.URL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fmt.Errorf("invalid attachment url %s", attachment.URL)
+			}
+		default:
+			return fmt.Errorf("attachments need a mediaId or an url")
+		}
+	}
+
+	return nil
+}
+
+// Hidden messages keep their metadata only
+func redactHidden(message *rentals.Message) {
+	if message.HiddenAt == nil {
+		return
+	}
+
+	message.Body = ""
+	message.Attachments = make([]rentals.MessageAttachment, 0)
+}
+
+func isParticipant(thread *rentals.Thread, userId uint) bool {
+	return thread.ClientID == userId || thread.RealtorID == userId
+}
+
+func getThread(id string, db *gorm.DB) (*rentals.Thread, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var thread rentals.Thread
+	if err = db.First(&thread, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &thread, nil
+}
+
+// Hands the threads about the given apartments to the realtor they
+// were reassigned to
+func reassignThreads(tx *gorm.DB, apartmentIds []uint, realtorId uint) error {
+	return tx.Model(&rentals.Thread{}).Where("apartment_id IN (?)", apartmentIds).
+		UpdateColumn("realtor_id", realtorId).Error
+}
+
+func NewDbMessageService(db *gorm.DB, notifier rentals.Notifier) *dbMessageService {
+	return &dbMessageService{Db: db, Notifier: notifier}
+}
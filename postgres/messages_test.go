@@ -0,0 +1,152 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+)
+
+func TestMessageThreads(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	notifier := &recordingNotifier{}
+	msgService := NewDbMessageService(db, notifier)
+	aptService := NewDbApartmentService(db)
+
+	createRealtor(t, db)
+	apt, err := aptService.Create(newApartmentPayload("apt", "apt", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+
+	// Act
+	created, err := msgService.CreateThread(rentals.ThreadCreateInput{
+		ApartmentId: uint(apt.ID),
+		ClientId:    2,
+		Body:        "Is it still available?",
+	})
+	tst.Ok(t, err)
+	threadId := fmt.Sprint(created.Thread.ID)
+
+	// True
+	tst.True(t, created.Thread.RealtorID == 1, "Expected the realtor of the apartment to join the thread")
+	tst.True(t, len(notifier.notifications) == 1 && notifier.notifications[0].UserID == 1,
+		"Expected the realtor to be notified")
+
+	t.Run("Writing about the same apartment continues the thread", func(t *testing.T) {
+		again, err := msgService.CreateThread(rentals.ThreadCreateInput{
+			ApartmentId: uint(apt.ID),
+			ClientId:    2,
+			Body:        "Can I visit on Monday?",
+		})
+		tst.Ok(t, err)
+		tst.True(t, again.Thread.ID == created.Thread.ID, "Expected the existing thread")
+	})
+
+	t.Run("Only participants can read the thread", func(t *testing.T) {
+		_, err := msgService.Messages(rentals.MessageListInput{ThreadId: threadId, ActorId: 3, ActorRole: "client"})
+		tst.True(t, err == rentals.ForbiddenError, fmt.Sprintf("Expected forbidden, got %v", err))
+
+		_, err = msgService.Send(rentals.MessageSendInput{ThreadId: threadId, ActorId: 3, Body: "Hi"})
+		tst.True(t, err == rentals.ForbiddenError, fmt.Sprintf("Expected forbidden, got %v", err))
+	})
+
+	t.Run("Reading the thread sends read receipts", func(t *testing.T) {
+		res, err := msgService.Threads(rentals.ThreadListInput{ActorId: 1, ActorRole: "realtor"})
+		tst.Ok(t, err)
+		tst.True(t, len(res.Threads) == 1, fmt.Sprintf("Expected 1 thread, got %d", len(res.Threads)))
+		tst.True(t, res.Threads[0].UnreadCount == 2,
+			fmt.Sprintf("Expected 2 unread messages, got %d", res.Threads[0].UnreadCount))
+
+		_, err = msgService.MarkRead(rentals.ThreadReadInput{Id: threadId, ActorId: 1, ActorRole: "realtor"})
+		tst.Ok(t, err)
+
+		messages, err := msgService.Messages(rentals.MessageListInput{ThreadId: threadId, ActorId: 2, ActorRole: "client"})
+		tst.Ok(t, err)
+		for _, message := range messages.Messages {
+			tst.True(t, message.ReadAt != nil, fmt.Sprintf("Expected message %d to be read", message.ID))
+		}
+	})
+
+	t.Run("Messages are paginated newest first", func(t *testing.T) {
+		_, err := msgService.Send(rentals.MessageSendInput{ThreadId: threadId, ActorId: 1, Body: "Sure"})
+		tst.Ok(t, err)
+
+		first, err := msgService.Messages(rentals.MessageListInput{ThreadId: threadId, ActorId: 2, Limit: 2})
+		tst.Ok(t, err)
+		tst.True(t, len(first.Messages) == 2 && first.Messages[0].Body == "Sure", "Expected the newest message first")
+		tst.True(t, first.NextCursor != "", "Expected a next cursor")
+
+		rest, err := msgService.Messages(rentals.MessageListInput{ThreadId: threadId, ActorId: 2, Cursor: first.NextCursor})
+		tst.Ok(t, err)
+		tst.True(t, len(rest.Messages) == 1, fmt.Sprintf("Expected 1 message, got %d", len(rest.Messages)))
+	})
+
+	t.Run("Attachments must belong to the apartment", func(t *testing.T) {
+		mediaId := uint(42)
+		_, err := msgService.Send(rentals.MessageSendInput{
+			ThreadId:    threadId,
+			ActorId:     2,
+			Attachments: []rentals.MessageAttachment{{MediaID: &mediaId}},
+		})
+		tst.True(t, err != nil, "Expected an error for a media of another apartment")
+
+		sent, err := msgService.Send(rentals.MessageSendInput{
+			ThreadId:    threadId,
+			ActorId:     2,
+			Attachments: []rentals.MessageAttachment{{URL: "https://example.com/payslip.pdf", Name: "payslip"}},
+		})
+		tst.Ok(t, err)
+		tst.True(t, len(sent.Attachments) == 1, "Expected the attachment")
+	})
+
+	t.Run("Admins hide messages from participants", func(t *testing.T) {
+		messages, err := msgService.Messages(rentals.MessageListInput{ThreadId: threadId, ActorId: 9, ActorRole: "admin"})
+		tst.Ok(t, err)
+		id := fmt.Sprint(messages.Messages[0].ID)
+
+		_, err = msgService.Hide(rentals.MessageHideInput{ThreadId: threadId, Id: id, ActorId: 1, ActorRole: "realtor"})
+		tst.True(t, err == rentals.ForbiddenError, fmt.Sprintf("Expected forbidden, got %v", err))
+
+		_, err = msgService.Hide(rentals.MessageHideInput{ThreadId: threadId, Id: id, ActorId: 9, ActorRole: "admin"})
+		tst.Ok(t, err)
+
+		messages, err = msgService.Messages(rentals.MessageListInput{ThreadId: threadId, ActorId: 1, ActorRole: "realtor"})
+		tst.Ok(t, err)
+		hidden := messages.Messages[0]
+		tst.True(t, hidden.HiddenAt != nil && len(hidden.Attachments) == 0, "Expected the message to be hidden")
+	})
+
+	t.Run("Only published apartments get threads", func(t *testing.T) {
+		payload := newApartmentPayload("draft", "draft", 1, 1000, 1, 1)
+		payload.Status = rentals.ApartmentDraft
+		draft, err := aptService.Create(payload)
+		tst.Ok(t, err)
+
+		_, err = msgService.CreateThread(rentals.ThreadCreateInput{ApartmentId: uint(draft.ID), ClientId: 2, Body: "Hi"})
+		tst.True(t, err == rentals.ApartmentNotAvailableError,
+			fmt.Sprintf("Expected ApartmentNotAvailableError, got %v", err))
+	})
+
+	t.Run("Threads follow reassigned apartments", func(t *testing.T) {
+		// Arrange
+		other, err := NewDbUserService(db).Create(rentals.UserCreateInput{
+			Username: "other", Password: "pass", Role: "realtor"})
+		tst.Ok(t, err)
+
+		// Act
+		_, err = aptService.Reassign(rentals.ApartmentReassignInput{
+			FromRealtorId: "1", ToRealtorId: fmt.Sprint(other.ID), Ids: []uint{uint(apt.ID)}})
+		tst.Ok(t, err)
+
+		// True
+		var thread rentals.Thread
+		tst.Ok(t, db.First(&thread, created.Thread.ID).Error)
+		tst.True(t, thread.RealtorID == uint(other.ID),
+			fmt.Sprintf("Expected realtor %d in the thread, got %d", other.ID, thread.RealtorID))
+	})
+}
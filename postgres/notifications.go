@@ -0,0 +1,208 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"net/url"
+	"rentals"
+	"strconv"
+	"time"
+)
+
+type dbNotificationService struct {
+	Db *gorm.DB
+
+	// Channels notifications are delivered through besides the inbox
+	Channels []rentals.NotificationChannel
+}
+
+// Stores the notification in the inbox of the user and delivers it
+// through the other channels the user enabled for the event.
+// Deliveries run in the background.
+func (ns *dbNotificationService) Notify(n rentals.Notification) error {
+	user, err := getUser(strconv.Itoa(int(n.UserID)), ns.Db)
+	if err != nil {
+		return err
+	}
+
+	if user.Status != rentals.UserActive {
+		return nil
+	}
+
+	preference, err := ns.preference(n.UserID, n.Event)
+	if err != nil {
+		return err
+	}
+
+	if preference.InApp {
+		inbox := rentals.InboxNotification{UserID: n.UserID, Event: n.Event, Title: n.Title, Body: n.Body}
+		if err := ns.Db.Create(&inbox).Error; err != nil {
+			return fmt.Errorf("[dbNotificationService.Notify] error storing notification %v", err)
+		}
+	}
+
+	for _, channel := range ns.Channels {
+		if !preference.Enabled(channel.Name()) {
+			continue
+		}
+
+		go func(channel rentals.NotificationChannel) {
+			if err := channel.Deliver(*user, n); err != nil {
+				log.Printf("[ERROR] delivering %s to user %d by %s: %v", n.Event, n.UserID, channel.Name(), err)
+			}
+		}(channel)
+	}
+
+	return nil
+}
+
+func (ns *dbNotificationService) Inbox(input rentals.NotificationInboxInput) (*rentals.NotificationInboxOutput, error) {
+	tx := ns.Db.New().Where("user_id = ?", input.UserId)
+	if input.UnreadOnly {
+		tx = tx.Where("read_at IS NULL")
+	}
+
+	// Newest first
+	tx, limit, err := paginate(tx, "id", true, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []rentals.InboxNotification
+	if err := tx.Find(&notifications).Error; err != nil {
+		return nil, err
+	}
+
+	output := &rentals.NotificationInboxOutput{Notifications: notifications}
+	if len(notifications) > limit {
+		output.Notifications = notifications[:limit]
+		last := output.Notifications[limit-1]
+		output.NextCursor = encodeCursor("", uint(last.ID))
+	}
+
+	if output.UnreadCount, err = ns.unreadCount(input.UserId); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (ns *dbNotificationService) MarkRead(input rentals.NotificationReadInput) (*rentals.NotificationReadOutput, error) {
+	if !input.All && len(input.Ids) == 0 {
+		return nil, fmt.Errorf("ids or all are required")
+	}
+
+	tx := ns.Db.Model(&rentals.InboxNotification{}).Where("user_id = ? AND read_at IS NULL", input.UserId)
+	if !input.All {
+		tx = tx.Where("id IN (?)", input.Ids)
+	}
+
+	if err := tx.UpdateColumn("read_at", time.Now()).Error; err != nil {
+		return nil, fmt.Errorf("[dbNotificationService.MarkRead] error updating %v", err)
+	}
+
+	unread, err := ns.unreadCount(input.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.NotificationReadOutput{UnreadCount: unread}, nil
+}
+
+func (ns *dbNotificationService) Preferences(input rentals.NotificationPreferencesInput) (*rentals.NotificationPreferencesOutput, error) {
+	user, err := getUser(strconv.Itoa(int(input.UserId)), ns.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []rentals.NotificationPreference
+	if err := ns.Db.Where("user_id = ?", input.UserId).Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	byEvent := make(map[string]rentals.NotificationPreference)
+	for _, p := range stored {
+		byEvent[p.Event] = p
+	}
+
+	output := &rentals.NotificationPreferencesOutput{WebhookUrl: user.NotificationWebhookUrl}
+	for _, event := range rentals.NotificationEvents {
+		p, ok := byEvent[event]
+		if !ok {
+			p = rentals.DefaultNotificationPreference
+			p.Event = event
+		}
+		output.Events = append(output.Events, p)
+	}
+
+	return output, nil
+}
+
+func (ns *dbNotificationService) UpdatePreferences(input rentals.NotificationPreferencesUpdateInput) (*rentals.NotificationPreferencesOutput, error) {
+	for _, p := range input.Events {
+		if !validEvent(p.Event) {
+			return nil, fmt.Errorf("unknown event %s", p.Event)
+		}
+	}
+
+	if input.WebhookUrl != nil && *input.WebhookUrl != "" {
+		u, err := url.Parse(*input.WebhookUrl)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook url %s", *input.WebhookUrl)
+		}
+	}
+
+	tx := ns.Db.Begin()
+	if input.WebhookUrl != nil {
+		err := tx.Model(&rentals.User{}).Where("id = ?", input.UserId).
+			UpdateColumn("notification_webhook_url", *input.WebhookUrl).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("[dbNotificationService.UpdatePreferences] error updating webhook %v", err)
+		}
+	}
+
+	for _, p := range input.Events {
+		preference := rentals.NotificationPreference{UserID: input.UserId, Event: p.Event}
+		err := tx.Where(preference).
+			Assign(map[string]interface{}{"in_app": p.InApp, "email": p.Email, "webhook": p.Webhook}).
+			FirstOrCreate(&preference).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("[dbNotificationService.UpdatePreferences] error saving preference %v", err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return ns.Preferences(rentals.NotificationPreferencesInput{UserId: input.UserId})
+}
+
+// Returns the preference of the user for the event, or the default
+func (ns *dbNotificationService) preference(userId uint, event string) (rentals.NotificationPreference, error) {
+	var preference rentals.NotificationPreference
+	err := ns.Db.Where("user_id = ? AND event = ?", userId, event).First(&preference).Error
+	if err == gorm.ErrRecordNotFound {
+		return rentals.DefaultNotificationPreference, nil
+	}
+
+	return preference, err
+}
+
+func (ns *dbNotificationService) unreadCount(userId uint) (int, error) {
+	var count int
+	err := ns.Db.Model(&rentals.InboxNotification{}).Where("user_id = ? AND read_at IS NULL", userId).
+		Count(&count).Error
+	return count, err
+}
+
+func validEvent(event string) bool {
+	return contains(rentals.NotificationEvents, event)
+}
+
+func NewDbNotificationService(db *gorm.DB, channels ...rentals.NotificationChannel) *dbNotificationService {
+	return &dbNotificationService{Db: db, Channels: channels}
+}
@@ -0,0 +1,60 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+)
+
+func TestNotificationInbox(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	service := NewDbNotificationService(db)
+	user, err := NewDbUserService(db).Create(rentals.UserCreateInput{Username: "client", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+	userId := uint(user.ID)
+
+	for i := 0; i < 3; i++ {
+		tst.Ok(t, service.Notify(rentals.Notification{
+			UserID: userId,
+			Event:  rentals.EventFavoritePriceChanged,
+			Title:  fmt.Sprintf("Price drop %d", i),
+		}))
+	}
+
+	t.Run("Inbox is paginated newest first", func(t *testing.T) {
+		res, err := service.Inbox(rentals.NotificationInboxInput{UserId: userId, Limit: 2})
+		tst.Ok(t, err)
+		tst.True(t, len(res.Notifications) == 2 && res.NextCursor != "", "Expected a page of 2 notifications")
+		tst.True(t, res.Notifications[0].Title == "Price drop 2", "Expected the newest first")
+		tst.True(t, res.UnreadCount == 3, fmt.Sprintf("Expected 3 unread, got %d", res.UnreadCount))
+	})
+
+	t.Run("Mark as read", func(t *testing.T) {
+		res, err := service.MarkRead(rentals.NotificationReadInput{UserId: userId, All: true})
+		tst.Ok(t, err)
+		tst.True(t, res.UnreadCount == 0, fmt.Sprintf("Expected 0 unread, got %d", res.UnreadCount))
+	})
+
+	t.Run("Disabled events are not stored", func(t *testing.T) {
+		_, err := service.UpdatePreferences(rentals.NotificationPreferencesUpdateInput{
+			UserId: userId,
+			Events: []rentals.NotificationPreference{{Event: rentals.EventFavoritePriceChanged}},
+		})
+		tst.Ok(t, err)
+
+		tst.Ok(t, service.Notify(rentals.Notification{UserID: userId, Event: rentals.EventFavoritePriceChanged}))
+		tst.Ok(t, service.Notify(rentals.Notification{UserID: userId, Event: rentals.EventViewingBooked}))
+
+		res, err := service.Inbox(rentals.NotificationInboxInput{UserId: userId, UnreadOnly: true})
+		tst.Ok(t, err)
+		tst.True(t, len(res.Notifications) == 1 && res.Notifications[0].Event == rentals.EventViewingBooked,
+			"Expected only the viewing notification")
+	})
+}
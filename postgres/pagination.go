@@ -0,0 +1,103 @@
+package postgres
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+var InvalidCursorError = errors.New("invalid cursor")
+
+// Position of the last element of a page. Value is the
+// value of the sorting column and Id is used to break ties.
+type cursor struct {
+	Value string `json:"v"`
+	Id    uint   `json:"id"`
+}
+
+func encodeCursor(value string, id uint) string {
+	raw, _ := json.Marshal(cursor{Value: value, Id: id})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, InvalidCursorError
+	}
+
+	var c cursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, InvalidCursorError
+	}
+
+	return &c, nil
+}
+
+// Parses a sort expression such as "-createdAt" and returns the db
+// column it refers to and whether the order is descending. columns
+// maps allowed sort fields to db columns.
+func parseSort(sort string, columns map[string]string) (string, bool, error) {
+	if sort == "" {
+		return "id", false, nil
+	}
+
+	desc := strings.HasPrefix(sort, "-")
+	column, ok := columns[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return "", false, fmt.Errorf("can't sort by %s", sort)
+	}
+
+	return column, desc, nil
+}
+
+// Applies keyset pagination to tx. Results are ordered by column and
+// then by id, starting right after the position encoded in rawCursor.
+// One extra row is requested so callers can tell if there are more pages.
+func paginate(tx *gorm.DB, column string, desc bool, rawCursor string, limit int) (*gorm.DB, int, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	op, dir := ">", "ASC"
+	if desc {
+		op, dir = "<", "DESC"
+	}
+
+	if rawCursor != "" {
+		c, err := decodeCursor(rawCursor)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if column == "id" {
+			tx = tx.Where(fmt.Sprintf("id %s ?", op), c.Id)
+		} else {
+			tx = tx.Where(fmt.Sprintf("%s %s ? OR (%s = ? AND id %s ?)", column, op, column, op),
+				c.Value, c.Value, c.Id)
+		}
+	}
+
+	if column != "id" {
+		tx = tx.Order(fmt.Sprintf("%s %s", column, dir))
+	}
+	tx = tx.Order(fmt.Sprintf("id %s", dir)).Limit(limit + 1)
+
+	return tx, limit, nil
+}
+
+// Escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
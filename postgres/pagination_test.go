@@ -0,0 +1,48 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals/tst"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	// Arrange
+	encoded := encodeCursor("2019-01-02T10:00:00Z", 42)
+
+	// Act
+	decoded, err := decodeCursor(encoded)
+	tst.Ok(t, err)
+
+	// True
+	tst.True(t, decoded.Value == "2019-01-02T10:00:00Z",
+		fmt.Sprintf("Expected 2019-01-02T10:00:00Z, got %s", decoded.Value))
+	tst.True(t, decoded.Id == 42, fmt.Sprintf("Expected 42, got %d", decoded.Id))
+
+	_, err = decodeCursor("not a cursor")
+	tst.True(t, err == InvalidCursorError, fmt.Sprintf("Expected InvalidCursorError, got %v", err))
+}
+
+func TestParseSort(t *testing.T) {
+	for _, elt := range []struct {
+		sort   string
+		column string
+		desc   bool
+		fails  bool
+	}{
+		{"", "id", false, false},
+		{"username", "username", false, false},
+		{"-createdAt", "created_at", true, false},
+		{"password", "", false, true},
+	} {
+		t.Run(elt.sort, func(t *testing.T) {
+			// Act
+			column, desc, err := parseSort(elt.sort, userSortColumns)
+
+			// True
+			tst.True(t, (err != nil) == elt.fails, fmt.Sprintf("Unexpected error %v", err))
+			tst.True(t, column == elt.column, fmt.Sprintf("Expected %s, got %s", elt.column, column))
+			tst.True(t, desc == elt.desc, fmt.Sprintf("Expected desc %v, got %v", elt.desc, desc))
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package postgres
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"rentals"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most apartments listed in a single digest
+const maxDigestItems = 10
+
+type dbSavedSearchService struct {
+	Db       *gorm.DB
+	Notifier rentals.Notifier
+}
+
+func (ss *dbSavedSearchService) Create(input rentals.SavedSearchCreateInput) (*rentals.SavedSearchCreateOutput, error) {
+	if input.Frequency == "" {
+		input.Frequency = rentals.SearchDaily
+	}
+
+	if err := validateSearch(input.Query, input.Frequency, ss.Db); err != nil {
+		return nil, err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	search := rentals.SavedSearch{
+		UserID:           input.UserId,
+		Name:             input.Name,
+		Query:            input.Query,
+		Frequency:        input.Frequency,
+		UnsubscribeToken: token,
+	}
+	if err := ss.Db.Create(&search).Error; err != nil {
+		return nil, fmt.Errorf("[dbSavedSearchService.Create] error creating search %v", err)
+	}
+
+	return &rentals.SavedSearchCreateOutput{SavedSearch: search}, nil
+}
+
+func (ss *dbSavedSearchService) List(input rentals.SavedSearchListInput) (*rentals.SavedSearchListOutput, error) {
+	searches := make([]rentals.SavedSearch, 0)
+	if err := ss.Db.Where("user_id = ?", input.UserId).Order("created_at").Find(&searches).Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.SavedSearchListOutput{Searches: searches}, nil
+}
+
+func (ss *dbSavedSearchService) Update(input rentals.SavedSearchUpdateInput) (*rentals.SavedSearchUpdateOutput, error) {
+	search, err := getSavedSearch(input.Id, input.UserId, ss.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.Name != "" {
+		search.Name = input.Name
+	}
+
+	if input.Query != "" {
+		search.Query = input.Query
+	}
+
+	if input.Frequency != "" {
+		search.Frequency = input.Frequency
+	}
+
+	if err := validateSearch(search.Query, search.Frequency, ss.Db); err != nil {
+		return nil, err
+	}
+
+	if err := ss.Db.Save(search).Error; err != nil {
+		return nil, fmt.Errorf("[dbSavedSearchService.Update] error updating search %v", err)
+	}
+
+	return &rentals.SavedSearchUpdateOutput{SavedSearch: *search}, nil
+}
+
+func (ss *dbSavedSearchService) Delete(input rentals.SavedSearchDeleteInput) (*rentals.SavedSearchDeleteOutput, error) {
+	search, err := getSavedSearch(input.Id, input.UserId, ss.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := ss.Db.Begin()
+	if err := tx.Where("search_id = ?", search.ID).Delete(rentals.SearchMatch{}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbSavedSearchService.Delete] error deleting matches %v", err)
+	}
+
+	if err := tx.Delete(search).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbSavedSearchService.Delete] error deleting search %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.SavedSearchDeleteOutput{}, nil
+}
+
+func (ss *dbSavedSearchService) Matches(input rentals.SavedSearchMatchesInput) (*rentals.SavedSearchMatchesOutput, error) {
+	search, err := getSavedSearch(input.Id, input.UserId, ss.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]rentals.SearchMatch, 0)
+	err = ss.Db.Preload("Apartment").Where("search_id = ?", search.ID).
+		Order("created_at DESC").Find(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.SavedSearchMatchesOutput{Matches: matches}, nil
+}
+
+func (ss *dbSavedSearchService) Unsubscribe(token string) (*rentals.SavedSearchUnsubscribeOutput, error) {
+	var search rentals.SavedSearch
+	if err := ss.Db.Where("unsubscribe_token = ?", token).First(&search).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	search.Frequency = rentals.SearchOff
+	if err := ss.Db.Model(&search).UpdateColumn("frequency", search.Frequency).Error; err != nil {
+		return nil, fmt.Errorf("[dbSavedSearchService.Unsubscribe] error updating search %v", err)
+	}
+
+	return &rentals.SavedSearchUnsubscribeOutput{SavedSearch: search}, nil
+}
+
+// Subscribed in the background, so saving apartments doesn't wait
+// for all the searches to be checked
+func (ss *dbSavedSearchService) ApartmentChanged(before rentals.Apartment, after *rentals.Apartment) {
+	if after == nil || after.Status != rentals.ApartmentPublished {
+		return
+	}
+
+	if _, err := ss.Match(*after); err != nil {
+		log.Printf("[ERROR] matching apartment %d against saved searches: %v", after.ID, err)
+	}
+}
+
+// Each search is checked running its query restricted to the
+// apartment, so matching uses the same filters as listing.
+func (ss *dbSavedSearchService) Match(apartment rentals.Apartment) (int, error) {
+	if apartment.Status != rentals.ApartmentPublished {
+		return 0, nil
+	}
+
+	var searches []rentals.SavedSearch
+	err := ss.Db.Where("frequency <> ? AND id NOT IN (?)", rentals.SearchOff,
+		ss.Db.Model(&rentals.SearchMatch{}).Select("search_id").Where("apartment_id = ?", apartment.ID).QueryExpr()).
+		Find(&searches).Error
+	if err != nil {
+		return 0, err
+	}
+
+	matched := 0
+	for _, search := range searches {
+		query, err := applyFilters(ss.Db.Model(&rentals.Apartment{}).Where("id = ?", apartment.ID), search.Query)
+		if err != nil {
+			log.Printf("[ERROR] invalid query in saved search %d: %v", search.ID, err)
+			continue
+		}
+
+		var count int
+		if err := query.Count(&count).Error; err != nil {
+			return matched, err
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		match := rentals.SearchMatch{SearchID: uint(search.ID), ApartmentID: uint(apartment.ID)}
+		if err := ss.Db.Create(&match).Error; err != nil {
+			return matched, fmt.Errorf("[dbSavedSearchService.Match] error creating match %v", err)
+		}
+		matched++
+	}
+
+	return matched, nil
+}
+
+func (ss *dbSavedSearchService) SendDigests(now time.Time) (int, error) {
+	var searches []rentals.SavedSearch
+	err := ss.Db.Where("frequency <> ? AND id IN (?)", rentals.SearchOff,
+		ss.Db.Model(&rentals.SearchMatch{}).Select("search_id").Where("notified_at IS NULL").QueryExpr()).
+		Find(&searches).Error
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, search := range searches {
+		period, ok := rentals.SearchFrequencies[search.Frequency]
+		if !ok || (search.LastDigestAt != nil && now.Sub(*search.LastDigestAt) < period) {
+			continue
+		}
+
+		if err := ss.sendDigest(search, now); err != nil {
+			return sent, fmt.Errorf("[dbSavedSearchService.SendDigests] error sending digest of search %d: %v",
+				search.ID, err)
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// Notifies the owner of search about its pending matches and marks
+// them as notified
+func (ss *dbSavedSearchService) sendDigest(search rentals.SavedSearch, now time.Time) error {
+	var matches []rentals.SearchMatch
+	err := ss.Db.Preload("Apartment").Where("search_id = ? AND notified_at IS NULL", search.ID).
+		Order("created_at").Find(&matches).Error
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, match := range matches {
+		// Apartments may be gone or rented by now
+		if match.Apartment == nil || match.Apartment.Status != rentals.ApartmentPublished {
+			continue
+		}
+
+		if len(lines) < maxDigestItems {
+			lines = append(lines, fmt.Sprintf("%s: $%.2f, %d rooms",
+				match.Apartment.Name, match.Apartment.PricePerMonthUsd, match.Apartment.RoomCount))
+		}
+	}
+
+	if len(lines) > 0 {
+		if more := len(matches) - len(lines); more > 0 {
+			lines = append(lines, fmt.Sprintf("and %d more", more))
+		}
+		lines = append(lines, fmt.Sprintf("Unsubscribe: /unsubscribe/%s", search.UnsubscribeToken))
+
+		ss.notify(rentals.Notification{
+			UserID: search.UserID,
+			Event:  rentals.EventSearchMatches,
+			Title:  fmt.Sprintf("New apartments match %s", search.Name),
+			Body:   strings.Join(lines, "\n"),
+		})
+	}
+
+	tx := ss.Db.Begin()
+	err = tx.Model(&rentals.SearchMatch{}).Where("search_id = ? AND notified_at IS NULL", search.ID).
+		UpdateColumn("notified_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Model(&search).UpdateColumn("last_digest_at", now).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (ss *dbSavedSearchService) notify(n rentals.Notification) {
+	if ss.Notifier == nil {
+		return
+	}
+
+	if err := ss.Notifier.Notify(n); err != nil {
+		log.Printf("[ERROR] notifying user %d of %s: %v", n.UserID, n.Event, err)
+	}
+}
+
+func validateSearch(query, frequency string, db *gorm.DB) error {
+	if _, ok := rentals.SearchFrequencies[frequency]; !ok && frequency != rentals.SearchOff {
+		return fmt.Errorf("unknown frequency %s", frequency)
+	}
+
+	_, err := applyFilters(db.New(), query)
+	return err
+}
+
+// Returns a saved search of the given user
+func getSavedSearch(id string, userId uint, db *gorm.DB) (*rentals.SavedSearch, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var search rentals.SavedSearch
+	if err = db.Where("user_id = ?", userId).First(&search, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &search, nil
+}
+
+func randomToken() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", secret), nil
+}
+
+func NewDbSavedSearchService(db *gorm.DB, notifier rentals.Notifier) *dbSavedSearchService {
+	return &dbSavedSearchService{Db: db, Notifier: notifier}
+}
@@ -0,0 +1,85 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+	"time"
+)
+
+func TestSavedSearchDigests(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	notifier := &recordingNotifier{}
+	searchService := NewDbSavedSearchService(db, notifier)
+	aptService := NewDbApartmentService(db)
+
+	createRealtor(t, db)
+	search, err := searchService.Create(rentals.SavedSearchCreateInput{
+		Name:      "near the park",
+		Query:     "minRoomCount=2&maxPricePerMonthUSD=1500&latitude=21.24&longitude=34.32&radiusKm=3",
+		Frequency: rentals.SearchDaily,
+		UserId:    2,
+	})
+	tst.Ok(t, err)
+
+	t.Run("Only matching apartments are recorded", func(t *testing.T) {
+		for _, elt := range []struct {
+			name    string
+			price   float32
+			rooms   int
+			matches int
+		}{
+			{"small", 1000, 1, 0},
+			{"expensive", 2000, 3, 0},
+			{"match", 1200, 3, 1},
+		} {
+			apt, err := aptService.Create(newApartmentPayload(elt.name, elt.name, 1, elt.price, elt.rooms, 1))
+			tst.Ok(t, err)
+
+			matched, err := searchService.Match(apt.Apartment)
+			tst.Ok(t, err)
+			tst.True(t, matched == elt.matches,
+				fmt.Sprintf("Expected %d matches for %s, got %d", elt.matches, elt.name, matched))
+
+			// Apartments match once
+			matched, err = searchService.Match(apt.Apartment)
+			tst.Ok(t, err)
+			tst.True(t, matched == 0, fmt.Sprintf("Expected no new matches for %s, got %d", elt.name, matched))
+		}
+	})
+
+	t.Run("Digests respect the frequency", func(t *testing.T) {
+		now := time.Now()
+		for _, elt := range []struct {
+			at   time.Time
+			sent int
+		}{{now, 1}, {now.Add(time.Hour), 0}} {
+			sent, err := searchService.SendDigests(elt.at)
+			tst.Ok(t, err)
+			tst.True(t, sent == elt.sent, fmt.Sprintf("Expected %d digests, got %d", elt.sent, sent))
+		}
+
+		tst.True(t, len(notifier.notifications) == 1,
+			fmt.Sprintf("Expected 1 notification, got %d", len(notifier.notifications)))
+	})
+
+	t.Run("Unsubscribed searches stop matching", func(t *testing.T) {
+		res, err := searchService.Unsubscribe(search.UnsubscribeToken)
+		tst.Ok(t, err)
+		tst.True(t, res.Frequency == rentals.SearchOff, "Expected the search to be off")
+
+		apt, err := aptService.Create(newApartmentPayload("another", "another", 1, 1200, 3, 1))
+		tst.Ok(t, err)
+
+		matched, err := searchService.Match(apt.Apartment)
+		tst.Ok(t, err)
+		tst.True(t, matched == 0, fmt.Sprintf("Expected no matches, got %d", matched))
+	})
+}
@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"rentals"
+	"strconv"
+)
+
+// Stores security events and writes them to the log as json lines
+// prefixed with [SECURITY], for log collectors to pick them up
+type dbSecurityLog struct {
+	Db *gorm.DB
+}
+
+func (sl *dbSecurityLog) Record(event rentals.SecurityEvent) {
+	if err := sl.Db.Create(&event).Error; err != nil {
+		log.Printf("[ERROR] recording security event %s: %v", event.Event, err)
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] logging security event %s: %v", event.Event, err)
+		return
+	}
+	log.Printf("[SECURITY] %s", line)
+}
+
+func (sl *dbSecurityLog) Events(input rentals.SecurityEventsInput) (*rentals.SecurityEventsOutput, error) {
+	tx := sl.Db.New()
+	if input.Event != "" {
+		if !contains(rentals.SecurityEvents, input.Event) {
+			return nil, fmt.Errorf("unknown event %s", input.Event)
+		}
+		tx = tx.Where("event = ?", input.Event)
+	}
+
+	if input.UserId != "" {
+		id, err := strconv.Atoi(input.UserId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user %s", input.UserId)
+		}
+		tx = tx.Where("user_id = ?", id)
+	}
+
+	if input.IP != "" {
+		tx = tx.Where("ip = ?", input.IP)
+	}
+
+	if input.Since != nil {
+		tx = tx.Where("created_at >= ?", *input.Since)
+	}
+
+	if input.Until != nil {
+		tx = tx.Where("created_at < ?", *input.Until)
+	}
+
+	// Newest first
+	tx, limit, err := paginate(tx, "id", true, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]rentals.SecurityEvent, 0)
+	if err := tx.Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	output := &rentals.SecurityEventsOutput{Events: events}
+	if len(events) > limit {
+		output.Events = events[:limit]
+		last := output.Events[limit-1]
+		output.NextCursor = encodeCursor("", uint(last.ID))
+	}
+
+	return output, nil
+}
+
+func NewDbSecurityLog(db *gorm.DB) *dbSecurityLog {
+	return &dbSecurityLog{Db: db}
+}
@@ -0,0 +1,61 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/auth"
+	"rentals/tst"
+	"testing"
+)
+
+func TestSecurityLog(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	securityLog := NewDbSecurityLog(db)
+	authn := auth.NewDbAuthnService(db)
+	authn.Security = securityLog
+
+	createRealtor(t, db)
+	client := auth.ClientInfo{IP: "10.0.0.1", UserAgent: "test"}
+
+	// Act
+	_, err = authn.Login("user", "wrong", client)
+	tst.True(t, err == auth.LoginError, "Expected the login to fail")
+	_, err = authn.Login("nobody", "pass", client)
+	tst.True(t, err == auth.LoginError, "Expected the login to fail")
+	_, err = authn.Login("user", "pass", client)
+	tst.Ok(t, err)
+	tst.Ok(t, authn.RevokeSessions(1, "", auth.ClientInfo{IP: "10.0.0.2", ActorId: 2}))
+
+	t.Run("Logins are recorded with the client", func(t *testing.T) {
+		failed, err := securityLog.Events(rentals.SecurityEventsInput{Event: rentals.SecurityLoginFailed})
+		tst.Ok(t, err)
+
+		tst.True(t, len(failed.Events) == 2, fmt.Sprintf("Expected 2 failed logins, got %d", len(failed.Events)))
+		tst.True(t, failed.Events[0].Username == "nobody" && failed.Events[0].UserID == 0,
+			fmt.Sprintf("Expected the unknown username first, got %+v", failed.Events[0]))
+		tst.True(t, failed.Events[1].UserID == 1 && failed.Events[1].Detail == "wrong password" &&
+			failed.Events[1].IP == "10.0.0.1" && failed.Events[1].UserAgent == "test",
+			fmt.Sprintf("Unexpected event %+v", failed.Events[1]))
+	})
+
+	t.Run("Events can be filtered by user and ip", func(t *testing.T) {
+		events, err := securityLog.Events(rentals.SecurityEventsInput{UserId: "1", IP: "10.0.0.2"})
+		tst.Ok(t, err)
+
+		tst.True(t, len(events.Events) == 1, fmt.Sprintf("Expected 1 event, got %d", len(events.Events)))
+		tst.True(t, events.Events[0].Event == rentals.SecuritySessionsRevoked && events.Events[0].ActorID == 2,
+			fmt.Sprintf("Expected the revocation by user 2, got %+v", events.Events[0]))
+	})
+
+	t.Run("Unknown events are rejected", func(t *testing.T) {
+		_, err := securityLog.Events(rentals.SecurityEventsInput{Event: "nope"})
+
+		tst.True(t, err != nil, "Expected an error")
+	})
+}
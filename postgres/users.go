@@ -7,28 +7,72 @@ import (
 	"rentals"
 	"rentals/crypto"
 	"strconv"
+	"strings"
+	"time"
 )
 
-
 type dbUserService struct {
 	Db *gorm.DB
+
+	// Optional. Where domain events are published.
+	Events rentals.EventPublisher
 }
 
 func (s *dbUserService) Create(input rentals.UserCreateInput) (*rentals.UserCreateOutput, error) {
-	user, err := createUser(input.Username, input.Password, input.Role, s.Db)
+	user, err := createUser(input, s.Db)
 	if err != nil {
 		return nil, err
 	}
+
+	publish(s.Events, rentals.UserCreated{User: *user})
 	return &rentals.UserCreateOutput{User: *user}, nil
 }
 
-func (s *dbUserService) All(rentals.UserAllInput) (*rentals.UserAllOutput, error) {
+func (s *dbUserService) All(input rentals.UserAllInput) (*rentals.UserAllOutput, error) {
+	column, desc, err := parseSort(input.Sort, userSortColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := s.Db.New()
+	if input.Role != "" {
+		tx = tx.Where("role = ?", input.Role)
+	}
+
+	if input.UsernamePrefix != "" {
+		tx = tx.Where("username LIKE ?", escapeLike(input.UsernamePrefix)+"%")
+	}
+
+	if input.Status != "" {
+		tx = tx.Where("status = ?", input.Status)
+	}
+
+	if input.CreatedAfter != nil {
+		tx = tx.Where("created_at >= ?", *input.CreatedAfter)
+	}
+
+	if input.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *input.CreatedBefore)
+	}
+
+	tx, limit, err := paginate(tx, column, desc, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
 	var users []rentals.User
-	if err := s.Db.Find(&users).Error; err != nil {
+	if err := tx.Find(&users).Error; err != nil {
 		return nil, err
 	}
 
-	return &rentals.UserAllOutput{Users: users}, nil
+	output := &rentals.UserAllOutput{Users: users}
+	if len(users) > limit {
+		output.Users = users[:limit]
+		last := output.Users[limit-1]
+		output.NextCursor = encodeCursor(userSortValue(last, column), uint(last.ID))
+	}
+
+	return output, nil
 }
 
 func (s *dbUserService) Read(input rentals.UserReadInput) (*rentals.UserReadOutput, error) {
@@ -46,6 +90,11 @@ func (s *dbUserService) Update(input rentals.UserUpdateInput) (*rentals.UserUpda
 		return nil, err
 	}
 
+	if err := checkVersion(input.Version, user.Version); err != nil {
+		return nil, err
+	}
+
+	before := *user
 	if input.Password != "" {
 		user.PasswordHash, err = crypto.EncryptPassword(input.Password)
 		if err != nil {
@@ -58,24 +107,276 @@ func (s *dbUserService) Update(input rentals.UserUpdateInput) (*rentals.UserUpda
 	}
 
 	// Save to DB
-	if err := s.Db.Save(&user).Error; err != nil {
+	entry := rentals.AuditEntry{ActorID: input.ActorId, Action: rentals.AuditUpdate, RequestID: input.RequestId}
+	if err := saveUser(s.Db, &before, user, entry); err != nil {
+		if err == rentals.VersionMismatchError {
+			return nil, err
+		}
 		return nil, fmt.Errorf("[dbUserService.Update] error updating %v", err)
 	}
 
-	return &rentals.UserUpdateOutput{User: *user}, nil
+	publish(s.Events, rentals.UserUpdated{Before: before, After: *user})
+	if user.Role != before.Role {
+		publish(s.Events, rentals.UserRoleChanged{UserId: uint(user.ID), From: before.Role, To: user.Role})
+	}
+
+	return &rentals.UserUpdateOutput{
+		User:            *user,
+		PreviousRole:    before.Role,
+		PasswordChanged: input.Password != "",
+	}, nil
 }
 
+// Users are not removed from the db, as apartments and sessions
+// reference them. They are deactivated instead.
 func (s *dbUserService) Delete(input rentals.UserDeleteInput) (*rentals.UserDeleteOutput, error) {
+	result, err := s.SetStatus(rentals.UserStatusInput{
+		Id:                input.Id,
+		Status:            rentals.UserDeactivated,
+		Reason:            input.Reason,
+		ReassignTo:        input.ReassignTo,
+		ArchiveApartments: input.ArchiveApartments,
+		Version:           input.Version,
+		ActorId:           input.ActorId,
+		RequestId:         input.RequestId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.UserDeleteOutput{SessionsRevoked: result.SessionsRevoked}, nil
+}
+
+func (s *dbUserService) SetStatus(input rentals.UserStatusInput) (*rentals.UserStatusOutput, error) {
+	if !validStatus(input.Status) {
+		return nil, fmt.Errorf("unknown status %s", input.Status)
+	}
+
 	user, err := getUser(input.Id, s.Db)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := s.Db.Delete(&user).Error; err != nil {
+	if err := checkVersion(input.Version, user.Version); err != nil {
 		return nil, err
 	}
 
-	return &rentals.UserDeleteOutput{}, nil
+	if !rentals.CanChangeStatus(user.Status, input.Status) {
+		return nil, rentals.InvalidStatusChangeError
+	}
+
+	before := *user
+	tx := s.Db.Begin()
+	if err := bumpVersion(tx, &rentals.User{}, uint(user.ID), user.Version); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	user.Version++
+
+	var released []rentals.Event
+	if user.Role == "realtor" && input.Status == rentals.UserDeactivated {
+		released, err = releaseApartments(tx, user, input)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	// Only active users can hold sessions
+	revoked := 0
+	if input.Status != rentals.UserActive {
+		res := tx.Where("user_id = ?", user.ID).Delete(rentals.UserSession{})
+		if res.Error != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("[dbUserService.SetStatus] error revoking sessions %v", res.Error)
+		}
+		revoked = int(res.RowsAffected)
+	}
+
+	now := time.Now()
+	user.Status = input.Status
+	user.StatusReason = input.Reason
+	user.StatusChangedAt = &now
+	if err := tx.Save(user).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbUserService.SetStatus] error updating %v", err)
+	}
+
+	entry := rentals.AuditEntry{ActorID: input.ActorId, Action: rentals.AuditSetStatus, RequestID: input.RequestId}
+	if err := writeUserAudit(tx, entry, &before, user); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	events := append(released, rentals.UserStatusChanged{
+		User:    *user,
+		UserId:  uint(user.ID),
+		From:    before.Status,
+		To:      user.Status,
+		Reason:  user.StatusReason,
+		ActorId: input.ActorId,
+	})
+	for _, event := range events {
+		if err := outboxEvent(tx, event); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		publish(s.Events, event)
+	}
+
+	return &rentals.UserStatusOutput{User: *user, SessionsRevoked: revoked}, nil
+}
+
+// Moves the apartments of a realtor that is going away to another
+// realtor or archives them. Fails if the realtor has apartments and
+// neither option was chosen. Returns the events to publish once tx
+// is committed.
+func releaseApartments(tx *gorm.DB, realtor *rentals.User, input rentals.UserStatusInput) ([]rentals.Event, error) {
+	var apartments []rentals.Apartment
+	err := tx.Where("realtor_id = ? AND status <> ?", realtor.ID, rentals.ApartmentArchived).
+		Find(&apartments).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apartments) == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case input.ReassignTo != "":
+		target, err := getActiveRealtor(input.ReassignTo, tx)
+		if err != nil {
+			return nil, err
+		}
+
+		if target.ID == realtor.ID {
+			return nil, fmt.Errorf("can't reassign apartments to the same realtor")
+		}
+
+		err = tx.Model(&rentals.Apartment{}).
+			Where("realtor_id = ? AND status <> ?", realtor.ID, rentals.ApartmentArchived).
+			Updates(map[string]interface{}{"realtor_id": target.ID, "version": nextVersion}).Error
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]uint, len(apartments))
+		for i, apartment := range apartments {
+			ids[i] = uint(apartment.ID)
+		}
+
+		if err := reassignThreads(tx, ids, uint(target.ID)); err != nil {
+			return nil, err
+		}
+
+		err = auditReassign(tx, ids, uint(realtor.ID), uint(target.ID), input.ActorId, input.RequestId)
+		if err != nil {
+			return nil, err
+		}
+
+		return []rentals.Event{rentals.ApartmentsReassigned{
+			ApartmentIds:  ids,
+			FromRealtorId: uint(realtor.ID),
+			ToRealtorId:   uint(target.ID),
+		}}, nil
+	case input.ArchiveApartments:
+		events := make([]rentals.Event, 0, len(apartments))
+		for _, apartment := range apartments {
+			apartment := apartment
+			before := apartment
+			err := changeStatus(tx, &apartment, rentals.ApartmentArchived, input.ActorId, input.RequestId)
+			if err != nil {
+				return nil, err
+			}
+
+			events = append(events, rentals.ApartmentUpdated{Before: before, After: apartment, ActorId: input.ActorId})
+		}
+		return events, nil
+	}
+
+	return nil, rentals.RealtorHasApartmentsError
+}
+
+func (s *dbUserService) UpdateProfile(input rentals.ProfileUpdateInput) (*rentals.ProfileUpdateOutput, error) {
+	user, err := getUser(input.Id, s.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	before := *user
+	passwordChanged := false
+	if input.NewPassword != "" {
+		if crypto.CheckPassword(user.PasswordHash, input.CurrentPassword) != nil {
+			return nil, rentals.WrongPasswordError
+		}
+
+		user.PasswordHash, err = crypto.EncryptPassword(input.NewPassword)
+		if err != nil {
+			return nil, fmt.Errorf("[dbUserService.UpdateProfile] error encrypting password %v", err)
+		}
+		passwordChanged = true
+	}
+
+	if input.Email != "" {
+		if !validEmail(input.Email) {
+			return nil, fmt.Errorf("invalid email %s", input.Email)
+		}
+		user.Email = input.Email
+	}
+
+	if input.Phone != "" {
+		user.Phone = input.Phone
+	}
+
+	// Save to DB
+	entry := rentals.AuditEntry{ActorID: uint(user.ID), Action: rentals.AuditUpdate, RequestID: input.RequestId}
+	if err := saveUser(s.Db, &before, user, entry); err != nil {
+		if err == rentals.VersionMismatchError {
+			return nil, err
+		}
+		return nil, fmt.Errorf("[dbUserService.UpdateProfile] error updating %v", err)
+	}
+
+	publish(s.Events, rentals.UserUpdated{Before: before, After: *user})
+
+	return &rentals.ProfileUpdateOutput{User: *user, PasswordChanged: passwordChanged}, nil
+}
+
+// Saves user and records the update in the audit trail, as entry
+// with the changes made since before, and in the outbox. Fails with
+// VersionMismatchError if the user changed since before was read.
+func saveUser(db *gorm.DB, before, user *rentals.User, entry rentals.AuditEntry) error {
+	tx := db.Begin()
+	if err := bumpVersion(tx, &rentals.User{}, uint(user.ID), before.Version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	user.Version = before.Version + 1
+
+	if err := tx.Save(user).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := writeUserAudit(tx, entry, before, user); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := outboxEvent(tx, rentals.UserUpdated{Before: *before, After: *user}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
 }
 
 func NewDbUserService(db *gorm.DB) *dbUserService {
@@ -100,27 +401,60 @@ func getUser(id string, db *gorm.DB) (*rentals.User, error) {
 	return &user, nil
 }
 
-func createUser(username, password, role string, db *gorm.DB) (*rentals.User, error) {
-	if !validRole(role) {
+// Returns the user with the given id, failing if it's not an active realtor
+func getActiveRealtor(id string, db *gorm.DB) (*rentals.User, error) {
+	user, err := getUser(id, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "realtor" || user.Status != rentals.UserActive {
+		return nil, fmt.Errorf("user %s is not an active realtor", id)
+	}
+
+	return user, nil
+}
+
+func createUser(input rentals.UserCreateInput, db *gorm.DB) (*rentals.User, error) {
+	if !validRole(input.Role) {
 		return nil, errors.New(
-			fmt.Sprintf("error creating user. Unknown role %s", role))
+			fmt.Sprintf("error creating user. Unknown role %s", input.Role))
 	}
 
-	pwdHash, err := crypto.EncryptPassword(password)
+	pwdHash, err := crypto.EncryptPassword(input.Password)
 	if err != nil {
 		return nil, fmt.Errorf("error encrypting password %v", err)
 	}
 
 	user := rentals.User{
-		Username:     username,
+		Username:     input.Username,
 		PasswordHash: pwdHash,
-		Role:         role,
+		Role:         input.Role,
+		Status:       rentals.UserActive,
+		Version:      1,
 	}
 
-	if err = db.Create(&user).Error; err != nil {
+	tx := db.Begin()
+	if err = tx.Create(&user).Error; err != nil {
+		tx.Rollback()
 		return nil, fmt.Errorf("error creating user %v", err)
 	}
 
+	entry := rentals.AuditEntry{ActorID: input.ActorId, Action: rentals.AuditCreate, RequestID: input.RequestId}
+	if err := writeUserAudit(tx, entry, nil, &user); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := outboxEvent(tx, rentals.UserCreated{User: user}); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
 	return &user, nil
 }
 
@@ -128,6 +462,34 @@ func validRole(role string) bool {
 	return contains([]string{"admin", "realtor", "client"}, role)
 }
 
+// Fields users can be sorted by
+var userSortColumns = map[string]string{
+	"id":        "id",
+	"username":  "username",
+	"createdAt": "created_at",
+}
+
+// Returns the value of the sorting column for the given user
+func userSortValue(user rentals.User, column string) string {
+	switch column {
+	case "username":
+		return user.Username
+	case "created_at":
+		return user.CreatedAt.Format(time.RFC3339Nano)
+	}
+
+	return strconv.Itoa(int(user.ID))
+}
+
+func validStatus(status string) bool {
+	return contains([]string{rentals.UserActive, rentals.UserSuspended, rentals.UserDeactivated}, status)
+}
+
+func validEmail(email string) bool {
+	at := strings.Index(email, "@")
+	return at > 0 && at < len(email)-1
+}
+
 func contains(a []string, b string) bool {
 	for _, elt := range a {
 		if elt == b {
@@ -0,0 +1,172 @@
+package postgres
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"rentals"
+	"rentals/auth"
+	"rentals/crypto"
+	"rentals/events"
+	"rentals/tst"
+	"strconv"
+	"testing"
+)
+
+func TestDeactivateRealtor(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	aptService := NewDbApartmentService(db)
+
+	leaving, err := usrService.Create(rentals.UserCreateInput{Username: "leaving", Password: "pass", Role: "realtor"})
+	tst.Ok(t, err)
+	staying, err := usrService.Create(rentals.UserCreateInput{Username: "staying", Password: "pass", Role: "realtor"})
+	tst.Ok(t, err)
+
+	_, err = aptService.Create(newApartmentPayload("apt", "apt", 1, 1, 1, uint(leaving.ID)))
+	tst.Ok(t, err)
+
+	leavingId := strconv.Itoa(int(leaving.ID))
+
+	t.Run("Realtor with apartments, fail", func(t *testing.T) {
+		// Act
+		_, err := usrService.Delete(rentals.UserDeleteInput{Id: leavingId})
+
+		// True
+		tst.True(t, err == rentals.RealtorHasApartmentsError,
+			fmt.Sprintf("Expected RealtorHasApartmentsError, got %v", err))
+	})
+
+	t.Run("Reassign apartments to client, fail", func(t *testing.T) {
+		client, err := usrService.Create(rentals.UserCreateInput{Username: "client", Password: "pass", Role: "client"})
+		tst.Ok(t, err)
+
+		// Act
+		_, err = usrService.Delete(rentals.UserDeleteInput{
+			Id:         leavingId,
+			ReassignTo: strconv.Itoa(int(client.ID)),
+		})
+
+		// True
+		tst.True(t, err != nil, "Expected error, got success")
+	})
+
+	t.Run("Reassign apartments, success", func(t *testing.T) {
+		// Act
+		_, err := usrService.Delete(rentals.UserDeleteInput{
+			Id:         leavingId,
+			ReassignTo: strconv.Itoa(int(staying.ID)),
+		})
+		tst.Ok(t, err)
+
+		// True
+		user, err := usrService.Read(rentals.UserReadInput{Id: leavingId})
+		tst.Ok(t, err)
+		tst.True(t, user.Status == rentals.UserDeactivated,
+			fmt.Sprintf("Expected deactivated, got %s", user.Status))
+
+		var count int
+		db.Model(&rentals.Apartment{}).Where("realtor_id = ?", staying.ID).Count(&count)
+		tst.True(t, count == 1, fmt.Sprintf("Expected 1 apartment, got %d", count))
+	})
+}
+
+func TestUserEvents(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	recorder := &events.Recorder{}
+	usrService := NewDbUserService(db)
+	usrService.Events = recorder
+
+	user, err := usrService.Create(rentals.UserCreateInput{Username: "user", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+	id := strconv.Itoa(int(user.ID))
+
+	// Act
+	_, err = usrService.Update(rentals.UserUpdateInput{Id: id, Role: "realtor"})
+	tst.Ok(t, err)
+	_, err = usrService.Update(rentals.UserUpdateInput{Id: id, Password: "other"})
+	tst.Ok(t, err)
+
+	// True
+	tst.True(t, len(recorder.Named(rentals.EventUserCreated)) == 1, "Expected UserCreated")
+	tst.True(t, len(recorder.Named(rentals.EventUserUpdated)) == 2, "Expected UserUpdated for both updates")
+
+	changed := recorder.Named(rentals.EventUserRoleChanged)
+	tst.True(t, len(changed) == 1, fmt.Sprintf("Expected a single UserRoleChanged, got %d", len(changed)))
+	tst.True(t, changed[0] == rentals.UserRoleChanged{UserId: uint(user.ID), From: "client", To: "realtor"},
+		fmt.Sprintf("Unexpected event %+v", changed[0]))
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	createRealtor(t, db)
+	var before rentals.User
+	tst.Ok(t, db.First(&before, 1).Error)
+
+	crypto.SetDefaultHasher(crypto.NewBcryptHasher(bcrypt.MinCost))
+	defer crypto.SetDefaultHasher(crypto.NewArgon2idHasher(crypto.DefaultArgon2idParams))
+
+	// Act
+	_, err = auth.NewDbAuthnService(db).Login("user", "pass", auth.ClientInfo{})
+	tst.Ok(t, err)
+
+	// True
+	var after rentals.User
+	tst.Ok(t, db.First(&after, 1).Error)
+	tst.True(t, after.PasswordHash != before.PasswordHash, "Expected the password to be rehashed")
+	tst.True(t, after.Version == before.Version+1,
+		fmt.Sprintf("Expected version %d, got %d", before.Version+1, after.Version))
+}
+
+func TestUserStatusTransitions(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	client, err := usrService.Create(rentals.UserCreateInput{Username: "client", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+	id := strconv.Itoa(int(client.ID))
+
+	for _, elt := range []struct {
+		name   string
+		status string
+		err    error
+	}{
+		{"Reactivate an active user, fail", rentals.UserActive, rentals.InvalidStatusChangeError},
+		{"Suspend, success", rentals.UserSuspended, nil},
+		{"Suspend again, fail", rentals.UserSuspended, rentals.InvalidStatusChangeError},
+		{"Reactivate, success", rentals.UserActive, nil},
+		{"Deactivate, success", rentals.UserDeactivated, nil},
+		{"Reactivate a deactivated user, fail", rentals.UserActive, rentals.InvalidStatusChangeError},
+		{"Suspend a deactivated user, fail", rentals.UserSuspended, rentals.InvalidStatusChangeError},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			// Act
+			_, err := usrService.SetStatus(rentals.UserStatusInput{Id: id, Status: elt.status})
+
+			// True
+			tst.True(t, err == elt.err, fmt.Sprintf("Expected %v, got %v", elt.err, err))
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package postgres
+
+import (
+	"github.com/jinzhu/gorm"
+	"rentals"
+)
+
+// Moves rows to their next version in updates that don't go through
+// bumpVersion, e.g. bulk updates and changes made by the system
+var nextVersion = gorm.Expr("version + 1")
+
+// Moves the row of model with id to the next version, as long as it's
+// still at version. Run it in the transaction making the change: the
+// row stays locked until the end, so a change made since the row was
+// read fails with VersionMismatchError instead of being overwritten.
+func bumpVersion(tx *gorm.DB, model interface{}, id, version uint) error {
+	res := tx.Model(model).Where("id = ? AND version = ?", id, version).UpdateColumn("version", nextVersion)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return rentals.VersionMismatchError
+	}
+
+	return nil
+}
+
+// Fails if the client read another version than current. 0 means the
+// client didn't say.
+func checkVersion(expected, current uint) error {
+	if expected != 0 && expected != current {
+		return rentals.VersionMismatchError
+	}
+
+	return nil
+}
@@ -0,0 +1,385 @@
+package postgres
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"log"
+	"rentals"
+	"rentals/auth"
+	"strconv"
+	"time"
+)
+
+// Name of the constraint that keeps realtors from having
+// overlapping viewings. Created in Migrate.
+const viewingOverlapConstraint = "viewings_realtor_no_overlap"
+
+// How long cancelled and past viewings stay in calendar feeds
+const calendarHistory = 30 * 24 * time.Hour
+
+type dbViewingService struct {
+	Db       *gorm.DB
+	Notifier rentals.Notifier
+}
+
+func (vs *dbViewingService) AddSlot(input rentals.ViewingSlotCreateInput) (*rentals.ViewingSlotCreateOutput, error) {
+	if !input.EndsAt.After(input.StartsAt) {
+		return nil, fmt.Errorf("slot must end after it starts")
+	}
+
+	if input.StartsAt.Before(time.Now()) {
+		return nil, fmt.Errorf("slot can't start in the past")
+	}
+
+	apartment, err := getApartment(input.ApartmentId, vs.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManage(apartment.RealtorId, input.ActorId, input.ActorRole) {
+		return nil, rentals.ForbiddenError
+	}
+
+	slot := rentals.ViewingSlot{
+		ApartmentID: uint(apartment.ID),
+		RealtorID:   apartment.RealtorId,
+		StartsAt:    input.StartsAt,
+		EndsAt:      input.EndsAt,
+	}
+	if err := vs.Db.Create(&slot).Error; err != nil {
+		return nil, fmt.Errorf("[dbViewingService.AddSlot] error creating slot %v", err)
+	}
+
+	return &rentals.ViewingSlotCreateOutput{ViewingSlot: slot}, nil
+}
+
+// Lists the slots of an apartment that haven't started yet. A slot
+// is booked if the realtor has a viewing at that time, even if it's
+// for another apartment.
+func (vs *dbViewingService) Slots(input rentals.ViewingSlotsInput) (*rentals.ViewingSlotsOutput, error) {
+	apartment, err := getApartment(input.ApartmentId, vs.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]rentals.ViewingSlot, 0)
+	err = vs.Db.Where("apartment_id = ? AND starts_at > ?", apartment.ID, time.Now()).
+		Order("starts_at").Find(&slots).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(slots) == 0 {
+		return &rentals.ViewingSlotsOutput{Slots: slots}, nil
+	}
+
+	var viewings []rentals.Viewing
+	err = vs.Db.Where("realtor_id = ? AND status = ? AND ends_at > ? AND starts_at < ?",
+		apartment.RealtorId, rentals.ViewingScheduled, slots[0].StartsAt, lastEnd(slots)).
+		Find(&viewings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range slots {
+		for _, viewing := range viewings {
+			if viewing.StartsAt.Before(slots[i].EndsAt) && viewing.EndsAt.After(slots[i].StartsAt) {
+				slots[i].Booked = true
+				break
+			}
+		}
+	}
+
+	return &rentals.ViewingSlotsOutput{Slots: slots}, nil
+}
+
+// Removing a slot doesn't affect viewings already booked on it
+func (vs *dbViewingService) DeleteSlot(input rentals.ViewingSlotDeleteInput) (*rentals.ViewingSlotDeleteOutput, error) {
+	slot, err := getSlot(input.Id, vs.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canManage(slot.RealtorID, input.ActorId, input.ActorRole) {
+		return nil, rentals.ForbiddenError
+	}
+
+	if err := vs.Db.Delete(slot).Error; err != nil {
+		return nil, fmt.Errorf("[dbViewingService.DeleteSlot] error deleting slot %v", err)
+	}
+
+	return &rentals.ViewingSlotDeleteOutput{}, nil
+}
+
+func (vs *dbViewingService) Book(input rentals.ViewingBookInput) (*rentals.ViewingBookOutput, error) {
+	slot, apartment, err := vs.bookableSlot(input.SlotId)
+	if err != nil {
+		return nil, err
+	}
+
+	viewing := rentals.Viewing{
+		SlotID:      uint(slot.ID),
+		ApartmentID: uint(apartment.ID),
+		RealtorID:   apartment.RealtorId,
+		ClientID:    input.ClientId,
+		StartsAt:    slot.StartsAt,
+		EndsAt:      slot.EndsAt,
+		Note:        input.Note,
+		Status:      rentals.ViewingScheduled,
+	}
+	if err := vs.Db.Create(&viewing).Error; err != nil {
+		if isViewingConflict(err) {
+			return nil, rentals.ViewingConflictError
+		}
+		return nil, fmt.Errorf("[dbViewingService.Book] error creating viewing %v", err)
+	}
+
+	vs.notify(rentals.Notification{
+		UserID: viewing.RealtorID,
+		Event:  rentals.EventViewingBooked,
+		Title:  fmt.Sprintf("New viewing of %s on %s", apartment.Name, formatViewingTime(viewing.StartsAt)),
+		Body:   viewing.Note,
+	})
+
+	return &rentals.ViewingBookOutput{Viewing: viewing}, nil
+}
+
+func (vs *dbViewingService) Find(input rentals.ViewingFindInput) (*rentals.ViewingFindOutput, error) {
+	tx := vs.Db.New().Where("ends_at > ?", time.Now())
+
+	switch input.ActorRole {
+	case "admin":
+	case "realtor":
+		tx = tx.Where("realtor_id = ?", input.ActorId)
+	default:
+		tx = tx.Where("client_id = ?", input.ActorId)
+	}
+
+	if input.ApartmentId != "" {
+		tx = tx.Where("apartment_id = ?", input.ApartmentId)
+	}
+
+	if input.Status != "" {
+		tx = tx.Where("status = ?", input.Status)
+	}
+
+	viewings := make([]rentals.Viewing, 0)
+	if err := tx.Order("starts_at").Find(&viewings).Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.ViewingFindOutput{Viewings: viewings}, nil
+}
+
+func (vs *dbViewingService) Cancel(input rentals.ViewingCancelInput) (*rentals.ViewingCancelOutput, error) {
+	viewing, err := vs.changeableViewing(input.Id, input.ActorId, input.ActorRole)
+	if err != nil {
+		return nil, err
+	}
+
+	viewing.Status = rentals.ViewingCancelled
+	viewing.CancelReason = input.Reason
+	viewing.Sequence++
+	if err := vs.Db.Save(viewing).Error; err != nil {
+		return nil, fmt.Errorf("[dbViewingService.Cancel] error updating viewing %v", err)
+	}
+
+	vs.notify(rentals.Notification{
+		UserID: otherParty(viewing, input.ActorId),
+		Event:  rentals.EventViewingCancelled,
+		Title:  fmt.Sprintf("The viewing on %s was cancelled", formatViewingTime(viewing.StartsAt)),
+		Body:   input.Reason,
+	})
+
+	return &rentals.ViewingCancelOutput{Viewing: *viewing}, nil
+}
+
+func (vs *dbViewingService) Reschedule(input rentals.ViewingRescheduleInput) (*rentals.ViewingRescheduleOutput, error) {
+	viewing, err := vs.changeableViewing(input.Id, input.ActorId, input.ActorRole)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, apartment, err := vs.bookableSlot(input.SlotId)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint(apartment.ID) != viewing.ApartmentID {
+		return nil, fmt.Errorf("slot %d is not for apartment %d", slot.ID, viewing.ApartmentID)
+	}
+
+	previousStart := viewing.StartsAt
+	viewing.SlotID = uint(slot.ID)
+	viewing.RealtorID = apartment.RealtorId
+	viewing.StartsAt = slot.StartsAt
+	viewing.EndsAt = slot.EndsAt
+	viewing.Sequence++
+	if err := vs.Db.Save(viewing).Error; err != nil {
+		if isViewingConflict(err) {
+			return nil, rentals.ViewingConflictError
+		}
+		return nil, fmt.Errorf("[dbViewingService.Reschedule] error updating viewing %v", err)
+	}
+
+	vs.notify(rentals.Notification{
+		UserID: otherParty(viewing, input.ActorId),
+		Event:  rentals.EventViewingRescheduled,
+		Title: fmt.Sprintf("The viewing of %s on %s was moved to %s", apartment.Name,
+			formatViewingTime(previousStart), formatViewingTime(viewing.StartsAt)),
+	})
+
+	return &rentals.ViewingRescheduleOutput{Viewing: *viewing}, nil
+}
+
+func (vs *dbViewingService) CalendarToken(userId uint) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = vs.Db.Model(&rentals.User{}).Where("id = ?", userId).
+		UpdateColumn("calendar_token_hash", auth.HashToken(token)).Error
+	if err != nil {
+		return "", fmt.Errorf("[dbViewingService.CalendarToken] error storing token %v", err)
+	}
+
+	return token, nil
+}
+
+func (vs *dbViewingService) Calendar(token string) (*rentals.ViewingCalendarOutput, error) {
+	if token == "" {
+		return nil, rentals.NotFoundError
+	}
+
+	var user rentals.User
+	err := vs.Db.Where("calendar_token_hash = ? AND status = ?", auth.HashToken(token), rentals.UserActive).
+		First(&user).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	viewings := make([]rentals.Viewing, 0)
+	err = vs.Db.Preload("Apartment").
+		Where("(client_id = ? OR realtor_id = ?) AND starts_at > ?", user.ID, user.ID, time.Now().Add(-calendarHistory)).
+		Order("starts_at").Find(&viewings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.ViewingCalendarOutput{User: user, Viewings: viewings}, nil
+}
+
+// Returns a slot that hasn't started yet and its apartment, if it
+// can still be visited
+func (vs *dbViewingService) bookableSlot(id uint) (*rentals.ViewingSlot, *rentals.Apartment, error) {
+	slot, err := getSlot(strconv.Itoa(int(id)), vs.Db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !slot.StartsAt.After(time.Now()) {
+		return nil, nil, fmt.Errorf("slot %d already started", slot.ID)
+	}
+
+	apartment, err := getApartment(strconv.Itoa(int(slot.ApartmentID)), vs.Db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if apartment.Status != rentals.ApartmentPublished {
+		return nil, nil, rentals.ApartmentNotAvailableError
+	}
+
+	return slot, apartment, nil
+}
+
+// Returns a viewing the actor can cancel or reschedule
+func (vs *dbViewingService) changeableViewing(id string, actorId uint, actorRole string) (*rentals.Viewing, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var viewing rentals.Viewing
+	if err := vs.Db.First(&viewing, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	if viewing.ClientID != actorId && !canManage(viewing.RealtorID, actorId, actorRole) {
+		return nil, rentals.ForbiddenError
+	}
+
+	if viewing.Status != rentals.ViewingScheduled || !viewing.StartsAt.After(time.Now()) {
+		return nil, rentals.ViewingClosedError
+	}
+
+	return &viewing, nil
+}
+
+func (vs *dbViewingService) notify(n rentals.Notification) {
+	if vs.Notifier == nil {
+		return
+	}
+
+	if err := vs.Notifier.Notify(n); err != nil {
+		log.Printf("[ERROR] notifying user %d of %s: %v", n.UserID, n.Event, err)
+	}
+}
+
+// Returns the participant of the viewing that didn't make the change
+func otherParty(viewing *rentals.Viewing, actorId uint) uint {
+	if viewing.ClientID == actorId {
+		return viewing.RealtorID
+	}
+
+	return viewing.ClientID
+}
+
+func isViewingConflict(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Constraint == viewingOverlapConstraint
+}
+
+func formatViewingTime(t time.Time) string {
+	return t.UTC().Format("Jan 2 15:04 MST")
+}
+
+func lastEnd(slots []rentals.ViewingSlot) time.Time {
+	end := slots[0].EndsAt
+	for _, slot := range slots {
+		if slot.EndsAt.After(end) {
+			end = slot.EndsAt
+		}
+	}
+
+	return end
+}
+
+func getSlot(id string, db *gorm.DB) (*rentals.ViewingSlot, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var slot rentals.ViewingSlot
+	if err = db.First(&slot, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &slot, nil
+}
+
+func NewDbViewingService(db *gorm.DB, notifier rentals.Notifier) *dbViewingService {
+	return &dbViewingService{Db: db, Notifier: notifier}
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+	"time"
+)
+
+func TestViewingsDoubleBooking(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	tst.Ok(t, Migrate(db))
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	usrService := NewDbUserService(db)
+	aptService := NewDbApartmentService(db)
+	viewingService := NewDbViewingService(db, nil)
+
+	createRealtor(t, db)
+	client, err := usrService.Create(rentals.UserCreateInput{Username: "client", Password: "pass", Role: "client"})
+	tst.Ok(t, err)
+
+	start := time.Now().Add(24 * time.Hour).Truncate(time.Hour)
+	addSlot := func(apartmentId uint, start time.Time) uint {
+		slot, err := viewingService.AddSlot(rentals.ViewingSlotCreateInput{
+			ApartmentId: fmt.Sprint(apartmentId),
+			StartsAt:    start,
+			EndsAt:      start.Add(30 * time.Minute),
+			ActorId:     1,
+			ActorRole:   "realtor",
+		})
+		tst.Ok(t, err)
+		return uint(slot.ID)
+	}
+
+	first, err := aptService.Create(newApartmentPayload("first", "first", 1, 1, 1, 1))
+	tst.Ok(t, err)
+	second, err := aptService.Create(newApartmentPayload("second", "second", 1, 1, 1, 1))
+	tst.Ok(t, err)
+
+	firstSlot := addSlot(uint(first.ID), start)
+	laterSlot := addSlot(uint(first.ID), start.Add(time.Hour))
+	secondSlot := addSlot(uint(second.ID), start.Add(15*time.Minute))
+
+	viewing, err := viewingService.Book(rentals.ViewingBookInput{SlotId: firstSlot, ClientId: uint(client.ID)})
+	tst.Ok(t, err)
+
+	t.Run("Overlapping viewing of another apartment fails", func(t *testing.T) {
+		_, err := viewingService.Book(rentals.ViewingBookInput{SlotId: secondSlot, ClientId: uint(client.ID)})
+		tst.True(t, err == rentals.ViewingConflictError, fmt.Sprintf("Expected conflict, got %v", err))
+
+		slots, err := viewingService.Slots(rentals.ViewingSlotsInput{ApartmentId: fmt.Sprint(second.ID)})
+		tst.Ok(t, err)
+		tst.True(t, len(slots.Slots) == 1 && slots.Slots[0].Booked, "Expected the slot to be booked")
+	})
+
+	t.Run("Rescheduling frees the realtor", func(t *testing.T) {
+		res, err := viewingService.Reschedule(rentals.ViewingRescheduleInput{
+			Id:        fmt.Sprint(viewing.ID),
+			SlotId:    laterSlot,
+			ActorId:   uint(client.ID),
+			ActorRole: "client",
+		})
+		tst.Ok(t, err)
+		tst.True(t, res.Sequence == 1, fmt.Sprintf("Expected sequence 1, got %d", res.Sequence))
+
+		_, err = viewingService.Book(rentals.ViewingBookInput{SlotId: secondSlot, ClientId: uint(client.ID)})
+		tst.Ok(t, err)
+	})
+
+	t.Run("Cancelled viewings stay in the calendar", func(t *testing.T) {
+		_, err := viewingService.Cancel(rentals.ViewingCancelInput{
+			Id:        fmt.Sprint(viewing.ID),
+			ActorId:   1,
+			ActorRole: "realtor",
+		})
+		tst.Ok(t, err)
+
+		token, err := viewingService.CalendarToken(uint(client.ID))
+		tst.Ok(t, err)
+
+		calendar, err := viewingService.Calendar(token)
+		tst.Ok(t, err)
+		tst.True(t, len(calendar.Viewings) == 2, fmt.Sprintf("Expected 2 viewings, got %d", len(calendar.Viewings)))
+		tst.True(t, calendar.Viewings[1].Status == rentals.ViewingCancelled, "Expected the later viewing to be cancelled")
+	})
+}
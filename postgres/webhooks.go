@@ -0,0 +1,560 @@
+package postgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"net/url"
+	"rentals"
+	"strconv"
+	"time"
+)
+
+const (
+	// Failed deliveries are retried after webhookBackoff, doubling
+	// every attempt up to maxWebhookBackoff
+	webhookBackoff    = 30 * time.Second
+	maxWebhookBackoff = 6 * time.Hour
+
+	// Deliveries are dead-lettered after this many failed attempts
+	maxWebhookAttempts = 8
+
+	// Deliveries being sent aren't picked up by other servers for
+	// this long
+	webhookClaimTimeout = 5 * time.Minute
+
+	// Most outbox events or deliveries handled per run
+	webhookBatchSize = 100
+)
+
+type dbWebhookService struct {
+	Db     *gorm.DB
+	Sender rentals.WebhookSender
+}
+
+// Body of deliveries
+type webhookEnvelope struct {
+	Id        uint            `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (ws *dbWebhookService) Create(input rentals.WebhookCreateInput) (*rentals.WebhookCreateOutput, error) {
+	if err := validateWebhook(input.URL, input.Events); err != nil {
+		return nil, err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := rentals.WebhookSubscription{
+		URL:         input.URL,
+		Description: input.Description,
+		Events:      input.Events,
+		Secret:      secret,
+		Active:      true,
+	}
+	if err := ws.Db.Create(&subscription).Error; err != nil {
+		return nil, fmt.Errorf("[dbWebhookService.Create] error creating subscription %v", err)
+	}
+
+	return &rentals.WebhookCreateOutput{WebhookSubscription: subscription, Secret: secret}, nil
+}
+
+func (ws *dbWebhookService) List() (*rentals.WebhookListOutput, error) {
+	subscriptions := make([]rentals.WebhookSubscription, 0)
+	if err := ws.Db.Order("id").Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.WebhookListOutput{Subscriptions: subscriptions}, nil
+}
+
+func (ws *dbWebhookService) Read(input rentals.WebhookReadInput) (*rentals.WebhookReadOutput, error) {
+	subscription, err := getWebhookSubscription(input.Id, ws.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.WebhookReadOutput{WebhookSubscription: *subscription}, nil
+}
+
+func (ws *dbWebhookService) Update(input rentals.WebhookUpdateInput) (*rentals.WebhookReadOutput, error) {
+	subscription, err := getWebhookSubscription(input.Id, ws.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.URL != nil {
+		subscription.URL = *input.URL
+	}
+
+	if input.Description != nil {
+		subscription.Description = *input.Description
+	}
+
+	if input.Events != nil {
+		subscription.Events = *input.Events
+	}
+
+	if input.Active != nil {
+		subscription.Active = *input.Active
+	}
+
+	if err := validateWebhook(subscription.URL, subscription.Events); err != nil {
+		return nil, err
+	}
+
+	if err := ws.Db.Save(subscription).Error; err != nil {
+		return nil, fmt.Errorf("[dbWebhookService.Update] error updating subscription %v", err)
+	}
+
+	return &rentals.WebhookReadOutput{WebhookSubscription: *subscription}, nil
+}
+
+// Removes the subscription with its deliveries and their logs
+func (ws *dbWebhookService) Delete(input rentals.WebhookReadInput) (*rentals.WebhookDeleteOutput, error) {
+	subscription, err := getWebhookSubscription(input.Id, ws.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := ws.Db.Begin()
+	deliveries := tx.Model(&rentals.WebhookDelivery{}).Select("id").Where("subscription_id = ?", subscription.ID)
+	if err := tx.Where("delivery_id IN (?)", deliveries.QueryExpr()).Delete(rentals.WebhookAttempt{}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbWebhookService.Delete] error deleting attempts %v", err)
+	}
+
+	if err := tx.Where("subscription_id = ?", subscription.ID).Delete(rentals.WebhookDelivery{}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbWebhookService.Delete] error deleting deliveries %v", err)
+	}
+
+	if err := tx.Delete(subscription).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbWebhookService.Delete] error deleting subscription %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return &rentals.WebhookDeleteOutput{}, nil
+}
+
+func (ws *dbWebhookService) Deliveries(input rentals.WebhookDeliveriesInput) (*rentals.WebhookDeliveriesOutput, error) {
+	tx := ws.Db.New()
+	if input.SubscriptionId != "" {
+		subscription, err := getWebhookSubscription(input.SubscriptionId, ws.Db)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("subscription_id = ?", subscription.ID)
+	}
+
+	if input.Status != "" {
+		tx = tx.Where("status = ?", input.Status)
+	}
+
+	// Newest first
+	tx, limit, err := paginate(tx, "id", true, input.Cursor, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]rentals.WebhookDelivery, 0)
+	if err := tx.Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+
+	output := &rentals.WebhookDeliveriesOutput{Deliveries: deliveries}
+	if len(deliveries) > limit {
+		output.Deliveries = deliveries[:limit]
+		last := output.Deliveries[limit-1]
+		output.NextCursor = encodeCursor("", uint(last.ID))
+	}
+
+	return output, nil
+}
+
+func (ws *dbWebhookService) Delivery(input rentals.WebhookDeliveryInput) (*rentals.WebhookDeliveryOutput, error) {
+	delivery, err := getWebhookDelivery(input.Id, ws.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rentals.WebhookDeliveryOutput{WebhookDelivery: *delivery}, nil
+}
+
+// The delivery is sent on the next run with a new set of attempts.
+// The log of the previous ones is kept.
+func (ws *dbWebhookService) Redeliver(input rentals.WebhookDeliveryInput) (*rentals.WebhookDeliveryOutput, error) {
+	delivery, err := getWebhookDelivery(input.Id, ws.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	delivery.Status = rentals.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = &now
+	err = ws.Db.Model(delivery).UpdateColumns(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+	}).Error
+	if err != nil {
+		return nil, fmt.Errorf("[dbWebhookService.Redeliver] error updating delivery %v", err)
+	}
+
+	return &rentals.WebhookDeliveryOutput{WebhookDelivery: *delivery}, nil
+}
+
+// Creates a delivery for each active subscription to the events in
+// the outbox. Rows are locked so servers don't dispatch them twice.
+func (ws *dbWebhookService) Dispatch(now time.Time) (int, error) {
+	tx := ws.Db.Begin()
+
+	var events []rentals.OutboxEvent
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("dispatched_at IS NULL").Order("id").Limit(webhookBatchSize).Find(&events).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if len(events) == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	var subscriptions []rentals.WebhookSubscription
+	if err := tx.Where("active = ?", true).Find(&subscriptions).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	ids := make([]uint, len(events))
+	for i, event := range events {
+		ids[i] = uint(event.ID)
+
+		body, err := json.Marshal(webhookEnvelope{
+			Id:        uint(event.ID),
+			Event:     event.Event,
+			CreatedAt: event.CreatedAt,
+			Data:      json.RawMessage(event.Payload),
+		})
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		for _, subscription := range subscriptions {
+			if !contains(subscription.Events, event.Event) {
+				continue
+			}
+
+			delivery := rentals.WebhookDelivery{
+				SubscriptionID: uint(subscription.ID),
+				OutboxEventID:  uint(event.ID),
+				Event:          event.Event,
+				Payload:        string(body),
+				Status:         rentals.DeliveryPending,
+				NextAttemptAt:  &now,
+			}
+			if err := tx.Create(&delivery).Error; err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("[dbWebhookService.Dispatch] error creating delivery %v", err)
+			}
+		}
+	}
+
+	err = tx.Model(&rentals.OutboxEvent{}).Where("id IN (?)", ids).UpdateColumn("dispatched_at", now).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("[dbWebhookService.Dispatch] error updating outbox %v", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+
+	return len(events), nil
+}
+
+// Sends the deliveries that are due. They are claimed first so the
+// requests aren't made holding locks.
+func (ws *dbWebhookService) Deliver(now time.Time) (int, error) {
+	deliveries, err := ws.claimDeliveries(now)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, delivery := range deliveries {
+		if err := ws.send(delivery, now); err != nil {
+			return i, err
+		}
+	}
+
+	return len(deliveries), nil
+}
+
+func (ws *dbWebhookService) claimDeliveries(now time.Time) ([]rentals.WebhookDelivery, error) {
+	tx := ws.Db.Begin()
+
+	var deliveries []rentals.WebhookDelivery
+	err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("status = ? AND next_attempt_at <= ?", rentals.DeliveryPending, now).
+		Order("next_attempt_at").Limit(webhookBatchSize).Find(&deliveries).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if len(deliveries) == 0 {
+		tx.Rollback()
+		return nil, nil
+	}
+
+	ids := make([]uint, len(deliveries))
+	for i, delivery := range deliveries {
+		ids[i] = uint(delivery.ID)
+	}
+
+	err = tx.Model(&rentals.WebhookDelivery{}).Where("id IN (?)", ids).
+		UpdateColumn("next_attempt_at", now.Add(webhookClaimTimeout)).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("[dbWebhookService.Deliver] error claiming deliveries %v", err)
+	}
+
+	return deliveries, tx.Commit().Error
+}
+
+// Makes an attempt and records its outcome. Deliveries of removed
+// or disabled subscriptions are dead-lettered.
+func (ws *dbWebhookService) send(delivery rentals.WebhookDelivery, now time.Time) error {
+	attempt := rentals.WebhookAttempt{DeliveryID: uint(delivery.ID)}
+
+	subscription, err := getWebhookSubscription(strconv.Itoa(int(delivery.SubscriptionID)), ws.Db)
+	switch {
+	case err == rentals.NotFoundError:
+		attempt.Error = "subscription not found"
+	case err != nil:
+		return err
+	case !subscription.Active:
+		attempt.Error = "subscription disabled"
+	default:
+		started := time.Now()
+		attempt.StatusCode, err = ws.Sender.Send(subscription.URL, subscription.Secret, delivery.Event,
+			strconv.Itoa(int(delivery.ID)), []byte(delivery.Payload))
+		attempt.DurationMs = int64(time.Since(started) / time.Millisecond)
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+	}
+
+	update := map[string]interface{}{
+		"attempts":         delivery.Attempts + 1,
+		"last_status_code": attempt.StatusCode,
+		"last_error":       attempt.Error,
+	}
+
+	switch {
+	case attempt.Error == "":
+		update["status"] = rentals.DeliverySucceeded
+		update["next_attempt_at"] = nil
+	case subscription == nil || !subscription.Active || delivery.Attempts+1 >= maxWebhookAttempts:
+		update["status"] = rentals.DeliveryDead
+		update["next_attempt_at"] = nil
+		log.Printf("[ERROR] webhook delivery %d dead-lettered: %s", delivery.ID, attempt.Error)
+	default:
+		update["next_attempt_at"] = now.Add(deliveryBackoff(delivery.Attempts + 1))
+	}
+
+	tx := ws.Db.Begin()
+	if err := tx.Create(&attempt).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("[dbWebhookService.Deliver] error logging attempt %v", err)
+	}
+
+	if err := tx.Model(&delivery).UpdateColumns(update).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("[dbWebhookService.Deliver] error updating delivery %v", err)
+	}
+
+	return tx.Commit().Error
+}
+
+// Time to wait after the given number of failed attempts
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := webhookBackoff
+	for i := 1; i < attempts && backoff < maxWebhookBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxWebhookBackoff {
+		return maxWebhookBackoff
+	}
+	return backoff
+}
+
+// Records in the outbox the webhook events standing for event. Called
+// in the transaction of the change event describes, so the outbox has
+// every committed change and none that was rolled back.
+func outboxEvent(tx *gorm.DB, event rentals.Event) error {
+	switch e := event.(type) {
+	case rentals.ApartmentCreated:
+		return writeOutbox(tx, rentals.WebhookApartmentCreated, e.Apartment)
+	case rentals.ApartmentUpdated:
+		return outboxApartmentUpdated(tx, e.Before, e.After)
+	case rentals.ApartmentsReassigned:
+		return outboxApartmentsReassigned(tx, e.ApartmentIds)
+	case rentals.ApartmentDeleted:
+		return writeOutbox(tx, rentals.WebhookApartmentDeleted, e.Apartment)
+	case rentals.ApartmentRestored:
+		return writeOutbox(tx, rentals.WebhookApartmentRestored, e.Apartment)
+	case rentals.UserCreated:
+		return writeOutbox(tx, rentals.WebhookUserCreated, e.User)
+	case rentals.UserUpdated:
+		return writeOutbox(tx, rentals.WebhookUserUpdated, e.After)
+	case rentals.UserStatusChanged:
+		webhookEvent := rentals.WebhookUserUpdated
+		if e.To == rentals.UserDeactivated {
+			webhookEvent = rentals.WebhookUserDeleted
+		}
+		return writeOutbox(tx, webhookEvent, e.User)
+	}
+
+	return nil
+}
+
+// Status changes are recorded as apartment.status_changed, and the
+// changes to any other field as apartment.updated
+func outboxApartmentUpdated(db *gorm.DB, before, after rentals.Apartment) error {
+	statusChanged := before.Status != after.Status
+	if statusChanged {
+		err := writeOutbox(db, rentals.WebhookApartmentStatusChanged, map[string]interface{}{
+			"from":      before.Status,
+			"to":        after.Status,
+			"apartment": after,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	changes, err := diffFields(&before, &after)
+	if err != nil {
+		return err
+	}
+
+	edited := false
+	for _, change := range changes {
+		if change.Field != "status" {
+			edited = true
+		}
+	}
+
+	// Updates that change nothing are still recorded
+	if edited || !statusChanged {
+		return writeOutbox(db, rentals.WebhookApartmentUpdated, after)
+	}
+
+	return nil
+}
+
+// Records the apartments moved to another realtor as updated
+func outboxApartmentsReassigned(db *gorm.DB, ids []uint) error {
+	var apartments []rentals.Apartment
+	if err := db.Where("id IN (?)", ids).Order("id").Find(&apartments).Error; err != nil {
+		return err
+	}
+
+	for _, apartment := range apartments {
+		if err := writeOutbox(db, rentals.WebhookApartmentUpdated, apartment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Records event in the outbox. data is sent as the data of the
+// deliveries.
+func writeOutbox(tx *gorm.DB, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Create(&rentals.OutboxEvent{Event: event, Payload: string(payload)}).Error; err != nil {
+		return fmt.Errorf("error writing %s to the outbox %v", event, err)
+	}
+
+	return nil
+}
+
+func validateWebhook(rawUrl string, events []string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %s", rawUrl)
+	}
+
+	if len(events) == 0 {
+		return fmt.Errorf("events are required")
+	}
+
+	for _, event := range events {
+		if !contains(rentals.WebhookEvents, event) {
+			return fmt.Errorf("unknown event %s", event)
+		}
+	}
+
+	return nil
+}
+
+func getWebhookSubscription(id string, db *gorm.DB) (*rentals.WebhookSubscription, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscription rentals.WebhookSubscription
+	if err = db.First(&subscription, intId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &subscription, nil
+}
+
+// Returns a delivery with the log of its attempts
+func getWebhookDelivery(id string, db *gorm.DB) (*rentals.WebhookDelivery, error) {
+	intId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var delivery rentals.WebhookDelivery
+	err = db.Preload("Log", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).First(&delivery, intId).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, rentals.NotFoundError
+		}
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+func NewDbWebhookService(db *gorm.DB, sender rentals.WebhookSender) *dbWebhookService {
+	return &dbWebhookService{Db: db, Sender: sender}
+}
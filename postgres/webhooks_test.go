@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"rentals"
+	"rentals/tst"
+	"testing"
+	"time"
+)
+
+// Records the deliveries sent and fails them if err is set
+type fakeSender struct {
+	sent []string
+	err  error
+}
+
+func (s *fakeSender) Send(url, secret, event, deliveryId string, body []byte) (int, error) {
+	s.sent = append(s.sent, event)
+	if s.err != nil {
+		return 500, s.err
+	}
+	return 200, nil
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	// Arrange
+	db, err := ConnectToDB(true)
+	tst.Ok(t, err)
+
+	db.AutoMigrate(rentals.DbModels...)
+	defer db.DropTableIfExists(rentals.DbModels...)
+
+	sender := &fakeSender{}
+	webhookService := NewDbWebhookService(db, sender)
+	aptService := NewDbApartmentService(db)
+	usrService := NewDbUserService(db)
+
+	subscription, err := webhookService.Create(rentals.WebhookCreateInput{
+		URL:    "https://example.com/hooks",
+		Events: []string{rentals.WebhookApartmentCreated},
+	})
+	tst.Ok(t, err)
+	tst.True(t, subscription.Secret != "", "Expected a secret")
+
+	_, err = usrService.Create(rentals.UserCreateInput{Username: "user", Password: "pass", Role: "realtor"})
+	tst.Ok(t, err)
+	_, err = aptService.Create(newApartmentPayload("apt", "apt", 1, 1000, 1, 1))
+	tst.Ok(t, err)
+
+	now := time.Now()
+
+	t.Run("Changes in the outbox become deliveries", func(t *testing.T) {
+		// Act
+		dispatched, err := webhookService.Dispatch(now)
+		tst.Ok(t, err)
+
+		sent, err := webhookService.Deliver(now)
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, dispatched >= 2, fmt.Sprintf("Expected the realtor and apartment events, got %d", dispatched))
+		tst.True(t, sent == 1 && sender.sent[0] == rentals.WebhookApartmentCreated,
+			fmt.Sprintf("Expected an apartment.created delivery, got %v", sender.sent))
+
+		again, err := webhookService.Dispatch(now)
+		tst.Ok(t, err)
+		tst.True(t, again == 0, "Expected the outbox to be dispatched once")
+	})
+
+	t.Run("Failed deliveries are retried and dead-lettered", func(t *testing.T) {
+		sender.err = errors.New("unavailable")
+		_, err := aptService.Create(newApartmentPayload("apt2", "apt2", 1, 1000, 1, 1))
+		tst.Ok(t, err)
+		_, err = webhookService.Dispatch(now)
+		tst.Ok(t, err)
+
+		// Each run is made once the previous backoff is over
+		at := now
+		for i := 0; i < maxWebhookAttempts; i++ {
+			_, err := webhookService.Deliver(at)
+			tst.Ok(t, err)
+			at = at.Add(maxWebhookBackoff)
+		}
+
+		dead, err := webhookService.Deliveries(rentals.WebhookDeliveriesInput{Status: rentals.DeliveryDead})
+		tst.Ok(t, err)
+		tst.True(t, len(dead.Deliveries) == 1, fmt.Sprintf("Expected 1 dead delivery, got %d", len(dead.Deliveries)))
+
+		delivery, err := webhookService.Delivery(rentals.WebhookDeliveryInput{Id: fmt.Sprint(dead.Deliveries[0].ID)})
+		tst.Ok(t, err)
+		tst.True(t, len(delivery.Log) == maxWebhookAttempts,
+			fmt.Sprintf("Expected %d attempts logged, got %d", maxWebhookAttempts, len(delivery.Log)))
+
+		// Act
+		sender.err = nil
+		_, err = webhookService.Redeliver(rentals.WebhookDeliveryInput{Id: fmt.Sprint(delivery.ID)})
+		tst.Ok(t, err)
+		sent, err := webhookService.Deliver(time.Now())
+		tst.Ok(t, err)
+
+		// True
+		tst.True(t, sent == 1, "Expected the delivery to be sent again")
+	})
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	tst.True(t, deliveryBackoff(1) == webhookBackoff, "Expected the first retry after webhookBackoff")
+	tst.True(t, deliveryBackoff(3) == 4*webhookBackoff, "Expected the backoff to double")
+	tst.True(t, deliveryBackoff(100) == maxWebhookBackoff, "Expected the backoff to be capped")
+}
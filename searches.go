@@ -0,0 +1,143 @@
+package rentals
+
+import "time"
+
+// How often saved searches send digests of new matches
+const (
+	SearchInstant = "instant"
+	SearchDaily   = "daily"
+	SearchWeekly  = "weekly"
+	SearchOff     = "off"
+)
+
+// Minimum time between two digests of a saved search
+var SearchFrequencies = map[string]time.Duration{
+	SearchInstant: 0,
+	SearchDaily:   24 * time.Hour,
+	SearchWeekly:  7 * 24 * time.Hour,
+}
+
+// Apartment search a user wants to be alerted about. Query uses the
+// same filters as ApartmentFindInput, e.g.
+// minRoomCount=2&maxPricePerMonthUSD=1500&latitude=41.7&longitude=12.3&radiusKm=3
+type SavedSearch struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	UserID uint `gorm:"index" json:"userId"`
+
+	Name  string `json:"name"`
+	Query string `json:"query"`
+
+	// One of the Search* constants
+	Frequency string `json:"frequency"`
+
+	// Secret used to unsubscribe from links, without logging in
+	UnsubscribeToken string `gorm:"unique_index" json:"-"`
+
+	LastDigestAt *time.Time `json:"lastDigestAt"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+// Apartment that started matching a saved search. Each apartment
+// matches a search once.
+type SearchMatch struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	SearchID    uint `gorm:"unique_index:idx_search_match" json:"searchId"`
+	ApartmentID uint `gorm:"unique_index:idx_search_match" json:"apartmentId"`
+
+	// Nil if the apartment no longer exists
+	Apartment *Apartment `json:"apartment"`
+
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Time the match was sent in a digest
+	NotifiedAt *time.Time `json:"notifiedAt"`
+}
+
+type SavedSearchService interface {
+	// ApartmentChanged matches published apartments against saved
+	// searches. Subscribed to the apartment events, see
+	// events.ApartmentChanges.
+	ApartmentChanged(before Apartment, after *Apartment)
+
+	Create(SavedSearchCreateInput) (*SavedSearchCreateOutput, error)
+	List(SavedSearchListInput) (*SavedSearchListOutput, error)
+	Update(SavedSearchUpdateInput) (*SavedSearchUpdateOutput, error)
+	Delete(SavedSearchDeleteInput) (*SavedSearchDeleteOutput, error)
+	Matches(SavedSearchMatchesInput) (*SavedSearchMatchesOutput, error)
+
+	// Unsubscribe turns off the digests of the search with the
+	// given unsubscribe token
+	Unsubscribe(token string) (*SavedSearchUnsubscribeOutput, error)
+
+	// Match records the saved searches the apartment matches
+	// for the first time. Returns the number of new matches.
+	Match(Apartment) (int, error)
+
+	// SendDigests notifies users of the new matches of their
+	// searches that are due. Returns the number of digests sent.
+	SendDigests(now time.Time) (int, error)
+}
+
+type SavedSearchCreateInput struct {
+	Name      string `json:"name"`
+	Query     string `json:"query"`
+	Frequency string `json:"frequency"`
+	UserId    uint   `json:"-"`
+}
+
+type SavedSearchCreateOutput struct {
+	SavedSearch
+}
+
+type SavedSearchListInput struct {
+	UserId uint
+}
+
+type SavedSearchListOutput struct {
+	Searches []SavedSearch
+}
+
+func (o *SavedSearchListOutput) Public() interface{} {
+	return o.Searches
+}
+
+// Empty fields are not changed
+type SavedSearchUpdateInput struct {
+	Id        string `json:"-"`
+	Name      string `json:"name"`
+	Query     string `json:"query"`
+	Frequency string `json:"frequency"`
+	UserId    uint   `json:"-"`
+}
+
+type SavedSearchUpdateOutput struct {
+	SavedSearch
+}
+
+type SavedSearchDeleteInput struct {
+	Id     string
+	UserId uint
+}
+
+type SavedSearchDeleteOutput struct{}
+
+type SavedSearchMatchesInput struct {
+	Id     string
+	UserId uint
+}
+
+type SavedSearchMatchesOutput struct {
+	Matches []SearchMatch
+}
+
+func (o *SavedSearchMatchesOutput) Public() interface{} {
+	return o.Matches
+}
+
+type SavedSearchUnsubscribeOutput struct {
+	SavedSearch
+}
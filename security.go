@@ -0,0 +1,79 @@
+package rentals
+
+import "time"
+
+// Authentication events recorded in the security log
+const (
+	SecurityLoginSucceeded  = "login_succeeded"
+	SecurityLoginFailed     = "login_failed"
+	SecurityTokenRejected   = "token_rejected"
+	SecurityRoleChanged     = "role_changed"
+	SecurityPasswordChanged = "password_changed"
+	SecuritySessionRevoked  = "session_revoked"
+	SecuritySessionsRevoked = "sessions_revoked"
+)
+
+var SecurityEvents = []string{
+	SecurityLoginSucceeded,
+	SecurityLoginFailed,
+	SecurityTokenRejected,
+	SecurityRoleChanged,
+	SecurityPasswordChanged,
+	SecuritySessionRevoked,
+	SecuritySessionsRevoked,
+}
+
+// Entry of the security log. Kept apart from the audit trail as it
+// records who tried to get in rather than what changed.
+type SecurityEvent struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	Event string `gorm:"index" json:"event"`
+
+	// User the event is about, 0 if unknown, e.g. for failed logins
+	// with an unknown username. Username is the one given.
+	UserID   uint   `gorm:"index" json:"userId"`
+	Username string `json:"username"`
+
+	// User that made the request, when it isn't UserID, e.g. an admin
+	// revoking the sessions of another user
+	ActorID uint `json:"actorId"`
+
+	IP        string `gorm:"index" json:"ip"`
+	UserAgent string `json:"userAgent"`
+
+	// Why a login or token was rejected, or what changed
+	Detail string `json:"detail"`
+
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+}
+
+// SecurityLog keeps the security events. Recording never fails the
+// operation being recorded, errors are logged instead.
+type SecurityLog interface {
+	Record(SecurityEvent)
+
+	// Events lists the events, newest first
+	Events(SecurityEventsInput) (*SecurityEventsOutput, error)
+}
+
+// Filters of the security log. Zero values mean no filtering.
+type SecurityEventsInput struct {
+	Event  string
+	UserId string
+	IP     string
+	Since  *time.Time
+	Until  *time.Time
+	Cursor string
+	Limit  int
+}
+
+type SecurityEventsOutput struct {
+	Events     []SecurityEvent
+	NextCursor string
+}
+
+func (o *SecurityEventsOutput) Public() interface{} {
+	return Page{Items: o.Events, NextCursor: o.NextCursor}
+}
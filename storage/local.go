@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stores objects as files under a base directory
+type localStorage struct {
+	Dir string
+}
+
+func (s *localStorage) Put(key, contentType string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so readers never see partial objects
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStorage) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, NotFoundError
+	}
+
+	return f, err
+}
+
+func (s *localStorage) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Maps a key to a path inside Dir, rejecting keys that escape it
+func (s *localStorage) path(key string) (string, error) {
+	path := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(s.Dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key %s", key)
+	}
+
+	return path, nil
+}
+
+// Creates a storage that keeps objects in dir
+func NewLocalStorage(dir string) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("[NewLocalStorage] error creating %s: %v", dir, err)
+	}
+
+	return &localStorage{Dir: dir}, nil
+}
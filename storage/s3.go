@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Stores objects in a bucket of an S3 compatible service
+// (AWS, minio, etc). Requests use path style urls
+// (<endpoint>/<bucket>/<key>) and are signed with AWS
+// signature version 4.
+type s3Storage struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+
+	// Used to sign requests. Replaced in tests.
+	now func() time.Time
+}
+
+type S3Config struct {
+	// Base url of the service, e.g. https://s3.amazonaws.com
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+func (s *s3Storage) Put(key, contentType string, data []byte) error {
+	res, err := s.do("PUT", key, contentType, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return checkS3Response(res)
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	res, err := s.do("GET", key, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, NotFoundError
+	}
+
+	if err := checkS3Response(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	res, err := s.do("DELETE", key, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return checkS3Response(res)
+}
+
+func (s *s3Storage) do(method, key, contentType string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.Bucket + "/" + key
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	s.sign(req, body)
+	return s.Client.Do(req)
+}
+
+// Signs req following
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *s3Storage) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := hashHex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSha256(key, s.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func checkS3Response(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3 error %d: %s", res.StatusCode, msg)
+}
+
+// Creates a storage backed by an S3 compatible service
+func NewS3Storage(config S3Config) *s3Storage {
+	return &s3Storage{
+		Endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+		Bucket:    config.Bucket,
+		Region:    config.Region,
+		AccessKey: config.AccessKey,
+		SecretKey: config.SecretKey,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		now:       time.Now,
+	}
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// Package storage has blob stores used to keep uploaded files
+
+var NotFoundError = errors.New("object not found")
+
+// Storage is a key/value store for binary objects. Keys are
+// slash separated paths such as "apartments/1/abc/original".
+type Storage interface {
+	// Put stores data under key, replacing any existing object
+	Put(key, contentType string, data []byte) error
+
+	// Get returns a reader for the object stored under key or
+	// NotFoundError if there is none. Callers must close it.
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes the object stored under key. Deleting a
+	// missing object is not an error.
+	Delete(key string) error
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"rentals/tst"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	// Arrange
+	dir, err := ioutil.TempDir("", "rentals-storage")
+	tst.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewLocalStorage(dir)
+	tst.Ok(t, err)
+
+	// Act & True
+	assertRoundTrip(t, s)
+
+	err = s.Put("../outside", "text/plain", []byte("data"))
+	tst.True(t, err != nil, "Expected error writing outside of the dir")
+}
+
+func TestS3Storage(t *testing.T) {
+	// Arrange
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := NewS3Storage(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "media",
+		Region:    "us-east-1",
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+
+	// Act & True
+	assertRoundTrip(t, s)
+	tst.True(t, fake.requests > 0, "Expected requests to the fake s3")
+}
+
+func assertRoundTrip(t *testing.T, s Storage) {
+	t.Helper()
+
+	err := s.Put("apartments/1/photo", "image/png", []byte("data"))
+	tst.Ok(t, err)
+
+	r, err := s.Get("apartments/1/photo")
+	tst.Ok(t, err)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	tst.Ok(t, err)
+	tst.True(t, string(data) == "data", fmt.Sprintf("Expected data, got %s", data))
+
+	tst.Ok(t, s.Delete("apartments/1/photo"))
+	tst.Ok(t, s.Delete("apartments/1/photo"))
+
+	_, err = s.Get("apartments/1/photo")
+	tst.True(t, err == NotFoundError, fmt.Sprintf("Expected NotFoundError, got %v", err))
+}
+
+// Minimal stand-in for an S3 service. Checks requests are
+// signed and keeps objects in memory.
+type fakeS3 struct {
+	sync.Mutex
+	objects  map[string][]byte
+	requests int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		f.objects[r.URL.Path] = body
+	case "GET":
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rentals"
+)
+
+// Creates the handlers for rental applications. Clients apply,
+// realtors accept or reject and clients can withdraw.
+func (s *Server) AddApplicationsHandlers(basePath string, service rentals.ApplicationService) {
+	url := fmt.Sprintf("/%s", basePath)
+	urlWithId := fmt.Sprintf("%s/{id:[0-9]+}", url)
+
+	s.router.HandleFunc(url, postApplicationsHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllApplicationsHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId+"/accept", decideApplicationHandler(service.Accept)).Methods("POST")
+	s.router.HandleFunc(urlWithId+"/reject", decideApplicationHandler(service.Reject)).Methods("POST")
+	s.router.HandleFunc(urlWithId+"/withdraw", decideApplicationHandler(service.Withdraw)).Methods("POST")
+}
+
+func postApplicationsHandler(service rentals.ApplicationService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		user := currentUser(r)
+		if user.Role != "client" {
+			respond(w, http.StatusForbidden, "Only clients can apply")
+			return
+		}
+
+		var input rentals.ApplicationCreateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.ClientId = uint(user.ID)
+		result, err := service.Create(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func getAllApplicationsHandler(service rentals.ApplicationService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		query := r.URL.Query()
+
+		result, err := service.Find(rentals.ApplicationFindInput{
+			ActorId:     uint(user.ID),
+			ActorRole:   user.Role,
+			ApartmentId: query.Get("apartmentId"),
+			Status:      query.Get("status"),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func decideApplicationHandler(decide func(rentals.ApplicationDecisionInput) (*rentals.ApplicationDecisionOutput, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		result, err := decide(rentals.ApplicationDecisionInput{
+			Id:        vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+			RequestId: requestId(r),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
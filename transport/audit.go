@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rentals"
+)
+
+// Creates the handler of the audit trail. Admins only, see
+// setupAuthorization.
+func (s *Server) AddAuditHandlers(basePath string, service rentals.AuditService) {
+	url := fmt.Sprintf("/%s", basePath)
+
+	s.router.HandleFunc(url, getAuditHandler(service)).Methods("GET")
+}
+
+// Creates the handler of the changes made to an apartment, under
+// the apartments path
+func (s *Server) AddApartmentHistoryHandlers(basePath string, service rentals.AuditService) {
+	url := fmt.Sprintf("/%s/{id:[0-9]+}/history", basePath)
+
+	s.router.HandleFunc(url, getApartmentHistoryHandler(service)).Methods("GET")
+}
+
+// Lists the audit trail, filtered with ?entity=, ?id=, ?actorId=
+// and ?action=
+func getAuditHandler(service rentals.AuditService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit, err := parseLimit(query)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.Entries(rentals.AuditListInput{
+			Entity:   query.Get("entity"),
+			EntityId: query.Get("id"),
+			ActorId:  query.Get("actorId"),
+			Action:   query.Get("action"),
+			Cursor:   query.Get("cursor"),
+			Limit:    limit,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getApartmentHistoryHandler(service rentals.AuditService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		query := r.URL.Query()
+		user := currentUser(r)
+
+		limit, err := parseLimit(query)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.ApartmentHistory(rentals.ApartmentAuditInput{
+			Id:        vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+			Cursor:    query.Get("cursor"),
+			Limit:     limit,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
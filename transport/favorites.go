@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rentals"
+)
+
+// Creates the handlers for the favorite apartments of the current
+// user under basePath (e.g. me/favorites)
+func (s *Server) AddFavoritesHandlers(basePath string, service rentals.FavoriteService) {
+	url := fmt.Sprintf("/%s", basePath)
+	urlWithId := fmt.Sprintf("%s/{apartmentId:[0-9]+}", url)
+
+	s.router.HandleFunc(url, getAllFavoritesHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, postFavoritesHandler(service)).Methods("POST")
+	s.router.HandleFunc(urlWithId, deleteFavoritesHandler(service)).Methods("DELETE")
+}
+
+func getAllFavoritesHandler(service rentals.FavoriteService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.List(rentals.FavoriteListInput{UserId: uint(currentUser(r).ID)})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func postFavoritesHandler(service rentals.FavoriteService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Add(rentals.FavoriteInput{
+			UserId:      uint(currentUser(r).ID),
+			ApartmentId: vars["apartmentId"],
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func deleteFavoritesHandler(service rentals.FavoriteService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		_, err := service.Remove(rentals.FavoriteInput{
+			UserId:      uint(currentUser(r).ID),
+			ApartmentId: vars["apartmentId"],
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	}
+}
@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"rentals"
+	"strings"
+)
+
+// Header clients send to make a POST safe to retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Set on responses replayed from the first request sent with a key
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+const maxIdempotencyKeyLength = 255
+
+// Largest body of a request sent with a key. Larger ones are refused
+// rather than buffered to fingerprint them.
+const maxIdempotentBodySize = 1 << 20
+
+// Makes POST requests sent with an Idempotency-Key safe to retry. See
+// IdempotencyMiddleware.
+func (s *Server) UseIdempotencyKeys(store rentals.IdempotencyStore) {
+	s.idempotency = store
+}
+
+// Stores the response to POST requests sent with an Idempotency-Key
+// and replays it when the request is retried with the same key. The
+// same key with another request is refused. Logins are left out, as
+// their response is a session token, and so are requests made
+// without logging in, as keys are only unique per user.
+func (s *Server) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		user := currentUser(r)
+		if s.idempotency == nil || key == "" || r.Method != "POST" || r.URL.Path == "/login" || user == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			respond(w, http.StatusBadRequest, "idempotency key is too long")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+		_ = r.Body.Close()
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if len(body) > maxIdempotentBodySize {
+			respond(w, http.StatusRequestEntityTooLarge, "body is too large for an idempotent request")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		claimed, err := s.idempotency.Begin(rentals.IdempotencyKey{
+			UserID:      uint(user.ID),
+			Key:         key,
+			Fingerprint: requestFingerprint(r, body),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		if claimed.Status != 0 {
+			var header http.Header
+			if err := json.Unmarshal([]byte(claimed.Header), &header); err != nil && claimed.Header != "" {
+				log.Printf("[ERROR] replaying headers: %v", err)
+			}
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(claimed.Status)
+			if _, err := w.Write(claimed.Body); err != nil {
+				log.Println("Error responding:", err)
+			}
+			return
+		}
+
+		// Unless the response is stored, the key is released so the
+		// request can be retried, e.g. after a server error or panic
+		stored := false
+		defer func() {
+			if stored {
+				return
+			}
+
+			if err := s.idempotency.Release(*claimed); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+		}()
+
+		// Headers set before, like X-Request-ID, belong to each request
+		before := w.Header().Clone()
+		recorder := &idempotentWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.status >= http.StatusInternalServerError {
+			return
+		}
+
+		header, err := json.Marshal(changedHeaders(before, w.Header()))
+		if err != nil {
+			log.Printf("[ERROR] %v", err)
+			return
+		}
+
+		claimed.Status = recorder.status
+		claimed.Body = recorder.body.Bytes()
+		claimed.Header = string(header)
+		if err := s.idempotency.Complete(*claimed); err != nil {
+			log.Printf("[ERROR] %v", err)
+			return
+		}
+		stored = true
+	})
+}
+
+// Returns the headers in after that aren't in before with the same
+// values
+func changedHeaders(before, after http.Header) http.Header {
+	changed := make(http.Header)
+	for name, values := range after {
+		if strings.Join(before[name], ",") != strings.Join(values, ",") {
+			changed[name] = values
+		}
+	}
+	return changed
+}
+
+// Identifies a request by its method, url and body
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	_, _ = io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	_, _ = hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Keeps a copy of the response written to the client
+type idempotentWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *idempotentWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotentWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
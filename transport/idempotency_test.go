@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rentals"
+	"rentals/tst"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keeps the keys in memory, by user and key
+type memoryIdempotencyStore struct {
+	keys map[string]*rentals.IdempotencyKey
+}
+
+func (ms *memoryIdempotencyStore) Begin(key rentals.IdempotencyKey) (*rentals.IdempotencyKey, error) {
+	id := fmt.Sprintf("%d/%s", key.UserID, key.Key)
+	if stored, ok := ms.keys[id]; ok {
+		return stored, nil
+	}
+
+	ms.keys[id] = &key
+	return &key, nil
+}
+
+func (ms *memoryIdempotencyStore) Complete(key rentals.IdempotencyKey) error {
+	ms.keys[fmt.Sprintf("%d/%s", key.UserID, key.Key)] = &key
+	return nil
+}
+
+func (ms *memoryIdempotencyStore) Release(key rentals.IdempotencyKey) error {
+	delete(ms.keys, fmt.Sprintf("%d/%s", key.UserID, key.Key))
+	return nil
+}
+
+func (ms *memoryIdempotencyStore) Purge(time.Time) (int, error) {
+	return 0, nil
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	// Arrange
+	store := &memoryIdempotencyStore{keys: make(map[string]*rentals.IdempotencyKey)}
+	s := &Server{idempotency: store}
+
+	calls := 0
+	handler := s.IdempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/apartments/1")
+		w.Header().Set("ETag", `"1"`)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":1}`))
+	}))
+
+	send := func(user *rentals.User) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/apartments", strings.NewReader(`{"name":"apt"}`))
+		r.Header.Set(idempotencyKeyHeader, "retry-me")
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Retries get the first response, headers included", func(t *testing.T) {
+		user := &rentals.User{}
+		user.ID = 1
+
+		// Act
+		send(user)
+		replayed := send(user)
+
+		// True
+		tst.True(t, calls == 1, fmt.Sprintf("Expected the request to be handled once, got %d", calls))
+		tst.True(t, replayed.Code == http.StatusCreated && replayed.Body.String() == `{"id":1}`,
+			fmt.Sprintf("Unexpected response %d %s", replayed.Code, replayed.Body))
+		tst.True(t, replayed.Header().Get("Location") == "/apartments/1" && replayed.Header().Get("ETag") == `"1"`,
+			fmt.Sprintf("Expected the headers to be replayed, got %v", replayed.Header()))
+		tst.True(t, replayed.Header().Get(idempotentReplayedHeader) == "true", "Expected the replay to be flagged")
+	})
+
+	t.Run("Requests without logging in don't take keys", func(t *testing.T) {
+		calls = 0
+
+		// Act
+		send(nil)
+		second := send(nil)
+
+		// True
+		tst.True(t, calls == 2, fmt.Sprintf("Expected both requests to be handled, got %d", calls))
+		tst.True(t, second.Header().Get(idempotentReplayedHeader) == "", "Expected no replay")
+	})
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"mime"
+	"net/http"
+	"rentals"
+	"strconv"
+)
+
+// Largest file that can be imported
+const maxImportSize = 10 << 20
+
+// Formats of the files that can be imported by content type
+var importContentTypes = map[string]string{
+	"text/csv":             rentals.ImportCsv,
+	"application/x-ndjson": rentals.ImportNdjson,
+}
+
+// Creates the handlers to import apartments under basePath/import and
+// to follow the progress of imports.
+func (s *Server) AddApartmentImportHandlers(basePath string, service rentals.ApartmentImportService) {
+	url := fmt.Sprintf("/%s/import", basePath)
+
+	s.router.HandleFunc(url, postApartmentImportHandler(service)).Methods("POST")
+	s.router.HandleFunc(url+"/{id:[0-9]+}", getApartmentImportHandler(service)).Methods("GET")
+}
+
+// Expects the file as the body. The format is taken from ?format= or
+// the content type. Imports that finish are answered with their
+// report, the ones left in the background with 202 and where to poll.
+func postApartmentImportHandler(service rentals.ApartmentImportService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		user := currentUser(r)
+
+		format := query.Get("format")
+		if format == "" {
+			contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			format = importContentTypes[contentType]
+		}
+
+		if format == "" {
+			respond(w, http.StatusBadRequest, "format must be csv or ndjson")
+			return
+		}
+
+		dryRun := false
+		if v := query.Get("dryRun"); v != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				respond(w, http.StatusBadRequest, "invalid dryRun")
+				return
+			}
+		}
+
+		var realtorId uint
+		if v := query.Get("realtorId"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				respond(w, http.StatusBadRequest, "invalid realtorId")
+				return
+			}
+			realtorId = uint(id)
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		defer r.Body.Close()
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respond(w, http.StatusRequestEntityTooLarge, "file is too large")
+				return
+			}
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.Import(rentals.ApartmentImportInput{
+			Format:    format,
+			Mode:      query.Get("mode"),
+			DryRun:    dryRun,
+			Data:      data,
+			RealtorId: realtorId,
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+			RequestId: requestId(r),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		if result.Status == rentals.ImportPending {
+			w.Header().Set("Location", fmt.Sprintf("%s/%d", r.URL.Path, uint(result.ID)))
+			respond(w, http.StatusAccepted, result)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getApartmentImportHandler(service rentals.ApartmentImportService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		result, err := service.Read(rentals.ApartmentImportReadInput{
+			Id:        vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
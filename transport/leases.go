@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rentals"
+	"strconv"
+)
+
+// Creates the handlers for leases. Realtors create and renew the
+// leases of their apartments, tenants can see theirs.
+func (s *Server) AddLeasesHandlers(basePath string, service rentals.LeaseService) {
+	url := fmt.Sprintf("/%s", basePath)
+	urlWithId := fmt.Sprintf("%s/{id:[0-9]+}", url)
+
+	s.router.HandleFunc(url, postLeasesHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllLeasesHandler(service)).Methods("GET")
+	s.router.HandleFunc(url+"/expiring", getExpiringLeasesHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, getLeasesHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId+"/renew", renewLeasesHandler(service)).Methods("POST")
+}
+
+func postLeasesHandler(service rentals.LeaseService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		user := currentUser(r)
+
+		var input rentals.LeaseCreateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.ActorId = uint(user.ID)
+		input.ActorRole = user.Role
+		input.RequestId = requestId(r)
+		result, err := service.Create(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func getAllLeasesHandler(service rentals.LeaseService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+
+		result, err := service.Find(rentals.LeaseFindInput{
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+			Status:    r.URL.Query().Get("status"),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// Lists active leases ending in the next ?days=N days (30 by default)
+func getExpiringLeasesHandler(service rentals.LeaseService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+
+		days := 30
+		if raw := r.URL.Query().Get("days"); raw != "" {
+			var err error
+			if days, err = strconv.Atoi(raw); err != nil || days <= 0 {
+				respond(w, http.StatusBadRequest, fmt.Sprintf("invalid days %s", raw))
+				return
+			}
+		}
+
+		result, err := service.Find(rentals.LeaseFindInput{
+			ActorId:        uint(user.ID),
+			ActorRole:      user.Role,
+			ExpiringInDays: days,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getLeasesHandler(service rentals.LeaseService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		result, err := service.Read(rentals.LeaseReadInput{
+			Id:        vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func renewLeasesHandler(service rentals.LeaseService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+		user := currentUser(r)
+
+		var input rentals.LeaseRenewInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.Id = vars["id"]
+		input.ActorId = uint(user.ID)
+		input.ActorRole = user.Role
+		result, err := service.Renew(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rentals"
+	"rentals/live"
+	"strings"
+	"time"
+)
+
+const (
+	// Comments are sent this often so proxies keep idle streams open
+	streamHeartbeat = 15 * time.Second
+
+	// Time allowed for each write. The server write timeout doesn't
+	// apply to streams.
+	streamWriteTimeout = 10 * time.Second
+
+	// Tells clients to drop what they have and list apartments again,
+	// sent when the events since their last event id are gone
+	streamReset = "reset"
+)
+
+// Payload of the streamed events
+type streamEvent struct {
+	Type      string            `json:"type"`
+	Apartment rentals.Apartment `json:"apartment"`
+	Time      time.Time         `json:"time"`
+}
+
+// Creates the Server-Sent Events stream of changes to apartments
+// under basePath/stream
+func (s *Server) AddApartmentStreamHandlers(basePath string, hub *live.Hub) {
+	url := fmt.Sprintf("/%s/stream", basePath)
+
+	s.router.HandleFunc(url, streamApartmentsHandler(hub)).Methods("GET")
+}
+
+// Streams the changes to the apartments matching the same query
+// parameters as GET /apartments. ?events= restricts the event types.
+// Clients resume with the Last-Event-ID header.
+func streamApartmentsHandler(hub *live.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var types []string
+		if v := r.URL.Query().Get("events"); v != "" {
+			types = strings.Split(v, ",")
+		}
+
+		actorId, actorRole := actor(r)
+		filter, err := live.Filter(r.URL.RawQuery, types, actorId, actorRole)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		subscription, missed, resumed := hub.Subscribe(r.Header.Get("Last-Event-ID"), filter)
+		defer subscription.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		stream := &eventStream{w: w, rc: http.NewResponseController(w)}
+		stream.write("retry: 3000\n\n")
+		if !resumed {
+			stream.write(fmt.Sprintf("event: %s\ndata: {}\n\n", streamReset))
+		}
+
+		for _, event := range missed {
+			stream.send(event)
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for stream.err == nil {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-subscription.Events:
+				// Dropped for falling behind, the client resumes
+				// from the last event it got
+				if !ok {
+					return
+				}
+				stream.send(event)
+			case <-heartbeat.C:
+				stream.write(": ping\n\n")
+			}
+		}
+	}
+}
+
+// Writes and flushes events, remembering the first error
+type eventStream struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	err error
+}
+
+func (s *eventStream) send(event live.Event) {
+	data, err := json.Marshal(streamEvent{Type: event.Type, Apartment: event.Apartment, Time: event.Time})
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	s.write(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data))
+}
+
+func (s *eventStream) write(text string) {
+	if s.err != nil {
+		return
+	}
+
+	err := s.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.err = err
+		return
+	}
+
+	if _, s.err = fmt.Fprint(s.w, text); s.err != nil {
+		return
+	}
+
+	s.err = s.rc.Flush()
+}
@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"rentals"
+)
+
+// Creates the handlers to upload, list, download, update and
+// delete the media of apartments under basePath/{id}/media.
+func (s *Server) AddMediaHandlers(basePath string, service rentals.MediaService) {
+	url := fmt.Sprintf("/%s/{id:[0-9]+}/media", basePath)
+	urlWithId := fmt.Sprintf("%s/{mediaId:[0-9]+}", url)
+
+	s.router.HandleFunc(url, postMediaHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllMediaHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, getMediaFileHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, patchMediaHandler(service)).Methods("PATCH")
+	s.router.HandleFunc(urlWithId, deleteMediaHandler(service)).Methods("DELETE")
+}
+
+// Expects a multipart form with the file in the "file" field
+// and optional "kind" and "caption" fields.
+func postMediaHandler(service rentals.MediaService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		// Leave some room for the rest of the form
+		r.Body = http.MaxBytesReader(w, r.Body, rentals.MaxMediaSize+64<<10)
+		defer r.Body.Close()
+
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respond(w, http.StatusRequestEntityTooLarge, rentals.MediaTooLargeError.Error())
+				return
+			}
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer file.Close()
+
+		result, err := service.Upload(rentals.MediaUploadInput{
+			ApartmentId: vars["id"],
+			Kind:        r.FormValue("kind"),
+			Caption:     r.FormValue("caption"),
+			File:        file,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func getAllMediaHandler(service rentals.MediaService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.List(rentals.MediaListInput{ApartmentId: vars["id"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// Serves the file of a media. Use ?size=<thumbnail> for thumbnails.
+func getMediaFileHandler(service rentals.MediaService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Open(rentals.MediaOpenInput{
+			ApartmentId: vars["id"],
+			Id:          vars["mediaId"],
+			Size:        r.URL.Query().Get("size"),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+		defer result.File.Close()
+
+		// Files never change, a new upload gets a new id
+		w.Header().Set("Content-Type", result.ContentType)
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, result.File); err != nil {
+			log.Println("Error responding:", err)
+		}
+	}
+}
+
+func patchMediaHandler(service rentals.MediaService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+
+		var input rentals.MediaUpdateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.ApartmentId = vars["id"]
+		input.Id = vars["mediaId"]
+		result, err := service.Update(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func deleteMediaHandler(service rentals.MediaService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		_, err := service.Delete(rentals.MediaDeleteInput{ApartmentId: vars["id"], Id: vars["mediaId"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	}
+}
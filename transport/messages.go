@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rentals"
+)
+
+// Creates the handlers for the message threads between clients and
+// realtors. Admins can list and read every thread and hide messages.
+func (s *Server) AddThreadsHandlers(basePath string, service rentals.MessageService) {
+	url := fmt.Sprintf("/%s", basePath)
+	urlWithId := fmt.Sprintf("%s/{id:[0-9]+}", url)
+
+	s.router.HandleFunc(url, postThreadsHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllThreadsHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, getThreadsHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId+"/messages", getAllMessagesHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId+"/messages", postMessagesHandler(service)).Methods("POST")
+	s.router.HandleFunc(urlWithId+"/messages/{messageId:[0-9]+}", deleteMessagesHandler(service)).Methods("DELETE")
+	s.router.HandleFunc(urlWithId+"/read", postReadThreadsHandler(service)).Methods("POST")
+}
+
+func postThreadsHandler(service rentals.MessageService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		user := currentUser(r)
+		if user.Role != "client" {
+			respond(w, http.StatusForbidden, "Only clients can start threads")
+			return
+		}
+
+		var input rentals.ThreadCreateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.ClientId = uint(user.ID)
+		result, err := service.CreateThread(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+// Lists the threads of the current user. Admins get all threads and
+// can filter them with ?apartmentId= and ?userId=.
+func getAllThreadsHandler(service rentals.MessageService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		query := r.URL.Query()
+
+		limit, err := parseLimit(query)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.Threads(rentals.ThreadListInput{
+			ActorId:     uint(user.ID),
+			ActorRole:   user.Role,
+			ApartmentId: query.Get("apartmentId"),
+			UserId:      query.Get("userId"),
+			Cursor:      query.Get("cursor"),
+			Limit:       limit,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getThreadsHandler(service rentals.MessageService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		result, err := service.Thread(rentals.ThreadReadInput{
+			Id:        vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getAllMessagesHandler(service rentals.MessageService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+		query := r.URL.Query()
+
+		limit, err := parseLimit(query)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.Messages(rentals.MessageListInput{
+			ThreadId:  vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+			Cursor:    query.Get("cursor"),
+			Limit:     limit,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func postMessagesHandler(service rentals.MessageService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+
+		var input rentals.MessageSendInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.ThreadId = vars["id"]
+		input.ActorId = uint(currentUser(r).ID)
+		result, err := service.Send(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+// Hides a message from the participants of the thread. Admins only.
+func deleteMessagesHandler(service rentals.MessageService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		result, err := service.Hide(rentals.MessageHideInput{
+			ThreadId:  vars["id"],
+			Id:        vars["messageId"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func postReadThreadsHandler(service rentals.MessageService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		result, err := service.MarkRead(rentals.ThreadReadInput{
+			Id:        vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
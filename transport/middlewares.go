@@ -1,20 +1,39 @@
 package transport
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/gorilla/handlers"
 	"net/http"
 	"os"
+	"rentals"
 	"rentals/auth"
 	"strings"
+	"time"
 )
 
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	tokenKey
+	requestIdKey
+)
+
+// Header identifying a request. Clients can set it to correlate
+// their requests with the audit trail, otherwise one is generated.
+const requestIdHeader = "X-Request-ID"
+
 // Middleware used to authenticate and authorize users.
 // Uses the url to check which resource is being accessed
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip if we are trying to login or creating a new client
-		if r.URL.Path == "/login" || r.URL.Path == "/newClient" {
+		// Skip if we are trying to login or creating a new client.
+		// Calendar feeds and unsubscribe links carry their own token.
+		if r.URL.Path == "/login" || r.URL.Path == "/newClient" ||
+			strings.HasPrefix(r.URL.Path, calendarPath) || strings.HasPrefix(r.URL.Path, unsubscribePath) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -29,6 +48,12 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 		user := s.authn.Verify(token)
 
 		if user == nil {
+			if s.rejectedTokens.allow(s.clientIP(r), time.Now()) {
+				s.recordSecurityEvent(r, rentals.SecurityEvent{
+					Event:  rentals.SecurityTokenRejected,
+					Detail: fmt.Sprintf("%s %s", r.Method, r.URL.Path),
+				})
+			}
 			respond(w, http.StatusUnauthorized, "Not allowed")
 			return
 		}
@@ -46,10 +71,75 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 			}
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), userKey, user)
+		ctx = context.WithValue(ctx, tokenKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the user authenticated by the AuthMiddleware
+func currentUser(r *http.Request) *rentals.User {
+	user, _ := r.Context().Value(userKey).(*rentals.User)
+	return user
+}
+
+// Returns the id and role of the user making the request, zero
+// values if it's not authenticated
+func actor(r *http.Request) (uint, string) {
+	if user := currentUser(r); user != nil {
+		return uint(user.ID), user.Role
+	}
+	return 0, ""
+}
+
+// Returns the token used to authenticate the request
+func currentToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenKey).(string)
+	return token
+}
+
+// Assigns an id to every request, taken from X-Request-ID if the
+// client sent a valid one, and returns it in the response headers
+func (s *Server) RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = generateRequestId()
+		}
+
+		w.Header().Set(requestIdHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey, id)))
 	})
 }
 
+// Returns the id assigned by the RequestIdMiddleware
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey).(string)
+	return id
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func generateRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 func (s *Server) ContentTypeJsonMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
@@ -60,11 +150,30 @@ func (s *Server) ContentTypeJsonMiddleware(next http.Handler) http.Handler {
 func (s *Server) LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = fmt.Fprintln(os.Stderr, "starting")
-		next = handlers.LoggingHandler(os.Stderr, next)
-		next.ServeHTTP(w, r)
+		logged := handlers.LoggingHandler(os.Stderr, http.HandlerFunc(func(lw http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(loggedWriter{ResponseWriter: lw, original: w}, r)
+		}))
+		logged.ServeHTTP(w, r)
 	})
 }
 
+// Lets http.ResponseController reach the writer wrapped by the
+// logging handler, e.g. for streams to extend their write deadline
+type loggedWriter struct {
+	http.ResponseWriter
+	original http.ResponseWriter
+}
+
+func (w loggedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w loggedWriter) Unwrap() http.ResponseWriter {
+	return w.original
+}
+
 func getOp(method string) auth.Permission {
 	meth2Perm := make(map[string]auth.Permission)
 	meth2Perm["POST"] = auth.Create
@@ -81,6 +190,20 @@ func getResource(urlPath string) string {
 		return "users"
 	} else if strings.HasPrefix(urlPath, "/apartments") {
 		return "apartments"
+	} else if strings.HasPrefix(urlPath, "/applications") {
+		return "applications"
+	} else if strings.HasPrefix(urlPath, "/leases") {
+		return "leases"
+	} else if strings.HasPrefix(urlPath, "/viewings") {
+		return "viewings"
+	} else if strings.HasPrefix(urlPath, "/threads") {
+		return "threads"
+	} else if strings.HasPrefix(urlPath, "/webhooks") {
+		return "webhooks"
+	} else if strings.HasPrefix(urlPath, "/audit") {
+		return "audit"
+	} else if strings.HasPrefix(urlPath, "/security-events") {
+		return "security-events"
 	}
 	return ""
 }
@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"rentals"
+	"strconv"
+)
+
+// Creates the handlers for the inbox and notification preferences
+// of the current user under basePath (e.g. me/notifications)
+func (s *Server) AddNotificationsHandlers(basePath string, service rentals.NotificationService) {
+	url := fmt.Sprintf("/%s", basePath)
+
+	s.router.HandleFunc(url, getNotificationsHandler(service)).Methods("GET")
+	s.router.HandleFunc(url+"/unread", getUnreadCountHandler(service)).Methods("GET")
+	s.router.HandleFunc(url+"/read", postReadNotificationsHandler(service)).Methods("POST")
+	s.router.HandleFunc(url+"/preferences", getPreferencesHandler(service)).Methods("GET")
+	s.router.HandleFunc(url+"/preferences", patchPreferencesHandler(service)).Methods("PATCH")
+}
+
+// Lists the inbox, newest first. Use ?unread=true to skip read
+// notifications and cursor/limit to paginate.
+func getNotificationsHandler(service rentals.NotificationService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		input := rentals.NotificationInboxInput{
+			UserId:     uint(currentUser(r).ID),
+			UnreadOnly: query.Get("unread") == "true",
+			Cursor:     query.Get("cursor"),
+		}
+
+		if limit := query.Get("limit"); limit != "" {
+			var err error
+			if input.Limit, err = strconv.Atoi(limit); err != nil {
+				respond(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %s", limit))
+				return
+			}
+		}
+
+		result, err := service.Inbox(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getUnreadCountHandler(service rentals.NotificationService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.Inbox(rentals.NotificationInboxInput{
+			UserId:     uint(currentUser(r).ID),
+			UnreadOnly: true,
+			Limit:      1,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, rentals.NotificationReadOutput{UnreadCount: result.UnreadCount})
+	}
+}
+
+func postReadNotificationsHandler(service rentals.NotificationService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var input rentals.NotificationReadInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.UserId = uint(currentUser(r).ID)
+		result, err := service.MarkRead(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getPreferencesHandler(service rentals.NotificationService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.Preferences(rentals.NotificationPreferencesInput{UserId: uint(currentUser(r).ID)})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func patchPreferencesHandler(service rentals.NotificationService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var input rentals.NotificationPreferencesUpdateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.UserId = uint(currentUser(r).ID)
+		result, err := service.UpdatePreferences(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
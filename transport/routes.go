@@ -2,9 +2,12 @@ package transport
 
 import (
 	"encoding/json"
+	"github.com/gorilla/mux"
 	"log"
 	"net/http"
 	"rentals"
+	"rentals/auth"
+	"strconv"
 )
 
 func (s *Server) LoginHandler() http.HandlerFunc {
@@ -23,7 +26,7 @@ func (s *Server) LoginHandler() http.HandlerFunc {
 			return
 		}
 
-		token, err := s.authn.Login(userData.Username, userData.Password)
+		token, err := s.authn.Login(userData.Username, userData.Password, s.clientInfo(r))
 		if err != nil {
 			respond(w, http.StatusUnauthorized, "Not allowed")
 			return
@@ -41,8 +44,7 @@ func (s *Server) LoginHandler() http.HandlerFunc {
 func (s *Server) profileHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// This must exist otherwise the middleware would have rejected it
-		token := r.Header["Authorization"][0]
-		user := s.authn.Verify(token)
+		user := currentUser(r)
 
 		if user == nil {
 			respond(w, http.StatusUnauthorized, "Not allowed")
@@ -52,6 +54,145 @@ func (s *Server) profileHandler() http.HandlerFunc {
 	})
 }
 
+func (s *Server) patchProfileHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil {
+			respond(w, http.StatusUnauthorized, "Not allowed")
+			return
+		}
+
+		defer r.Body.Close()
+		var input rentals.ProfileUpdateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.Id = strconv.Itoa(int(user.ID))
+		input.RequestId = requestId(r)
+		result, err := s.userService.UpdateProfile(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		// Log out everywhere else after a password change
+		if result.PasswordChanged {
+			s.recordSecurityEvent(r, rentals.SecurityEvent{
+				Event:    rentals.SecurityPasswordChanged,
+				UserID:   uint(user.ID),
+				Username: user.Username,
+			})
+
+			if err := s.authn.RevokeSessions(uint(user.ID), currentToken(r), s.clientInfo(r)); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+		}
+
+		respond(w, http.StatusOK, result)
+	})
+}
+
+func (s *Server) deleteProfileHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil {
+			respond(w, http.StatusUnauthorized, "Not allowed")
+			return
+		}
+
+		// Realtors must hand over their apartments before leaving
+		query := r.URL.Query()
+		_, err := s.userService.Delete(rentals.UserDeleteInput{
+			Id:                strconv.Itoa(int(user.ID)),
+			Reason:            "closed by user",
+			ReassignTo:        query.Get("reassignTo"),
+			ArchiveApartments: query.Get("archiveApartments") == "true",
+			ActorId:           uint(user.ID),
+			RequestId:         requestId(r),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	})
+}
+
+// Session as shown to its owner
+type sessionResponse struct {
+	rentals.UserSession
+
+	// Whether this is the session used in the request
+	Current bool `json:"current"`
+}
+
+func (s *Server) getSessionsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil {
+			respond(w, http.StatusUnauthorized, "Not allowed")
+			return
+		}
+
+		sessions, err := s.authn.Sessions(uint(user.ID))
+		if err != nil {
+			respond(w, http.StatusInternalServerError, "Internal Server error")
+			log.Printf("[ERROR] %v", err)
+			return
+		}
+
+		currentHash := auth.HashToken(currentToken(r))
+		result := make([]sessionResponse, 0, len(sessions))
+		for _, session := range sessions {
+			result = append(result, sessionResponse{
+				UserSession: session,
+				Current:     session.TokenHash == currentHash,
+			})
+		}
+
+		respond(w, http.StatusOK, result)
+	})
+}
+
+func (s *Server) deleteSessionHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil {
+			respond(w, http.StatusUnauthorized, "Not allowed")
+			return
+		}
+
+		if err := s.authn.RevokeSession(uint(user.ID), mux.Vars(r)["id"], s.clientInfo(r)); err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	})
+}
+
+// Revokes all the sessions of the user in the url
+func (s *Server) deleteUserSessionsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.userService.Read(rentals.UserReadInput{Id: mux.Vars(r)["id"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		if err := s.authn.RevokeSessions(uint(user.ID), "", s.clientInfo(r)); err != nil {
+			respond(w, http.StatusInternalServerError, "Internal Server error")
+			log.Printf("[ERROR] %v", err)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	})
+}
+
 func (s *Server) newClientHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var newClient struct {
@@ -67,9 +208,10 @@ func (s *Server) newClientHandler() http.HandlerFunc {
 		}
 
 		user, err := s.userService.Create(rentals.UserCreateInput{
-			Username: newClient.Username,
-			Password: newClient.Password,
-			Role:     "client",
+			Username:  newClient.Username,
+			Password:  newClient.Password,
+			Role:      "client",
+			RequestId: requestId(r),
 		})
 
 		if err != nil {
@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rentals"
+)
+
+// Prefix of the links in digests to stop them. They work without
+// logging in, the token identifies the search.
+const unsubscribePath = "/unsubscribe/"
+
+// Creates the handlers for the saved searches of the current
+// user under basePath (e.g. me/searches)
+func (s *Server) AddSavedSearchesHandlers(basePath string, service rentals.SavedSearchService) {
+	url := fmt.Sprintf("/%s", basePath)
+	urlWithId := fmt.Sprintf("%s/{id:[0-9]+}", url)
+
+	s.router.HandleFunc(url, postSavedSearchesHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllSavedSearchesHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, patchSavedSearchesHandler(service)).Methods("PATCH")
+	s.router.HandleFunc(urlWithId, deleteSavedSearchesHandler(service)).Methods("DELETE")
+	s.router.HandleFunc(urlWithId+"/matches", getSavedSearchMatchesHandler(service)).Methods("GET")
+	s.router.HandleFunc(unsubscribePath+"{token:[0-9a-f]+}", unsubscribeHandler(service)).Methods("GET", "POST")
+}
+
+func postSavedSearchesHandler(service rentals.SavedSearchService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var input rentals.SavedSearchCreateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.UserId = uint(currentUser(r).ID)
+		result, err := service.Create(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func getAllSavedSearchesHandler(service rentals.SavedSearchService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.List(rentals.SavedSearchListInput{UserId: uint(currentUser(r).ID)})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func patchSavedSearchesHandler(service rentals.SavedSearchService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+
+		var input rentals.SavedSearchUpdateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.Id = vars["id"]
+		input.UserId = uint(currentUser(r).ID)
+		result, err := service.Update(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func deleteSavedSearchesHandler(service rentals.SavedSearchService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		_, err := service.Delete(rentals.SavedSearchDeleteInput{Id: vars["id"], UserId: uint(currentUser(r).ID)})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	}
+}
+
+func getSavedSearchMatchesHandler(service rentals.SavedSearchService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Matches(rentals.SavedSearchMatchesInput{Id: vars["id"], UserId: uint(currentUser(r).ID)})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func unsubscribeHandler(service rentals.SavedSearchService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Unsubscribe(vars["token"])
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,244 @@
+package transport
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"rentals"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Events read per query when exporting the security log
+const securityExportPageSize = 500
+
+// Time given to write each page of an export, past the server's
+// write timeout
+const securityExportWriteTimeout = 30 * time.Second
+
+// Rejected tokens are recorded once per client ip in this interval,
+// so clients retrying with a stale token don't flood the log
+const tokenRejectedInterval = time.Minute
+
+// Records rejected tokens, role and password changes and revoked
+// sessions to securityLog
+func (s *Server) UseSecurityLog(securityLog rentals.SecurityLog) {
+	s.security = securityLog
+}
+
+// Creates the handlers to list and export the security log. Admins
+// only, see setupAuthorization.
+func (s *Server) AddSecurityEventsHandlers(basePath string, securityLog rentals.SecurityLog) {
+	url := fmt.Sprintf("/%s", basePath)
+
+	s.router.HandleFunc(url, getSecurityEventsHandler(securityLog)).Methods("GET")
+	s.router.HandleFunc(url+"/export", exportSecurityEventsHandler(securityLog)).Methods("GET")
+}
+
+// Records event with the client making the request, if there's a
+// security log
+func (s *Server) recordSecurityEvent(r *http.Request, event rentals.SecurityEvent) {
+	if s.security == nil {
+		return
+	}
+
+	client := s.clientInfo(r)
+	event.IP = client.IP
+	event.UserAgent = client.UserAgent
+	if client.ActorId != event.UserID {
+		event.ActorID = client.ActorId
+	}
+
+	s.security.Record(event)
+}
+
+// Lets an event through once per key and interval
+type eventSampler struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+
+	// Keys are forgotten once their interval is over, at most once
+	// per interval
+	swept time.Time
+}
+
+func newEventSampler(interval time.Duration) *eventSampler {
+	return &eventSampler{interval: interval, last: make(map[string]time.Time)}
+}
+
+// Tells whether an event for key at now should be recorded. Nil
+// samplers let every event through.
+func (es *eventSampler) allow(key string, now time.Time) bool {
+	if es == nil {
+		return true
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if now.Sub(es.swept) >= es.interval {
+		for k, last := range es.last {
+			if now.Sub(last) >= es.interval {
+				delete(es.last, k)
+			}
+		}
+		es.swept = now
+	}
+
+	if last, ok := es.last[key]; ok && now.Sub(last) < es.interval {
+		return false
+	}
+
+	es.last[key] = now
+	return true
+}
+
+// Filters the log with ?event=, ?userId=, ?ip=, ?since= and ?until=
+func getSecurityEventsHandler(service rentals.SecurityLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		input, err := parseSecurityEventsInput(r.URL.Query())
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.Events(*input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// Streams every event matching the same filters as the listing, as
+// csv (default) or ndjson with ?format=
+func exportSecurityEventsHandler(service rentals.SecurityLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		input, err := parseSecurityEventsInput(query)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		format := query.Get("format")
+		if format != "" && format != "csv" && format != "ndjson" {
+			respond(w, http.StatusBadRequest, fmt.Sprintf("unknown format %s", format))
+			return
+		}
+
+		// Fail before writing anything if the filters are wrong
+		input.Limit = securityExportPageSize
+		page, err := service.Events(*input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		var writer securityEventWriter
+		if format == "ndjson" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="security-events.ndjson"`)
+			writer = &ndjsonSecurityEventWriter{encoder: json.NewEncoder(w)}
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="security-events.csv"`)
+			writer = newCsvSecurityEventWriter(w)
+		}
+
+		streamExport(w, "security events", securityExportWriteTimeout, func() (bool, error) {
+			if err := writer.write(page.Events); err != nil {
+				return false, err
+			}
+
+			if page.NextCursor == "" {
+				return false, nil
+			}
+
+			input.Cursor = page.NextCursor
+			page, err = service.Events(*input)
+			return err == nil, err
+		})
+	}
+}
+
+type securityEventWriter interface {
+	write([]rentals.SecurityEvent) error
+}
+
+type csvSecurityEventWriter struct {
+	w *csv.Writer
+}
+
+func newCsvSecurityEventWriter(w http.ResponseWriter) *csvSecurityEventWriter {
+	writer := &csvSecurityEventWriter{w: csv.NewWriter(w)}
+	_ = writer.w.Write([]string{"id", "createdAt", "event", "userId", "username", "actorId", "ip", "userAgent", "detail"})
+	return writer
+}
+
+func (c *csvSecurityEventWriter) write(events []rentals.SecurityEvent) error {
+	for _, event := range events {
+		err := c.w.Write([]string{
+			strconv.Itoa(int(event.ID)),
+			event.CreatedAt.Format(time.RFC3339),
+			event.Event,
+			strconv.Itoa(int(event.UserID)),
+			event.Username,
+			strconv.Itoa(int(event.ActorID)),
+			event.IP,
+			event.UserAgent,
+			event.Detail,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonSecurityEventWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonSecurityEventWriter) write(events []rentals.SecurityEvent) error {
+	for _, event := range events {
+		if err := n.encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseSecurityEventsInput(values url.Values) (*rentals.SecurityEventsInput, error) {
+	input := &rentals.SecurityEventsInput{
+		Event:  values.Get("event"),
+		UserId: values.Get("userId"),
+		IP:     values.Get("ip"),
+		Cursor: values.Get("cursor"),
+	}
+
+	var err error
+	if input.Since, err = parseTimeParam(values, "since"); err != nil {
+		return nil, err
+	}
+
+	if input.Until, err = parseTimeParam(values, "until"); err != nil {
+		return nil, err
+	}
+
+	if input.Limit, err = parseLimit(values); err != nil {
+		return nil, err
+	}
+
+	return input, nil
+}
@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"rentals"
+	"rentals/tst"
+	"testing"
+	"time"
+)
+
+// Keeps the events recorded
+type securityRecorder struct {
+	events []rentals.SecurityEvent
+}
+
+func (sr *securityRecorder) Record(event rentals.SecurityEvent) {
+	sr.events = append(sr.events, event)
+}
+
+func (sr *securityRecorder) Events(rentals.SecurityEventsInput) (*rentals.SecurityEventsOutput, error) {
+	return &rentals.SecurityEventsOutput{Events: sr.events}, nil
+}
+
+func TestSecurityEventsIP(t *testing.T) {
+	for _, elt := range []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		{"Forged header without trusted proxies", nil, "192.0.2.1:4000", "203.0.113.9", "192.0.2.1"},
+		{"Forged header from an untrusted address", []string{"10.0.0.0/8"}, "192.0.2.1:4000", "203.0.113.9", "192.0.2.1"},
+		{"Behind a trusted proxy", []string{"10.0.0.1"}, "10.0.0.1:4000", "198.51.100.7", "198.51.100.7"},
+		{"Forged hop behind trusted proxies", []string{"10.0.0.0/8"}, "10.0.0.1:4000",
+			"203.0.113.9, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+	} {
+		t.Run(elt.name, func(t *testing.T) {
+			// Arrange
+			recorder := &securityRecorder{}
+			s := &Server{security: recorder}
+			tst.Ok(t, s.TrustProxies(elt.proxies))
+
+			r := httptest.NewRequest("POST", "/login", nil)
+			r.RemoteAddr = elt.remoteAddr
+			r.Header.Set("X-Forwarded-For", elt.forwarded)
+
+			// Act
+			s.recordSecurityEvent(r, rentals.SecurityEvent{Event: rentals.SecurityLoginFailed})
+
+			// True
+			tst.True(t, len(recorder.events) == 1 && recorder.events[0].IP == elt.ip,
+				fmt.Sprintf("Expected ip %s, got %+v", elt.ip, recorder.events))
+		})
+	}
+}
+
+func TestEventSampler(t *testing.T) {
+	// Arrange
+	sampler := newEventSampler(time.Minute)
+	now := time.Now()
+
+	// Act
+	first := sampler.allow("192.0.2.1", now)
+	again := sampler.allow("192.0.2.1", now.Add(time.Second))
+	other := sampler.allow("192.0.2.2", now.Add(time.Second))
+	later := sampler.allow("192.0.2.1", now.Add(2*time.Minute))
+
+	// True
+	tst.True(t, first && other, "Expected the first event of each key to be let through")
+	tst.True(t, !again, "Expected the repeated event to be sampled out")
+	tst.True(t, later, "Expected the event to be let through once the interval is over")
+	tst.True(t, len(sampler.last) == 1, fmt.Sprintf("Expected past keys to be forgotten, got %v", sampler.last))
+}
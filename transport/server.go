@@ -2,17 +2,28 @@ package transport
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"rentals"
 	"rentals/auth"
+	"strconv"
 	"time"
 )
 
+// Apartments read per query when exporting
+const apartmentExportPageSize = 500
+
+// Time given to write each page of an export, past the server's
+// write timeout
+const apartmentExportWriteTimeout = 30 * time.Second
+
 // Implemented by models that only expose certain fields.
 // This method returns a struct with json tags used by
 // the transports
@@ -29,6 +40,18 @@ type Server struct {
 	authz            *auth.AuthzService
 	apartmentService rentals.ApartmentService
 	userService      rentals.UserService
+
+	// Optional. See UseSecurityLog.
+	security rentals.SecurityLog
+
+	// Samples the rejected tokens recorded in security
+	rejectedTokens *eventSampler
+
+	// Optional. See UseIdempotencyKeys.
+	idempotency rentals.IdempotencyStore
+
+	// Optional. See TrustProxies.
+	trustedProxies []*net.IPNet
 }
 
 // Creates an http server and serves it in the specified address
@@ -51,6 +74,21 @@ func (s *Server) setupAuthorization() {
 	s.authz.AddPermission("realtor", "apartments",
 		auth.Create, auth.Read, auth.Update, auth.Delete)
 	s.authz.AddPermission("client", "apartments", auth.Read)
+	s.authz.AddPermission("admin", "applications", auth.Create, auth.Read)
+	s.authz.AddPermission("realtor", "applications", auth.Create, auth.Read)
+	s.authz.AddPermission("client", "applications", auth.Create, auth.Read)
+	s.authz.AddPermission("admin", "leases", auth.Create, auth.Read)
+	s.authz.AddPermission("realtor", "leases", auth.Create, auth.Read)
+	s.authz.AddPermission("client", "leases", auth.Read)
+	s.authz.AddPermission("admin", "viewings", auth.Create, auth.Read)
+	s.authz.AddPermission("realtor", "viewings", auth.Create, auth.Read)
+	s.authz.AddPermission("client", "viewings", auth.Create, auth.Read)
+	s.authz.AddPermission("admin", "threads", auth.Create, auth.Read, auth.Delete)
+	s.authz.AddPermission("realtor", "threads", auth.Create, auth.Read)
+	s.authz.AddPermission("client", "threads", auth.Create, auth.Read)
+	s.authz.AddPermission("admin", "webhooks", auth.Create, auth.Read, auth.Update, auth.Delete)
+	s.authz.AddPermission("admin", "audit", auth.Read)
+	s.authz.AddPermission("admin", "security-events", auth.Read)
 }
 
 // Creates GET, POST, PATH and DELETE user handlers.
@@ -63,6 +101,11 @@ func (s *Server) AddApartmentsHandlers(basePath string) {
 	s.router.HandleFunc(urlWithId, getApartmentsHandler(s.apartmentService)).Methods("GET")
 	s.router.HandleFunc(urlWithId, patchApartmentsHandler(s.apartmentService)).Methods("PATCH")
 	s.router.HandleFunc(urlWithId, deleteApartmentsHandler(s.apartmentService)).Methods("DELETE")
+	s.router.HandleFunc(urlWithId+"/status", postApartmentStatusHandler(s.apartmentService)).Methods("POST")
+	s.router.HandleFunc(urlWithId+"/transitions", getApartmentTransitionsHandler(s.apartmentService)).Methods("GET")
+	s.router.HandleFunc(url+"/trash", getApartmentTrashHandler(s.apartmentService)).Methods("GET")
+	s.router.HandleFunc(urlWithId+"/restore", postApartmentRestoreHandler(s.apartmentService)).Methods("POST")
+	s.router.HandleFunc(url+"/export", exportApartmentsHandler(s.apartmentService)).Methods("GET")
 }
 
 // Creates GET, POST, PATH and DELETE user handlers.
@@ -73,8 +116,15 @@ func (s *Server) AddUsersHandlers(basePath string) {
 	s.router.HandleFunc(url, postUsersHandler(s.userService)).Methods("POST")
 	s.router.HandleFunc(url, getAllUsersHandler(s.userService)).Methods("GET")
 	s.router.HandleFunc(urlWithId, getUsersHandler(s.userService)).Methods("GET")
-	s.router.HandleFunc(urlWithId, patchUsersHandler(s.userService)).Methods("PATCH")
-	s.router.HandleFunc(urlWithId, deleteUsersHandler(s.userService)).Methods("DELETE")
+	s.router.HandleFunc(urlWithId, patchUsersHandler(s.userService, s.recordSecurityEvent)).Methods("PATCH")
+	s.router.HandleFunc(urlWithId, deleteUsersHandler(s.userService, s.recordSecurityEvent)).Methods("DELETE")
+	s.router.HandleFunc(urlWithId+"/suspend",
+		userStatusHandler(s.userService, rentals.UserSuspended, s.recordSecurityEvent)).Methods("POST")
+	s.router.HandleFunc(urlWithId+"/reactivate",
+		userStatusHandler(s.userService, rentals.UserActive, s.recordSecurityEvent)).Methods("POST")
+	s.router.HandleFunc(urlWithId+"/sessions", s.deleteUserSessionsHandler()).Methods("DELETE")
+	s.router.HandleFunc(urlWithId+"/apartments/reassign",
+		reassignApartmentsHandler(s.apartmentService)).Methods("POST")
 }
 
 func getUsersHandler(service rentals.UserService) func(http.ResponseWriter, *http.Request) {
@@ -89,15 +139,23 @@ func getUsersHandler(service rentals.UserService) func(http.ResponseWriter, *htt
 			return
 		}
 
+		if notModified(w, r, result.Version) {
+			return
+		}
+
 		respond(w, http.StatusOK, result)
 	}
 }
 
 func getAllUsersHandler(service rentals.UserService) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var input rentals.UserAllInput
+		input, err := parseUserAllInput(r.URL.Query())
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-		result, err := service.All(input)
+		result, err := service.All(*input)
 		if err != nil {
 			respond(w, http.StatusBadRequest, err.Error())
 			return
@@ -116,6 +174,8 @@ func postUsersHandler(service rentals.UserService) func(http.ResponseWriter, *ht
 			return
 		}
 
+		newUser.ActorId = uint(currentUser(r).ID)
+		newUser.RequestId = requestId(r)
 		result, err := service.Create(newUser)
 		if err != nil {
 			badRequestError(err, w)
@@ -126,7 +186,9 @@ func postUsersHandler(service rentals.UserService) func(http.ResponseWriter, *ht
 	}
 }
 
-func patchUsersHandler(service rentals.UserService) func(w http.ResponseWriter, r *http.Request) {
+// Role and password changes are recorded with record
+func patchUsersHandler(service rentals.UserService,
+	record func(*http.Request, rentals.SecurityEvent)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		defer r.Body.Close()
@@ -139,39 +201,160 @@ func patchUsersHandler(service rentals.UserService) func(w http.ResponseWriter,
 			return
 		}
 
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
 		updateInput.Id = vars["id"]
+		updateInput.Version = version
+		updateInput.ActorId = uint(currentUser(r).ID)
+		updateInput.RequestId = requestId(r)
 		result, err := service.Update(updateInput)
 		if err != nil {
 			badRequestError(err, w)
 			return
 		}
 
+		if result.Role != result.PreviousRole {
+			record(r, rentals.SecurityEvent{
+				Event:    rentals.SecurityRoleChanged,
+				UserID:   uint(result.ID),
+				Username: result.Username,
+				Detail:   fmt.Sprintf("%s to %s", result.PreviousRole, result.Role),
+			})
+		}
+
+		if result.PasswordChanged {
+			record(r, rentals.SecurityEvent{
+				Event:    rentals.SecurityPasswordChanged,
+				UserID:   uint(result.ID),
+				Username: result.Username,
+			})
+		}
+
+		w.Header().Set("ETag", etag(result.Version))
 		respond(w, http.StatusOK, result)
 	}
 }
 
-func deleteUsersHandler(service rentals.UserService) func(w http.ResponseWriter, r *http.Request) {
+// The sessions revoked with the user are recorded with record
+func deleteUsersHandler(service rentals.UserService,
+	record func(*http.Request, rentals.SecurityEvent)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
+		query := r.URL.Query()
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
 		var deleteIn rentals.UserDeleteInput
 		deleteIn.Id = vars["id"]
-
-		_, err := service.Delete(deleteIn)
+		deleteIn.Version = version
+		deleteIn.Reason = query.Get("reason")
+		deleteIn.ReassignTo = query.Get("reassignTo")
+		deleteIn.ArchiveApartments = query.Get("archiveApartments") == "true"
+		deleteIn.ActorId = uint(currentUser(r).ID)
+		deleteIn.RequestId = requestId(r)
+
+		result, err := service.Delete(deleteIn)
 		if err != nil {
 			badRequestError(err, w)
 			return
 		}
+		userId, _ := strconv.Atoi(deleteIn.Id)
+		recordStatusRevokes(r, record, uint(userId), "", rentals.UserDeactivated, result.SessionsRevoked)
 
 		respond(w, http.StatusNoContent, nil)
 	}
 }
 
+// Changes the status of a user. The reason, if any, is taken from the
+// body. The sessions revoked with the change are recorded with record.
+func userStatusHandler(service rentals.UserService, status string,
+	record func(*http.Request, rentals.SecurityEvent)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+
+		var body struct {
+			Reason string `json:"reason"`
+		}
+
+		// The body is optional
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.SetStatus(rentals.UserStatusInput{
+			Id:        vars["id"],
+			Status:    status,
+			Reason:    body.Reason,
+			ActorId:   uint(currentUser(r).ID),
+			RequestId: requestId(r),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+		recordStatusRevokes(r, record, uint(result.ID), result.Username, status, result.SessionsRevoked)
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// Records the sessions of the user with the given id revoked as it
+// moved to status, if any were
+func recordStatusRevokes(r *http.Request, record func(*http.Request, rentals.SecurityEvent),
+	userId uint, username, status string, revoked int) {
+	if revoked == 0 {
+		return
+	}
+
+	record(r, rentals.SecurityEvent{
+		Event:    rentals.SecuritySessionsRevoked,
+		UserID:   userId,
+		Username: username,
+		Detail:   fmt.Sprintf("user %s, %d revoked", status, revoked),
+	})
+}
+
+// Moves the apartments of the realtor in the url to another realtor
+func reassignApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+
+		var input rentals.ApartmentReassignInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.FromRealtorId = vars["id"]
+		input.ActorId = uint(currentUser(r).ID)
+		input.RequestId = requestId(r)
+		result, err := srv.Reassign(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
 func getApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		var input rentals.ApartmentReadInput
 		input.Id = vars["id"]
+		input.ActorId, input.ActorRole = actor(r)
 
 		result, err := srv.Read(input)
 		if err != nil {
@@ -179,14 +362,27 @@ func getApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWrit
 			return
 		}
 
+		if notModified(w, r, result.Version) {
+			return
+		}
+
 		respond(w, http.StatusOK, result)
 	}
 }
 
 func getAllApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := parseLimit(r.URL.Query())
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
 		var input rentals.ApartmentFindInput
 		input.Query = r.URL.RawQuery
+		input.Cursor = r.URL.Query().Get("cursor")
+		input.Limit = limit
+		input.ActorId, input.ActorRole = actor(r)
 
 		result, err := srv.Find(input)
 		if err != nil {
@@ -207,7 +403,11 @@ func postApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWri
 			return
 		}
 
-		result, err := srv.Create(rentals.ApartmentCreateInput{Apartment: newApartment})
+		result, err := srv.Create(rentals.ApartmentCreateInput{
+			Apartment: newApartment,
+			ActorId:   uint(currentUser(r).ID),
+			RequestId: requestId(r),
+		})
 		if err != nil {
 			badRequestError(err, w)
 			return
@@ -229,7 +429,16 @@ func patchApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWr
 			return
 		}
 
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
 		updateInput.Id = vars["id"]
+		updateInput.Version = version
+		updateInput.ActorId = uint(currentUser(r).ID)
+		updateInput.RequestId = requestId(r)
 
 		result, err := srv.Update(updateInput)
 		if err != nil {
@@ -237,6 +446,47 @@ func patchApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWr
 			return
 		}
 
+		w.Header().Set("ETag", etag(result.Version))
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// Moves an apartment to the status in the body
+func postApartmentStatusHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+
+		var input rentals.ApartmentTransitionInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.Id = vars["id"]
+		input.ActorId = uint(currentUser(r).ID)
+		input.RequestId = requestId(r)
+
+		result, err := srv.Transition(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getApartmentTransitionsHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := srv.History(rentals.ApartmentHistoryInput{Id: vars["id"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
 		respond(w, http.StatusOK, result)
 	}
 }
@@ -245,9 +495,18 @@ func deleteApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseW
 	return func(w http.ResponseWriter, r *http.Request) {
 		var deleteIn rentals.ApartmentDeleteInput
 
+		version, err := ifMatchVersion(r)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
 		vars := mux.Vars(r)
 		deleteIn.Id = vars["id"]
-		_, err := srv.Delete(deleteIn)
+		deleteIn.Version = version
+		deleteIn.ActorId = uint(currentUser(r).ID)
+		deleteIn.RequestId = requestId(r)
+		_, err = srv.Delete(deleteIn)
 		if err != nil {
 			badRequestError(err, w)
 			return
@@ -257,11 +516,157 @@ func deleteApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseW
 	}
 }
 
+// Lists the deleted apartments the current user can restore
+func getApartmentTrashHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		user := currentUser(r)
+
+		limit, err := parseLimit(query)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := srv.Trash(rentals.ApartmentTrashInput{
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+			Cursor:    query.Get("cursor"),
+			Limit:     limit,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func postApartmentRestoreHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		result, err := srv.Restore(rentals.ApartmentRestoreInput{
+			Id:        vars["id"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+			RequestId: requestId(r),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// Streams every apartment matching the same filters as the listing,
+// as csv (default), ndjson or geojson with ?format=
+func exportApartmentsHandler(srv rentals.ApartmentService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = rentals.ExportCsv
+		}
+
+		// Writers don't write anything until the first page
+		writer, err := rentals.NewApartmentExportWriter(format, w)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Fail before writing anything if the filters are wrong
+		input := rentals.ApartmentExportInput{
+			Query:     r.URL.RawQuery,
+			ActorRole: user.Role,
+			Limit:     apartmentExportPageSize,
+		}
+		page, err := srv.Export(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", rentals.ExportContentTypes[format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="apartments.%s"`, format))
+
+		completed := streamExport(w, "apartments", apartmentExportWriteTimeout, func() (bool, error) {
+			if err := writer.Write(page.Apartments); err != nil {
+				return false, err
+			}
+
+			if page.NextCursor == "" {
+				return false, nil
+			}
+
+			input.Cursor = page.NextCursor
+			page, err = srv.Export(input)
+			return err == nil, err
+		})
+
+		if !completed {
+			return
+		}
+
+		if err := writer.Close(); err != nil {
+			log.Printf("[ERROR] exporting apartments: %v", err)
+		}
+	}
+}
+
+// Writes an export a page at a time once its headers are set, giving
+// each page timeout past the server's write timeout. next writes the
+// page at hand and fetches the following one, telling whether there
+// is one. Headers are gone by then, so errors can only cut the export
+// short. Returns whether every page was written.
+func streamExport(w http.ResponseWriter, name string, timeout time.Duration, next func() (bool, error)) bool {
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	for {
+		err := rc.SetWriteDeadline(time.Now().Add(timeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("[ERROR] exporting %s: %v", name, err)
+			return false
+		}
+
+		more, err := next()
+		if err != nil {
+			log.Printf("[ERROR] exporting %s: %v", name, err)
+			return false
+		}
+
+		if !more {
+			return true
+		}
+	}
+}
+
 func badRequestError(err error, w http.ResponseWriter) {
 	log.Printf("[ERROR] %s", err.Error())
 	switch err {
 	case rentals.NotFoundError:
 		respond(w, http.StatusNotFound, err.Error())
+	case rentals.WrongPasswordError:
+		respond(w, http.StatusForbidden, err.Error())
+	case rentals.ForbiddenError:
+		respond(w, http.StatusForbidden, err.Error())
+	case rentals.VersionMismatchError:
+		respond(w, http.StatusPreconditionFailed, err.Error())
+	case rentals.IdempotencyKeyReusedError:
+		respond(w, http.StatusUnprocessableEntity, err.Error())
+	case rentals.RealtorHasApartmentsError, rentals.InvalidTransitionError, rentals.InvalidStatusChangeError,
+		rentals.ApartmentNotAvailableError, rentals.DuplicateApplicationError, rentals.ApplicationClosedError,
+		rentals.ViewingConflictError, rentals.ViewingClosedError, rentals.IdempotencyKeyInProgressError:
+		respond(w, http.StatusConflict, err.Error())
+	case rentals.UnsupportedMediaError:
+		respond(w, http.StatusUnsupportedMediaType, err.Error())
+	case rentals.MediaTooLargeError:
+		respond(w, http.StatusRequestEntityTooLarge, err.Error())
 	default:
 		respond(w, http.StatusBadRequest, err.Error())
 	}
@@ -278,6 +683,7 @@ func NewServer(db *gorm.DB, authNService auth.AuthnService, authZService *auth.A
 		authz:            authZService,
 		apartmentService: apartmentsService,
 		userService:      userService,
+		rejectedTokens:   newEventSampler(tokenRejectedInterval),
 	}
 
 	// Adds POST, GET, PATCH, DELETE for users
@@ -289,7 +695,14 @@ func NewServer(db *gorm.DB, authNService auth.AuthnService, authZService *auth.A
 	// Add other handlers
 	router.HandleFunc("/login", s.LoginHandler()).Methods("POST")
 	router.HandleFunc("/profile", s.profileHandler()).Methods("GET")
+	router.HandleFunc("/profile", s.patchProfileHandler()).Methods("PATCH")
+	router.HandleFunc("/profile", s.deleteProfileHandler()).Methods("DELETE")
 	router.HandleFunc("/newClient", s.newClientHandler()).Methods("POST")
+	router.HandleFunc("/sessions", s.getSessionsHandler()).Methods("GET")
+	router.HandleFunc("/sessions/{id:[0-9]+}", s.deleteSessionHandler()).Methods("DELETE")
+
+	// Identify requests, so changes can be traced back to them
+	router.Use(s.RequestIdMiddleware)
 
 	// Add Authentication/Authorization middleware
 	router.Use(s.AuthMiddleware)
@@ -300,6 +713,10 @@ func NewServer(db *gorm.DB, authNService auth.AuthnService, authZService *auth.A
 	// Log all things
 	router.Use(s.LoggingMiddleware)
 
+	// Replay the responses to retried requests. Runs last, so replies
+	// are logged and have the headers set above.
+	router.Use(s.IdempotencyMiddleware)
+
 	// Initialize roles' permissions
 	s.setupAuthorization()
 
@@ -309,6 +726,8 @@ func NewServer(db *gorm.DB, authNService auth.AuthnService, authZService *auth.A
 func setCors(router *mux.Router) http.Handler {
 	allOrigins := handlers.AllowedOrigins([]string{"*"})
 	allMethods := handlers.AllowedMethods([]string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"})
-	allHeaders := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
-	return handlers.CORS(allOrigins, allMethods, allHeaders)(router)
+	allHeaders := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization",
+		"If-Match", "If-None-Match", idempotencyKeyHeader, requestIdHeader})
+	exposedHeaders := handlers.ExposedHeaders([]string{"ETag", idempotentReplayedHeader, requestIdHeader})
+	return handlers.CORS(allOrigins, allMethods, allHeaders, exposedHeaders)(router)
 }
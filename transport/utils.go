@@ -3,12 +3,19 @@ package transport
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"rentals"
+	"rentals/auth"
+	"strconv"
+	"strings"
+	"time"
 )
 
-
 // Utility function to respond to http requests.
 func respond(w http.ResponseWriter, status int, data interface{}) {
 	if p, ok := data.(Public); ok {
@@ -26,3 +33,185 @@ func respond(w http.ResponseWriter, status int, data interface{}) {
 		log.Println("Error responding:", err)
 	}
 }
+
+// ETag of a resource at version. Versions are quoted as is, e.g. "3".
+func etag(version uint) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// Returns the version in the If-Match header, 0 if there's none or
+// it's *. Anything else, weak ETags included, can't match a version.
+func ifMatchVersion(r *http.Request) (uint, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseUint(strings.Trim(header, `"`), 10, 64)
+	if err != nil || version == 0 || !strings.HasPrefix(header, `"`) {
+		return 0, rentals.VersionMismatchError
+	}
+
+	return uint(version), nil
+}
+
+// Sets the ETag of a resource at version. If the client already has
+// that version, per If-None-Match, 304 is sent and true returned.
+func notModified(w http.ResponseWriter, r *http.Request, version uint) bool {
+	tag := etag(version)
+	w.Header().Set("ETag", tag)
+
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	// Weak comparison, as the RFC asks for If-None-Match
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Builds the input for listing users from the query string
+func parseUserAllInput(values url.Values) (*rentals.UserAllInput, error) {
+	input := &rentals.UserAllInput{
+		Role:           values.Get("role"),
+		UsernamePrefix: values.Get("username"),
+		Status:         values.Get("status"),
+		Sort:           values.Get("sort"),
+		Cursor:         values.Get("cursor"),
+	}
+
+	var err error
+	if input.CreatedAfter, err = parseTimeParam(values, "createdAfter"); err != nil {
+		return nil, err
+	}
+
+	if input.CreatedBefore, err = parseTimeParam(values, "createdBefore"); err != nil {
+		return nil, err
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		if input.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, fmt.Errorf("invalid limit %s", limit)
+		}
+	}
+
+	return input, nil
+}
+
+// Parses a date (2006-01-02) or RFC3339 timestamp query parameter.
+// Returns nil if the parameter is not present.
+func parseTimeParam(values url.Values, name string) (*time.Time, error) {
+	raw := values.Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid %s %s", name, raw)
+}
+
+// Takes the ip of clients from X-Forwarded-For on requests coming
+// from the given proxies, ips or CIDR ranges. The header is ignored
+// otherwise, as anyone can send it.
+func (s *Server) TrustProxies(proxies []string) error {
+	for _, proxy := range proxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			s.trustedProxies = append(s.trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy %s", proxy)
+		}
+		s.trustedProxies = append(s.trustedProxies, network)
+	}
+
+	return nil
+}
+
+func (s *Server) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the ip of the client making the request. Behind trusted
+// proxies it's the right-most X-Forwarded-For address that isn't a
+// trusted proxy, as the ones on its left can be forged by the client.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !s.trustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		ip = hop
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Returns the user agent and ip of the client making the request,
+// along with the authenticated user if any. See clientIP.
+func (s *Server) clientInfo(r *http.Request) auth.ClientInfo {
+	client := auth.ClientInfo{UserAgent: r.UserAgent(), IP: s.clientIP(r)}
+	if user := currentUser(r); user != nil {
+		client.ActorId = uint(user.ID)
+	}
+	return client
+}
+
+// Parses the limit query parameter of paginated listings. Returns 0,
+// the default page size, if the parameter is not present.
+func parseLimit(values url.Values) (int, error) {
+	raw := values.Get("limit")
+	if raw == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %s", raw)
+	}
+
+	return limit, nil
+}
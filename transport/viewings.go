@@ -0,0 +1,262 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"rentals"
+	"rentals/ical"
+)
+
+// Prefix of the calendar feeds. Calendar clients can't send the
+// Authorization header, feeds are authenticated by a secret token
+// in the url instead.
+const calendarPath = "/calendar/"
+
+// Creates the handlers for the viewing slots of apartments
+// under basePath/{id}/slots
+func (s *Server) AddViewingSlotsHandlers(basePath string, service rentals.ViewingService) {
+	url := fmt.Sprintf("/%s/{id:[0-9]+}/slots", basePath)
+
+	s.router.HandleFunc(url, postSlotsHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllSlotsHandler(service)).Methods("GET")
+	s.router.HandleFunc(url+"/{slotId:[0-9]+}", deleteSlotsHandler(service)).Methods("DELETE")
+}
+
+// Creates the handlers for viewings. Clients book slots and both
+// clients and realtors can cancel or reschedule viewings.
+func (s *Server) AddViewingsHandlers(basePath string, service rentals.ViewingService) {
+	url := fmt.Sprintf("/%s", basePath)
+	urlWithId := fmt.Sprintf("%s/{id:[0-9]+}", url)
+
+	s.router.HandleFunc(url, postViewingsHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllViewingsHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId+"/cancel", cancelViewingsHandler(service)).Methods("POST")
+	s.router.HandleFunc(urlWithId+"/reschedule", rescheduleViewingsHandler(service)).Methods("POST")
+	s.router.HandleFunc(url+"/calendar", postCalendarTokenHandler(service)).Methods("POST")
+	s.router.HandleFunc(calendarPath+"{token:[0-9a-f]+}.ics", getCalendarHandler(service)).Methods("GET")
+}
+
+func postSlotsHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+		user := currentUser(r)
+
+		var input rentals.ViewingSlotCreateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.ApartmentId = vars["id"]
+		input.ActorId = uint(user.ID)
+		input.ActorRole = user.Role
+		result, err := service.AddSlot(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func getAllSlotsHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Slots(rentals.ViewingSlotsInput{ApartmentId: vars["id"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func deleteSlotsHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := currentUser(r)
+
+		_, err := service.DeleteSlot(rentals.ViewingSlotDeleteInput{
+			Id:        vars["slotId"],
+			ActorId:   uint(user.ID),
+			ActorRole: user.Role,
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	}
+}
+
+func postViewingsHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		user := currentUser(r)
+		if user.Role != "client" {
+			respond(w, http.StatusForbidden, "Only clients can book viewings")
+			return
+		}
+
+		var input rentals.ViewingBookInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.ClientId = uint(user.ID)
+		result, err := service.Book(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func getAllViewingsHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		query := r.URL.Query()
+
+		result, err := service.Find(rentals.ViewingFindInput{
+			ActorId:     uint(user.ID),
+			ActorRole:   user.Role,
+			ApartmentId: query.Get("apartmentId"),
+			Status:      query.Get("status"),
+		})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func cancelViewingsHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+		user := currentUser(r)
+
+		// The body is optional
+		var input rentals.ViewingCancelInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil && err != io.EOF {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.Id = vars["id"]
+		input.ActorId = uint(user.ID)
+		input.ActorRole = user.Role
+		result, err := service.Cancel(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func rescheduleViewingsHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+		user := currentUser(r)
+
+		var input rentals.ViewingRescheduleInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.Id = vars["id"]
+		input.ActorId = uint(user.ID)
+		input.ActorRole = user.Role
+		result, err := service.Reschedule(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+// Creates a new calendar feed url for the current user. Urls
+// created before stop working.
+func postCalendarTokenHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := service.CalendarToken(uint(currentUser(r).ID))
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, map[string]string{
+			"url": fmt.Sprintf("%s%s.ics", calendarPath, token),
+		})
+	}
+}
+
+// Serves the viewings of the owner of the token as an iCalendar feed
+func getCalendarHandler(service rentals.ViewingService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Calendar(vars["token"])
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		cal := ical.Calendar{
+			ProdID: "-//rentals//viewings//EN",
+			Name:   fmt.Sprintf("Viewings of %s", result.User.Username),
+		}
+		for _, viewing := range result.Viewings {
+			cal.Events = append(cal.Events, viewingEvent(viewing))
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := ical.Write(w, cal); err != nil {
+			log.Println("Error responding:", err)
+		}
+	}
+}
+
+func viewingEvent(viewing rentals.Viewing) ical.Event {
+	event := ical.Event{
+		UID:         fmt.Sprintf("viewing-%d@rentals", viewing.ID),
+		Sequence:    viewing.Sequence,
+		Status:      ical.StatusConfirmed,
+		Stamp:       viewing.UpdatedAt,
+		Start:       viewing.StartsAt,
+		End:         viewing.EndsAt,
+		Summary:     fmt.Sprintf("Viewing of %s", viewing.Apartment.Name),
+		Description: viewing.Note,
+		Geo:         &[2]float32{viewing.Apartment.Latitude, viewing.Apartment.Longitude},
+	}
+
+	if viewing.Status == rentals.ViewingCancelled {
+		event.Status = ical.StatusCancelled
+		event.Description = viewing.CancelReason
+	}
+
+	return event
+}
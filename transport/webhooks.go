@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"rentals"
+)
+
+// Creates the handlers for webhook subscriptions and their delivery
+// logs. Admins only, see setupAuthorization.
+func (s *Server) AddWebhooksHandlers(basePath string, service rentals.WebhookService) {
+	url := fmt.Sprintf("/%s", basePath)
+	urlWithId := fmt.Sprintf("%s/{id:[0-9]+}", url)
+	deliveryUrl := fmt.Sprintf("%s/deliveries/{deliveryId:[0-9]+}", url)
+
+	s.router.HandleFunc(url, postWebhooksHandler(service)).Methods("POST")
+	s.router.HandleFunc(url, getAllWebhooksHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, getWebhooksHandler(service)).Methods("GET")
+	s.router.HandleFunc(urlWithId, patchWebhooksHandler(service)).Methods("PATCH")
+	s.router.HandleFunc(urlWithId, deleteWebhooksHandler(service)).Methods("DELETE")
+	s.router.HandleFunc(urlWithId+"/deliveries", getDeliveriesHandler(service, "")).Methods("GET")
+	s.router.HandleFunc(url+"/dead-letters", getDeliveriesHandler(service, rentals.DeliveryDead)).Methods("GET")
+	s.router.HandleFunc(deliveryUrl, getDeliveryHandler(service)).Methods("GET")
+	s.router.HandleFunc(deliveryUrl+"/redeliver", redeliverHandler(service)).Methods("POST")
+}
+
+func postWebhooksHandler(service rentals.WebhookService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var input rentals.WebhookCreateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := service.Create(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusCreated, result)
+	}
+}
+
+func getAllWebhooksHandler(service rentals.WebhookService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.List()
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getWebhooksHandler(service rentals.WebhookService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Read(rentals.WebhookReadInput{Id: vars["id"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func patchWebhooksHandler(service rentals.WebhookService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		defer r.Body.Close()
+
+		var input rentals.WebhookUpdateInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input.Id = vars["id"]
+		result, err := service.Update(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func deleteWebhooksHandler(service rentals.WebhookService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		if _, err := service.Delete(rentals.WebhookReadInput{Id: vars["id"]}); err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusNoContent, nil)
+	}
+}
+
+// Lists deliveries newest first. status is used unless empty,
+// otherwise it can be given with ?status=.
+func getDeliveriesHandler(service rentals.WebhookService, status string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		query := r.URL.Query()
+
+		limit, err := parseLimit(query)
+		if err != nil {
+			respond(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		input := rentals.WebhookDeliveriesInput{
+			SubscriptionId: vars["id"],
+			Status:         status,
+			Cursor:         query.Get("cursor"),
+			Limit:          limit,
+		}
+		if input.Status == "" {
+			input.Status = query.Get("status")
+		}
+
+		result, err := service.Deliveries(input)
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func getDeliveryHandler(service rentals.WebhookService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Delivery(rentals.WebhookDeliveryInput{Id: vars["deliveryId"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusOK, result)
+	}
+}
+
+func redeliverHandler(service rentals.WebhookService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		result, err := service.Redeliver(rentals.WebhookDeliveryInput{Id: vars["deliveryId"]})
+		if err != nil {
+			badRequestError(err, w)
+			return
+		}
+
+		respond(w, http.StatusAccepted, result)
+	}
+}
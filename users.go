@@ -1,5 +1,33 @@
 package rentals
 
+import "time"
+
+// User statuses
+const (
+	UserActive      = "active"
+	UserSuspended   = "suspended"
+	UserDeactivated = "deactivated"
+)
+
+// Statuses a user can move to from each status. Deactivated accounts
+// are gone for good.
+var UserStatusTransitions = map[string][]string{
+	UserActive:    {UserSuspended, UserDeactivated},
+	UserSuspended: {UserActive, UserDeactivated},
+}
+
+// Tells whether a user can move from status from to status to. See
+// UserStatusTransitions.
+func CanChangeStatus(from, to string) bool {
+	for _, status := range UserStatusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
 type User struct {
 	// Primary key
 	ID uid `gorm:"primary_key" json:"id"`
@@ -12,24 +40,59 @@ type User struct {
 
 	// Role
 	Role string `json:"role"`
+
+	// Contact details
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+
+	// Status of the account. Only active users can log in.
+	// Reason and date of the last status change are kept too.
+	Status          string     `gorm:"default:'active'" json:"status"`
+	StatusReason    string     `json:"statusReason"`
+	StatusChangedAt *time.Time `json:"statusChangedAt"`
+
+	// SHA-256 of the secret token of the viewings calendar feed
+	CalendarTokenHash string `gorm:"index" json:"-"`
+
+	// Url notifications are posted to, if the user wants them
+	NotificationWebhookUrl string `json:"-"`
+
+	// Date the user was created
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Incremented on every change. Used as the ETag of the user.
+	Version uint `gorm:"not null;default:1" json:"version"`
 }
 
 type UserSession struct {
 	// Primary key
-	ID uint `gorm:"primary_key"`
+	ID uint `gorm:"primary_key" json:"id"`
 
-	// Generated token
-	Token string
+	// SHA-256 of the generated token. The token itself
+	// is only known by the client.
+	TokenHash string `gorm:"unique_index" json:"-"`
 
 	// User associated to this session
-	UserID uint
-	User   User
+	UserID uint `json:"userId"`
+	User   User `json:"-"`
+
+	// Client that started the session
+	UserAgent string `json:"userAgent"`
+	IP        string `json:"ip"`
+
+	// Date the session was started
+	CreatedAt time.Time `json:"createdAt"`
 }
 
 type UserCreateInput struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Role     string `json:"role"`
+
+	// User making the change, 0 for signups, and the request it
+	// was made in
+	ActorId   uint   `json:"-"`
+	RequestId string `json:"-"`
 }
 
 type UserCreateOutput struct {
@@ -45,33 +108,121 @@ type UserReadOutput struct {
 	User
 }
 
+// Filters, sorting and pagination used when listing users.
+// Zero values mean no filtering.
 type UserAllInput struct {
+	Role           string
+	UsernamePrefix string
+	Status         string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+
+	// Field to sort by (id, username, createdAt). Prefix
+	// it with "-" to sort in descending order
+	Sort string
+
+	// Opaque cursor returned by a previous page
+	Cursor string
+
+	// Max number of users to return
+	Limit int
 }
 
 type UserAllOutput struct {
-	Users []User
+	Users      []User
+	NextCursor string
 }
 
 func (o *UserAllOutput) Public() interface{} {
-	return o.Users
+	return Page{Items: o.Users, NextCursor: o.NextCursor}
 }
 
 type UserUpdateInput struct {
 	Id       string `json:"-"`
 	Password string `json:"password"`
 	Role     string `json:"role"`
+
+	// Version the change was made against, see User.Version.
+	// 0 skips the check.
+	Version uint `json:"-"`
+
+	// User making the change and the request it was made in
+	ActorId   uint   `json:"-"`
+	RequestId string `json:"-"`
 }
 
 type UserUpdateOutput struct {
 	User
+
+	// What changed, for the security log
+	PreviousRole    string `json:"-"`
+	PasswordChanged bool   `json:"-"`
 }
 
+// Users are never removed, they are deactivated instead.
+// See UserStatusInput for the meaning of the fields.
 type UserDeleteInput struct {
-	Id string
+	Id                string
+	Reason            string
+	ReassignTo        string
+	ArchiveApartments bool
+	Version           uint
+	ActorId           uint
+	RequestId         string
 }
 
 type UserDeleteOutput struct {
 	Message string `json:"message"`
+
+	// Sessions revoked along with the user
+	SessionsRevoked int `json:"-"`
+}
+
+// Input used by users to update their own profile. Empty
+// fields are left untouched. Changing the password requires
+// the current one.
+type ProfileUpdateInput struct {
+	Id              string `json:"-"`
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+	Email           string `json:"email"`
+	Phone           string `json:"phone"`
+
+	// Request the change was made in. The user is the actor.
+	RequestId string `json:"-"`
+}
+
+type ProfileUpdateOutput struct {
+	User
+
+	// Whether the password was changed. Used to revoke
+	// the rest of the user's sessions.
+	PasswordChanged bool `json:"-"`
+}
+
+type UserStatusInput struct {
+	Id     string
+	Status string
+	Reason string
+
+	// Deactivating a realtor requires moving their apartments to
+	// another realtor (ReassignTo) or archiving them.
+	ReassignTo        string
+	ArchiveApartments bool
+
+	// Version the user was read at. 0 skips the check.
+	Version uint
+
+	// User making the change and the request it was made in
+	ActorId   uint
+	RequestId string
+}
+
+type UserStatusOutput struct {
+	User
+
+	// Sessions revoked as the user is no longer active
+	SessionsRevoked int `json:"-"`
 }
 
 type UserService interface {
@@ -80,4 +231,6 @@ type UserService interface {
 	All(UserAllInput) (*UserAllOutput, error)
 	Update(UserUpdateInput) (*UserUpdateOutput, error)
 	Delete(UserDeleteInput) (*UserDeleteOutput, error)
+	UpdateProfile(ProfileUpdateInput) (*ProfileUpdateOutput, error)
+	SetStatus(UserStatusInput) (*UserStatusOutput, error)
 }
@@ -0,0 +1,173 @@
+package rentals
+
+import (
+	"errors"
+	"time"
+)
+
+// Viewing statuses
+const (
+	ViewingScheduled = "scheduled"
+	ViewingCancelled = "cancelled"
+)
+
+var ViewingConflictError = errors.New("the realtor already has a viewing at that time")
+
+var ViewingClosedError = errors.New("viewing is not scheduled")
+
+// Time a realtor is available to show an apartment
+type ViewingSlot struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	ApartmentID uint `gorm:"index" json:"apartmentId"`
+	RealtorID   uint `gorm:"index" json:"realtorId"`
+
+	StartsAt time.Time `gorm:"index" json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+
+	// True if the realtor has a viewing at this time,
+	// for this or another apartment
+	Booked bool `gorm:"-" json:"booked"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Viewing of an apartment booked by a client. Realtors can't have
+// overlapping scheduled viewings, the db enforces it.
+type Viewing struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	SlotID uint `gorm:"index" json:"slotId"`
+
+	ApartmentID uint      `gorm:"index" json:"apartmentId"`
+	Apartment   Apartment `json:"-"`
+
+	RealtorID uint `gorm:"index" json:"realtorId"`
+	ClientID  uint `gorm:"index" json:"clientId"`
+
+	// Copied from the slot, so the slot can be removed later
+	StartsAt time.Time `gorm:"index" json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+
+	Note string `json:"note"`
+
+	Status       string `gorm:"index" json:"status"`
+	CancelReason string `json:"cancelReason"`
+
+	// Incremented on every change, used as the iCalendar SEQUENCE
+	Sequence int `json:"sequence"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ViewingService interface {
+	AddSlot(ViewingSlotCreateInput) (*ViewingSlotCreateOutput, error)
+	Slots(ViewingSlotsInput) (*ViewingSlotsOutput, error)
+	DeleteSlot(ViewingSlotDeleteInput) (*ViewingSlotDeleteOutput, error)
+
+	Book(ViewingBookInput) (*ViewingBookOutput, error)
+	Find(ViewingFindInput) (*ViewingFindOutput, error)
+	Cancel(ViewingCancelInput) (*ViewingCancelOutput, error)
+	Reschedule(ViewingRescheduleInput) (*ViewingRescheduleOutput, error)
+
+	// CalendarToken creates a new secret token for the calendar
+	// feed of a user. Previous tokens stop working.
+	CalendarToken(userId uint) (string, error)
+
+	// Calendar returns the viewings of the user owning token
+	Calendar(token string) (*ViewingCalendarOutput, error)
+}
+
+type ViewingSlotCreateInput struct {
+	ApartmentId string    `json:"-"`
+	StartsAt    time.Time `json:"startsAt"`
+	EndsAt      time.Time `json:"endsAt"`
+	ActorId     uint      `json:"-"`
+	ActorRole   string    `json:"-"`
+}
+
+type ViewingSlotCreateOutput struct {
+	ViewingSlot
+}
+
+// Lists the upcoming slots of an apartment
+type ViewingSlotsInput struct {
+	ApartmentId string
+}
+
+type ViewingSlotsOutput struct {
+	Slots []ViewingSlot
+}
+
+func (o *ViewingSlotsOutput) Public() interface{} {
+	return o.Slots
+}
+
+type ViewingSlotDeleteInput struct {
+	Id        string
+	ActorId   uint
+	ActorRole string
+}
+
+type ViewingSlotDeleteOutput struct{}
+
+type ViewingBookInput struct {
+	SlotId   uint   `json:"slotId"`
+	Note     string `json:"note"`
+	ClientId uint   `json:"-"`
+}
+
+type ViewingBookOutput struct {
+	Viewing
+}
+
+// Lists the upcoming viewings visible to the actor: clients see
+// their own, realtors the ones they hold and admins all of them.
+type ViewingFindInput struct {
+	ActorId     uint
+	ActorRole   string
+	ApartmentId string
+	Status      string
+}
+
+type ViewingFindOutput struct {
+	Viewings []Viewing
+}
+
+func (o *ViewingFindOutput) Public() interface{} {
+	return o.Viewings
+}
+
+// Both the client and the realtor can cancel a viewing
+type ViewingCancelInput struct {
+	Id        string `json:"-"`
+	Reason    string `json:"reason"`
+	ActorId   uint   `json:"-"`
+	ActorRole string `json:"-"`
+}
+
+type ViewingCancelOutput struct {
+	Viewing
+}
+
+// Moves a viewing to another slot of the same apartment
+type ViewingRescheduleInput struct {
+	Id        string `json:"-"`
+	SlotId    uint   `json:"slotId"`
+	ActorId   uint   `json:"-"`
+	ActorRole string `json:"-"`
+}
+
+type ViewingRescheduleOutput struct {
+	Viewing
+}
+
+// Viewings of a user, including cancelled ones so calendar
+// clients remove them. Apartment is loaded.
+type ViewingCalendarOutput struct {
+	User     User
+	Viewings []Viewing
+}
@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"rentals"
+	"strconv"
+	"time"
+)
+
+// Package webhook signs and posts deliveries to subscriptions
+
+// Headers of deliveries. Receivers check the signature against the
+// timestamp and the body, and reject old timestamps to stop replays.
+const (
+	EventHeader     = "X-Rentals-Event"
+	DeliveryHeader  = "X-Rentals-Delivery"
+	TimestampHeader = "X-Rentals-Timestamp"
+	SignatureHeader = "X-Rentals-Signature"
+)
+
+// Longest error body kept from failed deliveries
+const maxErrorBody = 512
+
+// Returns sha256= and the hex HMAC-SHA256 of timestamp.body keyed
+// with secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks a signature made by Sign in constant time
+func Verify(secret, signature string, timestamp int64, body []byte) bool {
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body)))
+}
+
+type sender struct {
+	client *http.Client
+	now    func() time.Time
+}
+
+func (s sender) Send(url, secret, event, deliveryId string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := s.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rentals-webhooks")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, deliveryId)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		text, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+		return res.StatusCode, fmt.Errorf("responded %d: %s", res.StatusCode, text)
+	}
+
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return res.StatusCode, nil
+}
+
+func NewSender() rentals.WebhookSender {
+	return sender{client: &http.Client{Timeout: 10 * time.Second}, now: time.Now}
+}
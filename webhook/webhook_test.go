@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"rentals/tst"
+	"strconv"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	// Arrange
+	var verified bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		verified = Verify("secret", r.Header.Get(SignatureHeader), timestamp, body) &&
+			r.Header.Get(EventHeader) == "apartment.created" && r.Header.Get(DeliveryHeader) == "7"
+
+		if r.URL.Path == "/fail" {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("Deliveries are signed", func(t *testing.T) {
+		// Act
+		status, err := NewSender().Send(server.URL, "secret", "apartment.created", "7", []byte(`{"id":1}`))
+
+		// True
+		tst.Ok(t, err)
+		tst.True(t, status == http.StatusOK, "Expected 200")
+		tst.True(t, verified, "Expected a valid signature")
+	})
+
+	t.Run("Responses other than 2xx are errors", func(t *testing.T) {
+		status, err := NewSender().Send(server.URL+"/fail", "secret", "apartment.created", "7", []byte(`{}`))
+
+		tst.True(t, err != nil, "Expected an error")
+		tst.True(t, status == http.StatusServiceUnavailable, "Expected the status code")
+	})
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	signature := Sign("secret", 100, []byte(`{"price":1000}`))
+
+	tst.True(t, Verify("secret", signature, 100, []byte(`{"price":1000}`)), "Expected a valid signature")
+	tst.True(t, !Verify("secret", signature, 100, []byte(`{"price":1}`)), "Expected a changed body to fail")
+	tst.True(t, !Verify("secret", signature, 101, []byte(`{"price":1000}`)), "Expected a changed timestamp to fail")
+	tst.True(t, !Verify("other", signature, 100, []byte(`{"price":1000}`)), "Expected another secret to fail")
+}
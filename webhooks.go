@@ -0,0 +1,211 @@
+package rentals
+
+import (
+	"strings"
+	"time"
+)
+
+// Events webhook subscriptions can be notified of
+const (
+	WebhookApartmentCreated       = "apartment.created"
+	WebhookApartmentUpdated       = "apartment.updated"
+	WebhookApartmentStatusChanged = "apartment.status_changed"
+	WebhookApartmentDeleted       = "apartment.deleted"
+	WebhookApartmentRestored      = "apartment.restored"
+	WebhookUserCreated            = "user.created"
+	WebhookUserUpdated            = "user.updated"
+	WebhookUserDeleted            = "user.deleted"
+)
+
+var WebhookEvents = []string{
+	WebhookApartmentCreated,
+	WebhookApartmentUpdated,
+	WebhookApartmentStatusChanged,
+	WebhookApartmentDeleted,
+	WebhookApartmentRestored,
+	WebhookUserCreated,
+	WebhookUserUpdated,
+	WebhookUserDeleted,
+}
+
+// Delivery statuses. Failed deliveries stay pending until they run
+// out of attempts and are dead-lettered.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+// Endpoint of a downstream system, managed by admins
+type WebhookSubscription struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	URL         string `json:"url"`
+	Description string `json:"description"`
+
+	// Events posted to the url, stored comma separated
+	Events    []string `gorm:"-" json:"events"`
+	EventList string   `json:"-"`
+
+	// Key deliveries are signed with. Only shown when created.
+	Secret string `json:"-"`
+
+	Active bool `json:"active"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (s *WebhookSubscription) BeforeSave() error {
+	s.EventList = strings.Join(s.Events, ",")
+	return nil
+}
+
+func (s *WebhookSubscription) AfterFind() error {
+	s.Events = make([]string, 0)
+	if s.EventList != "" {
+		s.Events = strings.Split(s.EventList, ",")
+	}
+	return nil
+}
+
+// Event written in the same transaction as the change it describes,
+// so no change goes unannounced. Turned into deliveries later.
+type OutboxEvent struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	Event   string `json:"event"`
+	Payload string `gorm:"type:text" json:"-"`
+
+	CreatedAt    time.Time  `json:"createdAt"`
+	DispatchedAt *time.Time `gorm:"index" json:"dispatchedAt"`
+}
+
+// An event to be posted to a subscription
+type WebhookDelivery struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	SubscriptionID uint   `gorm:"index" json:"subscriptionId"`
+	OutboxEventID  uint   `json:"outboxEventId"`
+	Event          string `json:"event"`
+
+	// Body posted, the same on every attempt
+	Payload string `gorm:"type:text" json:"payload"`
+
+	Status         string     `gorm:"index" json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `gorm:"index" json:"nextAttemptAt"`
+	LastStatusCode int        `json:"lastStatusCode"`
+	LastError      string     `json:"lastError"`
+
+	// Log of the attempts, when reading a single delivery
+	Log []WebhookAttempt `gorm:"foreignkey:DeliveryID" json:"log,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type WebhookAttempt struct {
+	// Primary key
+	ID uid `gorm:"primary_key" json:"id"`
+
+	DeliveryID uint   `gorm:"index" json:"-"`
+	StatusCode int    `json:"statusCode"`
+	Error      string `json:"error"`
+	DurationMs int64  `json:"durationMs"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// WebhookSender posts signed deliveries. Responses other than 2xx
+// are errors.
+type WebhookSender interface {
+	Send(url, secret, event, deliveryId string, body []byte) (statusCode int, err error)
+}
+
+type WebhookService interface {
+	Create(WebhookCreateInput) (*WebhookCreateOutput, error)
+	List() (*WebhookListOutput, error)
+	Read(WebhookReadInput) (*WebhookReadOutput, error)
+	Update(WebhookUpdateInput) (*WebhookReadOutput, error)
+	Delete(WebhookReadInput) (*WebhookDeleteOutput, error)
+
+	// Delivery logs
+	Deliveries(WebhookDeliveriesInput) (*WebhookDeliveriesOutput, error)
+	Delivery(WebhookDeliveryInput) (*WebhookDeliveryOutput, error)
+
+	// Redeliver sends a delivery again, whatever its status
+	Redeliver(WebhookDeliveryInput) (*WebhookDeliveryOutput, error)
+
+	// Dispatch creates the deliveries of the events in the outbox
+	Dispatch(now time.Time) (int, error)
+
+	// Deliver sends the deliveries that are due
+	Deliver(now time.Time) (int, error)
+}
+
+type WebhookCreateInput struct {
+	URL         string   `json:"url"`
+	Description string   `json:"description"`
+	Events      []string `json:"events"`
+}
+
+type WebhookCreateOutput struct {
+	WebhookSubscription
+	Secret string `json:"secret"`
+}
+
+type WebhookListOutput struct {
+	Subscriptions []WebhookSubscription
+}
+
+func (o *WebhookListOutput) Public() interface{} {
+	return o.Subscriptions
+}
+
+type WebhookReadInput struct {
+	Id string
+}
+
+type WebhookReadOutput struct {
+	WebhookSubscription
+}
+
+type WebhookUpdateInput struct {
+	Id          string    `json:"-"`
+	URL         *string   `json:"url"`
+	Description *string   `json:"description"`
+	Events      *[]string `json:"events"`
+	Active      *bool     `json:"active"`
+}
+
+type WebhookDeleteOutput struct{}
+
+// Lists deliveries newest first. Dead-lettered deliveries are the
+// ones with status dead.
+type WebhookDeliveriesInput struct {
+	SubscriptionId string
+	Status         string
+	Cursor         string
+	Limit          int
+}
+
+type WebhookDeliveriesOutput struct {
+	Deliveries []WebhookDelivery
+	NextCursor string
+}
+
+func (o *WebhookDeliveriesOutput) Public() interface{} {
+	return Page{Items: o.Deliveries, NextCursor: o.NextCursor}
+}
+
+type WebhookDeliveryInput struct {
+	Id string
+}
+
+type WebhookDeliveryOutput struct {
+	WebhookDelivery
+}